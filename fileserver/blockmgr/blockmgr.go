@@ -2,31 +2,136 @@
 package blockmgr
 
 import (
-	"github.com/haiwen/seafile-server/fileserver/objstore"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"io"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/objstore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var store *objstore.ObjectStore
 
+// Whether the content of blocks is checked against their IDs when they are read.
+var verify bool
+
+var (
+	readSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "seafile_block_read_seconds",
+		Help: "Time spent reading blocks, including writing them to the destination.",
+	})
+	writeSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "seafile_block_write_seconds",
+		Help: "Time spent writing blocks.",
+	})
+	readErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "seafile_block_read_errors_total",
+		Help: "Number of failed block reads.",
+	})
+	writeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "seafile_block_write_errors_total",
+		Help: "Number of failed block writes.",
+	})
+)
+
 // Init initializes block manager and creates underlying object store.
-func Init(seafileConfPath string, seafileDataDir string) {
-	store = objstore.New(seafileConfPath, seafileDataDir, "blocks")
+func Init(seafileConfPath string, seafileDataDir string) error {
+	var err error
+	store, err = objstore.New(seafileConfPath, seafileDataDir, "blocks")
+	return err
 }
 
-// Read reads block from storage backend.
+// SetVerify sets whether Read checks the content of blocks against their IDs.
+// Block IDs are the SHA1 of the stored content, which is the encrypted content for
+// encrypted repos, so blocks of all repos can be checked.
+// Damaged blocks are moved to quarantine and the read fails.
+func SetVerify(enabled bool) {
+	verify = enabled
+}
+
+// Read reads block from the cache or the storage backend.
 func Read(repoID string, blockID string, w io.Writer) error {
-	err := store.Read(repoID, blockID, w)
+	return ReadCtx(context.Background(), repoID, blockID, w)
+}
+
+// ReadCtx reads block like Read, and stops once ctx is done.
+func ReadCtx(ctx context.Context, repoID string, blockID string, w io.Writer) error {
+	start := time.Now()
+	err := read(ctx, repoID, blockID, w)
+	readSeconds.Observe(time.Since(start).Seconds())
 	if err != nil {
+		readErrors.Inc()
 		return err
 	}
 
 	return nil
 }
 
+func read(ctx context.Context, repoID string, blockID string, w io.Writer) error {
+	if !verify || !objstore.Verifiable(blockID) {
+		return readBlock(ctx, repoID, blockID, w)
+	}
+
+	if cache != nil && cacheable(repoID, blockID) {
+		data, err := cache.get(ctx, repoID, blockID)
+		if err != nil {
+			return err
+		}
+		if checksum(data) == blockID {
+			_, err = w.Write(data)
+			return err
+		}
+		// The cached copy may be damaged while the stored one is not.
+		cache.remove(repoID, blockID)
+	}
+
+	// The block is buffered to be checked before it's written to w, so that no damaged content is sent.
+	var buf bytes.Buffer
+	if err := store.ReadCtx(ctx, repoID, blockID, &buf); err != nil {
+		return err
+	}
+	if sum := checksum(buf.Bytes()); sum != blockID {
+		err := &objstore.ChecksumError{ObjType: store.ObjType, RepoID: repoID, ObjID: blockID, Checksum: sum}
+		store.Quarantine(repoID, blockID, func(data []byte) bool { return checksum(data) == blockID }, err)
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func checksum(data []byte) string {
+	checkSum := sha1.Sum(data)
+	return hex.EncodeToString(checkSum[:])
+}
+
+func readBlock(ctx context.Context, repoID string, blockID string, w io.Writer) error {
+	if cache == nil || !cacheable(repoID, blockID) {
+		return store.ReadCtx(ctx, repoID, blockID, w)
+	}
+	data, err := cache.get(ctx, repoID, blockID)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
 // Write writes block to storage backend.
 func Write(repoID string, blockID string, r io.Reader) error {
-	err := store.Write(repoID, blockID, r, false)
+	return WriteCtx(context.Background(), repoID, blockID, r)
+}
+
+// WriteCtx writes block like Write, and stops once ctx is done.
+func WriteCtx(ctx context.Context, repoID string, blockID string, r io.Reader) error {
+	start := time.Now()
+	err := store.WriteCtx(ctx, repoID, blockID, r, false)
+	writeSeconds.Observe(time.Since(start).Seconds())
 	if err != nil {
+		writeErrors.Inc()
 		return err
 	}
 
@@ -35,12 +140,47 @@ func Write(repoID string, blockID string, r io.Reader) error {
 
 // Exists checks block if exists.
 func Exists(repoID string, blockID string) bool {
-	ret, _ := store.Exists(repoID, blockID)
+	return ExistsCtx(context.Background(), repoID, blockID)
+}
+
+// ExistsCtx checks block like Exists, and returns false once ctx is done.
+func ExistsCtx(ctx context.Context, repoID string, blockID string) bool {
+	ret, _ := store.ExistsCtx(ctx, repoID, blockID)
 	return ret
 }
 
 // Stat calculates block size.
 func Stat(repoID string, blockID string) (int64, error) {
-	ret, err := store.Stat(repoID, blockID)
+	return StatCtx(context.Background(), repoID, blockID)
+}
+
+// StatCtx calculates block size like Stat, and stops once ctx is done.
+func StatCtx(ctx context.Context, repoID string, blockID string) (int64, error) {
+	ret, err := store.StatCtx(ctx, repoID, blockID)
 	return ret, err
 }
+
+// Verify checks whether the content of block matches its ID.
+// An error is returned only if the block can't be read.
+func Verify(repoID string, blockID string) (bool, error) {
+	hash := sha1.New()
+	err := store.Read(repoID, blockID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)) == blockID, nil
+}
+
+// Remove removes block from the cache and storage backend.
+func Remove(repoID string, blockID string) error {
+	if cache != nil && cacheable(repoID, blockID) {
+		cache.remove(repoID, blockID)
+	}
+	return store.Remove(repoID, blockID)
+}
+
+// List calls fn for every block of a repo.
+func List(repoID string, fn func(blockID string) error) error {
+	return store.List(repoID, fn)
+}
@@ -2,10 +2,15 @@ package blockmgr
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
+
+	"github.com/haiwen/seafile-server/fileserver/objstore"
 )
 
 const (
@@ -101,3 +106,45 @@ func TestBlock(t *testing.T) {
 	testBlockRead(t)
 	testBlockExists(t)
 }
+
+func TestVerify(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "block-verify-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	if err := Init("", dataDir); err != nil {
+		t.Fatalf("Failed to init block manager : %v\n", err)
+	}
+	SetVerify(true)
+	defer SetVerify(false)
+
+	content := []byte("hello world!\n")
+	checkSum := sha1.Sum(content)
+	goodID := hex.EncodeToString(checkSum[:])
+	if err := Write(repoID, goodID, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+	if err := Write(repoID, blockID, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Read(repoID, goodID, &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Failed to read block : %v\n", err)
+	}
+
+	buf.Reset()
+	err = Read(repoID, blockID, &buf)
+	if !objstore.IsChecksumError(err) {
+		t.Errorf("Damaged block is read : %v\n", err)
+	}
+	if Exists(repoID, blockID) {
+		t.Errorf("Damaged block is not removed\n")
+	}
+	quarantined := path.Join(dataDir, "quarantine", "blocks", repoID, blockID)
+	if data, err := ioutil.ReadFile(quarantined); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Damaged block is not moved to quarantine : %v\n", err)
+	}
+}
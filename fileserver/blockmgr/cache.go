@@ -0,0 +1,390 @@
+package blockmgr
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/objstore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CacheOptions configures the cache of blocks read from the storage backend.
+type CacheOptions struct {
+	// MemorySize is the maximum number of bytes cached in memory, 0 disables the memory cache.
+	MemorySize int64
+	// Dir is a directory on a local disk to cache blocks, empty disables the disk cache.
+	Dir string
+	// DirSize is the maximum number of bytes cached in Dir.
+	DirSize int64
+}
+
+const cacheTmpPrefix = ".tmp-"
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_block_cache_requests_total",
+		Help: "Number of block cache lookups by tier and result.",
+	}, []string{"tier", "result"})
+	cacheFillWaits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "seafile_block_cache_fill_waits_total",
+		Help: "Number of block reads that waited for another read of the same block to fill the cache.",
+	})
+)
+
+var (
+	memHits    = cacheRequests.WithLabelValues("memory", "hit")
+	memMisses  = cacheRequests.WithLabelValues("memory", "miss")
+	diskHits   = cacheRequests.WithLabelValues("disk", "hit")
+	diskMisses = cacheRequests.WithLabelValues("disk", "miss")
+)
+
+// cache is nil if neither tier is enabled.
+var cache *blockCache
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "seafile_block_cache_bytes",
+		Help:        "Number of bytes in the block cache by tier.",
+		ConstLabels: prometheus.Labels{"tier": "memory"},
+	}, func() float64 {
+		if c := cache; c != nil {
+			return float64(c.mem.used())
+		}
+		return 0
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "seafile_block_cache_bytes",
+		Help:        "Number of bytes in the block cache by tier.",
+		ConstLabels: prometheus.Labels{"tier": "disk"},
+	}, func() float64 {
+		if c := cache; c != nil {
+			return float64(c.disk.used())
+		}
+		return 0
+	})
+}
+
+// InitCache enables caching of blocks read by Read.
+// Blocks are looked up in memory first, then in the cache directory and the storage backend.
+// A block is read from the backend only once when it's requested by several readers at the same time.
+func InitCache(opts CacheOptions) error {
+	if opts.MemorySize <= 0 && opts.Dir == "" {
+		cache = nil
+		return nil
+	}
+
+	c := new(blockCache)
+	c.fills = make(map[string]*cacheFill)
+	if opts.MemorySize > 0 {
+		c.mem = newLRU(opts.MemorySize)
+	}
+	if opts.Dir != "" {
+		if opts.DirSize <= 0 {
+			err := fmt.Errorf("size of block cache dir %s must be positive", opts.Dir)
+			return err
+		}
+		if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
+			err := fmt.Errorf("failed to create block cache dir %s: %v", opts.Dir, err)
+			return err
+		}
+		c.dir = opts.Dir
+		c.disk = newLRU(opts.DirSize)
+		if err := c.loadDir(); err != nil {
+			return err
+		}
+	}
+
+	cache = c
+	return nil
+}
+
+type blockCache struct {
+	mem  *lru
+	dir  string
+	disk *lru
+
+	fillsLock sync.Mutex
+	// fills are the blocks being read from the backend, keyed by cache key.
+	fills map[string]*cacheFill
+}
+
+type cacheFill struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// cacheable returns false for IDs that can't be used as cache paths.
+func cacheable(repoID, blockID string) bool {
+	return len(blockID) > 2 && repoID != "" &&
+		!strings.ContainsAny(repoID+blockID, "/\\") && !strings.HasPrefix(repoID, ".")
+}
+
+func cacheKey(repoID, blockID string) string {
+	return repoID + "/" + blockID
+}
+
+// get returns the content of a block, reading it from the backend if it's not cached.
+// A reader waiting for the read of another reader stops waiting once ctx is done, and
+// reads the block again if the other reader was cancelled.
+func (c *blockCache) get(ctx context.Context, repoID, blockID string) ([]byte, error) {
+	key := cacheKey(repoID, blockID)
+	if c.mem != nil {
+		if data, ok := c.mem.get(key); ok {
+			memHits.Inc()
+			return data, nil
+		}
+		memMisses.Inc()
+	}
+
+	c.fillsLock.Lock()
+	for {
+		f, ok := c.fills[key]
+		if !ok {
+			break
+		}
+		c.fillsLock.Unlock()
+		cacheFillWaits.Inc()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !objstore.IsContextError(f.err) || ctx.Err() != nil {
+			return f.data, f.err
+		}
+		c.fillsLock.Lock()
+	}
+	f := &cacheFill{done: make(chan struct{})}
+	c.fills[key] = f
+	c.fillsLock.Unlock()
+
+	f.data, f.err = c.fill(ctx, repoID, blockID, key)
+
+	c.fillsLock.Lock()
+	delete(c.fills, key)
+	c.fillsLock.Unlock()
+	close(f.done)
+
+	return f.data, f.err
+}
+
+func (c *blockCache) fill(ctx context.Context, repoID, blockID, key string) ([]byte, error) {
+	if c.disk != nil {
+		data, err := ioutil.ReadFile(c.path(repoID, blockID))
+		if err == nil {
+			diskHits.Inc()
+			// The modification time orders the cached files when the directory is loaded again.
+			now := time.Now()
+			os.Chtimes(c.path(repoID, blockID), now, now)
+			c.disk.touch(key)
+			c.mem.add(key, data, int64(len(data)))
+			return data, nil
+		}
+		diskMisses.Inc()
+	}
+
+	var buf bytes.Buffer
+	if err := store.ReadCtx(ctx, repoID, blockID, &buf); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	c.mem.add(key, data, int64(len(data)))
+	if c.disk != nil {
+		// The block is still returned if it can't be cached on disk.
+		if err := c.writeFile(repoID, blockID, data); err == nil {
+			c.removeFiles(c.disk.add(key, nil, int64(len(data))))
+		}
+	}
+
+	return data, nil
+}
+
+func (c *blockCache) remove(repoID, blockID string) {
+	key := cacheKey(repoID, blockID)
+	c.mem.remove(key)
+	if c.disk != nil && c.disk.remove(key) {
+		os.Remove(c.path(repoID, blockID))
+	}
+}
+
+func (c *blockCache) path(repoID, blockID string) string {
+	return filepath.Join(c.dir, repoID, blockID[:2], blockID[2:])
+}
+
+func (c *blockCache) writeFile(repoID, blockID string, data []byte) error {
+	p := c.path(repoID, blockID)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), cacheTmpPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (c *blockCache) removeFiles(keys []string) {
+	for _, key := range keys {
+		slash := strings.IndexByte(key, '/')
+		os.Remove(c.path(key[:slash], key[slash+1:]))
+	}
+}
+
+// loadDir adds the blocks cached in the directory by previous runs, the least recently
+// used blocks are removed if they don't fit in the size limit.
+func (c *blockCache) loadDir() error {
+	type cachedFile struct {
+		key   string
+		size  int64
+		mtime time.Time
+	}
+	var files []cachedFile
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), cacheTmpPrefix) {
+			os.Remove(p)
+			return nil
+		}
+		rel, err := filepath.Rel(c.dir, p)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		key := cacheKey(parts[0], parts[1]+parts[2])
+		files = append(files, cachedFile{key, info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to load block cache dir %s: %v", c.dir, err)
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		c.removeFiles(c.disk.add(f.key, nil, f.size))
+	}
+	return nil
+}
+
+// lru is a set of entries with a size limit, the least recently used entries
+// are evicted when the limit is exceeded. A nil lru caches nothing.
+type lru struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	entries  *list.List
+	index    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	data []byte
+	size int64
+}
+
+func newLRU(capacity int64) *lru {
+	l := new(lru)
+	l.capacity = capacity
+	l.entries = list.New()
+	l.index = make(map[string]*list.Element)
+	return l
+}
+
+func (l *lru) get(key string) ([]byte, bool) {
+	if l == nil {
+		return nil, false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	elem, ok := l.index[key]
+	if !ok {
+		return nil, false
+	}
+	l.entries.MoveToFront(elem)
+	return elem.Value.(*lruEntry).data, true
+}
+
+func (l *lru) touch(key string) {
+	l.get(key)
+}
+
+// add adds an entry and returns the keys of the evicted entries.
+// Entries larger than the capacity are not added.
+func (l *lru) add(key string, data []byte, size int64) []string {
+	if l == nil || size > l.capacity {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if elem, ok := l.index[key]; ok {
+		l.entries.MoveToFront(elem)
+		return nil
+	}
+	l.index[key] = l.entries.PushFront(&lruEntry{key, data, size})
+	l.size += size
+
+	var evicted []string
+	for l.size > l.capacity {
+		e := l.entries.Remove(l.entries.Back()).(*lruEntry)
+		delete(l.index, e.key)
+		l.size -= e.size
+		evicted = append(evicted, e.key)
+	}
+	return evicted
+}
+
+// remove removes an entry and returns whether it existed.
+func (l *lru) remove(key string) bool {
+	if l == nil {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	elem, ok := l.index[key]
+	if !ok {
+		return false
+	}
+	l.entries.Remove(elem)
+	delete(l.index, key)
+	l.size -= elem.Value.(*lruEntry).size
+	return true
+}
+
+func (l *lru) used() int64 {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.size
+}
@@ -0,0 +1,183 @@
+package blockmgr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/objstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingBackend counts reads and makes them slow, so that concurrent reads overlap.
+type countingBackend struct {
+	objstore.Backend
+	reads int64
+}
+
+func (b *countingBackend) Read(repoID string, objID string, w io.Writer) error {
+	atomic.AddInt64(&b.reads, 1)
+	time.Sleep(50 * time.Millisecond)
+	return b.Backend.Read(repoID, objID, w)
+}
+
+func TestBlockCache(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "block-cache-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	if err := Init("", dataDir); err != nil {
+		t.Fatalf("Failed to init block manager : %v\n", err)
+	}
+	fsStore := store
+	backend := &countingBackend{Backend: fsStore}
+	store = objstore.NewWithBackend("blocks", backend)
+	defer func() {
+		store = fsStore
+		cache = nil
+	}()
+
+	blocks := []string{
+		"0401fc662e3bc87a41f299a907c056aaf8322a27",
+		"1b5d2a5d34ebd42c06e9b1c8cb3fc1e0db4a3c2e",
+		"2c0a6a9d2ab2cba35b6c1cd3e9bd8ff35a7e0b4a",
+	}
+	content := bytes.Repeat([]byte("x"), 100)
+	for _, blkID := range blocks {
+		if err := Write(repoID, blkID, bytes.NewReader(content)); err != nil {
+			t.Fatalf("Failed to write block : %v\n", err)
+		}
+	}
+
+	cacheDir := dataDir + "/cache"
+	opts := CacheOptions{MemorySize: 250, Dir: cacheDir, DirSize: 250}
+	if err := InitCache(opts); err != nil {
+		t.Fatalf("Failed to init cache : %v\n", err)
+	}
+
+	// Concurrent reads of the same block read the backend once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if err := Read(repoID, blocks[0], &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+				t.Errorf("Failed to read block : %v\n", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if backend.reads != 1 {
+		t.Errorf("Backend is read %d times\n", backend.reads)
+	}
+
+	hits := testutil.ToFloat64(memHits)
+	if err := Read(repoID, blocks[0], ioutil.Discard); err != nil {
+		t.Fatalf("Failed to read block : %v\n", err)
+	}
+	if testutil.ToFloat64(memHits) != hits+1 || backend.reads != 1 {
+		t.Errorf("Block is not read from memory\n")
+	}
+
+	// Reading the other blocks evicts the first one from both tiers.
+	for _, blkID := range blocks[1:] {
+		if err := Read(repoID, blkID, ioutil.Discard); err != nil {
+			t.Fatalf("Failed to read block : %v\n", err)
+		}
+	}
+	if cache.mem.used() > opts.MemorySize || cache.disk.used() > opts.DirSize {
+		t.Errorf("Cache exceeds its size : %d, %d\n", cache.mem.used(), cache.disk.used())
+	}
+	if _, err := os.Stat(cache.path(repoID, blocks[0])); !os.IsNotExist(err) {
+		t.Errorf("Evicted block is still cached on disk\n")
+	}
+
+	// Blocks cached on disk survive a restart.
+	if err := InitCache(opts); err != nil {
+		t.Fatalf("Failed to init cache : %v\n", err)
+	}
+	if cache.disk.used() != 200 {
+		t.Errorf("Cache dir has %d bytes after restart\n", cache.disk.used())
+	}
+	reads := backend.reads
+	hits = testutil.ToFloat64(diskHits)
+	if err := Read(repoID, blocks[2], ioutil.Discard); err != nil {
+		t.Fatalf("Failed to read block : %v\n", err)
+	}
+	if testutil.ToFloat64(diskHits) != hits+1 || backend.reads != reads {
+		t.Errorf("Block is not read from cache dir\n")
+	}
+
+	// Removed blocks are removed from the cache.
+	if err := Remove(repoID, blocks[2]); err != nil {
+		t.Fatalf("Failed to remove block : %v\n", err)
+	}
+	if err := Read(repoID, blocks[2], ioutil.Discard); err == nil {
+		t.Errorf("Removed block is still cached\n")
+	}
+}
+
+func TestBlockCacheCancel(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "block-cache-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	if err := Init("", dataDir); err != nil {
+		t.Fatalf("Failed to init block manager : %v\n", err)
+	}
+	fsStore := store
+	backend := &countingBackend{Backend: fsStore}
+	store = objstore.NewWithBackend("blocks", backend)
+	defer func() {
+		store = fsStore
+		cache = nil
+	}()
+
+	content := bytes.Repeat([]byte("x"), 100)
+	if err := Write(repoID, blockID, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+	if err := InitCache(CacheOptions{MemorySize: 1000}); err != nil {
+		t.Fatalf("Failed to init cache : %v\n", err)
+	}
+
+	// The reader filling the cache is cancelled, the reader waiting for it reads the block again.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ReadCtx(ctx, repoID, blockID, ioutil.Discard)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		var buf bytes.Buffer
+		err := Read(repoID, blockID, &buf)
+		if err == nil && !bytes.Equal(buf.Bytes(), content) {
+			err = fmt.Errorf("read wrong content")
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Unexpected error of cancelled read : %v\n", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Failed to read block : %v\n", err)
+	}
+	if backend.reads != 2 {
+		t.Errorf("Backend is read %d times\n", backend.reads)
+	}
+}
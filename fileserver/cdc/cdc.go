@@ -0,0 +1,145 @@
+// Package cdc provides content-defined chunking of files into blocks.
+package cdc
+
+import (
+	"fmt"
+	"io"
+)
+
+// Chunking algorithms.
+const (
+	// Rabin cuts blocks where the Rabin fingerprint of a 48 bytes window matches,
+	// the boundaries are the same as the ones of common/cdc.
+	Rabin = "rabin"
+	// FastCDC cuts blocks using a gear hash with normalized chunking.
+	FastCDC = "fastcdc"
+)
+
+// Default block sizes, the same as common/cdc.
+const (
+	DefaultMinSize = 1 << 18
+	DefaultAvgSize = 1 << 20
+	DefaultMaxSize = 1 << 22
+)
+
+const (
+	rabinWindowSize = 48
+	rabinBreakValue = 0x0013
+)
+
+// Options configures a chunker.
+type Options struct {
+	Algorithm string
+	// MinSize and MaxSize bound the size of blocks, except that the last block may be smaller than MinSize.
+	MinSize int
+	// AvgSize is the expected size of blocks, it must be a power of 2.
+	AvgSize int
+	MaxSize int
+}
+
+// DefaultOptions returns the options with default block sizes for an algorithm.
+func DefaultOptions(algorithm string) Options {
+	return Options{algorithm, DefaultMinSize, DefaultAvgSize, DefaultMaxSize}
+}
+
+// Validate checks if the options are valid.
+func (opts *Options) Validate() error {
+	if opts.Algorithm != Rabin && opts.Algorithm != FastCDC {
+		err := fmt.Errorf("unknown chunking algorithm %s", opts.Algorithm)
+		return err
+	}
+	if opts.MinSize < rabinWindowSize || opts.MinSize > opts.AvgSize || opts.AvgSize > opts.MaxSize {
+		err := fmt.Errorf("invalid block sizes: min %d, avg %d, max %d", opts.MinSize, opts.AvgSize, opts.MaxSize)
+		return err
+	}
+	if opts.AvgSize&(opts.AvgSize-1) != 0 {
+		err := fmt.Errorf("average block size %d is not a power of 2", opts.AvgSize)
+		return err
+	}
+	return nil
+}
+
+// Chunker splits the content read from a reader into blocks.
+type Chunker struct {
+	r    io.Reader
+	opts Options
+	cut  func(data []byte) int
+	buf  []byte
+	eof  bool
+}
+
+// NewChunker creates a chunker reading from r.
+func NewChunker(r io.Reader, opts Options) (*Chunker, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := new(Chunker)
+	c.r = r
+	c.opts = opts
+	if opts.Algorithm == Rabin {
+		c.cut = c.rabinCut
+	} else {
+		c.cut = newFastCDC(opts).cut
+	}
+	return c, nil
+}
+
+// Next returns the next block. The returned slice is owned by the caller.
+// io.EOF is returned after the last block.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf)
+	block := c.buf[:n:n]
+	rest := make([]byte, len(c.buf)-n, c.opts.MaxSize)
+	copy(rest, c.buf[n:])
+	c.buf = rest
+
+	return block, nil
+}
+
+// fill reads until the buffer holds MaxSize bytes or the reader is drained.
+func (c *Chunker) fill() error {
+	if c.buf == nil {
+		c.buf = make([]byte, 0, c.opts.MaxSize)
+	}
+	for !c.eof && len(c.buf) < c.opts.MaxSize {
+		n, err := c.r.Read(c.buf[len(c.buf):c.opts.MaxSize])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rabinCut returns the length of the first block in data.
+// data is shorter than MaxSize only at the end of the content.
+func (c *Chunker) rabinCut(data []byte) int {
+	minSize := c.opts.MinSize
+	if len(data) < minSize {
+		return len(data)
+	}
+
+	mask := uint32(c.opts.AvgSize - 1)
+	cur := minSize - 1
+	fingerprint := rabinChecksum(data[cur-rabinWindowSize+1 : cur+1])
+	for {
+		if fingerprint&mask == rabinBreakValue&mask || cur+1 >= c.opts.MaxSize {
+			return cur + 1
+		}
+		cur++
+		if cur >= len(data) {
+			return len(data)
+		}
+		fingerprint = rabinRollingChecksum(fingerprint, data[cur-rabinWindowSize], data[cur])
+	}
+}
@@ -0,0 +1,105 @@
+package cdc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"testing"
+)
+
+func lcgData(size int) []byte {
+	data := make([]byte, size)
+	x := uint32(1)
+	for i := range data {
+		x = x*1103515245 + 12345
+		data[i] = byte(x >> 16)
+	}
+	return data
+}
+
+func chunkAll(t *testing.T, data []byte, opts Options) [][]byte {
+	c, err := NewChunker(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("Failed to create chunker : %v\n", err)
+	}
+	var blocks [][]byte
+	for {
+		block, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to get next block : %v\n", err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestRabinCompatible(t *testing.T) {
+	// Block sizes produced by common/cdc for the same content and options.
+	want := []int{279, 388, 1164, 470, 610, 656, 818, 462, 2444, 4096, 774, 2891}
+
+	blocks := chunkAll(t, lcgData(64*1024), Options{Rabin, 256, 1024, 4096})
+	if len(blocks) < len(want) {
+		t.Fatalf("Got %d blocks, want at least %d\n", len(blocks), len(want))
+	}
+	for i, size := range want {
+		if len(blocks[i]) != size {
+			t.Errorf("Size of block %d is %d, want %d\n", i, len(blocks[i]), size)
+		}
+	}
+}
+
+func TestChunkBlocks(t *testing.T) {
+	data := lcgData(1 << 20)
+	for _, algorithm := range []string{Rabin, FastCDC} {
+		opts := Options{algorithm, 2048, 8192, 32768}
+		blocks := chunkAll(t, data, opts)
+
+		var joined []byte
+		for i, block := range blocks {
+			if len(block) > opts.MaxSize || (len(block) < opts.MinSize && i != len(blocks)-1) {
+				t.Errorf("%s: size of block %d is %d\n", algorithm, i, len(block))
+			}
+			joined = append(joined, block...)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Errorf("%s: blocks don't add up to the content\n", algorithm)
+		}
+
+		// Inserting a byte at the start only changes the first blocks.
+		shifted := chunkAll(t, append([]byte{'x'}, data...), opts)
+		ids := make(map[[20]byte]bool)
+		for _, block := range blocks {
+			ids[sha1.Sum(block)] = true
+		}
+		shared := 0
+		for _, block := range shifted {
+			if ids[sha1.Sum(block)] {
+				shared++
+			}
+		}
+		if shared < len(blocks)-2 {
+			t.Errorf("%s: only %d of %d blocks are shared after inserting a byte\n", algorithm, shared, len(blocks))
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	invalid := []Options{
+		{"fixed", DefaultMinSize, DefaultAvgSize, DefaultMaxSize},
+		{Rabin, 16, DefaultAvgSize, DefaultMaxSize},
+		{Rabin, DefaultMinSize, 3 << 18, DefaultMaxSize},
+		{FastCDC, DefaultAvgSize, DefaultMinSize, DefaultMaxSize},
+	}
+	for _, opts := range invalid {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Invalid options %+v are accepted\n", opts)
+		}
+	}
+	opts := DefaultOptions(FastCDC)
+	if err := opts.Validate(); err != nil {
+		t.Errorf("Default options are rejected : %v\n", err)
+	}
+}
@@ -0,0 +1,66 @@
+package cdc
+
+// FastCDC with normalized chunking, see "FastCDC: a Fast and Efficient Content-Defined
+// Chunking Approach for Data Deduplication" (USENIX ATC 2016).
+
+var gearTable [256]uint64
+
+func init() {
+	// The gear table is generated by splitmix64 with a fixed seed. Changing it changes
+	// all block boundaries, so it must stay the same.
+	seed := uint64(0x5eaf11e5eaf11e00)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+type fastCDC struct {
+	minSize int
+	avgSize int
+	// maskS is used before the average size is reached, it has more bits than maskL
+	// so that cutting small blocks is less likely.
+	maskS uint64
+	maskL uint64
+}
+
+func newFastCDC(opts Options) *fastCDC {
+	bits := uint(fls64(uint64(opts.AvgSize)) - 1)
+	f := new(fastCDC)
+	f.minSize = opts.MinSize
+	f.avgSize = opts.AvgSize
+	// The high bits of the gear hash depend on the most recent 64 bytes.
+	f.maskS = ^uint64(0) << (64 - (bits + 1))
+	f.maskL = ^uint64(0) << (64 - (bits - 1))
+	return f
+}
+
+func (f *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= f.minSize {
+		return n
+	}
+	normal := f.avgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := f.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&f.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&f.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
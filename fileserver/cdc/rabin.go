@@ -0,0 +1,108 @@
+package cdc
+
+// Rabin fingerprint over a sliding window, ported from common/cdc/rabin-checksum.c.
+// The C implementation keeps the checksum in 32 bits, the same is done here so that
+// both produce the same chunk boundaries for the same content.
+
+const rabinPoly = uint64(0xbfe6b8a5bf378d83)
+
+var (
+	rabinT     [256]uint64
+	rabinU     [256]uint64
+	rabinShift uint
+)
+
+func init() {
+	calcT(rabinPoly)
+	calcU(rabinWindowSize)
+}
+
+// fls64 returns the position of the most significant bit set, starting from 1.
+func fls64(v uint64) int {
+	n := 0
+	for v != 0 {
+		v >>= 1
+		n++
+	}
+	return n
+}
+
+func polymod(nh, nl, d uint64) uint64 {
+	k := fls64(d) - 1
+	d <<= uint(63 - k)
+
+	if nh != 0 {
+		if nh&(1<<63) != 0 {
+			nh ^= d
+		}
+		for i := 62; i >= 0; i-- {
+			if nh&(uint64(1)<<uint(i)) != 0 {
+				nh ^= d >> uint(63-i)
+				nl ^= d << uint(i+1)
+			}
+		}
+	}
+	for i := 63; i >= k; i-- {
+		if nl&(uint64(1)<<uint(i)) != 0 {
+			nl ^= d >> uint(63-i)
+		}
+	}
+
+	return nl
+}
+
+func polymult(x, y uint64) (uint64, uint64) {
+	var ph, pl uint64
+	if x&1 != 0 {
+		pl = y
+	}
+	for i := 1; i < 64; i++ {
+		if x&(uint64(1)<<uint(i)) != 0 {
+			ph ^= y >> uint(64-i)
+			pl ^= y << uint(i)
+		}
+	}
+	return ph, pl
+}
+
+func polymmult(x, y, d uint64) uint64 {
+	h, l := polymult(x, y)
+	return polymod(h, l, d)
+}
+
+func append8(p uint64, m byte) uint64 {
+	return ((p << 8) | uint64(m)) ^ rabinT[p>>rabinShift]
+}
+
+func calcT(poly uint64) {
+	xshift := uint(fls64(poly) - 1)
+	rabinShift = xshift - 8
+	t1 := polymod(0, uint64(1)<<xshift, poly)
+	for j := 0; j < 256; j++ {
+		rabinT[j] = polymmult(uint64(j), t1, poly) | (uint64(j) << xshift)
+	}
+}
+
+func calcU(size int) {
+	sizeShift := uint64(1)
+	for i := 1; i < size; i++ {
+		sizeShift = append8(sizeShift, 0)
+	}
+	for i := 0; i < 256; i++ {
+		rabinU[i] = polymmult(uint64(i), sizeShift, rabinPoly)
+	}
+}
+
+// rabinChecksum computes the checksum of a window.
+func rabinChecksum(buf []byte) uint32 {
+	var sum uint32
+	for _, c := range buf {
+		sum = rabinRollingChecksum(sum, 0, c)
+	}
+	return sum
+}
+
+// rabinRollingChecksum removes c1 from the window and appends c2.
+func rabinRollingChecksum(csum uint32, c1, c2 byte) uint32 {
+	return uint32(append8(uint64(csum)^rabinU[c1], c2))
+}
@@ -0,0 +1,278 @@
+// Maintenance commands run by the file server binary instead of serving requests.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/haiwen/seafile-server/fileserver/fsck"
+	"github.com/haiwen/seafile-server/fileserver/gc"
+	"github.com/haiwen/seafile-server/fileserver/migrate"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"gc", "gc [-dry-run] [-verbose] [repo_id ...]", runGC},
+		{"fsck", "fsck [-repair] [-json] [-workers n] [repo_id ...]", runFsck},
+		{"export", "export [-commit id] [-path dir] [-password pw|-] (-dir dir | -tar file|-) repo_id", runExport},
+		{"migrate", "migrate -dest-conf dir [-dest-data dir] [-workers n] [-incremental] [-verbose] [repo_id ...]", runMigrate},
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nCommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", cmd.usage)
+		}
+	}
+}
+
+// runCommand runs a maintenance command and returns the exit code.
+func runCommand(args []string) int {
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %s.\n", args[0])
+	flag.Usage()
+	return 2
+}
+
+func runGC(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report unused objects without removing them")
+	verbose := flags.Bool("verbose", false, "print progress of traversing commits")
+	flags.Parse(args)
+
+	opts := new(gc.Options)
+	opts.DryRun = *dryRun
+	opts.Verbose = *verbose
+	opts.DefaultKeepDays = options.keepHistoryDays
+
+	report, err := gc.Run(flags.Args(), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "GC failed: %v\n", err)
+		return 1
+	}
+
+	verb := "removed"
+	if report.DryRun {
+		verb = "can be removed"
+	}
+	for _, result := range report.Repos {
+		fmt.Printf("Repo %s: %d blocks total, about %d reachable blocks, %d blocks %s; "+
+			"%d fs objects total, %d fs objects %s; %d bytes of objects.\n",
+			result.RepoID, result.TotalBlocks, result.ReachableBlocks, result.RemovedBlocks, verb,
+			result.TotalFSObjs, result.RemovedFSObjs, verb, result.RemovedBytes)
+	}
+	for _, repoID := range report.DeletedRepos {
+		fmt.Printf("Deleted repo %s %s.\n", repoID, verb)
+	}
+	if len(report.CorruptedRepos) > 0 {
+		fmt.Printf("The following repos are damaged. You can run fsck to fix them.\n")
+		for _, repoID := range report.CorruptedRepos {
+			fmt.Printf("%s\n", repoID)
+		}
+	}
+	if report.DryRun {
+		fmt.Printf("GC is finished. %d bytes of objects can be removed.\n", report.RemovedBytes)
+	} else {
+		fmt.Printf("GC is finished. %d bytes of objects are removed.\n", report.RemovedBytes)
+	}
+
+	return 0
+}
+
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair damaged repos, otherwise repos are only verified")
+	jsonReport := flags.Bool("json", false, "print the report in JSON format")
+	workers := flags.Int("workers", 1, "number of repos checked concurrently")
+	flags.Parse(args)
+
+	opts := new(fsck.Options)
+	opts.Repair = *repair
+	opts.Workers = *workers
+
+	report, err := fsck.Run(flags.Args(), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fsck failed: %v\n", err)
+		return 1
+	}
+
+	if *jsonReport {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode report: %v\n", err)
+			return 1
+		}
+	} else {
+		for _, result := range report.Repos {
+			switch {
+			case result.Error != "":
+				fmt.Printf("Repo %s: %s.\n", result.RepoID, result.Error)
+			case !result.Corrupted:
+				fmt.Printf("Repo %s is OK.\n", result.RepoID)
+			default:
+				fmt.Printf("Repo %s is damaged: %d files, %d folders.\n",
+					result.RepoID, len(result.DamagedFiles), len(result.DamagedDirs))
+				if result.ResetCommitID != "" {
+					fmt.Printf("  Head commit is damaged, available commit is %s.\n", result.ResetCommitID)
+				}
+				for _, path := range result.DamagedFiles {
+					fmt.Printf("  damaged file %s\n", path)
+				}
+				for _, path := range result.DamagedDirs {
+					fmt.Printf("  damaged folder %s\n", path)
+				}
+				if result.RepairCommitID != "" {
+					fmt.Printf("  Repaired by commit %s.\n", result.RepairCommitID)
+				}
+			}
+		}
+	}
+
+	for _, result := range report.Repos {
+		if result.Error != "" || (result.Corrupted && !report.Repair) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	commitID := flags.String("commit", "", "commit to export, defaults to the head commit")
+	path := flags.String("path", "/", "folder in the repo to export")
+	password := flags.String("password", "", "password of encrypted repo, - reads it from stdin")
+	tarFile := flags.String("tar", "", "write a tar archive to file, - writes it to stdout")
+	outDir := flags.String("dir", "", "write the files to a local dir")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (*tarFile == "") == (*outDir == "") {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [options] repo_id\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Exactly one of -dir and -tar must be given.\n")
+		flags.PrintDefaults()
+		return 2
+	}
+	repoID := flags.Arg(0)
+
+	if *password == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintf(os.Stderr, "Failed to read password: %v\n", err)
+			return 1
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	var sink exportSink
+	var err error
+	out := os.Stdout
+	switch {
+	case *tarFile == "-":
+		sink = newTarSink(os.Stdout)
+		out = os.Stderr
+	case *tarFile != "":
+		sink, err = openTarSink(*tarFile)
+	default:
+		sink, err = newDirSink(*outDir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open output: %v\n", err)
+		return 1
+	}
+
+	stats, err := exportRepo(repoID, *commitID, normalizeExportPath(*path), *password, sink)
+	if closeErr := sink.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close output: %v", closeErr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(out, "Exported %d folders, %d files, %d links, %d bytes; %d files were already exported.\n",
+		stats.dirs, stats.files, stats.links, stats.bytes, stats.skipped)
+	return 0
+}
+
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	destConf := flags.String("dest-conf", "", "dir of the seafile.conf configuring the destination backends")
+	destData := flags.String("dest-data", "", "data dir of the destination fs backends, defaults to the seafile data dir")
+	workers := flags.Int("workers", 4, "number of objects copied concurrently")
+	incremental := flags.Bool("incremental", false, "only copy the commits created since the last migration")
+	verbose := flags.Bool("verbose", false, "print progress of the migration")
+	flags.Parse(args)
+
+	if *destConf == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s migrate [options] [repo_id ...]\n", os.Args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+	if *destData == "" {
+		*destData = dataDir
+	}
+
+	src, err := migrate.NewStores(centralDir, dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open source storage: %v\n", err)
+		return 1
+	}
+	dst, err := migrate.NewStores(*destConf, *destData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open destination storage: %v\n", err)
+		return 1
+	}
+
+	opts := new(migrate.Options)
+	opts.Workers = *workers
+	opts.Incremental = *incremental
+	opts.Verbose = *verbose
+
+	report, err := migrate.Run(src, dst, flags.Args(), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+
+	for _, c := range []struct {
+		name   string
+		counts migrate.Counts
+	}{{"commits", report.Commits}, {"fs objects", report.FS}, {"blocks", report.Blocks}} {
+		fmt.Printf("%s: %d copied, %d bytes; %d already exist; %d failed.\n",
+			c.name, c.counts.Copied, c.counts.Bytes, c.counts.Skipped, c.counts.Failed)
+	}
+	if len(report.Corrupted) > 0 {
+		fmt.Printf("The following objects are damaged in the source and copied as is. You can run fsck to fix them.\n")
+		for _, obj := range report.Corrupted {
+			fmt.Printf("%s\n", obj)
+		}
+	}
+	for _, repoID := range report.FailedRepos {
+		fmt.Printf("Repo %s is not migrated.\n", repoID)
+	}
+	if report.Failed() > 0 {
+		fmt.Printf("Migration is not finished, run it again to copy the missing objects.\n")
+		return 1
+	}
+	fmt.Printf("Migration is finished.\n")
+	return 0
+}
@@ -3,11 +3,14 @@ package commitmgr
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"sort"
 	"time"
 
 	"github.com/haiwen/seafile-server/fileserver/objstore"
@@ -43,8 +46,10 @@ type Commit struct {
 var store *objstore.ObjectStore
 
 // Init initializes commit manager and creates underlying object store.
-func Init(seafileConfPath string, seafileDataDir string) {
-	store = objstore.New(seafileConfPath, seafileDataDir, "commits")
+func Init(seafileConfPath string, seafileDataDir string) error {
+	var err error
+	store, err = objstore.New(seafileConfPath, seafileDataDir, "commits")
+	return err
 }
 
 // NewCommit initializes a Commit object.
@@ -105,7 +110,12 @@ func (commit *Commit) ToData(w io.Writer) error {
 
 // ReadRaw reads data in binary format from storage backend.
 func ReadRaw(repoID string, commitID string, w io.Writer) error {
-	err := store.Read(repoID, commitID, w)
+	return ReadRawCtx(context.Background(), repoID, commitID, w)
+}
+
+// ReadRawCtx reads data like ReadRaw, and stops once ctx is done.
+func ReadRawCtx(ctx context.Context, repoID string, commitID string, w io.Writer) error {
+	err := store.ReadCtx(ctx, repoID, commitID, w)
 	if err != nil {
 		return err
 	}
@@ -114,7 +124,12 @@ func ReadRaw(repoID string, commitID string, w io.Writer) error {
 
 // WriteRaw writes data in binary format to storage backend.
 func WriteRaw(repoID string, commitID string, r io.Reader) error {
-	err := store.Write(repoID, commitID, r, false)
+	return WriteRawCtx(context.Background(), repoID, commitID, r)
+}
+
+// WriteRawCtx writes data like WriteRaw, and stops once ctx is done.
+func WriteRawCtx(ctx context.Context, repoID string, commitID string, r io.Reader) error {
+	err := store.WriteCtx(ctx, repoID, commitID, r, false)
 	if err != nil {
 		return err
 	}
@@ -123,9 +138,14 @@ func WriteRaw(repoID string, commitID string, r io.Reader) error {
 
 // Load commit from storage backend.
 func Load(repoID string, commitID string) (*Commit, error) {
+	return LoadCtx(context.Background(), repoID, commitID)
+}
+
+// LoadCtx loads commit like Load, and stops once ctx is done.
+func LoadCtx(ctx context.Context, repoID string, commitID string) (*Commit, error) {
 	var buf bytes.Buffer
 	commit := new(Commit)
-	err := ReadRaw(repoID, commitID, &buf)
+	err := ReadRawCtx(ctx, repoID, commitID, &buf)
 	if err != nil {
 		return nil, err
 	}
@@ -139,13 +159,18 @@ func Load(repoID string, commitID string) (*Commit, error) {
 
 // Save commit to storage backend.
 func Save(commit *Commit) error {
+	return SaveCtx(context.Background(), commit)
+}
+
+// SaveCtx saves commit like Save, and stops once ctx is done.
+func SaveCtx(ctx context.Context, commit *Commit) error {
 	var buf bytes.Buffer
 	err := commit.ToData(&buf)
 	if err != nil {
 		return err
 	}
 
-	err = WriteRaw(commit.RepoID, commit.CommitID, &buf)
+	err = WriteRawCtx(ctx, commit.RepoID, commit.CommitID, &buf)
 	if err != nil {
 		return err
 	}
@@ -157,3 +182,171 @@ func Save(commit *Commit) error {
 func Exists(repoID string, commitID string) (bool, error) {
 	return store.Exists(repoID, commitID)
 }
+
+// ExistsCtx checks commit like Exists, and stops once ctx is done.
+func ExistsCtx(ctx context.Context, repoID string, commitID string) (bool, error) {
+	return store.ExistsCtx(ctx, repoID, commitID)
+}
+
+// Remove removes commit from storage backend.
+func Remove(repoID string, commitID string) error {
+	return store.Remove(repoID, commitID)
+}
+
+// List calls fn for every commit of a repo.
+func List(repoID string, fn func(commitID string) error) error {
+	return store.List(repoID, fn)
+}
+
+// SkipParents is used as a return value from TraverseFunc to indicate that
+// the parents of the commit are not to be traversed.
+var SkipParents = fmt.Errorf("skip parents")
+
+// TraverseFunc is called for each commit visited by TraverseCommitTree.
+type TraverseFunc func(commit *Commit) error
+
+// TraverseCommitTree visits the commit history starting from headID, newest commits first.
+// Every commit is visited once even if it's reachable through multiple merges.
+// If fn returns SkipParents, the parents of the commit are not traversed unless they're reachable
+// from other commits. Any other error stops the traversal and is returned.
+func TraverseCommitTree(repoID string, headID string, fn TraverseFunc) error {
+	head, err := Load(repoID, headID)
+	if err != nil {
+		err := fmt.Errorf("failed to load commit %s:%s: %v", repoID, headID, err)
+		return err
+	}
+
+	visited := make(map[string]bool)
+	visited[headID] = true
+	// Commits to be visited, sorted by ctime in descending order.
+	queue := []*Commit{head}
+
+	for len(queue) > 0 {
+		commit := queue[0]
+		queue = queue[1:]
+
+		err := fn(commit)
+		if err == SkipParents {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		parents := []string{commit.ParentID.String, commit.SecondParentID.String}
+		for _, parentID := range parents {
+			if parentID == "" || visited[parentID] {
+				continue
+			}
+			visited[parentID] = true
+
+			parent, err := Load(repoID, parentID)
+			if err != nil {
+				err := fmt.Errorf("failed to load commit %s:%s: %v", repoID, parentID, err)
+				return err
+			}
+			i := sort.Search(len(queue), func(i int) bool {
+				return queue[i].Ctime < parent.Ctime
+			})
+			queue = append(queue, nil)
+			copy(queue[i+1:], queue[i:])
+			queue[i] = parent
+		}
+	}
+
+	return nil
+}
+
+// HistoryOptions selects the commits returned by History.
+type HistoryOptions struct {
+	// Only commits created in [Since, Until) are returned, zero means no bound.
+	Since int64
+	Until int64
+	// Limit is the maximum number of commits returned, zero means no limit.
+	Limit int
+	// Cursor is the cursor returned with the previous page of the history, the ID of the
+	// last commit of the page. The history is walked from the head again to find it, so
+	// getting a page costs as much as getting all the pages before it.
+	Cursor string
+	// MaxDepth is the maximum number of parents between the head and the commits
+	// returned, zero means no limit.
+	MaxDepth int
+	// Filter returns whether a commit is returned, it's only called for commits in the
+	// time range and after the cursor.
+	Filter func(commit *Commit) (bool, error)
+}
+
+var errHistoryFull = fmt.Errorf("history page full")
+
+// ErrCursorNotFound is returned by History if the cursor is not in the history,
+// e.g. it's not returned for the history or its commit is removed by GC.
+var ErrCursorNotFound = fmt.Errorf("cursor not found in history")
+
+// History returns a page of the commit history starting from headID, newest commits first.
+// The returned cursor is passed in opts to get the next page, it's empty on the last page.
+// To tell whether a full page is the last one, the history is walked until one more commit
+// is found.
+func History(repoID string, headID string, opts *HistoryOptions) ([]*Commit, string, error) {
+	if opts == nil {
+		opts = new(HistoryOptions)
+	}
+
+	var commits []*Commit
+	skipping := opts.Cursor != ""
+	// The least number of parents between the head and the commits found.
+	depths := map[string]int{headID: 0}
+
+	err := TraverseCommitTree(repoID, headID, func(commit *Commit) error {
+		depth := depths[commit.CommitID]
+		delete(depths, commit.CommitID)
+		var ret error
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			ret = SkipParents
+		} else {
+			for _, parentID := range []string{commit.ParentID.String, commit.SecondParentID.String} {
+				if d, ok := depths[parentID]; parentID != "" && (!ok || d > depth+1) {
+					depths[parentID] = depth + 1
+				}
+			}
+		}
+
+		if opts.Since > 0 && commit.Ctime < opts.Since {
+			// Parents are older, except for commits from clients with wrong clocks.
+			return SkipParents
+		}
+		if skipping {
+			skipping = commit.CommitID != opts.Cursor
+			return ret
+		}
+		if opts.Until > 0 && commit.Ctime >= opts.Until {
+			return ret
+		}
+		if opts.Filter != nil {
+			ok, err := opts.Filter(commit)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return ret
+			}
+		}
+
+		if opts.Limit > 0 && len(commits) >= opts.Limit {
+			// The page is full and there's at least one more commit for the next page.
+			return errHistoryFull
+		}
+		commits = append(commits, commit)
+		return ret
+	})
+	if err == errHistoryFull {
+		return commits, commits[len(commits)-1].CommitID, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if skipping {
+		return nil, "", ErrCursorNotFound
+	}
+
+	return commits, "", nil
+}
@@ -3,6 +3,7 @@ package commitmgr
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -65,3 +66,90 @@ func TestCommit(t *testing.T) {
 	assertEqual(t, commit.CreatorID, commitID)
 	assertEqual(t, commit.ParentID, commitID)
 }
+
+func saveTestCommit(t *testing.T, desc string, ctime int64, parents ...*Commit) *Commit {
+	commit := NewCommit(repoID, "", commitID, "seafile", desc)
+	commit.Ctime = ctime
+	commit.CommitID = computeCommitID(commit)
+	commit.ParentID = NewString("", false)
+	if len(parents) > 0 {
+		commit.ParentID.SetValid(parents[0].CommitID)
+	}
+	if len(parents) > 1 {
+		commit.SecondParentID.SetValid(parents[1].CommitID)
+	}
+	if err := Save(commit); err != nil {
+		t.Fatalf("Failed to save commit : %v\n", err)
+	}
+	return commit
+}
+
+func historyDescs(commits []*Commit) string {
+	var descs []string
+	for _, commit := range commits {
+		descs = append(descs, commit.Desc)
+	}
+	return strings.Join(descs, ",")
+}
+
+func TestHistory(t *testing.T) {
+	Init(seafileConfPath, seafileDataDir)
+	c1 := saveTestCommit(t, "c1", 100)
+	c2 := saveTestCommit(t, "c2", 200, c1)
+	c3 := saveTestCommit(t, "c3", 300, c2)
+	b1 := saveTestCommit(t, "b1", 250, c1)
+	head := saveTestCommit(t, "merge", 400, c3, b1)
+
+	tests := []struct {
+		opts     HistoryOptions
+		expected string
+	}{
+		{HistoryOptions{}, "merge,c3,b1,c2,c1"},
+		{HistoryOptions{Since: 200, Until: 400}, "c3,b1,c2"},
+		{HistoryOptions{MaxDepth: 1}, "merge,c3,b1"},
+		{HistoryOptions{Filter: func(commit *Commit) (bool, error) {
+			return commit.SecondParentID.String == "", nil
+		}}, "c3,b1,c2,c1"},
+	}
+	for _, test := range tests {
+		commits, cursor, err := History(repoID, head.CommitID, &test.opts)
+		if err != nil {
+			t.Fatalf("Failed to get history : %v\n", err)
+		}
+		if descs := historyDescs(commits); descs != test.expected || cursor != "" {
+			t.Errorf("History is %s with cursor %q, expected %s\n", descs, cursor, test.expected)
+		}
+	}
+
+	// Pages are continued from the cursor.
+	var pages []string
+	opts := &HistoryOptions{Limit: 2}
+	for {
+		commits, cursor, err := History(repoID, head.CommitID, opts)
+		if err != nil {
+			t.Fatalf("Failed to get history : %v\n", err)
+		}
+		pages = append(pages, historyDescs(commits))
+		if cursor == "" {
+			break
+		}
+		opts.Cursor = cursor
+	}
+	if expected := "merge,c3|b1,c2|c1"; strings.Join(pages, "|") != expected {
+		t.Errorf("History pages are %s, expected %s\n", strings.Join(pages, "|"), expected)
+	}
+
+	// A full last page has no cursor.
+	commits, cursor, err := History(repoID, head.CommitID, &HistoryOptions{Limit: 5})
+	if err != nil {
+		t.Fatalf("Failed to get history : %v\n", err)
+	}
+	if descs := historyDescs(commits); descs != "merge,c3,b1,c2,c1" || cursor != "" {
+		t.Errorf("History is %s with cursor %q, expected full history without cursor\n", descs, cursor)
+	}
+
+	opts.Cursor = "0401fc662e3bc87a41f299a907c056aaf8322a27"
+	if _, _, err := History(repoID, head.CommitID, opts); err != ErrCursorNotFound {
+		t.Errorf("Unexpected error of unknown cursor : %v\n", err)
+	}
+}
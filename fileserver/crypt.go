@@ -1,47 +1,105 @@
 package main
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/haiwen/seafile-server/fileserver/crypt"
+	"golang.org/x/crypto/pbkdf2"
 )
 
-func pkcs7Padding(p []byte, blockSize int) []byte {
-	padding := blockSize - len(p)%blockSize
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(p, padtext...)
-}
+// Parameters of key derivation, they must be the same as the ones used by seafile clients.
+const (
+	keygenIteration  = 1 << 19
+	keygenIteration2 = 1000
+)
 
-func pkcs7UnPadding(p []byte) []byte {
-	length := len(p)
-	paddLen := int(p[length-1])
-	return p[:(length - paddLen)]
+// Fixed salt used by encryption version 1 and 2, version 3 and later use per-repo salts.
+var defaultSalt = []byte{0xda, 0x90, 0x45, 0xc3, 0x06, 0xc7, 0xcc, 0x26}
+
+// bytesToKey is the EVP_BytesToKey function of OpenSSL using SHA1, it derives a 16 bytes key and iv.
+func bytesToKey(data, salt []byte, count int) ([]byte, []byte) {
+	var out, prev []byte
+	for len(out) < 32 {
+		hash := sha1.New()
+		hash.Write(prev)
+		hash.Write(data)
+		hash.Write(salt)
+		md := hash.Sum(nil)
+		for i := 1; i < count; i++ {
+			sum := sha1.Sum(md)
+			md = sum[:]
+		}
+		out = append(out, md...)
+		prev = md
+	}
+	return out[:16], out[16:32]
 }
 
-func decrypt(input, key, iv []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+// deriveKey derives the key and iv from data for an encryption version.
+func deriveKey(data []byte, version int, repoSalt string) ([]byte, []byte, error) {
+	switch {
+	case version >= 3:
+		salt, err := hex.DecodeString(repoSalt)
+		if err != nil || len(salt) != 32 {
+			err := fmt.Errorf("invalid repo salt")
+			return nil, nil, err
+		}
+		key := pbkdf2.Key(data, salt, keygenIteration2, 32, sha256.New)
+		iv := pbkdf2.Key(key, salt, 10, 16, sha256.New)
+		return key, iv, nil
+	case version == 2:
+		key := pbkdf2.Key(data, defaultSalt, keygenIteration2, 32, sha256.New)
+		iv := pbkdf2.Key(key, defaultSalt, 10, 16, sha256.New)
+		return key, iv, nil
+	case version == 1:
+		key, iv := bytesToKey(data, defaultSalt, keygenIteration)
+		return key, iv, nil
 	}
 
-	out := make([]byte, len(input))
-	blockMode := cipher.NewCBCDecrypter(block, iv)
-	blockMode.CryptBlocks(out, input)
-	out = pkcs7UnPadding(out)
+	err := fmt.Errorf("unsupported encryption version %d", version)
+	return nil, nil, err
+}
 
-	return out, nil
+// verifyRepoPasswd checks passwd against the magic of an encrypted repo.
+func verifyRepoPasswd(repoID, passwd, magic string, version int, repoSalt string) error {
+	key, _, err := deriveKey([]byte(repoID+passwd), version, repoSalt)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(key) != magic {
+		err := fmt.Errorf("incorrect password")
+		return err
+	}
+	return nil
 }
 
-func encrypt(input, key, iv []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// decryptRepoEncKey returns the key and iv to decrypt the blocks of an encrypted repo.
+func decryptRepoEncKey(version int, passwd, randomKey, repoSalt string) (*seafileCrypt, error) {
+	key, iv, err := deriveKey([]byte(passwd), version, repoSalt)
 	if err != nil {
 		return nil, err
 	}
+	if version == 1 {
+		return &seafileCrypt{key, iv}, nil
+	}
 
-	input = pkcs7Padding(input, block.BlockSize())
-	out := make([]byte, len(input))
-	blockMode := cipher.NewCBCEncrypter(block, iv)
-	blockMode.CryptBlocks(out, input)
+	encRandomKey, err := hex.DecodeString(randomKey)
+	if err != nil || len(encRandomKey) != 48 {
+		err := fmt.Errorf("invalid random key")
+		return nil, err
+	}
+	secretKey, err := crypt.Decrypt(encRandomKey, key, iv)
+	if err != nil {
+		err := fmt.Errorf("failed to decrypt random key: %v", err)
+		return nil, err
+	}
 
-	return out, nil
+	key, iv, err = deriveKey(secretKey, version, repoSalt)
+	if err != nil {
+		return nil, err
+	}
+	return &seafileCrypt{key, iv}, nil
 }
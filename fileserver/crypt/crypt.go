@@ -0,0 +1,58 @@
+// Package crypt encrypts and decrypts the blocks of encrypted repos.
+// Blocks are encrypted by AES-CBC and padded with PKCS7, like the seafile clients do.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+func pkcs7Padding(p []byte, blockSize int) []byte {
+	padding := blockSize - len(p)%blockSize
+	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
+	return append(p, padtext...)
+}
+
+func pkcs7UnPadding(p []byte, blockSize int) ([]byte, error) {
+	length := len(p)
+	paddLen := int(p[length-1])
+	if paddLen == 0 || paddLen > blockSize || paddLen > length {
+		err := fmt.Errorf("invalid padding of encrypted data")
+		return nil, err
+	}
+	return p[:(length - paddLen)], nil
+}
+
+// Decrypt decrypts input with key and iv.
+func Decrypt(input, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(input) == 0 || len(input)%block.BlockSize() != 0 {
+		err := fmt.Errorf("invalid length %d of encrypted data", len(input))
+		return nil, err
+	}
+
+	out := make([]byte, len(input))
+	blockMode := cipher.NewCBCDecrypter(block, iv)
+	blockMode.CryptBlocks(out, input)
+	return pkcs7UnPadding(out, block.BlockSize())
+}
+
+// Encrypt encrypts input with key and iv.
+func Encrypt(input, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	input = pkcs7Padding(input, block.BlockSize())
+	out := make([]byte, len(input))
+	blockMode := cipher.NewCBCEncrypter(block, iv)
+	blockMode.CryptBlocks(out, input)
+
+	return out, nil
+}
@@ -0,0 +1,34 @@
+package crypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	iv := bytes.Repeat([]byte{2}, 16)
+	for _, size := range []int{0, 1, 15, 16, 17, 1000} {
+		data := bytes.Repeat([]byte{'a'}, size)
+		encrypted, err := Encrypt(append([]byte(nil), data...), key, iv)
+		if err != nil {
+			t.Fatalf("Failed to encrypt : %v\n", err)
+		}
+		if len(encrypted)%16 != 0 || len(encrypted) <= size {
+			t.Errorf("Unexpected length %d of encrypted data of %d bytes\n", len(encrypted), size)
+		}
+		decrypted, err := Decrypt(encrypted, key, iv)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Errorf("Failed to decrypt data of %d bytes : %v\n", size, err)
+		}
+	}
+
+	if _, err := Decrypt([]byte("not a multiple of block size"), key, iv); err == nil {
+		t.Errorf("Data of invalid length is decrypted\n")
+	}
+	// Decrypted with a wrong key, the padding is garbage.
+	encrypted, _ := Encrypt([]byte("content"), key, iv)
+	if _, err := Decrypt(encrypted, bytes.Repeat([]byte{3}, 32), iv); err == nil {
+		t.Errorf("Data with invalid padding is decrypted\n")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestBytesToKey(t *testing.T) {
+	// Generated by EVP_BytesToKey of OpenSSL with EVP_aes_128_cbc and EVP_sha1.
+	tests := []struct {
+		data  string
+		count int
+		key   string
+		iv    string
+	}{
+		{"password", 1, "66e24122857250f403897c5621c645b0", "e45dc8f8056a81c193f650d8ea5000bb"},
+		{"password", 3, "3c12bc010164d256ae7ea629b730ae86", "a94a9c85271c3053becb95698495e85c"},
+		{"b1f2ad61-9164-418a-a47f-ab805dbd5694passwd", keygenIteration,
+			"4100a37fb60351ffc51f33ac86aafa98", "a9eaa5158b2b2075f1ad8b6bc10e5046"},
+	}
+	for _, test := range tests {
+		key, iv := bytesToKey([]byte(test.data), defaultSalt, test.count)
+		if hex.EncodeToString(key) != test.key || hex.EncodeToString(iv) != test.iv {
+			t.Errorf("Unexpected key %x and iv %x of %q with count %d\n", key, iv, test.data, test.count)
+		}
+	}
+}
@@ -27,6 +27,14 @@ type DiffOptions struct {
 	Data   interface{}
 }
 
+// context returns the context of the diff, storage operations stop once it's done.
+func (opt *DiffOptions) context() context.Context {
+	if opt.Ctx == nil {
+		return context.Background()
+	}
+	return opt.Ctx
+}
+
 type diffData struct {
 	foldDirDiff bool
 	results     *[]*DiffEntry
@@ -40,7 +48,7 @@ func DiffTrees(roots []string, opt *DiffOptions) error {
 	}
 	trees := make([]*fsmgr.SeafDir, n)
 	for i := 0; i < n; i++ {
-		root, err := fsmgr.GetSeafdir(opt.RepoID, roots[i])
+		root, err := fsmgr.GetSeafdirCtx(opt.context(), opt.RepoID, roots[i])
 		if err != nil {
 			err := fmt.Errorf("Failed to find dir %s:%s", opt.RepoID, roots[i])
 			return err
@@ -123,7 +131,7 @@ func diffFiles(baseDir string, dents []*fsmgr.SeafDirent, opt *DiffOptions) erro
 	var nFiles int
 	files := make([]*fsmgr.SeafDirent, 3)
 	for i := 0; i < n; i++ {
-		if dents[i] != nil && fsmgr.IsRegular(dents[i].Mode) {
+		if dents[i] != nil && (fsmgr.IsRegular(dents[i].Mode) || fsmgr.IsLink(dents[i].Mode)) {
 			files[i] = dents[i]
 			nFiles++
 		}
@@ -165,7 +173,7 @@ func diffDirectories(baseDir string, dents []*fsmgr.SeafDirent, opt *DiffOptions
 	var dirName string
 	for i := 0; i < n; i++ {
 		if dents[i] != nil && fsmgr.IsDir(dents[i].Mode) {
-			dir, err := fsmgr.GetSeafdir(opt.RepoID, dents[i].ID)
+			dir, err := fsmgr.GetSeafdirCtx(opt.context(), opt.RepoID, dents[i].ID)
 			if err != nil {
 				err := fmt.Errorf("Failed to find dir %s:%s", opt.RepoID, dents[i].ID)
 				return err
@@ -207,6 +215,8 @@ type DiffEntry struct {
 	NewName    string
 	Size       int64
 	OriginSize int64
+	// Mode of the dirent, it tells links from files.
+	Mode uint32
 }
 
 func diffEntryNewFromDirent(diffType, status rune, dent *fsmgr.SeafDirent, baseDir string) *DiffEntry {
@@ -215,6 +225,7 @@ func diffEntryNewFromDirent(diffType, status rune, dent *fsmgr.SeafDirent, baseD
 	de.DiffType = diffType
 	de.Status = status
 	de.Size = dent.Size
+	de.Mode = dent.Mode
 	de.Name = filepath.Join(baseDir, dent.Name)
 
 	return de
@@ -313,6 +324,11 @@ func DiffCommitRoots(storeID, p1Root, p2Root string, results *[]*DiffEntry, fold
 }
 
 func DiffCommits(commit1, commit2 *commitmgr.Commit, results *[]*DiffEntry, foldDirDiff bool) error {
+	return DiffCommitsCtx(context.Background(), commit1, commit2, results, foldDirDiff)
+}
+
+// DiffCommitsCtx is like DiffCommits, but stops reading the trees once ctx is done.
+func DiffCommitsCtx(ctx context.Context, commit1, commit2 *commitmgr.Commit, results *[]*DiffEntry, foldDirDiff bool) error {
 	repo := repomgr.Get(commit1.RepoID)
 	if repo == nil {
 		err := fmt.Errorf("failed to get repo %s", commit1.RepoID)
@@ -322,6 +338,7 @@ func DiffCommits(commit1, commit2 *commitmgr.Commit, results *[]*DiffEntry, fold
 
 	opt := new(DiffOptions)
 	opt.RepoID = repo.StoreID
+	opt.Ctx = ctx
 	opt.FileCB = twowayDiffFiles
 	opt.DirCB = twowayDiffDirs
 	opt.Data = diffData{foldDirDiff, results}
@@ -403,6 +420,68 @@ func twowayDiffDirs(ctx context.Context, baseDir string, dents []*fsmgr.SeafDire
 	return nil
 }
 
+// CommitTouchesPath returns whether commit changes the file or dir at p, including
+// the files under it. A merge commit only changes p if it differs from both parents.
+// Loading and diffing the commits stops once ctx is done.
+func CommitTouchesPath(ctx context.Context, commit *commitmgr.Commit, p string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	p = strings.Trim(filepath.Clean("/"+p), "/")
+
+	var parents []*commitmgr.Commit
+	for _, parentID := range []string{commit.ParentID.String, commit.SecondParentID.String} {
+		if parentID == "" {
+			continue
+		}
+		parent, err := commitmgr.LoadCtx(ctx, commit.RepoID, parentID)
+		if err != nil {
+			err := fmt.Errorf("failed to load commit %s:%s: %v", commit.RepoID, parentID, err)
+			return false, err
+		}
+		parents = append(parents, parent)
+	}
+	if len(parents) == 0 {
+		parents = append(parents, &commitmgr.Commit{RepoID: commit.RepoID, RootID: EmptySha1})
+	}
+
+	for _, parent := range parents {
+		if parent.RootID == commit.RootID {
+			return false, nil
+		}
+		var results []*DiffEntry
+		if err := DiffCommitsCtx(ctx, parent, commit, &results, false); err != nil {
+			return false, err
+		}
+		touched := false
+		for _, de := range results {
+			if pathUnder(de.Name, p) || (de.NewName != "" && pathUnder(de.NewName, p)) {
+				touched = true
+				break
+			}
+		}
+		if !touched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// pathUnder returns whether name is dir or under it, an empty dir is the root.
+func pathUnder(name, dir string) bool {
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// renameKey identifies the content of a deleted or added file when detecting renames.
+// Links and files with the same content have the same ID, but aren't renames of each other.
+func renameKey(de *DiffEntry) string {
+	if fsmgr.IsLink(de.Mode) {
+		return "link:" + de.Sha1
+	}
+	return de.Sha1
+}
+
 func diffResolveRenames(des *[]*DiffEntry) error {
 	var deletedEmptyCount, deletedEmptyDirCount, addedEmptyCount, addedEmptyDirCount int
 	for _, de := range *des {
@@ -436,7 +515,7 @@ func diffResolveRenames(des *[]*DiffEntry) error {
 				results = append(results, de)
 				continue
 			}
-			deletedFiles[de.Sha1] = de
+			deletedFiles[renameKey(de)] = de
 		}
 
 		if de.Status == DiffStatusDirDeleted {
@@ -475,7 +554,7 @@ func diffResolveRenames(des *[]*DiffEntry) error {
 
 		deAdd = de
 		if deAdd.Status == DiffStatusAdded {
-			deTmp, ok := deletedFiles[de.Sha1]
+			deTmp, ok := deletedFiles[renameKey(de)]
 			if !ok {
 				results = append(results, deAdd)
 				continue
@@ -498,11 +577,12 @@ func diffResolveRenames(des *[]*DiffEntry) error {
 
 		deRename = diffEntryNew(deDel.DiffType, renameStatus, deDel.Sha1, deDel.Name)
 		deRename.NewName = de.Name
+		deRename.Mode = deDel.Mode
 		results = append(results, deRename)
 		if deDel.Status == DiffStatusDirDeleted {
 			delete(deletedDirs, deAdd.Sha1)
 		} else {
-			delete(deletedFiles, deAdd.Sha1)
+			delete(deletedFiles, renameKey(deAdd))
 		}
 	}
 
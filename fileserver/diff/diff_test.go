@@ -7,6 +7,7 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
 	"github.com/haiwen/seafile-server/fileserver/fsmgr"
 )
 
@@ -280,3 +281,39 @@ func diffTestDirCB(ctx context.Context, baseDir string, dirs []*fsmgr.SeafDirent
 
 	return nil
 }
+
+func TestDiffRenameLink(t *testing.T) {
+	fileID := "0401fc662e3bc87a41f299a907c056aaf8322a27"
+	file := fsmgr.NewDirent(fileID, "file", syscall.S_IFREG|0644, 1, "", 1)
+	link := fsmgr.NewDirent(fileID, "link", syscall.S_IFLNK|0777, 1, "", 1)
+	renamed := fsmgr.NewDirent(fileID, "renamed", syscall.S_IFREG|0644, 1, "", 1)
+
+	// A file replaced by a link of the same content isn't renamed.
+	results := []*DiffEntry{
+		diffEntryNewFromDirent(DiffTypeCommits, DiffStatusDeleted, file, "/"),
+		diffEntryNewFromDirent(DiffTypeCommits, DiffStatusAdded, link, "/"),
+	}
+	diffResolveRenames(&results)
+	if len(results) != 2 {
+		t.Errorf("Unexpected diff results of replacing file with link : %d\n", len(results))
+	}
+
+	results = []*DiffEntry{
+		diffEntryNewFromDirent(DiffTypeCommits, DiffStatusDeleted, file, "/"),
+		diffEntryNewFromDirent(DiffTypeCommits, DiffStatusAdded, renamed, "/"),
+	}
+	diffResolveRenames(&results)
+	if len(results) != 1 || results[0].Status != DiffStatusRenamed {
+		t.Errorf("File rename is not detected\n")
+	}
+}
+
+func TestCommitTouchesPathCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	commit := &commitmgr.Commit{RepoID: diffTestRepoID, RootID: emptySHA1, ParentID: commitmgr.StringFrom(emptySHA1)}
+	if _, err := CommitTouchesPath(ctx, commit, "/dir"); err != context.Canceled {
+		t.Errorf("Unexpected error of canceled request : %v\n", err)
+	}
+}
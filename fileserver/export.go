@@ -0,0 +1,424 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/crypt"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+)
+
+// exportSink receives the dirs and files of an exported tree.
+// Paths are relative to the exported dir and use "/" as separator, the exported dir itself is "".
+type exportSink interface {
+	// exported reports whether an entry was completely written by an interrupted export.
+	exported(path string, dent *fsmgr.SeafDirent) bool
+	addDir(path string, dent *fsmgr.SeafDirent) error
+	// closeDir is called after all entries of a dir are exported.
+	closeDir(path string, dent *fsmgr.SeafDirent) error
+	// addFile writes a file of size bytes, whose content is written to w by content.
+	addFile(path string, dent *fsmgr.SeafDirent, size int64, content func(w io.Writer) error) error
+	addLink(path string, dent *fsmgr.SeafDirent, target string) error
+	close() error
+}
+
+type exportStats struct {
+	dirs    int64
+	files   int64
+	links   int64
+	skipped int64
+	bytes   int64
+}
+
+type exporter struct {
+	storeID string
+	crypt   *seafileCrypt
+	sink    exportSink
+	stats   exportStats
+}
+
+// exportRepo exports the dir at path in a commit of a repo to sink.
+// If commitID is empty, the head commit is exported. For encrypted repos, password must be given.
+func exportRepo(repoID, commitID, path, password string, sink exportSink) (*exportStats, error) {
+	repo := repomgr.Get(repoID)
+	if repo == nil {
+		err := fmt.Errorf("failed to get repo %s", repoID)
+		return nil, err
+	}
+	if commitID == "" {
+		commitID = repo.HeadCommitID
+	}
+	commit, err := commitmgr.Load(repoID, commitID)
+	if err != nil {
+		err := fmt.Errorf("failed to load commit %s: %v", commitID, err)
+		return nil, err
+	}
+
+	e := new(exporter)
+	e.storeID = repo.StoreID
+	e.sink = sink
+
+	if commit.Encrypted == "true" {
+		if password == "" {
+			err := fmt.Errorf("repo is encrypted, password is required")
+			return nil, err
+		}
+		err := verifyRepoPasswd(repoID, password, commit.Magic, commit.EncVersion, commit.Salt)
+		if err != nil {
+			return nil, err
+		}
+		e.crypt, err = decryptRepoEncKey(commit.EncVersion, password, commit.RandomKey, commit.Salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dirID := commit.RootID
+	if path != "" && path != "/" {
+		dirID, err = fsmgr.GetSeafdirIDByPath(repo.StoreID, commit.RootID, path)
+		if err != nil {
+			err := fmt.Errorf("failed to get dir %s: %v", path, err)
+			return nil, err
+		}
+	}
+
+	root := fsmgr.NewDirent(dirID, "", syscall.S_IFDIR, commit.Ctime, "", 0)
+	if err := e.exportDir("", root); err != nil {
+		return &e.stats, err
+	}
+
+	return &e.stats, nil
+}
+
+func (e *exporter) exportDir(path string, dent *fsmgr.SeafDirent) error {
+	dir, err := fsmgr.GetSeafdir(e.storeID, dent.ID)
+	if err != nil {
+		err := fmt.Errorf("failed to get dir %s: %v", path, err)
+		return err
+	}
+
+	if err := e.sink.addDir(path, dent); err != nil {
+		return err
+	}
+	e.stats.dirs++
+
+	for _, v := range dir.Entries {
+		entryPath := v.Name
+		if path != "" {
+			entryPath = path + "/" + v.Name
+		}
+		if fsmgr.IsDir(v.Mode) {
+			if err := e.exportDir(entryPath, v); err != nil {
+				return err
+			}
+		} else if fsmgr.IsRegular(v.Mode) {
+			if err := e.exportFile(entryPath, v); err != nil {
+				return err
+			}
+		} else if fsmgr.IsLink(v.Mode) {
+			if err := e.exportLink(entryPath, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return e.sink.closeDir(path, dent)
+}
+
+func (e *exporter) exportFile(path string, dent *fsmgr.SeafDirent) error {
+	if e.sink.exported(path, dent) {
+		e.stats.skipped++
+		return nil
+	}
+
+	file, err := fsmgr.GetSeafile(e.storeID, dent.ID)
+	if err != nil {
+		err := fmt.Errorf("failed to get file %s: %v", path, err)
+		return err
+	}
+
+	err = e.sink.addFile(path, dent, int64(file.FileSize), func(w io.Writer) error {
+		return e.writeBlocks(w, file)
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to export file %s: %v", path, err)
+		return err
+	}
+	e.stats.files++
+	e.stats.bytes += int64(file.FileSize)
+
+	return nil
+}
+
+func (e *exporter) exportLink(path string, dent *fsmgr.SeafDirent) error {
+	if e.sink.exported(path, dent) {
+		e.stats.skipped++
+		return nil
+	}
+
+	file, err := fsmgr.GetSeafile(e.storeID, dent.ID)
+	if err != nil {
+		err := fmt.Errorf("failed to get link %s: %v", path, err)
+		return err
+	}
+	var target bytes.Buffer
+	if err := e.writeBlocks(&target, file); err != nil {
+		err := fmt.Errorf("failed to read link %s: %v", path, err)
+		return err
+	}
+
+	if err := e.sink.addLink(path, dent, target.String()); err != nil {
+		err := fmt.Errorf("failed to export link %s: %v", path, err)
+		return err
+	}
+	e.stats.links++
+
+	return nil
+}
+
+func (e *exporter) writeBlocks(w io.Writer, file *fsmgr.Seafile) error {
+	for _, blkID := range file.BlkIDs {
+		if e.crypt == nil {
+			if err := blockmgr.Read(e.storeID, blkID, w); err != nil {
+				err := fmt.Errorf("failed to read block %s: %v", blkID, err)
+				return err
+			}
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := blockmgr.Read(e.storeID, blkID, &buf); err != nil {
+			err := fmt.Errorf("failed to read block %s: %v", blkID, err)
+			return err
+		}
+		decoded, err := crypt.Decrypt(buf.Bytes(), e.crypt.key, e.crypt.iv)
+		if err != nil {
+			err := fmt.Errorf("failed to decrypt block %s: %v", blkID, err)
+			return err
+		}
+		if _, err := w.Write(decoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirSink writes the exported tree to a local dir.
+// Files are written to temp files and renamed when complete, so that an interrupted
+// export can be resumed by skipping files with the same size and mtime.
+type dirSink struct {
+	dir string
+}
+
+func newDirSink(dir string) (*dirSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirSink{dir}, nil
+}
+
+func (s *dirSink) localPath(path string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path))
+}
+
+func (s *dirSink) exported(path string, dent *fsmgr.SeafDirent) bool {
+	info, err := os.Lstat(s.localPath(path))
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return info.Size() == dent.Size && info.ModTime().Unix() == dent.Mtime
+}
+
+func (s *dirSink) addDir(path string, dent *fsmgr.SeafDirent) error {
+	return os.MkdirAll(s.localPath(path), 0755)
+}
+
+func (s *dirSink) closeDir(path string, dent *fsmgr.SeafDirent) error {
+	mtime := time.Unix(dent.Mtime, 0)
+	return os.Chtimes(s.localPath(path), mtime, mtime)
+}
+
+func (s *dirSink) addFile(path string, dent *fsmgr.SeafDirent, size int64, content func(w io.Writer) error) error {
+	localPath := s.localPath(path)
+	tmpPath := filepath.Join(filepath.Dir(localPath), "."+filepath.Base(localPath)+".export")
+
+	fp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	err = content(fp)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	mtime := time.Unix(dent.Mtime, 0)
+	if err := os.Chtimes(tmpPath, mtime, mtime); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, localPath)
+}
+
+func (s *dirSink) addLink(path string, dent *fsmgr.SeafDirent, target string) error {
+	localPath := s.localPath(path)
+	if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, localPath)
+}
+
+func (s *dirSink) close() error {
+	return nil
+}
+
+// tarSink writes the exported tree as a tar stream.
+// When writing to a file, an interrupted export is resumed by keeping the complete
+// entries in the file and appending the rest.
+type tarSink struct {
+	fp   *os.File
+	tw   *tar.Writer
+	done map[string]bool
+}
+
+func newTarSink(w io.Writer) *tarSink {
+	return &tarSink{tw: tar.NewWriter(w), done: make(map[string]bool)}
+}
+
+// openTarSink opens a tar file for export, complete entries written by an interrupted export are kept.
+func openTarSink(path string) (*tarSink, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	done, end, err := scanTarEntries(fp)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if err := fp.Truncate(end); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if _, err := fp.Seek(end, io.SeekStart); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	sink := newTarSink(fp)
+	sink.fp = fp
+	sink.done = done
+	return sink, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// scanTarEntries returns the names of complete entries in a tar file and the offset after the last one.
+func scanTarEntries(r io.Reader) (map[string]bool, int64, error) {
+	done := make(map[string]bool)
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	var end int64
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			// The end of archive or a truncated entry.
+			return done, end, nil
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return done, end, nil
+		}
+		// Entries are padded to 512 bytes blocks.
+		end = (cr.n + 511) / 512 * 512
+		done[hdr.Name] = true
+	}
+}
+
+func (s *tarSink) exported(path string, dent *fsmgr.SeafDirent) bool {
+	return s.done[path]
+}
+
+func (s *tarSink) addDir(path string, dent *fsmgr.SeafDirent) error {
+	if path == "" || s.done[path+"/"] {
+		return nil
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     path + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(dent.Mtime, 0),
+	}
+	return s.tw.WriteHeader(hdr)
+}
+
+func (s *tarSink) closeDir(path string, dent *fsmgr.SeafDirent) error {
+	return nil
+}
+
+func (s *tarSink) addFile(path string, dent *fsmgr.SeafDirent, size int64, content func(w io.Writer) error) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(dent.Mtime, 0),
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	return content(s.tw)
+}
+
+func (s *tarSink) addLink(path string, dent *fsmgr.SeafDirent, target string) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     path,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  time.Unix(dent.Mtime, 0),
+	}
+	return s.tw.WriteHeader(hdr)
+}
+
+func (s *tarSink) close() error {
+	err := s.tw.Close()
+	if s.fp != nil {
+		if closeErr := s.fp.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// normalizeExportPath converts a repo path to the form used by fsmgr.
+func normalizeExportPath(path string) string {
+	path = strings.Trim(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+	if path == "" {
+		return "/"
+	}
+	return "/" + path
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/crypt"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	exportTestRepoID   = "b1f2ad61-9164-418a-a47f-ab805dbd5694"
+	exportTestPassword = "123456"
+	exportTestContent  = "hello world"
+	exportTestMtime    = 1600000000
+)
+
+// exportTestCreateRepo creates a repo containing /docs/a.txt and /b.txt, the content of files is encrypted if key is not nil.
+func exportTestCreateRepo(t *testing.T, key *seafileCrypt, commit *commitmgr.Commit) string {
+	dataDir, err := ioutil.TempDir("", "export-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	blockmgr.Init("", dataDir)
+	fsmgr.Init("", dataDir)
+	commitmgr.Init("", dataDir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dataDir, "seafile.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database : %v\n", err)
+	}
+	schema := []string{
+		"CREATE TABLE Repo (repo_id CHAR(36) PRIMARY KEY)",
+		"CREATE TABLE Branch (name VARCHAR(10), repo_id CHAR(36), commit_id CHAR(41), PRIMARY KEY (repo_id, name))",
+		"CREATE TABLE VirtualRepo (repo_id CHAR(36) PRIMARY KEY, origin_repo CHAR(36), path TEXT, base_commit CHAR(40))",
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Failed to create table : %v\n", err)
+		}
+	}
+	repomgr.Init(db)
+
+	data := []byte(exportTestContent)
+	if key != nil {
+		data, err = crypt.Encrypt(data, key.key, key.iv)
+		if err != nil {
+			t.Fatalf("Failed to encrypt block : %v\n", err)
+		}
+	}
+	checkSum := sha1.Sum(data)
+	blkID := hex.EncodeToString(checkSum[:])
+	if err := blockmgr.Write(exportTestRepoID, blkID, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+
+	file, err := fsmgr.NewSeafile(1, int64(len(exportTestContent)), []string{blkID})
+	if err != nil {
+		t.Fatalf("Failed to create seafile : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafile(exportTestRepoID, file); err != nil {
+		t.Fatalf("Failed to save seafile : %v\n", err)
+	}
+
+	size := int64(len(exportTestContent))
+	fileDent := fsmgr.NewDirent(file.FileID, "a.txt", syscall.S_IFREG|0644, exportTestMtime, "", size)
+	subDir, err := fsmgr.NewSeafdir(1, []*fsmgr.SeafDirent{fileDent})
+	if err != nil {
+		t.Fatalf("Failed to create seafdir : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafdir(exportTestRepoID, subDir); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+
+	dirDent := fsmgr.NewDirent(subDir.DirID, "docs", syscall.S_IFDIR, exportTestMtime, "", 0)
+	fileDent2 := fsmgr.NewDirent(file.FileID, "b.txt", syscall.S_IFREG|0644, exportTestMtime, "", size)
+	root, err := fsmgr.NewSeafdir(1, []*fsmgr.SeafDirent{fileDent2, dirDent})
+	if err != nil {
+		t.Fatalf("Failed to create seafdir : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafdir(exportTestRepoID, root); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+
+	commit.RootID = root.DirID
+	commit.CommitID = fmt.Sprintf("%x", sha1.Sum([]byte(root.DirID)))
+	commit.Ctime = exportTestMtime
+	if err := commitmgr.Save(commit); err != nil {
+		t.Fatalf("Failed to save commit : %v\n", err)
+	}
+
+	if _, err := db.Exec("INSERT INTO Repo (repo_id) VALUES (?)", exportTestRepoID); err != nil {
+		t.Fatalf("Failed to insert repo : %v\n", err)
+	}
+	if _, err := db.Exec("INSERT INTO Branch (name, repo_id, commit_id) VALUES ('master', ?, ?)", exportTestRepoID, commit.CommitID); err != nil {
+		t.Fatalf("Failed to insert branch : %v\n", err)
+	}
+
+	return dataDir
+}
+
+func exportTestNewCommit() *commitmgr.Commit {
+	commit := commitmgr.NewCommit(exportTestRepoID, "", fsmgr.EmptySha1, "seafile", "test commit")
+	commit.ParentID.Valid = false
+	return commit
+}
+
+func exportTestCheckDir(t *testing.T, dir string) {
+	for _, name := range []string{"b.txt", "docs/a.txt"} {
+		path := filepath.Join(dir, name)
+		content, err := ioutil.ReadFile(path)
+		if err != nil || string(content) != exportTestContent {
+			t.Errorf("Unexpected content of %s : %q %v\n", name, content, err)
+			continue
+		}
+		info, _ := os.Stat(path)
+		if info.ModTime().Unix() != exportTestMtime {
+			t.Errorf("Mtime of %s is not preserved : %v\n", name, info.ModTime())
+		}
+	}
+}
+
+func TestExportDir(t *testing.T) {
+	dataDir := exportTestCreateRepo(t, nil, exportTestNewCommit())
+	defer os.RemoveAll(dataDir)
+
+	outDir := filepath.Join(dataDir, "out")
+	sink, err := newDirSink(outDir)
+	if err != nil {
+		t.Fatalf("Failed to create dir sink : %v\n", err)
+	}
+	stats, err := exportRepo(exportTestRepoID, "", "/", "", sink)
+	if err != nil {
+		t.Fatalf("Failed to export repo : %v\n", err)
+	}
+	if stats.files != 2 || stats.dirs != 2 {
+		t.Errorf("Unexpected export stats %+v\n", stats)
+	}
+	exportTestCheckDir(t, outDir)
+
+	// Exporting again skips the files already exported.
+	stats, err = exportRepo(exportTestRepoID, "", "/", "", sink)
+	if err != nil {
+		t.Fatalf("Failed to resume export : %v\n", err)
+	}
+	if stats.files != 0 || stats.skipped != 2 {
+		t.Errorf("Exported files are not skipped : %+v\n", stats)
+	}
+
+	subDir := filepath.Join(dataDir, "sub")
+	sink, _ = newDirSink(subDir)
+	if _, err := exportRepo(exportTestRepoID, "", "/docs", "", sink); err != nil {
+		t.Fatalf("Failed to export sub dir : %v\n", err)
+	}
+	if _, err := os.Stat(filepath.Join(subDir, "a.txt")); err != nil {
+		t.Errorf("Sub dir is not exported : %v\n", err)
+	}
+}
+
+func TestExportEncryptedRepo(t *testing.T) {
+	salt := "a0c6f9ea8f8ba6c0b4b0bb3b5b5a1b0e8f7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e"
+	secret := bytes.Repeat([]byte{0x5a}, 32)
+	passwdKey, passwdIV, err := deriveKey([]byte(exportTestPassword), 3, salt)
+	if err != nil {
+		t.Fatalf("Failed to derive key : %v\n", err)
+	}
+	encKey, err := crypt.Encrypt(secret, passwdKey, passwdIV)
+	if err != nil {
+		t.Fatalf("Failed to encrypt random key : %v\n", err)
+	}
+	magic, _, _ := deriveKey([]byte(exportTestRepoID+exportTestPassword), 3, salt)
+	fileKey, fileIV, _ := deriveKey(secret, 3, salt)
+
+	commit := exportTestNewCommit()
+	commit.Encrypted = "true"
+	commit.EncVersion = 3
+	commit.Magic = hex.EncodeToString(magic)
+	commit.RandomKey = hex.EncodeToString(encKey)
+	commit.Salt = salt
+	dataDir := exportTestCreateRepo(t, &seafileCrypt{fileKey, fileIV}, commit)
+	defer os.RemoveAll(dataDir)
+
+	outDir := filepath.Join(dataDir, "out")
+	sink, _ := newDirSink(outDir)
+	if _, err := exportRepo(exportTestRepoID, "", "/", "wrong", sink); err == nil {
+		t.Errorf("Encrypted repo is exported with wrong password\n")
+	}
+	if _, err := exportRepo(exportTestRepoID, "", "/", exportTestPassword, sink); err != nil {
+		t.Fatalf("Failed to export encrypted repo : %v\n", err)
+	}
+	exportTestCheckDir(t, outDir)
+}
+
+func TestExportTarResume(t *testing.T) {
+	dataDir := exportTestCreateRepo(t, nil, exportTestNewCommit())
+	defer os.RemoveAll(dataDir)
+
+	tarPath := filepath.Join(dataDir, "out.tar")
+	sink, err := openTarSink(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to open tar sink : %v\n", err)
+	}
+	if _, err := exportRepo(exportTestRepoID, "", "/", "", sink); err != nil {
+		t.Fatalf("Failed to export repo : %v\n", err)
+	}
+	if err := sink.close(); err != nil {
+		t.Fatalf("Failed to close tar sink : %v\n", err)
+	}
+
+	// Simulate an interrupted export by cutting the archive in the middle of the last file.
+	info, _ := os.Stat(tarPath)
+	if err := os.Truncate(tarPath, info.Size()-1024-512+5); err != nil {
+		t.Fatalf("Failed to truncate tar file : %v\n", err)
+	}
+
+	sink, err = openTarSink(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen tar sink : %v\n", err)
+	}
+	stats, err := exportRepo(exportTestRepoID, "", "/", "", sink)
+	if err != nil {
+		t.Fatalf("Failed to resume export : %v\n", err)
+	}
+	sink.close()
+	if stats.files != 1 || stats.skipped != 1 {
+		t.Errorf("Unexpected resumed export stats %+v\n", stats)
+	}
+
+	fp, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to open tar file : %v\n", err)
+	}
+	defer fp.Close()
+	tr := tar.NewReader(fp)
+	names := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar file : %v\n", err)
+		}
+		if names[hdr.Name] {
+			t.Errorf("Duplicated entry %s in tar file\n", hdr.Name)
+		}
+		names[hdr.Name] = true
+		if hdr.Typeflag == tar.TypeReg {
+			content, _ := ioutil.ReadAll(tr)
+			if string(content) != exportTestContent || hdr.ModTime.Unix() != exportTestMtime {
+				t.Errorf("Unexpected entry %s : %q %v\n", hdr.Name, content, hdr.ModTime)
+			}
+		}
+	}
+	for _, name := range []string{"b.txt", "docs/", "docs/a.txt"} {
+		if !names[name] {
+			t.Errorf("Entry %s is missing in tar file\n", name)
+		}
+	}
+}
+
+func TestExportLinks(t *testing.T) {
+	commit := exportTestNewCommit()
+	dataDir := exportTestCreateRepo(t, nil, commit)
+	defer os.RemoveAll(dataDir)
+
+	// Add a link to docs/a.txt to the root.
+	target := "docs/a.txt"
+	checkSum := sha1.Sum([]byte(target))
+	blkID := hex.EncodeToString(checkSum[:])
+	if err := blockmgr.Write(exportTestRepoID, blkID, bytes.NewReader([]byte(target))); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+	file, err := fsmgr.NewSeafile(1, int64(len(target)), []string{blkID})
+	if err != nil {
+		t.Fatalf("Failed to create seafile : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafile(exportTestRepoID, file); err != nil {
+		t.Fatalf("Failed to save seafile : %v\n", err)
+	}
+	root, err := fsmgr.GetSeafdir(exportTestRepoID, commit.RootID)
+	if err != nil {
+		t.Fatalf("Failed to get root : %v\n", err)
+	}
+	linkDent := fsmgr.NewDirent(file.FileID, "link", syscall.S_IFLNK|0777, exportTestMtime, "", int64(len(target)))
+	newRoot, err := fsmgr.NewSeafdir(1, append([]*fsmgr.SeafDirent{linkDent}, root.Entries...))
+	if err != nil {
+		t.Fatalf("Failed to create seafdir : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafdir(exportTestRepoID, newRoot); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+	linkCommit := exportTestNewCommit()
+	linkCommit.RootID = newRoot.DirID
+	linkCommit.CommitID = fmt.Sprintf("%x", sha1.Sum([]byte(newRoot.DirID)))
+	if err := commitmgr.Save(linkCommit); err != nil {
+		t.Fatalf("Failed to save commit : %v\n", err)
+	}
+
+	outDir := filepath.Join(dataDir, "out")
+	sink, _ := newDirSink(outDir)
+	for i := 0; i < 2; i++ {
+		stats, err := exportRepo(exportTestRepoID, linkCommit.CommitID, "/", "", sink)
+		if err != nil {
+			t.Fatalf("Failed to export repo : %v\n", err)
+		}
+		if stats.links != 1 {
+			t.Errorf("Unexpected export stats %+v\n", stats)
+		}
+	}
+	if linkTarget, err := os.Readlink(filepath.Join(outDir, "link")); err != nil || linkTarget != target {
+		t.Errorf("Exported link target is %q, expected %q : %v\n", linkTarget, target, err)
+	}
+
+	var buf bytes.Buffer
+	tarSink := newTarSink(&buf)
+	if _, err := exportRepo(exportTestRepoID, linkCommit.CommitID, "/", "", tarSink); err != nil {
+		t.Fatalf("Failed to export repo : %v\n", err)
+	}
+	tarSink.close()
+	tr := tar.NewReader(&buf)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name == "link" {
+			found = hdr.Typeflag == tar.TypeSymlink && hdr.Linkname == target
+		}
+	}
+	if !found {
+		t.Errorf("Link is not exported to tar file\n")
+	}
+}
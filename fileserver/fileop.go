@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime/debug"
 	"strconv"
@@ -30,7 +31,9 @@ import (
 	"syscall"
 
 	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/cdc"
 	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/crypt"
 	"github.com/haiwen/seafile-server/fileserver/diff"
 	"github.com/haiwen/seafile-server/fileserver/fsmgr"
 	"github.com/haiwen/seafile-server/fileserver/repomgr"
@@ -276,8 +279,8 @@ func doFile(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, fileID
 	if cryptKey != nil {
 		for _, blkID := range file.BlkIDs {
 			var buf bytes.Buffer
-			blockmgr.Read(repo.StoreID, blkID, &buf)
-			decoded, err := decrypt(buf.Bytes(), encKey, encIv)
+			blockmgr.ReadCtx(r.Context(), repo.StoreID, blkID, &buf)
+			decoded, err := crypt.Decrypt(buf.Bytes(), encKey, encIv)
 			if err != nil {
 				err := fmt.Errorf("failed to decrypt block %s: %v", blkID, err)
 				return &appError{err, "", http.StatusInternalServerError}
@@ -292,9 +295,9 @@ func doFile(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, fileID
 	}
 
 	for _, blkID := range file.BlkIDs {
-		err := blockmgr.Read(repo.StoreID, blkID, rsp)
+		err := blockmgr.ReadCtx(r.Context(), repo.StoreID, blkID, rsp)
 		if err != nil {
-			log.Printf("fatild to write block %s to response: %v", blkID, err)
+			log.Printf("failed to write block %s to response: %v", blkID, err)
 			return nil
 		}
 	}
@@ -315,6 +318,36 @@ type blockMap struct {
 	expireTime int64
 }
 
+// getBlockSizes returns the sizes of the blocks of file, they're cached for large files.
+func getBlockSizes(ctx context.Context, storeID string, file *fsmgr.Seafile) ([]uint64, error) {
+	var blkSize []uint64
+	if file.FileSize > cacheBlockMapThreshold {
+		if v, ok := blockMapCacheTable.Load(file.FileID); ok {
+			if blkMap, ok := v.(*blockMap); ok {
+				blkSize = blkMap.blkSize
+			}
+		}
+		recordCacheLookup("block-map", len(blkSize) != 0)
+		if len(blkSize) != 0 {
+			return blkSize, nil
+		}
+	}
+
+	for _, v := range file.BlkIDs {
+		size, err := blockmgr.StatCtx(ctx, storeID, v)
+		if err != nil {
+			err := fmt.Errorf("failed to stat block %s : %v", v, err)
+			return nil, err
+		}
+		blkSize = append(blkSize, uint64(size))
+	}
+	if file.FileSize > cacheBlockMapThreshold {
+		blockMapCacheTable.Store(file.FileID, &blockMap{blkSize, time.Now().Unix() + blockMapCacheExpiretime})
+	}
+
+	return blkSize, nil
+}
+
 func doFileRange(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, fileID string,
 	fileName string, operation string, byteRanges string, user string) *appError {
 
@@ -349,33 +382,9 @@ func doFileRange(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, f
 
 	rsp.WriteHeader(http.StatusPartialContent)
 
-	var blkSize []uint64
-	if file.FileSize > cacheBlockMapThreshold {
-		if v, ok := blockMapCacheTable.Load(file.FileID); ok {
-			if blkMap, ok := v.(*blockMap); ok {
-				blkSize = blkMap.blkSize
-			}
-		}
-		if len(blkSize) == 0 {
-			for _, v := range file.BlkIDs {
-				size, err := blockmgr.Stat(repo.StoreID, v)
-				if err != nil {
-					err := fmt.Errorf("failed to stat block %s : %v", v, err)
-					return &appError{err, "", http.StatusInternalServerError}
-				}
-				blkSize = append(blkSize, uint64(size))
-			}
-			blockMapCacheTable.Store(file.FileID, &blockMap{blkSize, time.Now().Unix() + blockMapCacheExpiretime})
-		}
-	} else {
-		for _, v := range file.BlkIDs {
-			size, err := blockmgr.Stat(repo.StoreID, v)
-			if err != nil {
-				err := fmt.Errorf("failed to stat block %s : %v", v, err)
-				return &appError{err, "", http.StatusInternalServerError}
-			}
-			blkSize = append(blkSize, uint64(size))
-		}
+	blkSize, err := getBlockSizes(r.Context(), repo.StoreID, file)
+	if err != nil {
+		return &appError{err, "", http.StatusInternalServerError}
 	}
 
 	var off uint64
@@ -400,7 +409,7 @@ func doFileRange(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, f
 		blkID := file.BlkIDs[i]
 		var buf bytes.Buffer
 		if end-start+1 <= blkSize[i]-pos {
-			err := blockmgr.Read(repo.StoreID, blkID, &buf)
+			err := blockmgr.ReadCtx(r.Context(), repo.StoreID, blkID, &buf)
 			if err != nil {
 				log.Printf("failed to read block %s: %v", blkID, err)
 				return nil
@@ -413,7 +422,7 @@ func doFileRange(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, f
 			return nil
 		}
 
-		err := blockmgr.Read(repo.StoreID, blkID, &buf)
+		err := blockmgr.ReadCtx(r.Context(), repo.StoreID, blkID, &buf)
 		if err != nil {
 			log.Printf("failed to read block %s: %v", blkID, err)
 			return nil
@@ -434,7 +443,7 @@ func doFileRange(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, f
 		blkID := file.BlkIDs[i]
 		var buf bytes.Buffer
 		if end-start+1 <= blkSize[i] {
-			err := blockmgr.Read(repo.StoreID, blkID, &buf)
+			err := blockmgr.ReadCtx(r.Context(), repo.StoreID, blkID, &buf)
 			if err != nil {
 				log.Printf("failed to read block %s: %v", blkID, err)
 				return nil
@@ -447,7 +456,7 @@ func doFileRange(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, f
 			}
 			break
 		} else {
-			err := blockmgr.Read(repo.StoreID, blkID, rsp)
+			err := blockmgr.ReadCtx(r.Context(), repo.StoreID, blkID, rsp)
 			if err != nil {
 				log.Printf("failed to write block %s to response: %v", blkID, err)
 				return nil
@@ -621,7 +630,7 @@ func doBlock(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, fileI
 		return nil
 	}
 
-	exists := blockmgr.Exists(repo.StoreID, blkID)
+	exists := blockmgr.ExistsCtx(r.Context(), repo.StoreID, blkID)
 	if !exists {
 		rsp.WriteHeader(http.StatusBadRequest)
 		return nil
@@ -630,7 +639,7 @@ func doBlock(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, fileI
 	rsp.Header().Set("Access-Control-Allow-Origin", "*")
 	setCommonHeaders(rsp, r, "downloadblks", blkID)
 
-	size, err := blockmgr.Stat(repo.StoreID, blkID)
+	size, err := blockmgr.StatCtx(r.Context(), repo.StoreID, blkID)
 	if err != nil {
 		msg := "Failed to stat block"
 		return &appError{nil, msg, http.StatusBadRequest}
@@ -643,9 +652,9 @@ func doBlock(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, fileI
 	fileSize := fmt.Sprintf("%d", size)
 	rsp.Header().Set("Content-Length", fileSize)
 
-	err = blockmgr.Read(repo.StoreID, blkID, rsp)
+	err = blockmgr.ReadCtx(r.Context(), repo.StoreID, blkID, rsp)
 	if err != nil {
-		log.Printf("fatild to write block %s to response: %v", blkID, err)
+		log.Printf("failed to write block %s to response: %v", blkID, err)
 	}
 
 	sendStatisticMsg(repo.StoreID, user, "web-file-download", uint64(size))
@@ -724,7 +733,7 @@ func downloadZipFile(rsp http.ResponseWriter, r *http.Request, data, repoID, use
 
 		setCommonHeaders(rsp, r, "download", dirName)
 
-		err := packDir(ar, repo, objID, dirName)
+		err := packDir(r.Context(), ar, repo, objID, dirName)
 		if err != nil {
 			log.Printf("failed to pack dir %s: %v", dirName, err)
 			return nil
@@ -742,12 +751,12 @@ func downloadZipFile(rsp http.ResponseWriter, r *http.Request, data, repoID, use
 
 		for _, v := range dirList {
 			if fsmgr.IsDir(v.Mode) {
-				if err := packDir(ar, repo, v.ID, v.Name); err != nil {
+				if err := packDir(r.Context(), ar, repo, v.ID, v.Name); err != nil {
 					log.Printf("failed to pack dir %s: %v", v.Name, err)
 					return nil
 				}
 			} else {
-				if err := packFiles(ar, &v, repo, ""); err != nil {
+				if err := packFiles(r.Context(), ar, &v, repo, ""); err != nil {
 					log.Printf("failed to pack file %s: %v", v.Name, err)
 					return nil
 				}
@@ -803,46 +812,28 @@ func parseDirFilelist(repo *repomgr.Repo, obj map[string]interface{}) ([]fsmgr.S
 	return direntList, nil
 }
 
-func packDir(ar *zip.Writer, repo *repomgr.Repo, dirID, dirPath string) error {
-	dirent, err := fsmgr.GetSeafdir(repo.StoreID, dirID)
-	if err != nil {
-		err := fmt.Errorf("failed to get dir for zip: %v", err)
-		return err
-	}
-
-	if dirent.Entries == nil {
-		fileDir := filepath.Join(dirPath)
-		fileDir = strings.TrimLeft(fileDir, "/")
-		_, err := ar.Create(fileDir + "/")
-		if err != nil {
-			err := fmt.Errorf("failed to create zip dir: %v", err)
-			return err
-		}
-
-		return nil
-	}
-
-	entries := dirent.Entries
-
-	for _, v := range entries {
-		fileDir := filepath.Join(dirPath, v.Name)
-		fileDir = strings.TrimLeft(fileDir, "/")
+func packDir(ctx context.Context, ar *zip.Writer, repo *repomgr.Repo, dirID, dirPath string) error {
+	return fsmgr.Walk(ctx, repo.StoreID, dirID, func(p string, v *fsmgr.SeafDirent) error {
 		if fsmgr.IsDir(v.Mode) {
-			if err := packDir(ar, repo, v.ID, fileDir); err != nil {
-				return err
+			if v.ID != fsmgr.EmptySha1 {
+				return nil
 			}
-		} else {
-			if err := packFiles(ar, v, repo, dirPath); err != nil {
+			fileDir := filepath.Join(dirPath, p)
+			fileDir = strings.TrimLeft(fileDir, "/")
+			_, err := ar.Create(fileDir + "/")
+			if err != nil {
+				err := fmt.Errorf("failed to create zip dir: %v", err)
 				return err
 			}
+			return nil
 		}
-	}
 
-	return nil
+		return packFiles(ctx, ar, v, repo, filepath.Join(dirPath, path.Dir(p)))
+	}, nil)
 }
 
-func packFiles(ar *zip.Writer, dirent *fsmgr.SeafDirent, repo *repomgr.Repo, parentPath string) error {
-	file, err := fsmgr.GetSeafile(repo.StoreID, dirent.ID)
+func packFiles(ctx context.Context, ar *zip.Writer, dirent *fsmgr.SeafDirent, repo *repomgr.Repo, parentPath string) error {
+	file, err := fsmgr.GetSeafileCtx(ctx, repo.StoreID, dirent.ID)
 	if err != nil {
 		err := fmt.Errorf("failed to get seafile : %v", err)
 		return err
@@ -855,6 +846,11 @@ func packFiles(ar *zip.Writer, dirent *fsmgr.SeafDirent, repo *repomgr.Repo, par
 	fileHeader.Name = filePath
 	fileHeader.Modified = time.Unix(dirent.Mtime, 0)
 	fileHeader.Method = zip.Deflate
+	if fsmgr.IsLink(dirent.Mode) {
+		// Zip stores the target of a link as its content, just like fs objects.
+		fileHeader.SetMode(os.ModeSymlink | 0777)
+		fileHeader.Method = zip.Store
+	}
 	zipFile, err := ar.CreateHeader(fileHeader)
 	if err != nil {
 		err := fmt.Errorf("failed to create zip file : %v", err)
@@ -862,7 +858,7 @@ func packFiles(ar *zip.Writer, dirent *fsmgr.SeafDirent, repo *repomgr.Repo, par
 	}
 
 	for _, blkID := range file.BlkIDs {
-		err := blockmgr.Read(repo.StoreID, blkID, zipFile)
+		err := blockmgr.ReadCtx(ctx, repo.StoreID, blkID, zipFile)
 		if err != nil {
 			return err
 		}
@@ -882,6 +878,9 @@ type recvData struct {
 	fileNames   []string
 	files       []string
 	fileHeaders []*multipart.FileHeader
+	// IDs and sizes of files indexed while they are received
+	fileIDs   []string
+	fileSizes []int64
 }
 
 func uploadAPICB(rsp http.ResponseWriter, r *http.Request) *appError {
@@ -941,63 +940,67 @@ func formatJSONError(rsp http.ResponseWriter, err *appError) {
 func doUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData, isAjax bool) *appError {
 	setAccessControl(rsp)
 
-	if err := r.ParseMultipartForm(1 << 20); err != nil {
-		return &appError{nil, "", http.StatusBadRequest}
-	}
-	defer r.MultipartForm.RemoveAll()
-
 	repoID := fsm.repoID
 	user := fsm.user
 
-	replaceStr := r.FormValue("replace")
 	var replaceExisted bool
-	if replaceStr != "" {
-		replace, err := strconv.ParseInt(replaceStr, 10, 64)
-		if err != nil || (replace != 0 && replace != 1) {
-			msg := "Invalid argument replace.\n"
-			return &appError{nil, msg, http.StatusBadRequest}
-		}
-		if replace == 1 {
-			replaceExisted = true
+	var parentDir, relativePath string
+	var contentLen int64
+	// The fields may follow the files in the form, so they are checked after the whole form is read.
+	checkForm := func() *appError {
+		var appErr *appError
+		replaceExisted, appErr = parseReplaceArg(r)
+		if appErr != nil {
+			return appErr
 		}
-	}
-
-	parentDir := r.FormValue("parent_dir")
-	if parentDir == "" {
-		msg := "No parent_dir given.\n"
-		return &appError{nil, msg, http.StatusBadRequest}
-	}
 
-	relativePath := r.FormValue("relative_path")
-	if relativePath != "" {
-		if relativePath[0] == '/' || relativePath[0] == '\\' {
-			msg := "Invalid relative path"
+		parentDir = r.FormValue("parent_dir")
+		if parentDir == "" {
+			msg := "No parent_dir given.\n"
 			return &appError{nil, msg, http.StatusBadRequest}
 		}
-	}
 
-	newParentDir := filepath.Join("/", parentDir, relativePath)
-	defer clearTmpFile(fsm, newParentDir)
+		relativePath = r.FormValue("relative_path")
+		if relativePath != "" {
+			if relativePath[0] == '/' || relativePath[0] == '\\' {
+				msg := "Invalid relative path"
+				return &appError{nil, msg, http.StatusBadRequest}
+			}
+		}
 
-	if fsm.rstart >= 0 {
-		if parentDir[0] != '/' {
+		if fsm.rstart >= 0 && parentDir[0] != '/' {
 			msg := "Invalid parent dir"
 			return &appError{nil, msg, http.StatusBadRequest}
 		}
 
-		formFiles := r.MultipartForm.File
-		files, ok := formFiles["file"]
-		if !ok {
-			msg := "No file in multipart form.\n"
-			return &appError{nil, msg, http.StatusBadRequest}
+		if err := checkParentDir(repoID, parentDir); err != nil {
+			return err
 		}
 
-		if len(files) > 1 {
-			msg := "More files in one request"
-			return &appError{nil, msg, http.StatusBadRequest}
+		if !isParentMatched(fsm.parentDir, parentDir) {
+			msg := "Parent dir doesn't match."
+			return &appError{nil, msg, http.StatusForbidden}
 		}
 
-		err := writeBlockDataToTmpFile(r, fsm, formFiles, repoID, newParentDir)
+		contentLen, appErr = checkUploadQuota(r, fsm)
+		return appErr
+	}
+
+	chunk, appErr := receiveUploadForm(rsp, r, fsm, false)
+	if appErr != nil {
+		return appErr
+	}
+	defer removeUploadChunk(chunk)
+
+	if appErr := checkForm(); appErr != nil {
+		return appErr
+	}
+
+	newParentDir := filepath.Join("/", parentDir, relativePath)
+	defer clearTmpFile(fsm, newParentDir)
+
+	if fsm.rstart >= 0 {
+		err := writeBlockDataToTmpFile(r, fsm, chunk, repoID, newParentDir)
 		if err != nil {
 			msg := "Internal error.\n"
 			err := fmt.Errorf("failed to write block data to tmp file: %v", err)
@@ -1014,18 +1017,6 @@ func doUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData, isAjax bo
 
 			return nil
 		}
-	} else {
-		formFiles := r.MultipartForm.File
-		fileHeaders, ok := formFiles["file"]
-		if !ok {
-			msg := "No file in multipart form.\n"
-			return &appError{nil, msg, http.StatusBadRequest}
-		}
-		for _, handler := range fileHeaders {
-			fileName := filepath.Base(handler.Filename)
-			fsm.fileNames = append(fsm.fileNames, fileName)
-			fsm.fileHeaders = append(fsm.fileHeaders, handler)
-		}
 	}
 
 	if fsm.fileNames == nil {
@@ -1033,19 +1024,34 @@ func doUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData, isAjax bo
 		return &appError{nil, msg, http.StatusBadRequest}
 	}
 
-	if err := checkParentDir(repoID, parentDir); err != nil {
+	if err := checkTmpFileList(fsm); err != nil {
 		return err
 	}
 
-	if !isParentMatched(fsm.parentDir, parentDir) {
-		msg := "Parent dir doesn't match."
-		return &appError{nil, msg, http.StatusForbidden}
+	if err := createRelativePath(repoID, parentDir, relativePath, user); err != nil {
+		return err
 	}
 
-	if err := checkTmpFileList(fsm); err != nil {
+	if err := postMultiFiles(rsp, r, repoID, newParentDir, user, fsm,
+		replaceExisted, isAjax); err != nil {
 		return err
 	}
 
+	rsp.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	oper := "web-file-upload"
+	if fsm.tokenType == "upload-link" {
+		oper = "link-file-upload"
+	}
+
+	sendStatisticMsg(repoID, user, oper, uint64(contentLen))
+
+	return nil
+}
+
+// checkUploadQuota checks the quota of the repo against the size of an upload, which is
+// the file size of resumable uploads or the Content-Length of the request.
+func checkUploadQuota(r *http.Request, fsm *recvData) (int64, *appError) {
 	var contentLen int64
 	if fsm.fsize > 0 {
 		contentLen = fsm.fsize
@@ -1058,53 +1064,310 @@ func doUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData, isAjax bo
 			if err != nil {
 				msg := "Internal error.\n"
 				err := fmt.Errorf("failed to parse content len: %v", err)
-				return &appError{err, msg, http.StatusInternalServerError}
+				return -1, &appError{err, msg, http.StatusInternalServerError}
 			}
 			contentLen = tmpLen
 		}
 	}
 
-	ret, err := checkQuota(repoID, contentLen)
+	ret, err := checkQuota(fsm.repoID, contentLen)
 	if err != nil {
 		msg := "Internal error.\n"
 		err := fmt.Errorf("failed to check quota: %v", err)
-		return &appError{err, msg, http.StatusInternalServerError}
+		return -1, &appError{err, msg, http.StatusInternalServerError}
 	}
 	if ret == 1 {
 		msg := "Out of quota.\n"
-		return &appError{nil, msg, seafHTTPResNoQuota}
+		return -1, &appError{nil, msg, seafHTTPResNoQuota}
 	}
 
-	if err := createRelativePath(repoID, parentDir, relativePath, user); err != nil {
+	return contentLen, nil
+}
+
+// parseReplaceArg parses the replace field of upload forms.
+func parseReplaceArg(r *http.Request) (bool, *appError) {
+	replaceStr := r.FormValue("replace")
+	if replaceStr == "" {
+		return false, nil
+	}
+	replace, err := strconv.ParseInt(replaceStr, 10, 64)
+	if err != nil || (replace != 0 && replace != 1) {
+		msg := "Invalid argument replace.\n"
+		return false, &appError{nil, msg, http.StatusBadRequest}
+	}
+	return replace == 1, nil
+}
+
+// maxSymlinkTarget is the maximum length of link targets.
+const maxSymlinkTarget = 4096
+
+// uploadSymlinkAPICB creates a symbolic link with an upload token. The form has the
+// fields parent_dir, name and target, and replace like file uploads.
+func uploadSymlinkAPICB(rsp http.ResponseWriter, r *http.Request) *appError {
+	if r.Method == "OPTIONS" {
+		setAccessControl(rsp)
+		rsp.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	fsm, err := parseUploadHeaders(r)
+	if err != nil {
 		return err
 	}
 
-	if err := postMultiFiles(rsp, r, repoID, newParentDir, user, fsm,
-		replaceExisted, isAjax); err != nil {
+	if err := doUploadSymlink(rsp, r, fsm); err != nil {
+		formatJSONError(rsp, err)
+		return err
+	}
+
+	return nil
+}
+
+func doUploadSymlink(rsp http.ResponseWriter, r *http.Request, fsm *recvData) *appError {
+	setAccessControl(rsp)
+
+	if err := r.ParseMultipartForm(maxUploadFormValueSize); err != nil && err != http.ErrNotMultipart {
+		return &appError{nil, "", http.StatusBadRequest}
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+
+	replace, appErr := parseReplaceArg(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	parentDir := r.FormValue("parent_dir")
+	if parentDir == "" {
+		msg := "No parent_dir given.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+	if strings.Index(parentDir, "//") != -1 {
+		msg := "parent_dir contains // sequence.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+	name := r.FormValue("name")
+	if name == "" || shouldIgnoreFile(name) {
+		msg := "Invalid name.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+	target := r.FormValue("target")
+	if target == "" || len(target) > maxSymlinkTarget {
+		msg := "Invalid target.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+
+	if err := checkParentDir(fsm.repoID, parentDir); err != nil {
 		return err
 	}
+	if !isParentMatched(fsm.parentDir, parentDir) {
+		msg := "Parent dir doesn't match."
+		return &appError{nil, msg, http.StatusForbidden}
+	}
+
+	repo := repomgr.Get(fsm.repoID)
+	if repo == nil {
+		msg := "Failed to get repo.\n"
+		err := fmt.Errorf("Failed to get repo %s", fsm.repoID)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	var cryptKey *seafileCrypt
+	if repo.IsEncrypted {
+		key, err := parseCryptKey(rsp, repo.ID, fsm.user)
+		if err != nil {
+			return err
+		}
+		cryptKey = key
+	}
+
+	ret, err := checkQuota(repo.ID, int64(len(target)))
+	if err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to check quota: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	if ret == 1 {
+		msg := "Out of quota.\n"
+		return &appError{nil, msg, seafHTTPResNoQuota}
+	}
+
+	// The target is stored as the content of the link.
+	id, size, err := indexStream(r.Context(), repo.StoreID, repo.Version, strings.NewReader(target), cryptKey)
+	if err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to index link target: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+
+	retStr, err := postFilesAndGenCommit([]string{name}, repo, fsm.user, getCanonPath(parentDir), replace,
+		[]string{id}, []int64{size}, syscall.S_IFLNK|0777)
+	if err != nil {
+		err := fmt.Errorf("failed to post link and gen commit: %v", err)
+		return &appError{err, "", http.StatusInternalServerError}
+	}
 
 	rsp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rsp.Write([]byte(retStr))
 
-	oper := "web-file-upload"
-	if fsm.tokenType == "upload-link" {
-		oper = "link-file-upload"
+	return nil
+}
+
+// maxUploadFormValueSize limits the total size of the non-file fields of an upload form.
+const maxUploadFormValueSize = 10 << 20
+
+// readUploadForm reads the multipart form of an upload request as a stream instead of
+// spooling it with ParseMultipartForm. Non-file fields are added to r.Form and r.PostForm
+// as they arrive, each file in the "file" field is passed to handleFile.
+func readUploadForm(r *http.Request, handleFile func(part *multipart.Part) *appError) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{nil, "", http.StatusBadRequest}
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return &appError{nil, "", http.StatusBadRequest}
+	}
+	if r.PostForm == nil {
+		r.PostForm = make(url.Values)
 	}
 
-	sendStatisticMsg(repoID, user, oper, uint64(contentLen))
+	var valueSize int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &appError{nil, "", http.StatusBadRequest}
+		}
+
+		name := part.FormName()
+		if part.FileName() == "" {
+			var buf bytes.Buffer
+			n, err := io.CopyN(&buf, part, maxUploadFormValueSize-valueSize+1)
+			if err != nil && err != io.EOF {
+				part.Close()
+				return &appError{nil, "", http.StatusBadRequest}
+			}
+			valueSize += n
+			if valueSize > maxUploadFormValueSize {
+				part.Close()
+				msg := "Form is too large.\n"
+				return &appError{nil, msg, http.StatusBadRequest}
+			}
+			r.Form.Add(name, buf.String())
+			r.PostForm.Add(name, buf.String())
+		} else if name == "file" {
+			if err := handleFile(part); err != nil {
+				part.Close()
+				return err
+			}
+		}
+		part.Close()
+	}
 
 	return nil
 }
 
-func writeBlockDataToTmpFile(r *http.Request, fsm *recvData, formFiles map[string][]*multipart.FileHeader,
-	repoID, parentDir string) error {
-	httpTempDir := filepath.Join(absDataDir, "httptemp")
+// receiveUploadForm reads the form of an upload request. Files of non-resumable uploads are
+// indexed while they are received, and their names, IDs and sizes are added to fsm.
+// For resumable uploads, the received chunk is saved to a temp file which is returned,
+// because the temp file of the upload can only be found after all fields are read.
+// Fields may come in any order, the caller checks them once the form is read. Blocks of
+// rejected uploads are left in storage for GC to remove.
+func receiveUploadForm(rsp http.ResponseWriter, r *http.Request, fsm *recvData, singleFile bool) (*os.File, *appError) {
+	var repo *repomgr.Repo
+	var cryptKey *seafileCrypt
+	if fsm.rstart < 0 {
+		repo = repomgr.Get(fsm.repoID)
+		if repo == nil {
+			msg := "Failed to get repo.\n"
+			err := fmt.Errorf("Failed to get repo %s", fsm.repoID)
+			return nil, &appError{err, msg, http.StatusInternalServerError}
+		}
+		if repo.IsEncrypted {
+			key, err := parseCryptKey(rsp, fsm.repoID, fsm.user)
+			if err != nil {
+				return nil, err
+			}
+			cryptKey = key
+		}
+	}
 
-	fileHeaders, ok := formFiles["file"]
-	if !ok {
-		err := fmt.Errorf("failed to get file from multipart form")
-		return err
+	var chunk *os.File
+	var totalSize int64
+	nFiles := 0
+	err := readUploadForm(r, func(part *multipart.Part) *appError {
+		nFiles++
+		if nFiles > 1 && (singleFile || fsm.rstart >= 0) {
+			msg := "More files in one request"
+			return &appError{nil, msg, http.StatusBadRequest}
+		}
+
+		if fsm.rstart >= 0 {
+			f, err := ioutil.TempFile(filepath.Join(absDataDir, "httptemp"), "chunk-")
+			if err != nil {
+				msg := "Internal error.\n"
+				err := fmt.Errorf("failed to create temp file for chunk: %v", err)
+				return &appError{err, msg, http.StatusInternalServerError}
+			}
+			chunk = f
+			if _, err := io.Copy(f, part); err != nil {
+				return &appError{nil, "", http.StatusBadRequest}
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				msg := "Internal error.\n"
+				err := fmt.Errorf("failed to seek temp file for chunk: %v", err)
+				return &appError{err, msg, http.StatusInternalServerError}
+			}
+			return nil
+		}
+
+		var reader io.Reader = part
+		if options.maxUploadSize > 0 {
+			reader = io.LimitReader(part, int64(options.maxUploadSize)-totalSize+1)
+		}
+		id, size, err := indexStream(r.Context(), repo.StoreID, repo.Version, reader, cryptKey)
+		if err != nil {
+			msg := "Internal error.\n"
+			err := fmt.Errorf("failed to index blocks: %v", err)
+			return &appError{err, msg, http.StatusInternalServerError}
+		}
+		totalSize += size
+		if options.maxUploadSize > 0 && uint64(totalSize) > options.maxUploadSize {
+			msg := "File size is too large.\n"
+			return &appError{nil, msg, seafHTTPResTooLarge}
+		}
+
+		fsm.fileNames = append(fsm.fileNames, filepath.Base(part.FileName()))
+		fsm.fileIDs = append(fsm.fileIDs, id)
+		fsm.fileSizes = append(fsm.fileSizes, size)
+		return nil
+	})
+	if err != nil {
+		removeUploadChunk(chunk)
+		return nil, err
+	}
+
+	if nFiles == 0 {
+		msg := "No file in multipart form.\n"
+		return nil, &appError{nil, msg, http.StatusBadRequest}
+	}
+
+	return chunk, nil
+}
+
+func removeUploadChunk(chunk *os.File) {
+	if chunk == nil {
+		return
 	}
+	chunk.Close()
+	os.Remove(chunk.Name())
+}
+
+func writeBlockDataToTmpFile(r *http.Request, fsm *recvData, file io.Reader,
+	repoID, parentDir string) error {
+	httpTempDir := filepath.Join(absDataDir, "httptemp")
 
 	disposition := r.Header.Get("Content-Disposition")
 	if disposition == "" {
@@ -1123,14 +1386,6 @@ func writeBlockDataToTmpFile(r *http.Request, fsm *recvData, formFiles map[strin
 		return err
 	}
 
-	handler := fileHeaders[0]
-	file, err := handler.Open()
-	if err != nil {
-		err := fmt.Errorf("failed to open file for read: %v", err)
-		return err
-	}
-	defer file.Close()
-
 	var f *os.File
 	//filename := handler.Filename
 	filePath := filepath.Join("/", parentDir, filename)
@@ -1451,30 +1706,20 @@ func postMultiFiles(rsp http.ResponseWriter, r *http.Request, repoID, parentDir,
 		return &appError{nil, msg, http.StatusBadRequest}
 	}
 
-	var cryptKey *seafileCrypt
-	if repo.IsEncrypted {
-		key, err := parseCryptKey(rsp, repoID, user)
-		if err != nil {
-			return err
-		}
-		cryptKey = key
-	}
-
 	var ids []string
 	var sizes []int64
 	if fsm.rstart >= 0 {
-		for _, filePath := range files {
-			id, size, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, filePath, nil, cryptKey)
+		var cryptKey *seafileCrypt
+		if repo.IsEncrypted {
+			key, err := parseCryptKey(rsp, repoID, user)
 			if err != nil {
-				err := fmt.Errorf("failed to index blocks: %v", err)
-				return &appError{err, "", http.StatusInternalServerError}
+				return err
 			}
-			ids = append(ids, id)
-			sizes = append(sizes, size)
+			cryptKey = key
 		}
-	} else {
-		for _, handler := range fsm.fileHeaders {
-			id, size, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, "", handler, cryptKey)
+
+		for _, filePath := range files {
+			id, size, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, filePath, cryptKey)
 			if err != nil {
 				err := fmt.Errorf("failed to index blocks: %v", err)
 				return &appError{err, "", http.StatusInternalServerError}
@@ -1482,9 +1727,12 @@ func postMultiFiles(rsp http.ResponseWriter, r *http.Request, repoID, parentDir,
 			ids = append(ids, id)
 			sizes = append(sizes, size)
 		}
+	} else {
+		ids = fsm.fileIDs
+		sizes = fsm.fileSizes
 	}
 
-	retStr, err := postFilesAndGenCommit(fileNames, repo, user, canonPath, replace, ids, sizes)
+	retStr, err := postFilesAndGenCommit(fileNames, repo, user, canonPath, replace, ids, sizes, syscall.S_IFREG|0644)
 	if err != nil {
 		err := fmt.Errorf("failed to post files and gen commit: %v", err)
 		return &appError{err, "", http.StatusInternalServerError}
@@ -1519,7 +1767,7 @@ func postMultiFiles(rsp http.ResponseWriter, r *http.Request, repoID, parentDir,
 	return nil
 }
 
-func postFilesAndGenCommit(fileNames []string, repo *repomgr.Repo, user, canonPath string, replace bool, ids []string, sizes []int64) (string, error) {
+func postFilesAndGenCommit(fileNames []string, repo *repomgr.Repo, user, canonPath string, replace bool, ids []string, sizes []int64, mode uint32) (string, error) {
 	headCommit, err := commitmgr.Load(repo.ID, repo.HeadCommitID)
 	if err != nil {
 		err := fmt.Errorf("failed to get head commit for repo %s", repo.ID)
@@ -1532,9 +1780,8 @@ func postFilesAndGenCommit(fileNames []string, repo *repomgr.Repo, user, canonPa
 		if i > len(ids)-1 || i > len(sizes)-1 {
 			break
 		}
-		mode := (syscall.S_IFREG | 0644)
 		mtime := time.Now().Unix()
-		dent := fsmgr.NewDirent(ids[i], name, uint32(mode), mtime, "", sizes[i])
+		dent := fsmgr.NewDirent(ids[i], name, mode, mtime, "", sizes[i])
 		dents = append(dents, dent)
 	}
 
@@ -1972,29 +2219,72 @@ func shouldIgnoreFile(fileName string) bool {
 	return false
 }
 
-func indexBlocks(ctx context.Context, repoID string, version int, filePath string, handler *multipart.FileHeader, cryptKey *seafileCrypt) (string, int64, error) {
-	var size int64
-	if handler != nil {
-		size = handler.Size
+// fixedChunking splits uploaded files into blocks of options.fixedBlockSize.
+const fixedChunking = "fixed"
+
+func indexBlocks(ctx context.Context, repoID string, version int, filePath string, cryptKey *seafileCrypt) (string, int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		err := fmt.Errorf("failed to open file: %s: %v", filePath, err)
+		return "", -1, err
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		err := fmt.Errorf("failed to stat file %s: %v", filePath, err)
+		return "", -1, err
+	}
+	size := fileInfo.Size()
+
+	if size == 0 {
+		return fsmgr.EmptySha1, 0, nil
+	}
+
+	var blkIDs []string
+	if options.chunkingAlgorithm == fixedChunking {
+		blkIDs, err = indexFixedBlocks(ctx, repoID, filePath, size, cryptKey)
 	} else {
-		f, err := os.Open(filePath)
-		if err != nil {
-			err := fmt.Errorf("failed to open file: %s: %v", filePath, err)
-			return "", -1, err
+		var indexed int64
+		blkIDs, indexed, err = indexStreamBlocks(ctx, repoID, f, cryptKey)
+		if err == nil && indexed != size {
+			err = fmt.Errorf("file size changed while chunking")
 		}
-		defer f.Close()
-		fileInfo, err := f.Stat()
-		if err != nil {
-			err := fmt.Errorf("failed to stat file %s: %v", filePath, err)
-			return "", -1, err
-		}
-		size = fileInfo.Size()
+	}
+	if err != nil {
+		return "", -1, err
+	}
+
+	fileID, err := writeSeafile(repoID, version, size, blkIDs)
+	if err != nil {
+		err := fmt.Errorf("failed to write seafile: %v", err)
+		return "", -1, err
+	}
+
+	return fileID, size, nil
+}
+
+// indexStream indexes a file read from r, blocks are written as the content is read.
+// The blocks are the same as the ones created by indexBlocks for the same content.
+func indexStream(ctx context.Context, repoID string, version int, r io.Reader, cryptKey *seafileCrypt) (string, int64, error) {
+	blkIDs, size, err := indexStreamBlocks(ctx, repoID, r, cryptKey)
+	if err != nil {
+		return "", -1, err
 	}
 
 	if size == 0 {
 		return fsmgr.EmptySha1, 0, nil
 	}
 
+	fileID, err := writeSeafile(repoID, version, size, blkIDs)
+	if err != nil {
+		err := fmt.Errorf("failed to write seafile: %v", err)
+		return "", -1, err
+	}
+
+	return fileID, size, nil
+}
+
+func indexFixedBlocks(ctx context.Context, repoID string, filePath string, size int64, cryptKey *seafileCrypt) ([]string, error) {
 	chunkJobs := make(chan chunkingData, 10)
 	results := make(chan chunkingResult, 10)
 	go createChunkPool(ctx, int(options.maxIndexingThreads), chunkJobs, results)
@@ -2002,7 +2292,9 @@ func indexBlocks(ctx context.Context, repoID string, version int, filePath strin
 	var blkSize int64
 	var offset int64
 
-	jobNum := uint64(size)/options.fixedBlockSize + 1
+	// A file whose size is a multiple of the block size has no partial last block,
+	// and an empty file has no blocks. Every block ID must be filled by a job.
+	jobNum := (uint64(size) + options.fixedBlockSize - 1) / options.fixedBlockSize
 	blkIDs := make([]string, jobNum)
 
 	left := size
@@ -2013,7 +2305,8 @@ func indexBlocks(ctx context.Context, repoID string, version int, filePath strin
 			blkSize = left
 		}
 		if left > 0 {
-			job := chunkingData{repoID, filePath, handler, offset, cryptKey}
+			idx := offset / int64(options.fixedBlockSize)
+			job := chunkingData{repoID: repoID, filePath: filePath, offset: offset, idx: idx, cryptKey: cryptKey}
 			select {
 			case chunkJobs <- job:
 				left -= blkSize
@@ -2027,7 +2320,7 @@ func indexBlocks(ctx context.Context, repoID string, version int, filePath strin
 							_ = result
 						}
 					})
-					return "", -1, result.err
+					return nil, result.err
 				}
 				blkIDs[result.idx] = result.blkID
 			}
@@ -2040,7 +2333,7 @@ func indexBlocks(ctx context.Context, repoID string, version int, filePath strin
 							_ = result
 						}
 					})
-					return "", -1, result.err
+					return nil, result.err
 				}
 				blkIDs[result.idx] = result.blkID
 			}
@@ -2048,13 +2341,99 @@ func indexBlocks(ctx context.Context, repoID string, version int, filePath strin
 		}
 	}
 
-	fileID, err := writeSeafile(repoID, version, size, blkIDs)
+	return blkIDs, nil
+}
+
+// newBlockSplitter returns a function which returns the next block read from r, and io.EOF after the last block.
+func newBlockSplitter(r io.Reader) (func() ([]byte, error), error) {
+	if options.chunkingAlgorithm != fixedChunking {
+		chunker, err := cdc.NewChunker(r, options.cdcOptions)
+		if err != nil {
+			err := fmt.Errorf("failed to create chunker: %v", err)
+			return nil, err
+		}
+		return chunker.Next, nil
+	}
+
+	return func() ([]byte, error) {
+		buf := make([]byte, options.fixedBlockSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			return buf[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}, nil
+}
+
+// indexStreamBlocks splits the content read from r into blocks. Blocks are cut sequentially
+// and written by the chunking workers. It returns the block IDs and the size of the content.
+func indexStreamBlocks(ctx context.Context, repoID string, r io.Reader, cryptKey *seafileCrypt) ([]string, int64, error) {
+	nextBlock, err := newBlockSplitter(r)
 	if err != nil {
-		err := fmt.Errorf("failed to write seafile: %v", err)
-		return "", -1, err
+		return nil, -1, err
 	}
 
-	return fileID, size, nil
+	// Each job holds the content of a block, so the number of queued jobs is kept small.
+	chunkJobs := make(chan chunkingData, options.maxIndexingThreads)
+	results := make(chan chunkingResult, 10)
+	go createChunkPool(ctx, int(options.maxIndexingThreads), chunkJobs, results)
+
+	drain := func() {
+		go RecoverWrapper(func() {
+			for result := range results {
+				_ = result
+			}
+		})
+	}
+
+	var blkIDs []string
+	var indexed int64
+	var idx int64
+	var job *chunkingData
+	for {
+		if job == nil {
+			data, err := nextBlock()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				close(chunkJobs)
+				drain()
+				err := fmt.Errorf("failed to read file: %v", err)
+				return nil, -1, err
+			}
+			indexed += int64(len(data))
+			job = &chunkingData{repoID: repoID, idx: idx, data: data, cryptKey: cryptKey}
+			idx++
+			blkIDs = append(blkIDs, "")
+		}
+
+		select {
+		case chunkJobs <- *job:
+			job = nil
+		case result := <-results:
+			if result.err != nil {
+				close(chunkJobs)
+				drain()
+				return nil, -1, result.err
+			}
+			blkIDs[result.idx] = result.blkID
+		}
+	}
+
+	close(chunkJobs)
+	for result := range results {
+		if result.err != nil {
+			drain()
+			return nil, -1, result.err
+		}
+		blkIDs[result.idx] = result.blkID
+	}
+
+	return blkIDs, indexed, nil
 }
 
 func writeSeafile(repoID string, version int, fileSize int64, blkIDs []string) (string, error) {
@@ -2076,8 +2455,11 @@ func writeSeafile(repoID string, version int, fileSize int64, blkIDs []string) (
 type chunkingData struct {
 	repoID   string
 	filePath string
-	handler  *multipart.FileHeader
 	offset   int64
+	// Index of the block in the file
+	idx int64
+	// Content of the block if it's already read, otherwise the block is read from offset
+	data     []byte
 	cryptKey *seafileCrypt
 }
 
@@ -2121,8 +2503,7 @@ func chunkingWorker(ctx context.Context, wg *sync.WaitGroup, chunkJobs chan chun
 
 		job := job
 		blkID, err := chunkFile(job)
-		idx := job.offset / int64(options.fixedBlockSize)
-		result := chunkingResult{idx, blkID, err}
+		result := chunkingResult{job.idx, blkID, err}
 		res <- result
 	}
 	wg.Done()
@@ -2132,35 +2513,31 @@ func chunkFile(job chunkingData) (string, error) {
 	repoID := job.repoID
 	offset := job.offset
 	filePath := job.filePath
-	handler := job.handler
 	blkSize := options.fixedBlockSize
 	cryptKey := job.cryptKey
-	var file multipart.File
-	if handler != nil {
-		f, err := handler.Open()
+	if job.data != nil {
+		blkID, err := writeChunk(repoID, job.data, int64(len(job.data)), cryptKey)
 		if err != nil {
-			err := fmt.Errorf("failed to open file for read: %v", err)
-			return "", err
-		}
-		defer f.Close()
-		file = f
-	} else {
-		f, err := os.Open(filePath)
-		if err != nil {
-			err := fmt.Errorf("failed to open file for read: %v", err)
+			err := fmt.Errorf("failed to write chunk: %v", err)
 			return "", err
 		}
-		defer f.Close()
-		file = f
+		return blkID, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		err := fmt.Errorf("failed to open file for read: %v", err)
+		return "", err
 	}
-	_, err := file.Seek(offset, os.SEEK_SET)
+	defer file.Close()
+	_, err = file.Seek(offset, os.SEEK_SET)
 	if err != nil {
 		err := fmt.Errorf("failed to seek file: %v", err)
 		return "", err
 	}
 	buf := make([]byte, blkSize)
-	n, err := file.Read(buf)
-	if err != nil {
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
 		err := fmt.Errorf("failed to seek file: %v", err)
 		return "", err
 	}
@@ -2180,7 +2557,7 @@ func writeChunk(repoID string, input []byte, blkSize int64, cryptKey *seafileCry
 	if cryptKey != nil && blkSize > 0 {
 		encKey := cryptKey.key
 		encIv := cryptKey.iv
-		encoded, err := encrypt(input, encKey, encIv)
+		encoded, err := crypt.Encrypt(input, encKey, encIv)
 		if err != nil {
 			err := fmt.Errorf("failed to encrypt block: %v", err)
 			return "", err
@@ -2220,8 +2597,8 @@ func checkTmpFileList(fsm *recvData) *appError {
 			totalSize += fileInfo.Size()
 		}
 	} else {
-		for _, handler := range fsm.fileHeaders {
-			totalSize += handler.Size
+		for _, size := range fsm.fileSizes {
+			totalSize += size
 		}
 	}
 
@@ -2574,44 +2951,50 @@ func updateAjaxCB(rsp http.ResponseWriter, r *http.Request) *appError {
 func doUpdate(rsp http.ResponseWriter, r *http.Request, fsm *recvData, isAjax bool) *appError {
 	setAccessControl(rsp)
 
-	if err := r.ParseMultipartForm(1 << 20); err != nil {
-		return &appError{nil, "", http.StatusBadRequest}
-	}
-	defer r.MultipartForm.RemoveAll()
-
 	repoID := fsm.repoID
 	user := fsm.user
 
-	targetFile := r.FormValue("target_file")
-	if targetFile == "" {
-		msg := "No target_file given.\n"
-		return &appError{nil, msg, http.StatusBadRequest}
-	}
-
-	parentDir := filepath.Dir(targetFile)
-	fileName := filepath.Base(targetFile)
+	var parentDir, fileName string
+	var contentLen int64
+	// The fields may follow the file in the form, so they are checked after the whole form is read.
+	checkForm := func() *appError {
+		targetFile := r.FormValue("target_file")
+		if targetFile == "" {
+			msg := "No target_file given.\n"
+			return &appError{nil, msg, http.StatusBadRequest}
+		}
 
-	defer clearTmpFile(fsm, parentDir)
+		parentDir = filepath.Dir(targetFile)
+		fileName = filepath.Base(targetFile)
 
-	if fsm.rstart >= 0 {
-		if parentDir[0] != '/' {
+		if fsm.rstart >= 0 && parentDir[0] != '/' {
 			msg := "Invalid parent dir"
 			return &appError{nil, msg, http.StatusBadRequest}
 		}
 
-		formFiles := r.MultipartForm.File
-		files, ok := formFiles["file"]
-		if !ok {
-			msg := "No file in multipart form.\n"
-			return &appError{nil, msg, http.StatusBadRequest}
+		if err := checkParentDir(repoID, parentDir); err != nil {
+			return err
 		}
 
-		if len(files) > 1 {
-			msg := "More files in one request"
-			return &appError{nil, msg, http.StatusBadRequest}
-		}
+		var appErr *appError
+		contentLen, appErr = checkUploadQuota(r, fsm)
+		return appErr
+	}
+
+	chunk, appErr := receiveUploadForm(rsp, r, fsm, true)
+	if appErr != nil {
+		return appErr
+	}
+	defer removeUploadChunk(chunk)
+
+	if appErr := checkForm(); appErr != nil {
+		return appErr
+	}
+
+	defer clearTmpFile(fsm, parentDir)
 
-		err := writeBlockDataToTmpFile(r, fsm, formFiles, repoID, parentDir)
+	if fsm.rstart >= 0 {
+		err := writeBlockDataToTmpFile(r, fsm, chunk, repoID, parentDir)
 		if err != nil {
 			msg := "Internal error.\n"
 			err := fmt.Errorf("failed to write block data to tmp file: %v", err)
@@ -2628,22 +3011,6 @@ func doUpdate(rsp http.ResponseWriter, r *http.Request, fsm *recvData, isAjax bo
 
 			return nil
 		}
-	} else {
-		formFiles := r.MultipartForm.File
-		fileHeaders, ok := formFiles["file"]
-		if !ok {
-			msg := "No file in multipart form.\n"
-			return &appError{nil, msg, http.StatusBadRequest}
-		}
-		if len(fileHeaders) > 1 {
-			msg := "More files in one request"
-			return &appError{nil, msg, http.StatusBadRequest}
-		}
-		for _, handler := range fileHeaders {
-			fileName := filepath.Base(handler.Filename)
-			fsm.fileNames = append(fsm.fileNames, fileName)
-			fsm.fileHeaders = append(fsm.fileHeaders, handler)
-		}
 	}
 
 	if fsm.fileNames == nil {
@@ -2651,43 +3018,10 @@ func doUpdate(rsp http.ResponseWriter, r *http.Request, fsm *recvData, isAjax bo
 		return &appError{nil, msg, http.StatusBadRequest}
 	}
 
-	if err := checkParentDir(repoID, parentDir); err != nil {
-		return err
-	}
-
 	if err := checkTmpFileList(fsm); err != nil {
 		return err
 	}
 
-	var contentLen int64
-	if fsm.fsize > 0 {
-		contentLen = fsm.fsize
-	} else {
-		lenstr := r.Header.Get("Content-Length")
-		if lenstr == "" {
-			contentLen = -1
-		} else {
-			tmpLen, err := strconv.ParseInt(lenstr, 10, 64)
-			if err != nil {
-				msg := "Internal error.\n"
-				err := fmt.Errorf("failed to parse content len: %v", err)
-				return &appError{err, msg, http.StatusInternalServerError}
-			}
-			contentLen = tmpLen
-		}
-	}
-
-	ret, err := checkQuota(repoID, contentLen)
-	if err != nil {
-		msg := "Internal error.\n"
-		err := fmt.Errorf("failed to check quota: %v", err)
-		return &appError{err, msg, http.StatusInternalServerError}
-	}
-	if ret == 1 {
-		msg := "Out of quota.\n"
-		return &appError{nil, msg, seafHTTPResNoQuota}
-	}
-
 	headIDs, ok := r.Form["head"]
 	var headID string
 	if ok {
@@ -2747,20 +3081,20 @@ func putFile(rsp http.ResponseWriter, r *http.Request, repoID, parentDir, user,
 		return &appError{nil, msg, seafHTTPResNotExists}
 	}
 
-	var cryptKey *seafileCrypt
-	if repo.IsEncrypted {
-		key, err := parseCryptKey(rsp, repoID, user)
-		if err != nil {
-			return err
-		}
-		cryptKey = key
-	}
-
 	var fileID string
 	var size int64
 	if fsm.rstart >= 0 {
+		var cryptKey *seafileCrypt
+		if repo.IsEncrypted {
+			key, err := parseCryptKey(rsp, repoID, user)
+			if err != nil {
+				return err
+			}
+			cryptKey = key
+		}
+
 		filePath := files[0]
-		id, fileSize, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, filePath, nil, cryptKey)
+		id, fileSize, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, filePath, cryptKey)
 		if err != nil {
 			err := fmt.Errorf("failed to index blocks: %v", err)
 			return &appError{err, "", http.StatusInternalServerError}
@@ -2768,14 +3102,8 @@ func putFile(rsp http.ResponseWriter, r *http.Request, repoID, parentDir, user,
 		fileID = id
 		size = fileSize
 	} else {
-		handler := fsm.fileHeaders[0]
-		id, fileSize, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, "", handler, cryptKey)
-		if err != nil {
-			err := fmt.Errorf("failed to index blocks: %v", err)
-			return &appError{err, "", http.StatusInternalServerError}
-		}
-		fileID = id
-		size = fileSize
+		fileID = fsm.fileIDs[0]
+		size = fsm.fileSizes[0]
 	}
 
 	fullPath := filepath.Join(parentDir, fileName)
@@ -2887,17 +3215,9 @@ func doUploadBlks(rsp http.ResponseWriter, r *http.Request, fsm *recvData) *appE
 	repoID := fsm.repoID
 	user := fsm.user
 
-	replaceStr := r.FormValue("replace")
-	var replaceExisted bool
-	if replaceStr != "" {
-		replace, err := strconv.ParseInt(replaceStr, 10, 64)
-		if err != nil || (replace != 0 && replace != 1) {
-			msg := "Invalid argument replace.\n"
-			return &appError{nil, msg, http.StatusBadRequest}
-		}
-		if replace == 1 {
-			replaceExisted = true
-		}
+	replaceExisted, appErr := parseReplaceArg(r)
+	if appErr != nil {
+		return appErr
 	}
 
 	parentDir := r.FormValue("parent_dir")
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/cdc"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+)
+
+func indexTestContent(size int) []byte {
+	content := make([]byte, size)
+	x := uint32(1)
+	for i := range content {
+		x = x*1103515245 + 12345
+		content[i] = byte(x >> 16)
+	}
+	return content
+}
+
+func TestIndexBlocks(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+	blockmgr.Init("", dataDir)
+	fsmgr.Init("", dataDir)
+
+	content := indexTestContent(200000)
+	filePath := filepath.Join(dataDir, "upload")
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatalf("Failed to write file : %v\n", err)
+	}
+
+	saved := options
+	defer func() { options = saved }()
+	options.maxIndexingThreads = 2
+	options.fixedBlockSize = 1 << 15
+	options.cdcOptions = cdc.Options{Algorithm: cdc.FastCDC, MinSize: 2048, AvgSize: 8192, MaxSize: 32768}
+
+	for _, algorithm := range []string{fixedChunking, cdc.FastCDC} {
+		options.chunkingAlgorithm = algorithm
+
+		fileID, size, err := indexBlocks(context.Background(), exportTestRepoID, 1, filePath, nil)
+		if err != nil || size != int64(len(content)) {
+			t.Fatalf("%s: failed to index file : %v\n", algorithm, err)
+		}
+		streamID, streamSize, err := indexStream(context.Background(), exportTestRepoID, 1, bytes.NewReader(content), nil)
+		if err != nil || streamSize != size || streamID != fileID {
+			t.Errorf("%s: streaming index %s differs from %s : %v\n", algorithm, streamID, fileID, err)
+		}
+
+		file, err := fsmgr.GetSeafile(exportTestRepoID, fileID)
+		if err != nil {
+			t.Fatalf("%s: failed to get seafile : %v\n", algorithm, err)
+		}
+		if len(file.BlkIDs) < 2 {
+			t.Errorf("%s: file is not split into blocks : %v\n", algorithm, file.BlkIDs)
+		}
+		var buf bytes.Buffer
+		for _, blkID := range file.BlkIDs {
+			if err := blockmgr.Read(exportTestRepoID, blkID, &buf); err != nil {
+				t.Fatalf("%s: failed to read block %s : %v\n", algorithm, blkID, err)
+			}
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("%s: blocks don't add up to the uploaded file\n", algorithm)
+		}
+	}
+
+	// Files whose sizes are multiples of the block size don't get an empty last block ID,
+	// like the stream index of the same content.
+	options.chunkingAlgorithm = fixedChunking
+	blockSize := int64(options.fixedBlockSize)
+	for _, size := range []int64{0, blockSize, 2 * blockSize, 2*blockSize + 1} {
+		if err := ioutil.WriteFile(filePath, content[:size], 0644); err != nil {
+			t.Fatalf("Failed to write file : %v\n", err)
+		}
+		blkIDs, err := indexFixedBlocks(context.Background(), exportTestRepoID, filePath, size, nil)
+		if err != nil {
+			t.Fatalf("Failed to index file of %d bytes : %v\n", size, err)
+		}
+		streamBlkIDs, _, err := indexStreamBlocks(context.Background(), exportTestRepoID, bytes.NewReader(content[:size]), nil)
+		if err != nil {
+			t.Fatalf("Failed to index stream of %d bytes : %v\n", size, err)
+		}
+		if !reflect.DeepEqual(blkIDs, streamBlkIDs) && !(len(blkIDs) == 0 && len(streamBlkIDs) == 0) {
+			t.Errorf("Blocks of file of %d bytes are %v, expected %v\n", size, blkIDs, streamBlkIDs)
+		}
+		if expected := int((size + blockSize - 1) / blockSize); len(blkIDs) != expected {
+			t.Errorf("File of %d bytes has %d blocks, expected %d\n", size, len(blkIDs), expected)
+		}
+	}
+}
+
+func TestReadUploadForm(t *testing.T) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("parent_dir", "/docs")
+	part, _ := writer.CreateFormFile("file", "a.txt")
+	part.Write([]byte("content of a"))
+	part, _ = writer.CreateFormFile("file", "b.txt")
+	part.Write([]byte("content of b"))
+	writer.WriteField("replace", "1")
+	writer.Close()
+
+	r := httptest.NewRequest("POST", "/upload-api/token?ret-json=1", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	files := make(map[string]string)
+	err := readUploadForm(r, func(part *multipart.Part) *appError {
+		if r.FormValue("parent_dir") != "/docs" {
+			t.Errorf("Field before file is not available when reading file\n")
+		}
+		content, _ := ioutil.ReadAll(part)
+		files[part.FileName()] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read upload form : %v\n", err.Error)
+	}
+
+	if files["a.txt"] != "content of a" || files["b.txt"] != "content of b" {
+		t.Errorf("Unexpected files %v\n", files)
+	}
+	if r.FormValue("replace") != "1" || r.FormValue("ret-json") != "1" {
+		t.Errorf("Form values are not set : %v\n", r.Form)
+	}
+}
+
+func TestUploadFieldsAfterFile(t *testing.T) {
+	_, cleanup := tusTestInit(t)
+	defer cleanup()
+
+	// Fields may follow the files, like in curl -F file=@a.txt -F parent_dir=/.
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", "a.txt")
+	part.Write([]byte("content of a"))
+	writer.WriteField("parent_dir", "/")
+	writer.WriteField("replace", "1")
+	writer.Close()
+
+	r := httptest.NewRequest("POST", "/upload-api/token?ret-json=1", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	fsm := &recvData{parentDir: "/", tokenType: "upload", repoID: exportTestRepoID, user: tusTestUser, rstart: -1, rend: -1, fsize: -1}
+	rsp := httptest.NewRecorder()
+	if appErr := doUpload(rsp, r, fsm, false); appErr != nil {
+		t.Fatalf("Failed to upload with fields after file : %v %s\n", appErr.Error, appErr.Message)
+	}
+	if size := repoFileSize(t, "a.txt"); size != int64(len("content of a")) {
+		t.Errorf("Size of uploaded file is %d\n", size)
+	}
+
+	// The fields are still checked.
+	body.Reset()
+	writer = multipart.NewWriter(&body)
+	part, _ = writer.CreateFormFile("file", "b.txt")
+	part.Write([]byte("content of b"))
+	writer.WriteField("parent_dir", "/missing")
+	writer.Close()
+	r = httptest.NewRequest("POST", "/upload-api/token?ret-json=1", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	fsm = &recvData{parentDir: "/", tokenType: "upload", repoID: exportTestRepoID, user: tusTestUser, rstart: -1, rend: -1, fsize: -1}
+	if appErr := doUpload(httptest.NewRecorder(), r, fsm, false); appErr == nil {
+		t.Errorf("Upload to missing parent dir is accepted\n")
+	}
+	if size := repoFileSize(t, "b.txt"); size != -1 {
+		t.Errorf("Upload to missing parent dir is committed\n")
+	}
+}
+
+func TestPackLink(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "zip-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+	blockmgr.Init("", dataDir)
+	fsmgr.Init("", dataDir)
+
+	saved := options
+	defer func() { options = saved }()
+	options.maxIndexingThreads = 1
+	options.chunkingAlgorithm = fixedChunking
+	options.fixedBlockSize = 1 << 15
+
+	repo := &repomgr.Repo{ID: exportTestRepoID, StoreID: exportTestRepoID, Version: 1}
+	target := "../a.txt"
+	id, size, err := indexStream(context.Background(), repo.StoreID, repo.Version, bytes.NewReader([]byte(target)), nil)
+	if err != nil {
+		t.Fatalf("Failed to index link target : %v\n", err)
+	}
+
+	var buf bytes.Buffer
+	ar := zip.NewWriter(&buf)
+	dent := fsmgr.NewDirent(id, "link", syscall.S_IFLNK|0777, 0, "", size)
+	if err := packFiles(context.Background(), ar, dent, repo, "docs"); err != nil {
+		t.Fatalf("Failed to pack link : %v\n", err)
+	}
+	ar.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || len(zr.File) != 1 {
+		t.Fatalf("Failed to read zip file : %v\n", err)
+	}
+	f := zr.File[0]
+	if f.Name != "docs/link" || f.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Unexpected zip entry %s of mode %v\n", f.Name, f.Mode())
+	}
+	rc, _ := f.Open()
+	content, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(content) != target {
+		t.Errorf("Zip entry content is %q, expected %q\n", content, target)
+	}
+}
@@ -19,8 +19,10 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/cdc"
 	"github.com/haiwen/seafile-server/fileserver/commitmgr"
 	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/objstore"
 	"github.com/haiwen/seafile-server/fileserver/repomgr"
 	"github.com/haiwen/seafile-server/fileserver/searpc"
 	"github.com/haiwen/seafile-server/fileserver/share"
@@ -39,6 +41,7 @@ var dbType string
 var groupTableName string
 var cloudMode bool
 var seafileDB, ccnetDB *sql.DB
+var ccnetDBType string
 
 // when SQLite is used, user and group db are separated.
 var userDB, groupDB *sql.DB
@@ -58,6 +61,22 @@ type fileServerOptions struct {
 	maxDownloadDirSize uint64
 	// Block size for indexing uploaded files
 	fixedBlockSize uint64
+	// Algorithm to split uploaded files into blocks, fixed or one of the cdc algorithms
+	chunkingAlgorithm string
+	// Block sizes for content-defined chunking
+	cdcOptions cdc.Options
+	// Cache of blocks read from the storage backend
+	blockCache blockmgr.CacheOptions
+	// Size of the cache of decoded fs objects in bytes
+	fsCacheSize int64
+	// Check the content of blocks and fs objects against their IDs when they are read
+	verifyChecksums bool
+	// Serve libraries over WebDAV under /webdav/
+	enableWebDAV bool
+	// Seahub database for WebDAV logins, the database name for MySQL or the path of seahub.db for SQLite
+	seahubDB string
+	// Address to serve metrics on, metrics are not served if it's empty
+	metricsAddr string
 	// Maximum number of goroutines to index uploaded files
 	maxIndexingThreads uint32
 	webTokenExpireTime uint32
@@ -67,6 +86,8 @@ type fileServerOptions struct {
 	// Timeout for fs-id-list requests.
 	fsIDListRequestTimeout uint32
 	defaultQuota           int64
+	// Days of history kept for repos without history limit, negative value keeps all history.
+	keepHistoryDays int
 }
 
 var options fileServerOptions
@@ -136,17 +157,55 @@ func loadCcnetDB() {
 		if err != nil {
 			log.Fatalf("Failed to open database: %v", err)
 		}
+		userDB = ccnetDB
+		ccnetDBType = "mysql"
 	} else if strings.EqualFold(dbEngine, "sqlite") {
 		ccnetDBPath := filepath.Join(centralDir, "groupmgr.db")
 		ccnetDB, err = sql.Open("sqlite3", ccnetDBPath)
 		if err != nil {
 			log.Fatalf("Failed to open database %s: %v", ccnetDBPath, err)
 		}
+		userDBPath := filepath.Join(centralDir, "usermgr.db")
+		userDB, err = sql.Open("sqlite3", userDBPath)
+		if err != nil {
+			log.Fatalf("Failed to open database %s: %v", userDBPath, err)
+		}
+		ccnetDBType = "sqlite"
 	} else {
 		log.Fatalf("Unsupported database %s.", dbEngine)
 	}
 }
 
+// loadSeahubDB opens the Seahub database, which WebDAV logins check API tokens and two-factor
+// authentication against. With MySQL it's accessed through the connection of the ccnet database.
+// WebDAV is disabled if the database isn't configured.
+func loadSeahubDB() {
+	if options.seahubDB == "" {
+		log.Printf("seahub_db is not set, WebDAV is disabled.")
+		options.enableWebDAV = false
+		return
+	}
+
+	if ccnetDBType == "mysql" {
+		if strings.ContainsAny(options.seahubDB, "`.") {
+			log.Fatalf("Invalid seahub database name %s.", options.seahubDB)
+		}
+		seahubDB = ccnetDB
+		seahubTablePrefix = "`" + options.seahubDB + "`."
+		return
+	}
+
+	seahubDBPath := options.seahubDB
+	if !filepath.IsAbs(seahubDBPath) {
+		seahubDBPath = filepath.Join(centralDir, seahubDBPath)
+	}
+	db, err := sql.Open("sqlite3", seahubDBPath)
+	if err != nil {
+		log.Fatalf("Failed to open database %s: %v", seahubDBPath, err)
+	}
+	seahubDB = db
+}
+
 func loadSeafileDB() {
 	seafileConfPath := filepath.Join(centralDir, "seafile.conf")
 
@@ -282,6 +341,12 @@ func loadFileServerOptions() {
 	if section, err := config.GetSection("fileserver"); err == nil {
 		parseFileServerSection(section)
 	}
+	if options.chunkingAlgorithm != fixedChunking {
+		options.cdcOptions.Algorithm = options.chunkingAlgorithm
+		if err := options.cdcOptions.Validate(); err != nil {
+			log.Fatalf("Invalid chunking options: %v", err)
+		}
+	}
 
 	if section, err := config.GetSection("quota"); err == nil {
 		if key, err := section.GetKey("default"); err == nil {
@@ -290,6 +355,14 @@ func loadFileServerOptions() {
 		}
 	}
 
+	if section, err := config.GetSection("history"); err == nil {
+		if key, err := section.GetKey("keep_days"); err == nil {
+			if days, err := key.Int(); err == nil {
+				options.keepHistoryDays = days
+			}
+		}
+	}
+
 	ccnetConfPath := filepath.Join(centralDir, "ccnet.conf")
 	config, err = ini.Load(ccnetConfPath)
 	if err != nil {
@@ -325,6 +398,58 @@ func parseFileServerSection(section *ini.Section) {
 			options.fixedBlockSize = blkSize
 		}
 	}
+	if key, err := section.GetKey("chunking_algorithm"); err == nil {
+		options.chunkingAlgorithm = strings.ToLower(key.String())
+	}
+	if key, err := section.GetKey("cdc_min_block_size"); err == nil {
+		if blkSize, err := key.Int(); err == nil {
+			options.cdcOptions.MinSize = blkSize
+		}
+	}
+	if key, err := section.GetKey("cdc_avg_block_size"); err == nil {
+		if blkSize, err := key.Int(); err == nil {
+			options.cdcOptions.AvgSize = blkSize
+		}
+	}
+	if key, err := section.GetKey("cdc_max_block_size"); err == nil {
+		if blkSize, err := key.Int(); err == nil {
+			options.cdcOptions.MaxSize = blkSize
+		}
+	}
+	if key, err := section.GetKey("block_cache_size"); err == nil {
+		if size, err := key.Int64(); err == nil {
+			options.blockCache.MemorySize = size * (1 << 20)
+		}
+	}
+	if key, err := section.GetKey("block_cache_dir"); err == nil {
+		options.blockCache.Dir = key.String()
+	}
+	if key, err := section.GetKey("block_cache_dir_size"); err == nil {
+		if size, err := key.Int64(); err == nil {
+			options.blockCache.DirSize = size * (1 << 20)
+		}
+	}
+	if key, err := section.GetKey("fs_cache_size"); err == nil {
+		if size, err := key.Int64(); err == nil {
+			options.fsCacheSize = size * (1 << 20)
+		}
+	}
+	if key, err := section.GetKey("verify_checksums"); err == nil {
+		if verify, err := key.Bool(); err == nil {
+			options.verifyChecksums = verify
+		}
+	}
+	if key, err := section.GetKey("enable_webdav"); err == nil {
+		if enable, err := key.Bool(); err == nil {
+			options.enableWebDAV = enable
+		}
+	}
+	if key, err := section.GetKey("seahub_db"); err == nil {
+		options.seahubDB = key.String()
+	}
+	if key, err := section.GetKey("metrics_listen_addr"); err == nil {
+		options.metricsAddr = key.String()
+	}
 	if key, err := section.GetKey("web_token_expire_time"); err == nil {
 		expire, err := key.Uint()
 		if err == nil {
@@ -344,10 +469,15 @@ func initDefaultOptions() {
 	options.port = 8082
 	options.maxDownloadDirSize = 100 * (1 << 20)
 	options.fixedBlockSize = 1 << 23
+	options.chunkingAlgorithm = fixedChunking
+	options.cdcOptions = cdc.DefaultOptions(cdc.Rabin)
 	options.maxIndexingThreads = 1
+	options.blockCache.DirSize = 10 * (1 << 30)
+	options.fsCacheSize = fsmgr.DefaultCacheSize
 	options.webTokenExpireTime = 7200
 	options.clusterSharedTempFileMode = 0600
 	options.defaultQuota = InfiniteQuota
+	options.keepHistoryDays = -1
 }
 
 func writePidFile(pid_file_path string) error {
@@ -382,7 +512,8 @@ func main() {
 		log.Fatal("central config directory must be specified.")
 	}
 
-	if pidFilePath != "" {
+	// Maintenance commands don't write the pid file, which belongs to the server.
+	if pidFilePath != "" && flag.NArg() == 0 {
 		if writePidFile(pidFilePath) != nil {
 			log.Fatal("write pid file failed.")
 		}
@@ -407,6 +538,11 @@ func main() {
 	loadSeafileDB()
 	loadFileServerOptions()
 
+	// Maintenance commands log to stderr unless a log file is specified.
+	if logFile == "" && flag.NArg() > 0 {
+		logFile = "-"
+	}
+
 	if logFile == "" {
 		absLogFile = filepath.Join(absDataDir, "fileserver.log")
 		fp, err := os.OpenFile(absLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
@@ -440,16 +576,46 @@ func main() {
 		syscall.Dup3(int(fp.Fd()), int(os.Stderr.Fd()), 0)
 	}
 
+	if options.enableWebDAV {
+		loadSeahubDB()
+	}
+
 	repomgr.Init(seafileDB)
 
-	fsmgr.Init(centralDir, dataDir)
+	// Background maintenance of storage backends is left to the server.
+	if flag.NArg() > 0 {
+		objstore.DisableBackgroundTasks()
+	}
+
+	// Commit and fs objects can be stored in the seafile database.
+	objstore.RegisterBackend("sql", func(seafileDataDir string, objType string, section *ini.Section) (objstore.Backend, error) {
+		return objstore.NewSQLBackend(seafileDB, dbType, objType)
+	})
 
-	blockmgr.Init(centralDir, dataDir)
+	if err := fsmgr.Init(centralDir, dataDir); err != nil {
+		log.Fatalf("Failed to init fs manager: %v", err)
+	}
+	fsmgr.InitCache(options.fsCacheSize)
+	fsmgr.SetVerify(options.verifyChecksums)
 
-	commitmgr.Init(centralDir, dataDir)
+	if err := blockmgr.Init(centralDir, dataDir); err != nil {
+		log.Fatalf("Failed to init block manager: %v", err)
+	}
+	if err := blockmgr.InitCache(options.blockCache); err != nil {
+		log.Fatalf("Failed to init block cache: %v", err)
+	}
+	blockmgr.SetVerify(options.verifyChecksums)
+
+	if err := commitmgr.Init(centralDir, dataDir); err != nil {
+		log.Fatalf("Failed to init commit manager: %v", err)
+	}
 
 	share.Init(ccnetDB, seafileDB, groupTableName, cloudMode)
 
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	rpcClientInit()
 
 	fileopInit()
@@ -462,6 +628,10 @@ func main() {
 
 	initUpload()
 
+	tusInit()
+
+	metricsInit()
+
 	router := newHTTPRouter()
 
 	go handleSignals()
@@ -534,6 +704,9 @@ func newHTTPRouter() *mux.Router {
 	r.Handle("/update-aj/{.*}", appHandler(updateAjaxCB))
 	r.Handle("/upload-blks-api/{.*}", appHandler(uploadBlksAPICB))
 	r.Handle("/upload-raw-blks-api/{.*}", appHandler(uploadRawBlksAPICB))
+	r.Handle("/upload-symlink-api/{.*}", appHandler(uploadSymlinkAPICB))
+	r.Handle("/upload-tus/{token}{slash:\\/?}", appHandler(uploadTusCB))
+	r.Handle("/upload-tus/{token}/{id}", appHandler(uploadTusCB))
 	// file syncing api
 	r.Handle("/repo/{repoid:[\\da-z]{8}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{12}}/permission-check{slash:\\/?}",
 		appHandler(permissionCheckCB))
@@ -557,11 +730,20 @@ func newHTTPRouter() *mux.Router {
 		appHandler(recvFSCB))
 	r.Handle("/repo/{repoid:[\\da-z]{8}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{12}}/quota-check{slash:\\/?}",
 		appHandler(getCheckQuotaCB))
+	r.Handle("/repo/{repoid:[\\da-z]{8}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{12}}/history{slash:\\/?}",
+		appHandler(getHistoryCB))
 
 	// seadrive api
 	r.Handle("/repo/{repoid:[\\da-z]{8}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{12}}/block-map/{id:[\\da-z]{40}}",
 		appHandler(getBlockMapCB))
 	r.Handle("/accessible-repos{slash:\\/?}", appHandler(getAccessibleRepoListCB))
+
+	if options.enableWebDAV {
+		r.PathPrefix(webdavPrefix + "/").Handler(http.HandlerFunc(handleWebDAV))
+		r.Handle(webdavPrefix, http.RedirectHandler(webdavPrefix+"/", http.StatusMovedPermanently))
+	}
+
+	r.Use(metricsMiddleware)
 	return r
 }
 
@@ -579,6 +761,10 @@ type appHandler func(http.ResponseWriter, *http.Request) *appError
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if e := fn(w, r); e != nil {
+		if r.Context().Err() != nil {
+			// The client has gone away, storage operations of the request were cancelled.
+			return
+		}
 		if e.Error != nil && e.Code == http.StatusInternalServerError {
 			log.Printf("path %s internal server error: %v\n", r.URL.Path, e.Error)
 		}
@@ -0,0 +1,458 @@
+// Package fsck verifies the integrity of repos and repairs damaged repos.
+//
+// Every fs object and block reachable from the head commit is checked to exist and
+// to match its ID. In repair mode, damaged files and dirs are replaced with empty ones
+// and a repair commit is created on top of the head commit.
+//
+// The corrupted state of repos isn't stored, repomgr.GetForCheck sets IsCorrupted when
+// the head commit of a repo can't be loaded. A repair commit becomes the new head,
+// so repaired repos are no longer corrupted when they're loaded again.
+package fsck
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+)
+
+// Options controls a fsck run.
+type Options struct {
+	// Repair damaged repos, otherwise repos are only verified.
+	Repair bool
+	// Number of repos checked concurrently.
+	Workers int
+}
+
+// RepoReport is the result of checking a repo.
+type RepoReport struct {
+	RepoID       string `json:"repo_id"`
+	HeadCommitID string `json:"head_commit_id"`
+	// Set if the head commit is damaged and the repo is reset to an older commit.
+	ResetCommitID   string   `json:"reset_commit_id,omitempty"`
+	DamagedFiles    []string `json:"damaged_files,omitempty"`
+	DamagedDirs     []string `json:"damaged_dirs,omitempty"`
+	MissingFSObjs   []string `json:"missing_fs_objects,omitempty"`
+	CorruptedFSObjs []string `json:"corrupted_fs_objects,omitempty"`
+	MissingBlocks   []string `json:"missing_blocks,omitempty"`
+	CorruptedBlocks []string `json:"corrupted_blocks,omitempty"`
+	Corrupted       bool     `json:"corrupted"`
+	// Set if a repair commit is created.
+	RepairCommitID string `json:"repair_commit_id,omitempty"`
+	// Set if the repo can't be checked.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the result of a fsck run.
+type Report struct {
+	Repair bool          `json:"repair"`
+	Repos  []*RepoReport `json:"repos"`
+}
+
+// Run checks repos in repoIDs, or all repos if repoIDs is empty.
+func Run(repoIDs []string, opts *Options) (*Report, error) {
+	if len(repoIDs) == 0 {
+		ids, err := repomgr.GetRepoIDList()
+		if err != nil {
+			err := fmt.Errorf("failed to get repo list: %v", err)
+			return nil, err
+		}
+		repoIDs = ids
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	report := new(Report)
+	report.Repair = opts.Repair
+	report.Repos = make([]*RepoReport, len(repoIDs))
+
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				report.Repos[idx] = CheckRepo(repoIDs[idx], opts.Repair)
+			}
+		}()
+	}
+	for idx := range repoIDs {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	return report, nil
+}
+
+// CheckRepo checks a repo and repairs it if repair is true.
+func CheckRepo(repoID string, repair bool) *RepoReport {
+	report := new(RepoReport)
+	report.RepoID = repoID
+
+	log.Printf("Running fsck for repo %s.", repoID)
+	if err := checkRepo(report, repair); err != nil {
+		log.Printf("Failed to run fsck for repo %s: %v", repoID, err)
+		report.Error = err.Error()
+	}
+	log.Printf("Fsck finished for repo %s.", repoID)
+
+	return report
+}
+
+type checker struct {
+	report  *RepoReport
+	storeID string
+	repair  bool
+	// Results of checked files and blocks, shared files and blocks are only checked once.
+	files  map[string]bool
+	blocks map[string]bool
+}
+
+func checkRepo(report *RepoReport, repair bool) error {
+	repoID := report.RepoID
+	exists, err := repomgr.Exists(repoID)
+	if err != nil {
+		err := fmt.Errorf("failed to check whether repo exists: %v", err)
+		return err
+	}
+	if !exists {
+		err := fmt.Errorf("repo doesn't exist")
+		return err
+	}
+
+	repo := repomgr.GetForCheck(repoID)
+	if repo == nil {
+		err := fmt.Errorf("failed to get repo")
+		return err
+	}
+	report.HeadCommitID = repo.HeadCommitID
+
+	c := new(checker)
+	c.report = report
+	c.storeID = repo.StoreID
+	c.repair = repair
+	c.files = make(map[string]bool)
+	c.blocks = make(map[string]bool)
+
+	var head *commitmgr.Commit
+	if !repo.IsCorrupted {
+		head, err = commitmgr.Load(repoID, repo.HeadCommitID)
+		if err != nil {
+			log.Printf("Failed to load head commit %s of repo %s: %v", repo.HeadCommitID, repoID, err)
+			head = nil
+		}
+	}
+	if head != nil {
+		valid, err := c.verifyFSObj(head.RootID)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			head = nil
+		}
+	}
+
+	reset := false
+	if head == nil {
+		log.Printf("Head commit of repo %s is damaged, need to restore to an old version.", repoID)
+		report.Corrupted = true
+		head, err = c.findAvailableCommit(repoID)
+		if err != nil {
+			return err
+		}
+		log.Printf("Find available commit %.8s(created at %s) for repo %s.",
+			head.CommitID, time.Unix(head.Ctime, 0).Format("2006-01-02 15:04:05"), repoID)
+		report.ResetCommitID = head.CommitID
+		reset = true
+	}
+
+	rootID, err := c.checkDir(head.RootID, "/")
+	if err != nil {
+		return err
+	}
+	if rootID != head.RootID {
+		report.Corrupted = true
+	}
+
+	if repair && (reset || rootID != head.RootID) {
+		commitID, err := createRepairCommit(head, rootID, report)
+		if err != nil {
+			err := fmt.Errorf("failed to create repair commit: %v", err)
+			return err
+		}
+		report.RepairCommitID = commitID
+	}
+
+	return nil
+}
+
+// findAvailableCommit returns the latest commit whose root dir is not damaged.
+func (c *checker) findAvailableCommit(repoID string) (*commitmgr.Commit, error) {
+	var commits []*commitmgr.Commit
+	err := commitmgr.List(repoID, func(commitID string) error {
+		commit, err := commitmgr.Load(repoID, commitID)
+		if err != nil {
+			return nil
+		}
+		commits = append(commits, commit)
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to list commits: %v", err)
+		return nil, err
+	}
+
+	sort.Slice(commits, func(i, j int) bool {
+		return commits[i].Ctime > commits[j].Ctime
+	})
+
+	for _, commit := range commits {
+		valid, err := c.verifyFSObj(commit.RootID)
+		if err != nil {
+			return nil, err
+		}
+		if valid {
+			return commit, nil
+		}
+	}
+
+	err = fmt.Errorf("no available commits found, can't be repaired")
+	return nil, err
+}
+
+// verifyFSObj checks whether a fs object exists and matches its ID.
+// In repair mode, corrupted objects are removed. An error is returned on IO errors.
+func (c *checker) verifyFSObj(objID string) (bool, error) {
+	if objID == fsmgr.EmptySha1 {
+		return true, nil
+	}
+
+	exists, err := fsmgr.Exists(c.storeID, objID)
+	if !exists {
+		c.report.MissingFSObjs = append(c.report.MissingFSObjs, objID)
+		return false, nil
+	}
+	if err != nil {
+		err := fmt.Errorf("failed to check fs object %s: %v", objID, err)
+		return false, err
+	}
+
+	valid, err := fsmgr.Verify(c.storeID, objID)
+	if err != nil {
+		err := fmt.Errorf("failed to verify fs object %s: %v", objID, err)
+		return false, err
+	}
+	if !valid {
+		c.report.CorruptedFSObjs = append(c.report.CorruptedFSObjs, objID)
+		if c.repair {
+			log.Printf("Fs object %s:%s is damaged, remove it.", c.storeID, objID)
+			if err := fsmgr.Remove(c.storeID, objID); err != nil {
+				log.Printf("Failed to remove fs object %s:%s: %v", c.storeID, objID, err)
+			}
+		}
+	}
+
+	return valid, nil
+}
+
+// checkBlocks checks whether all blocks of a file exist and match their IDs.
+// In repair mode, corrupted blocks are removed. An error is returned on IO errors.
+func (c *checker) checkBlocks(fileID string) (bool, error) {
+	file, err := fsmgr.GetSeafile(c.storeID, fileID)
+	if err != nil {
+		return false, nil
+	}
+
+	ok := true
+	for _, blkID := range file.BlkIDs {
+		if valid, checked := c.blocks[blkID]; checked {
+			ok = ok && valid
+			continue
+		}
+
+		if !blockmgr.Exists(c.storeID, blkID) {
+			c.report.MissingBlocks = append(c.report.MissingBlocks, blkID)
+			c.blocks[blkID] = false
+			ok = false
+			continue
+		}
+
+		valid, err := blockmgr.Verify(c.storeID, blkID)
+		if err != nil {
+			err := fmt.Errorf("failed to verify block %s: %v", blkID, err)
+			return false, err
+		}
+		if !valid {
+			c.report.CorruptedBlocks = append(c.report.CorruptedBlocks, blkID)
+			if c.repair {
+				log.Printf("Block %s:%s is damaged, remove it.", c.storeID, blkID)
+				if err := blockmgr.Remove(c.storeID, blkID); err != nil {
+					log.Printf("Failed to remove block %s:%s: %v", c.storeID, blkID, err)
+				}
+			}
+			ok = false
+		}
+		c.blocks[blkID] = valid
+	}
+
+	return ok, nil
+}
+
+func (c *checker) checkFile(fileID string) (bool, error) {
+	if valid, checked := c.files[fileID]; checked {
+		return valid, nil
+	}
+
+	valid, err := c.verifyFSObj(fileID)
+	if err != nil {
+		return false, err
+	}
+	if valid {
+		valid, err = c.checkBlocks(fileID)
+		if err != nil {
+			return false, err
+		}
+	}
+	c.files[fileID] = valid
+
+	return valid, nil
+}
+
+// checkDir checks a dir recursively and returns the ID of the dir with damaged entries
+// replaced by empty ones. In repair mode, the new dirs are saved.
+func (c *checker) checkDir(dirID string, parentDir string) (string, error) {
+	dir, err := fsmgr.GetSeafdir(c.storeID, dirID)
+	if err != nil {
+		err := fmt.Errorf("failed to get dir %s: %v", dirID, err)
+		return "", err
+	}
+
+	changed := false
+	for _, dent := range dir.Entries {
+		if fsmgr.IsRegular(dent.Mode) || fsmgr.IsLink(dent.Mode) {
+			path := parentDir + dent.Name
+			valid, err := c.checkFile(dent.ID)
+			if err != nil {
+				return "", err
+			}
+			if !valid {
+				log.Printf("Repo[%.8s] file %s(%.8s) is damaged.", c.report.RepoID, path, dent.ID)
+				c.report.DamagedFiles = append(c.report.DamagedFiles, path)
+				// File damaged, set it empty.
+				dent.ID = fsmgr.EmptySha1
+				dent.Mtime = time.Now().Unix()
+				dent.Size = 0
+				changed = true
+			}
+		} else if fsmgr.IsDir(dent.Mode) {
+			path := parentDir + dent.Name + "/"
+			valid, err := c.verifyFSObj(dent.ID)
+			if err != nil {
+				return "", err
+			}
+			if !valid {
+				log.Printf("Repo[%.8s] dir %s(%.8s) is damaged.", c.report.RepoID, path, dent.ID)
+				c.report.DamagedDirs = append(c.report.DamagedDirs, path)
+				// Dir damaged, set it empty.
+				dent.ID = fsmgr.EmptySha1
+				changed = true
+				continue
+			}
+			subDirID, err := c.checkDir(dent.ID, path)
+			if err != nil {
+				return "", err
+			}
+			if subDirID != dent.ID {
+				dent.ID = subDirID
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return dirID, nil
+	}
+
+	newDir, err := fsmgr.NewSeafdir(dir.Version, dir.Entries)
+	if err != nil {
+		err := fmt.Errorf("failed to create dir: %v", err)
+		return "", err
+	}
+	if c.repair {
+		if err := fsmgr.SaveSeafdir(c.storeID, newDir); err != nil {
+			err := fmt.Errorf("failed to save dir: %v", err)
+			return "", err
+		}
+	}
+
+	return newDir.DirID, nil
+}
+
+func genRepairCommitDesc(report *RepoReport) string {
+	desc := "Repaired by system."
+	if len(report.DamagedFiles) > 0 {
+		desc += "\nDamaged files:\n"
+		for _, path := range report.DamagedFiles {
+			desc += path + "\n"
+		}
+	}
+	if len(report.DamagedDirs) > 0 {
+		desc += "\nDamaged folders:\n"
+		for _, path := range report.DamagedDirs {
+			desc += path + "\n"
+		}
+	}
+	return desc
+}
+
+// createRepairCommit creates a commit with the repaired root on top of parent,
+// and updates the repo head to it.
+func createRepairCommit(parent *commitmgr.Commit, rootID string, report *RepoReport) (string, error) {
+	repoID := report.RepoID
+
+	// Clients have to resync the repo after it's repaired.
+	if err := repomgr.DeleteRepoTokens(repoID); err != nil {
+		err := fmt.Errorf("failed to delete repo sync tokens: %v", err)
+		return "", err
+	}
+
+	commit := commitmgr.NewCommit(repoID, parent.CommitID, rootID, parent.CreatorName, genRepairCommitDesc(report))
+	commit.RepoName = parent.RepoName
+	commit.RepoDesc = parent.RepoDesc
+	commit.RepoCategory = parent.RepoCategory
+	commit.Encrypted = parent.Encrypted
+	commit.EncVersion = parent.EncVersion
+	commit.Magic = parent.Magic
+	commit.RandomKey = parent.RandomKey
+	commit.Salt = parent.Salt
+	commit.Version = parent.Version
+	commit.Repaired = 1
+
+	if err := commitmgr.Save(commit); err != nil {
+		err := fmt.Errorf("failed to save commit: %v", err)
+		return "", err
+	}
+
+	log.Printf("Update repo %s status to commit %.8s.", repoID, commit.CommitID)
+	branch := &repomgr.Branch{Name: "master", RepoID: repoID, CommitID: commit.CommitID}
+	if err := repomgr.SetBranch(branch); err != nil {
+		err := fmt.Errorf("failed to update head of repo: %v", err)
+		return "", err
+	}
+	if err := repomgr.UpdateRepoInfo(repoID, commit.CommitID); err != nil {
+		log.Printf("Failed to update repo info of %s: %v", repoID, err)
+	}
+
+	return commit.CommitID, nil
+}
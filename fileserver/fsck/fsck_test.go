@@ -0,0 +1,158 @@
+package fsck
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	"github.com/haiwen/seafile-server/fileserver/repotest"
+)
+
+const (
+	repoID = "b1f2ad61-9164-418a-a47f-ab805dbd5694"
+	token  = "6f7a2b81c6a1f8a4f1e1b8d1f0c2e3a4b5c6d7e8"
+)
+
+var env *repotest.Env
+
+func TestMain(m *testing.M) {
+	var err error
+	env, err = repotest.Setup("fsck-test")
+	if err != nil {
+		fmt.Printf("Failed to set up test repos : %v\n", err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	env.Close()
+	os.Exit(code)
+}
+
+type testRepo struct {
+	block      string
+	fileID     string
+	rootID     string
+	oldCommit  string
+	headCommit string
+}
+
+// createRepo creates a repo with an empty commit and a head commit containing /docs/a.txt.
+func createRepo(t *testing.T) *testRepo {
+	env.Reset(t)
+
+	now := time.Now().Unix()
+	repo := new(testRepo)
+	repo.block = repotest.WriteBlock(t, repoID, "hello world")
+	repo.fileID = repotest.WriteFile(t, repoID, 10, repo.block)
+	subDirID := repotest.WriteDir(t, repoID, fsmgr.NewDirent(repo.fileID, "a.txt", syscall.S_IFREG|0644, now, "", 10))
+	repo.rootID = repotest.WriteDir(t, repoID, fsmgr.NewDirent(subDirID, "docs", syscall.S_IFDIR, now, "", 0))
+
+	repo.oldCommit = repotest.WriteCommit(t, repoID, fsmgr.EmptySha1, "", now-100)
+	repo.headCommit = repotest.WriteCommit(t, repoID, repo.rootID, repo.oldCommit, now)
+	env.AddRepo(t, repoID, repo.headCommit)
+	if _, err := env.DB.Exec("INSERT INTO RepoUserToken (repo_id, email, token) VALUES (?, 'seafile', ?)", repoID, token); err != nil {
+		t.Fatalf("Failed to insert token : %v\n", err)
+	}
+
+	return repo
+}
+
+func getHead(t *testing.T) *commitmgr.Commit {
+	repo := repomgr.GetForCheck(repoID)
+	if repo == nil || repo.IsCorrupted {
+		t.Fatalf("Repo is corrupted after repair\n")
+	}
+	head, err := commitmgr.Load(repoID, repo.HeadCommitID)
+	if err != nil {
+		t.Fatalf("Failed to load head commit : %v\n", err)
+	}
+	return head
+}
+
+func TestCheckHealthyRepo(t *testing.T) {
+	repo := createRepo(t)
+
+	report := CheckRepo(repoID, true)
+	if report.Error != "" || report.Corrupted {
+		t.Errorf("Healthy repo is reported as damaged : %+v\n", report)
+	}
+	if head := getHead(t); head.CommitID != repo.headCommit {
+		t.Errorf("Head commit of healthy repo is changed\n")
+	}
+}
+
+func TestCheckCorruptedBlock(t *testing.T) {
+	repo := createRepo(t)
+	if err := blockmgr.Write(repoID, repo.block, bytes.NewBufferString("bad content")); err != nil {
+		t.Fatalf("Failed to corrupt block : %v\n", err)
+	}
+
+	report := CheckRepo(repoID, false)
+	if report.Error != "" || !report.Corrupted {
+		t.Fatalf("Corrupted block is not detected : %+v\n", report)
+	}
+	if len(report.DamagedFiles) != 1 || report.DamagedFiles[0] != "/docs/a.txt" {
+		t.Errorf("Damaged files %v, want [/docs/a.txt]\n", report.DamagedFiles)
+	}
+	if len(report.CorruptedBlocks) != 1 || report.CorruptedBlocks[0] != repo.block {
+		t.Errorf("Corrupted blocks %v, want [%s]\n", report.CorruptedBlocks, repo.block)
+	}
+	if report.RepairCommitID != "" || !blockmgr.Exists(repoID, repo.block) {
+		t.Errorf("Repo is changed in read-only mode\n")
+	}
+
+	report = CheckRepo(repoID, true)
+	if report.Error != "" || report.RepairCommitID == "" {
+		t.Fatalf("Repo is not repaired : %+v\n", report)
+	}
+
+	head := getHead(t)
+	if head.CommitID != report.RepairCommitID || head.Repaired != 1 || head.ParentID.String != repo.headCommit {
+		t.Errorf("Unexpected repair commit %+v\n", head)
+	}
+	fileID, _, err := fsmgr.GetObjIDByPath(repoID, head.RootID, "/docs/a.txt")
+	if err != nil || fileID != fsmgr.EmptySha1 {
+		t.Errorf("Damaged file is not replaced by empty file : %s %v\n", fileID, err)
+	}
+
+	var count int
+	env.DB.QueryRow("SELECT COUNT(*) FROM RepoUserToken WHERE repo_id = ?", repoID).Scan(&count)
+	if count != 0 {
+		t.Errorf("Sync tokens are not deleted after repair\n")
+	}
+
+	report = CheckRepo(repoID, false)
+	if report.Corrupted {
+		t.Errorf("Repaired repo is still reported as damaged : %+v\n", report)
+	}
+}
+
+func TestCheckMissingHead(t *testing.T) {
+	repo := createRepo(t)
+	if err := commitmgr.Remove(repoID, repo.headCommit); err != nil {
+		t.Fatalf("Failed to remove head commit : %v\n", err)
+	}
+	if r := repomgr.GetForCheck(repoID); r == nil || !r.IsCorrupted {
+		t.Fatalf("Repo with missing head commit is not marked as corrupted\n")
+	}
+	if r := repomgr.GetEx(repoID); r != nil {
+		t.Errorf("Repo with missing head commit is returned to sync clients\n")
+	}
+
+	report := CheckRepo(repoID, true)
+	if report.Error != "" || report.ResetCommitID != repo.oldCommit {
+		t.Fatalf("Repo is not reset to available commit : %+v\n", report)
+	}
+
+	head := getHead(t)
+	if head.Repaired != 1 || head.RootID != fsmgr.EmptySha1 {
+		t.Errorf("Unexpected repair commit %+v\n", head)
+	}
+}
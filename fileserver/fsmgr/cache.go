@@ -0,0 +1,237 @@
+package fsmgr
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultCacheSize is the default size of the cache of decoded fs objects in bytes.
+const DefaultCacheSize = 64 << 20
+
+const cacheShards = 16
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_fs_cache_requests_total",
+		Help: "Number of decoded fs object cache lookups by object type and result.",
+	}, []string{"type", "result"})
+	cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "seafile_fs_cache_evictions_total",
+		Help: "Number of fs objects evicted from the cache.",
+	})
+)
+
+var (
+	dirHits    = cacheRequests.WithLabelValues("dir", "hit")
+	dirMisses  = cacheRequests.WithLabelValues("dir", "miss")
+	fileHits   = cacheRequests.WithLabelValues("file", "hit")
+	fileMisses = cacheRequests.WithLabelValues("file", "miss")
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "seafile_fs_cache_bytes",
+		Help: "Estimated size of the cached fs objects.",
+	}, func() float64 { return float64(cache.load().usage().size) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "seafile_fs_cache_objects",
+		Help: "Number of cached fs objects.",
+	}, func() float64 { return float64(cache.load().usage().count) })
+}
+
+// cache holds the current *objCache, which is nil if caching is disabled.
+var cache cacheHolder
+
+type cacheHolder struct {
+	lock sync.RWMutex
+	c    *objCache
+}
+
+func (h *cacheHolder) load() *objCache {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.c
+}
+
+func (h *cacheHolder) store(c *objCache) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.c = c
+}
+
+// InitCache sets the size in bytes of the cache of objects returned by GetSeafile and GetSeafdir.
+// fs objects are immutable, so they are cached until they're evicted or removed.
+// A size of 0 disables the cache.
+func InitCache(size int64) {
+	if size <= 0 {
+		cache.store(nil)
+		return
+	}
+	cache.store(newObjCache(size))
+}
+
+// objCache is a sharded LRU cache of decoded fs objects keyed by store ID and object ID.
+// Cached objects are never returned to callers, only copies of them.
+type objCache struct {
+	shards [cacheShards]cacheShard
+}
+
+type cacheShard struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	entries  *list.List
+	index    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key string
+	// obj is a *SeafDir or a *Seafile.
+	obj  interface{}
+	size int64
+}
+
+type cacheUsage struct {
+	size  int64
+	count int
+}
+
+func newObjCache(size int64) *objCache {
+	c := new(objCache)
+	for i := range c.shards {
+		c.shards[i].capacity = size / cacheShards
+		c.shards[i].entries = list.New()
+		c.shards[i].index = make(map[string]*list.Element)
+	}
+	return c
+}
+
+func cacheKey(storeID, objID string) string {
+	return storeID + "/" + objID
+}
+
+func (c *objCache) shard(key string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.shards[h.Sum32()%cacheShards]
+}
+
+func (c *objCache) get(storeID, objID string) interface{} {
+	if c == nil {
+		return nil
+	}
+	key := cacheKey(storeID, objID)
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elem, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	s.entries.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).obj
+}
+
+func (c *objCache) add(storeID, objID string, obj interface{}, size int64) {
+	if c == nil {
+		return
+	}
+	key := cacheKey(storeID, objID)
+	s := c.shard(key)
+	if size > s.capacity {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.index[key]; ok {
+		s.entries.MoveToFront(elem)
+		return
+	}
+	s.index[key] = s.entries.PushFront(&cacheEntry{key, obj, size})
+	s.size += size
+	for s.size > s.capacity {
+		e := s.entries.Remove(s.entries.Back()).(*cacheEntry)
+		delete(s.index, e.key)
+		s.size -= e.size
+		cacheEvictions.Inc()
+	}
+}
+
+func (c *objCache) remove(storeID, objID string) {
+	if c == nil {
+		return
+	}
+	key := cacheKey(storeID, objID)
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.index[key]; ok {
+		s.entries.Remove(elem)
+		delete(s.index, key)
+		s.size -= elem.Value.(*cacheEntry).size
+	}
+}
+
+func (c *objCache) usage() cacheUsage {
+	var u cacheUsage
+	if c == nil {
+		return u
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		u.size += s.size
+		u.count += len(s.index)
+		s.lock.Unlock()
+	}
+	return u
+}
+
+// Sizes used to estimate the memory used by cached objects.
+const (
+	objOverhead    = 128
+	direntOverhead = 96
+	stringOverhead = 16
+)
+
+func (seafdir *SeafDir) copy() *SeafDir {
+	dir := *seafdir
+	dir.data = nil
+	if seafdir.Entries != nil {
+		dir.Entries = make([]*SeafDirent, len(seafdir.Entries))
+		for i, dent := range seafdir.Entries {
+			d := *dent
+			dir.Entries[i] = &d
+		}
+	}
+	return &dir
+}
+
+func (seafdir *SeafDir) cacheSize() int64 {
+	size := int64(objOverhead + len(seafdir.DirID))
+	for _, dent := range seafdir.Entries {
+		size += int64(direntOverhead + len(dent.ID) + len(dent.Name) + len(dent.Modifier))
+	}
+	return size
+}
+
+func (seafile *Seafile) copy() *Seafile {
+	file := *seafile
+	file.data = nil
+	if seafile.BlkIDs != nil {
+		file.BlkIDs = append([]string(nil), seafile.BlkIDs...)
+	}
+	return &file
+}
+
+func (seafile *Seafile) cacheSize() int64 {
+	size := int64(objOverhead + len(seafile.FileID))
+	for _, id := range seafile.BlkIDs {
+		size += int64(stringOverhead + len(id))
+	}
+	return size
+}
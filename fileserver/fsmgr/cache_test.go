@@ -0,0 +1,75 @@
+package fsmgr
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObjectCache(t *testing.T) {
+	InitCache(DefaultCacheSize)
+	defer InitCache(0)
+
+	dirHitCount := testutil.ToFloat64(dirHits)
+	for i := 0; i < 2; i++ {
+		seafdir, err := GetSeafdir(repoID, dirID)
+		if err != nil {
+			t.Fatalf("Failed to get seafdir : %v\n", err)
+		}
+		// Changes made by callers don't affect the cached object.
+		seafdir.Entries[0].Name = "changed"
+		seafdir.Entries = seafdir.Entries[:1]
+	}
+	if testutil.ToFloat64(dirHits) != dirHitCount+1 {
+		t.Errorf("Seafdir is not read from cache\n")
+	}
+	seafdir, err := GetSeafdir(repoID, dirID)
+	if err != nil || len(seafdir.Entries) != 2 || seafdir.Entries[0].Name != "/" {
+		t.Errorf("Cached seafdir is modified : %v\n", err)
+	}
+
+	fileHitCount := testutil.ToFloat64(fileHits)
+	for i := 0; i < 2; i++ {
+		seafile, err := GetSeafile(repoID, fileID)
+		if err != nil {
+			t.Fatalf("Failed to get seafile : %v\n", err)
+		}
+		seafile.BlkIDs[0] = "changed"
+	}
+	if testutil.ToFloat64(fileHits) != fileHitCount+1 {
+		t.Errorf("Seafile is not read from cache\n")
+	}
+	seafile, err := GetSeafile(repoID, fileID)
+	if err != nil || seafile.BlkIDs[0] != blkID {
+		t.Errorf("Cached seafile is modified : %v\n", err)
+	}
+
+	// Removed objects are removed from the cache.
+	seafile, _ = NewSeafile(1, 1, []string{subDirID})
+	if err := SaveSeafile(repoID, seafile); err != nil {
+		t.Fatalf("Failed to save seafile : %v\n", err)
+	}
+	if _, err := GetSeafile(repoID, seafile.FileID); err != nil {
+		t.Fatalf("Failed to get seafile : %v\n", err)
+	}
+	if err := Remove(repoID, seafile.FileID); err != nil {
+		t.Fatalf("Failed to remove seafile : %v\n", err)
+	}
+	if _, err := GetSeafile(repoID, seafile.FileID); err == nil {
+		t.Errorf("Removed seafile is still cached\n")
+	}
+}
+
+func TestObjectCacheLimit(t *testing.T) {
+	size := int64(cacheShards * 1024)
+	c := newObjCache(size)
+	for i := 0; i < 1000; i++ {
+		file := &Seafile{Version: 1, FileID: fmt.Sprintf("%040d", i), BlkIDs: []string{blkID}}
+		c.add(repoID, file.FileID, file, file.cacheSize())
+	}
+	usage := c.usage()
+	if usage.size > size || usage.count == 0 || usage.count == 1000 {
+		t.Errorf("Unexpected cache usage %+v with limit %d\n", usage, size)
+	}
+}
@@ -4,6 +4,7 @@ package fsmgr
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
@@ -199,7 +200,8 @@ func (dir *SeafDir) toJSON() ([]byte, error) {
 type FileCountInfo struct {
 	FileCount int64
 	Size      int64
-	DirCount  int64
+	// DirCount is the number of all dirs under the dir, not counting the dir itself.
+	DirCount int64
 }
 
 // Meta data type of dir or file
@@ -212,14 +214,19 @@ const (
 
 var store *objstore.ObjectStore
 
+// Whether the content of fs objects is checked against their IDs when they are read.
+var verify bool
+
 // Empty value of sha1
 const (
 	EmptySha1 = "0000000000000000000000000000000000000000"
 )
 
 // Init initializes fs manager and creates underlying object store.
-func Init(seafileConfPath string, seafileDataDir string) {
-	store = objstore.New(seafileConfPath, seafileDataDir, "fs")
+func Init(seafileConfPath string, seafileDataDir string) error {
+	var err error
+	store, err = objstore.New(seafileConfPath, seafileDataDir, "fs")
+	return err
 }
 
 // NewDirent initializes a SeafDirent object
@@ -376,27 +383,101 @@ func (seafdir *SeafDir) FromData(p []byte) error {
 	return nil
 }
 
+// SetVerify sets whether ReadRaw checks the content of fs objects against their IDs.
+// Damaged objects are moved to quarantine and the read fails.
+func SetVerify(enabled bool) {
+	verify = enabled
+}
+
 // ReadRaw reads data in binary format from storage backend.
 func ReadRaw(repoID string, objID string, w io.Writer) error {
-	err := store.Read(repoID, objID, w)
+	return ReadRawCtx(context.Background(), repoID, objID, w)
+}
+
+// ReadRawCtx reads data like ReadRaw, and stops once ctx is done.
+func ReadRawCtx(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	if !verify || !objstore.Verifiable(objID) {
+		return store.ReadCtx(ctx, repoID, objID, w)
+	}
+
+	// fs objects are small, they are buffered to be checked before written to w.
+	var buf bytes.Buffer
+	err := store.ReadCtx(ctx, repoID, objID, &buf)
 	if err != nil {
 		return err
 	}
+	if err := check(repoID, objID, buf.Bytes()); err != nil {
+		cache.load().remove(repoID, objID)
+		store.Quarantine(repoID, objID, valid(repoID, objID), err)
+		return err
+	}
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
 
+// ReadRawMulti calls fn with the binary data of every object in objIDs, in the order the
+// storage backend reads them most efficiently, e.g. the order they are stored in a pack.
+func ReadRawMulti(repoID string, objIDs []string, fn func(objID string, data []byte) error) error {
+	return store.ReadMulti(repoID, objIDs, func(objID string, data []byte) error {
+		if verify && objstore.Verifiable(objID) {
+			if err := check(repoID, objID, data); err != nil {
+				cache.load().remove(repoID, objID)
+				store.Quarantine(repoID, objID, valid(repoID, objID), err)
+				return err
+			}
+		}
+		return fn(objID, data)
+	})
+}
+
+// valid returns a function reporting whether a copy of a fs object is intact.
+func valid(repoID string, objID string) func(data []byte) bool {
+	return func(data []byte) bool {
+		return check(repoID, objID, data) == nil
+	}
+}
+
+// check returns a *objstore.ChecksumError if the stored data of a fs object doesn't match its ID.
+func check(repoID string, objID string, data []byte) error {
+	p, err := uncompress(data)
+	if err != nil {
+		return &objstore.ChecksumError{ObjType: store.ObjType, RepoID: repoID, ObjID: objID}
+	}
+	checkSum := sha1.Sum(p)
+	if sum := hex.EncodeToString(checkSum[:]); sum != objID {
+		return &objstore.ChecksumError{ObjType: store.ObjType, RepoID: repoID, ObjID: objID, Checksum: sum}
+	}
 	return nil
 }
 
 // WriteRaw writes data in binary format to storage backend.
 func WriteRaw(repoID string, objID string, r io.Reader) error {
-	err := store.Write(repoID, objID, r, false)
+	return WriteRawCtx(context.Background(), repoID, objID, r)
+}
+
+// WriteRawCtx writes data like WriteRaw, and stops once ctx is done.
+func WriteRawCtx(ctx context.Context, repoID string, objID string, r io.Reader) error {
+	err := store.WriteCtx(ctx, repoID, objID, r, false)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// GetSeafile gets seafile from storage backend.
+// WriteRawBatch writes many objects in binary format to storage backend, in one batch if the backend supports it.
+func WriteRawBatch(repoID string, objs []objstore.Object) error {
+	return store.WriteBatch(repoID, objs, false)
+}
+
+// GetSeafile gets seafile from the cache or storage backend.
+// The returned object may be modified by the caller.
 func GetSeafile(repoID string, fileID string) (*Seafile, error) {
+	return GetSeafileCtx(context.Background(), repoID, fileID)
+}
+
+// GetSeafileCtx gets seafile like GetSeafile, and stops once ctx is done.
+func GetSeafileCtx(ctx context.Context, repoID string, fileID string) (*Seafile, error) {
 	var buf bytes.Buffer
 	seafile := new(Seafile)
 	if fileID == EmptySha1 {
@@ -404,7 +485,16 @@ func GetSeafile(repoID string, fileID string) (*Seafile, error) {
 		return seafile, nil
 	}
 
-	err := ReadRaw(repoID, fileID, &buf)
+	c := cache.load()
+	if cached, ok := c.get(repoID, fileID).(*Seafile); ok {
+		fileHits.Inc()
+		return cached.copy(), nil
+	}
+	if c != nil {
+		fileMisses.Inc()
+	}
+
+	err := ReadRawCtx(ctx, repoID, fileID, &buf)
 	if err != nil {
 		errors := fmt.Errorf("failed to read seafile object from storage : %v", err)
 		return nil, errors
@@ -422,6 +512,8 @@ func GetSeafile(repoID string, fileID string) (*Seafile, error) {
 	}
 
 	seafile.FileID = fileID
+	cached := seafile.copy()
+	c.add(repoID, fileID, cached, cached.cacheSize())
 
 	return seafile, nil
 }
@@ -455,8 +547,14 @@ func SaveSeafile(repoID string, seafile *Seafile) error {
 	return nil
 }
 
-// GetSeafdir gets seafdir from storage backend.
+// GetSeafdir gets seafdir from the cache or storage backend.
+// The returned object may be modified by the caller.
 func GetSeafdir(repoID string, dirID string) (*SeafDir, error) {
+	return GetSeafdirCtx(context.Background(), repoID, dirID)
+}
+
+// GetSeafdirCtx gets seafdir like GetSeafdir, and stops once ctx is done.
+func GetSeafdirCtx(ctx context.Context, repoID string, dirID string) (*SeafDir, error) {
 	var buf bytes.Buffer
 	seafdir := new(SeafDir)
 	if dirID == EmptySha1 {
@@ -464,7 +562,16 @@ func GetSeafdir(repoID string, dirID string) (*SeafDir, error) {
 		return seafdir, nil
 	}
 
-	err := ReadRaw(repoID, dirID, &buf)
+	c := cache.load()
+	if cached, ok := c.get(repoID, dirID).(*SeafDir); ok {
+		dirHits.Inc()
+		return cached.copy(), nil
+	}
+	if c != nil {
+		dirMisses.Inc()
+	}
+
+	err := ReadRawCtx(ctx, repoID, dirID, &buf)
 	if err != nil {
 		errors := fmt.Errorf("failed to read seafdir object from storage : %v", err)
 		return nil, errors
@@ -482,6 +589,8 @@ func GetSeafdir(repoID string, dirID string) (*SeafDir, error) {
 	}
 
 	seafdir.DirID = dirID
+	cached := seafdir.copy()
+	c.add(repoID, dirID, cached, cached.cacheSize())
 
 	return seafdir, nil
 }
@@ -516,10 +625,56 @@ func SaveSeafdir(repoID string, seafdir *SeafDir) error {
 
 // Exists check if fs object is exists.
 func Exists(repoID string, objID string) (bool, error) {
+	return ExistsCtx(context.Background(), repoID, objID)
+}
+
+// ExistsCtx checks fs object like Exists, and stops once ctx is done.
+func ExistsCtx(ctx context.Context, repoID string, objID string) (bool, error) {
 	if objID == EmptySha1 {
 		return true, nil
 	}
-	return store.Exists(repoID, objID)
+	return store.ExistsCtx(ctx, repoID, objID)
+}
+
+// Verify checks whether the content of fs object matches its ID.
+// An error is returned only if the object can't be read.
+func Verify(repoID string, objID string) (bool, error) {
+	if objID == EmptySha1 {
+		return true, nil
+	}
+
+	var buf bytes.Buffer
+	err := store.Read(repoID, objID, &buf)
+	if err != nil {
+		return false, err
+	}
+
+	return check(repoID, objID, buf.Bytes()) == nil, nil
+}
+
+// Stat calculates the stored size of fs object.
+func Stat(repoID string, objID string) (int64, error) {
+	return store.Stat(repoID, objID)
+}
+
+// Remove removes fs object from the cache and storage backend.
+func Remove(repoID string, objID string) error {
+	if objID == EmptySha1 {
+		return nil
+	}
+	cache.load().remove(repoID, objID)
+	return store.Remove(repoID, objID)
+}
+
+// Repack reclaims the space of removed fs objects of a repo, if the storage backend stores
+// objects in packs. It returns the number of bytes reclaimed.
+func Repack(repoID string) (int64, error) {
+	return store.Repack(repoID)
+}
+
+// List calls fn for every fs object of a repo.
+func List(repoID string, fn func(objID string) error) error {
+	return store.List(repoID, fn)
 }
 
 func comp(c rune) bool {
@@ -536,6 +691,14 @@ func IsRegular(m uint32) bool {
 	return (m & syscall.S_IFMT) == syscall.S_IFREG
 }
 
+// IsLink check if the mode is symbolic link.
+// The dirent of a link refers to a file object whose content is the link target.
+// The file object is an ordinary file object, so links and files with the same
+// content have the same ID and only differ in the mode of dirents.
+func IsLink(m uint32) bool {
+	return (m & syscall.S_IFMT) == syscall.S_IFLNK
+}
+
 // ErrPathNoExist is an error indicating that the file does not exist
 var ErrPathNoExist = fmt.Errorf("path does not exist")
 
@@ -647,29 +810,21 @@ func GetFileCountInfoByPath(repoID, rootID, path string) (*FileCountInfo, error)
 }
 
 func getFileCountInfo(repoID, dirID string) (*FileCountInfo, error) {
-	dir, err := GetSeafdir(repoID, dirID)
-	if err != nil {
-		err := fmt.Errorf("failed to get dir: %v", err)
-		return nil, err
-	}
-
 	info := new(FileCountInfo)
-
-	entries := dir.Entries
-	for _, de := range entries {
+	err := Walk(context.Background(), repoID, dirID, func(path string, de *SeafDirent) error {
 		if IsDir(de.Mode) {
-			tmpInfo, err := getFileCountInfo(repoID, de.ID)
-			if err != nil {
-				err := fmt.Errorf("failed to get file count: %v", err)
-				return nil, err
+			if path != "/" {
+				info.DirCount++
 			}
-			info.DirCount = tmpInfo.DirCount + 1
-			info.FileCount += tmpInfo.FileCount
-			info.Size += tmpInfo.Size
 		} else {
 			info.FileCount++
 			info.Size += de.Size
 		}
+		return nil
+	}, nil)
+	if err != nil {
+		err := fmt.Errorf("failed to get file count: %v", err)
+		return nil, err
 	}
 
 	return info, nil
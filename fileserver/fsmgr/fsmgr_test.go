@@ -1,8 +1,10 @@
 package fsmgr
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -130,3 +132,42 @@ func TestGetSeafdirByPath(t *testing.T) {
 	}
 
 }
+
+func TestVerify(t *testing.T) {
+	SetVerify(true)
+	defer SetVerify(false)
+
+	var buf bytes.Buffer
+	if err := ReadRaw(repoID, fileID, &buf); err != nil {
+		t.Fatalf("Failed to read seafile : %v.\n", err)
+	}
+
+	// A copy of the file object stored under another ID is damaged.
+	damagedID := "1b5d2a5d34ebd42c06e9b1c8cb3fc1e0db4a3c2e"
+	if err := WriteRaw(repoID, damagedID, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to write object : %v.\n", err)
+	}
+	if _, err := GetSeafile(repoID, damagedID); err == nil {
+		t.Errorf("Damaged seafile is read.\n")
+	}
+	if exists, _ := Exists(repoID, damagedID); exists {
+		t.Errorf("Damaged seafile is not removed.\n")
+	}
+	quarantined := filepath.Join(seafileDataDir, "quarantine", "fs", repoID, damagedID)
+	if _, err := os.Stat(quarantined); err != nil {
+		t.Errorf("Damaged seafile is not moved to quarantine : %v.\n", err)
+	}
+}
+
+func TestGetFileCountInfo(t *testing.T) {
+	rootID := createWalkTree(t)
+
+	// Dirs with the same content are counted as many times as they appear in the tree.
+	info, err := getFileCountInfo(repoID, rootID)
+	if err != nil {
+		t.Fatalf("Failed to get file count info : %v.\n", err)
+	}
+	if info.FileCount != 5 || info.DirCount != 4 {
+		t.Errorf("Counted %d files and %d dirs, expected 5 files and 4 dirs.\n", info.FileCount, info.DirCount)
+	}
+}
@@ -0,0 +1,188 @@
+package fsmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"syscall"
+)
+
+// DefaultPrefetch is the default number of dirs read ahead by Walk.
+const DefaultPrefetch = 16
+
+// SkipDir is returned by walk callbacks to skip the entries of a dir. Returned for
+// a file, it skips the remaining entries of the dir containing the file.
+var SkipDir = errors.New("skip this dir")
+
+// WalkFunc is called by Walk for the dirents of a tree. Paths start with "/", and the
+// dirent of the root has the ID of the root and an empty name.
+type WalkFunc func(path string, dent *SeafDirent) error
+
+// WalkOptions are the options of Walk.
+type WalkOptions struct {
+	// Post is called for each dir after its entries are walked, unless it's skipped.
+	Post WalkFunc
+	// Prefetch is the maximum number of dirs read ahead in parallel, 0 means
+	// DefaultPrefetch and a negative value disables reading ahead.
+	Prefetch int
+	// Visited contains the IDs of the dirs walked, dirs in it are skipped without
+	// calling the callbacks. Walks of trees with common subtrees can share it.
+	Visited map[string]bool
+}
+
+// Walk walks the tree rootID in storeID in depth-first order, calling fn for each
+// dirent before the entries of dirs. Dirs are read ahead in parallel, but callbacks
+// are called in order from the calling goroutine.
+// Walk stops when ctx is done, or when a callback returns an error other than SkipDir.
+func Walk(ctx context.Context, storeID, rootID string, fn WalkFunc, opts *WalkOptions) error {
+	if opts == nil {
+		opts = new(WalkOptions)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := new(walker)
+	w.ctx = ctx
+	w.storeID = storeID
+	w.fn = fn
+	w.opts = opts
+	prefetch := opts.Prefetch
+	if prefetch == 0 {
+		prefetch = DefaultPrefetch
+	}
+	if prefetch > 0 {
+		w.slots = make(chan struct{}, prefetch)
+	}
+
+	root := &SeafDirent{ID: rootID, Mode: syscall.S_IFDIR}
+	err := w.walkDir("/", root, &dirFetch{w: w, dirID: rootID})
+	if err == SkipDir {
+		return nil
+	}
+	return err
+}
+
+type walker struct {
+	ctx     context.Context
+	storeID string
+	fn      WalkFunc
+	opts    *WalkOptions
+	// Each dir read ahead and not walked yet takes a slot.
+	slots chan struct{}
+}
+
+// dirFetch is a dir to be walked, which may be read ahead in the background.
+type dirFetch struct {
+	w     *walker
+	dirID string
+	// done is closed when the dir is read, it's nil if the dir isn't read ahead.
+	done     chan struct{}
+	dir      *SeafDir
+	err      error
+	released bool
+}
+
+// fetch starts reading a dir ahead if there's a free slot.
+func (w *walker) fetch(dirID string) *dirFetch {
+	f := &dirFetch{w: w, dirID: dirID}
+	select {
+	case w.slots <- struct{}{}:
+		f.done = make(chan struct{})
+		go func() {
+			f.dir, f.err = GetSeafdirCtx(w.ctx, w.storeID, dirID)
+			close(f.done)
+		}()
+	default:
+	}
+	return f
+}
+
+// wait returns the dir, which is read now if it isn't read ahead.
+func (f *dirFetch) wait() (*SeafDir, error) {
+	if f.done == nil {
+		return GetSeafdirCtx(f.w.ctx, f.w.storeID, f.dirID)
+	}
+	<-f.done
+	f.release()
+	return f.dir, f.err
+}
+
+// release frees the slot of a dir read ahead, once it's walked or skipped.
+func (f *dirFetch) release() {
+	if f != nil && f.done != nil && !f.released {
+		<-f.w.slots
+		f.released = true
+	}
+}
+
+func releaseAll(fetches []*dirFetch) {
+	for _, f := range fetches {
+		f.release()
+	}
+}
+
+func (w *walker) walkDir(p string, dent *SeafDirent, f *dirFetch) error {
+	if visited := w.opts.Visited; visited != nil {
+		if visited[dent.ID] {
+			f.release()
+			return nil
+		}
+		visited[dent.ID] = true
+	}
+
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if err := w.fn(p, dent); err != nil {
+		f.release()
+		return err
+	}
+
+	dir, err := f.wait()
+	if err != nil {
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+		err := fmt.Errorf("failed to get dir %s: %v", p, err)
+		return err
+	}
+
+	fetches := make([]*dirFetch, len(dir.Entries))
+	for i, e := range dir.Entries {
+		if IsDir(e.Mode) && !w.opts.Visited[e.ID] {
+			fetches[i] = w.fetch(e.ID)
+		}
+	}
+
+	for i, e := range dir.Entries {
+		entryPath := path.Join(p, e.Name)
+		if IsDir(e.Mode) {
+			if fetches[i] == nil {
+				fetches[i] = &dirFetch{w: w, dirID: e.ID}
+			}
+			err = w.walkDir(entryPath, e, fetches[i])
+			if err == SkipDir {
+				continue
+			}
+		} else {
+			err = w.ctx.Err()
+			if err == nil {
+				err = w.fn(entryPath, e)
+			}
+			if err == SkipDir {
+				releaseAll(fetches[i+1:])
+				break
+			}
+		}
+		if err != nil {
+			releaseAll(fetches[i+1:])
+			return err
+		}
+	}
+
+	if w.opts.Post != nil {
+		return w.opts.Post(p, dent)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package fsmgr
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func saveTestDir(t *testing.T, entries ...*SeafDirent) string {
+	seafdir, err := NewSeafdir(1, entries)
+	if err != nil {
+		t.Fatalf("Failed to new seafdir : %v\n", err)
+	}
+	if err := SaveSeafdir(repoID, seafdir); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+	return seafdir.DirID
+}
+
+// createWalkTree creates a tree in which b and c have the same content.
+func createWalkTree(t *testing.T) string {
+	leafID := saveTestDir(t,
+		&SeafDirent{ID: fileID, Name: "f1", Mode: syscall.S_IFREG | 0644},
+		&SeafDirent{ID: fileID, Name: "f2", Mode: syscall.S_IFREG | 0644},
+	)
+	aID := saveTestDir(t,
+		&SeafDirent{ID: leafID, Name: "b", Mode: syscall.S_IFDIR},
+		&SeafDirent{ID: EmptySha1, Name: "e", Mode: syscall.S_IFDIR},
+	)
+	return saveTestDir(t,
+		&SeafDirent{ID: aID, Name: "a", Mode: syscall.S_IFDIR},
+		&SeafDirent{ID: leafID, Name: "c", Mode: syscall.S_IFDIR},
+		&SeafDirent{ID: fileID, Name: "g", Mode: syscall.S_IFREG | 0644},
+	)
+}
+
+func TestWalk(t *testing.T) {
+	rootID := createWalkTree(t)
+
+	expected := []string{"/", "/a", "/a/b", "/a/b/f1", "/a/b/f2", "/a/e", "/c", "/c/f1", "/c/f2", "/g"}
+	expectedPost := []string{"/a/b", "/a/e", "/a", "/c", "/"}
+	for _, prefetch := range []int{-1, 1, 0} {
+		var paths, post []string
+		opts := &WalkOptions{Prefetch: prefetch}
+		opts.Post = func(path string, dent *SeafDirent) error {
+			post = append(post, path)
+			return nil
+		}
+		err := Walk(context.Background(), repoID, rootID, func(path string, dent *SeafDirent) error {
+			paths = append(paths, path)
+			return nil
+		}, opts)
+		if err != nil {
+			t.Fatalf("Failed to walk tree : %v\n", err)
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("Walked %v with prefetch %d, expected %v\n", paths, prefetch, expected)
+		}
+		if !reflect.DeepEqual(post, expectedPost) {
+			t.Errorf("Walked %v after entries with prefetch %d, expected %v\n", post, prefetch, expectedPost)
+		}
+	}
+}
+
+func TestWalkSkipDir(t *testing.T) {
+	rootID := createWalkTree(t)
+
+	var paths []string
+	err := Walk(context.Background(), repoID, rootID, func(path string, dent *SeafDirent) error {
+		paths = append(paths, path)
+		if path == "/a" || path == "/c/f1" {
+			return SkipDir
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to walk tree : %v\n", err)
+	}
+	expected := []string{"/", "/a", "/c", "/c/f1", "/g"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Walked %v, expected %v\n", paths, expected)
+	}
+}
+
+func TestWalkVisited(t *testing.T) {
+	rootID := createWalkTree(t)
+
+	var paths []string
+	visited := make(map[string]bool)
+	fn := func(path string, dent *SeafDirent) error {
+		paths = append(paths, path)
+		return nil
+	}
+	err := Walk(context.Background(), repoID, rootID, fn, &WalkOptions{Visited: visited})
+	if err != nil {
+		t.Fatalf("Failed to walk tree : %v\n", err)
+	}
+	expected := []string{"/", "/a", "/a/b", "/a/b/f1", "/a/b/f2", "/a/e", "/g"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Walked %v, expected %v\n", paths, expected)
+	}
+
+	// Trees walked before are skipped.
+	paths = nil
+	err = Walk(context.Background(), repoID, rootID, fn, &WalkOptions{Visited: visited})
+	if err != nil || len(paths) != 0 {
+		t.Errorf("Walked %v again : %v\n", paths, err)
+	}
+}
+
+func TestWalkCancel(t *testing.T) {
+	rootID := createWalkTree(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var paths []string
+	err := Walk(ctx, repoID, rootID, func(path string, dent *SeafDirent) error {
+		paths = append(paths, path)
+		if path == "/a/b" {
+			cancel()
+		}
+		return nil
+	}, nil)
+	if err != context.Canceled {
+		t.Errorf("Unexpected error of cancelled walk : %v\n", err)
+	}
+	if len(paths) != 3 {
+		t.Errorf("Walked %v after cancel\n", paths)
+	}
+}
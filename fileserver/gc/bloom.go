@@ -0,0 +1,70 @@
+package gc
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Bounds of the number of bits in a bloom filter.
+const (
+	minBloomBits = 1 << 13
+	// 64MB
+	maxBloomBits = 1 << 29
+	bloomHashes  = 3
+)
+
+// bloomFilter records the reachable objects of a repo.
+// The number of bits is 4 times the number of objects in the store, with 3 hash functions
+// the probability of false positive is at most (1 - e^(-3/4))^3 = 0.15. Since a bloom filter
+// has no false negative, a reachable object is never removed, while about 85% of garbage
+// objects are removed in each run.
+type bloomFilter struct {
+	bits  []uint64
+	nbits uint64
+}
+
+func newBloomFilter(nObjs int64) *bloomFilter {
+	nbits := uint64(nObjs) << 2
+	if nbits < minBloomBits {
+		nbits = minBloomBits
+	}
+	if nbits > maxBloomBits {
+		nbits = maxBloomBits
+	}
+
+	filter := new(bloomFilter)
+	filter.bits = make([]uint64, (nbits+63)/64)
+	filter.nbits = nbits
+	return filter
+}
+
+// hashID derives two hash values from an object ID. Object IDs are SHA1 hex strings already,
+// so they're used directly; other strings are hashed first.
+func hashID(id string) (uint64, uint64) {
+	sum, err := hex.DecodeString(id)
+	if err != nil || len(sum) < 16 {
+		digest := sha1.Sum([]byte(id))
+		sum = digest[:]
+	}
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16])
+}
+
+func (f *bloomFilter) add(id string) {
+	h1, h2 := hashID(id)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % f.nbits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) test(id string) bool {
+	h1, h2 := hashID(id)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % f.nbits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
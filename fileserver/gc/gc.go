@@ -0,0 +1,459 @@
+// Package gc removes blocks and fs objects that are no longer referenced by any repo.
+//
+// Objects are considered reachable if they're referenced by a commit of any branch
+// within the history limit of the repo. Since objects uploaded by clients are written
+// before the commit referencing them, GC should run while the file server isn't accepting uploads.
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+)
+
+// Options controls a GC run.
+type Options struct {
+	// Only report garbage objects without removing them.
+	DryRun  bool
+	Verbose bool
+	// Days of history kept for repos without their own history limit,
+	// negative value keeps all history.
+	DefaultKeepDays int
+}
+
+// RepoResult is the result of GC for one repo and its virtual repos.
+type RepoResult struct {
+	RepoID          string
+	TotalBlocks     int64
+	ReachableBlocks int64
+	RemovedBlocks   int64
+	TotalFSObjs     int64
+	ReachableFSObjs int64
+	RemovedFSObjs   int64
+	// Logical size of the objects removed, or can be removed in dry run mode, as
+	// reported by Stat. Less space is freed if objects are compressed or packed.
+	RemovedBytes int64
+}
+
+// Report is the result of a GC run.
+type Report struct {
+	DryRun bool
+	Repos  []*RepoResult
+	// Repos that can't be traversed, run fsck to fix them.
+	CorruptedRepos []string
+	// Repos deleted by users whose objects are removed, or can be removed in dry run mode.
+	DeletedRepos []string
+	// Logical size of all objects removed, see RepoResult.RemovedBytes.
+	RemovedBytes int64
+}
+
+// Run runs GC for repos in repoIDs. If repoIDs is empty, GC runs for all repos,
+// and the objects of repos deleted by users are removed too.
+func Run(repoIDs []string, opts *Options) (*Report, error) {
+	report := new(Report)
+	report.DryRun = opts.DryRun
+
+	delGarbage := false
+	if len(repoIDs) == 0 {
+		ids, err := repomgr.GetRepoIDList()
+		if err != nil {
+			err := fmt.Errorf("failed to get repo list: %v", err)
+			return nil, err
+		}
+		repoIDs = ids
+		delGarbage = true
+	}
+
+	for _, repoID := range repoIDs {
+		repo := repomgr.GetForCheck(repoID)
+		if repo == nil {
+			continue
+		}
+		if repo.IsCorrupted {
+			log.Printf("Repo %s is damaged, skip GC.", repoID)
+			report.CorruptedRepos = append(report.CorruptedRepos, repoID)
+			continue
+		}
+		// Virtual repos share fs and block store with their origin repos,
+		// they're collected together with the origin repos.
+		if repo.VirtualInfo != nil {
+			continue
+		}
+
+		result, err := gcRepo(repo, opts)
+		if err != nil {
+			log.Printf("Failed to run GC for repo %s: %v", repoID, err)
+			report.CorruptedRepos = append(report.CorruptedRepos, repoID)
+			continue
+		}
+		report.Repos = append(report.Repos, result)
+		report.RemovedBytes += result.RemovedBytes
+	}
+
+	if delGarbage {
+		if err := deleteGarbageRepos(report, opts); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// RunRepo runs GC for a single repo.
+func RunRepo(repoID string, opts *Options) (*RepoResult, error) {
+	repo := repomgr.GetForCheck(repoID)
+	if repo == nil {
+		err := fmt.Errorf("failed to get repo %s", repoID)
+		return nil, err
+	}
+	if repo.IsCorrupted {
+		err := fmt.Errorf("repo %s is damaged", repoID)
+		return nil, err
+	}
+	if repo.VirtualInfo != nil {
+		err := fmt.Errorf("repo %s is a virtual repo, run GC for its origin repo %s instead", repoID, repo.StoreID)
+		return nil, err
+	}
+
+	return gcRepo(repo, opts)
+}
+
+func gcRepo(repo *repomgr.Repo, opts *Options) (*RepoResult, error) {
+	result := new(RepoResult)
+	result.RepoID = repo.ID
+
+	err := blockmgr.List(repo.StoreID, func(blockID string) error {
+		result.TotalBlocks++
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to list blocks: %v", err)
+		return nil, err
+	}
+	err = fsmgr.List(repo.StoreID, func(objID string) error {
+		result.TotalFSObjs++
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to list fs objects: %v", err)
+		return nil, err
+	}
+
+	if result.TotalBlocks == 0 && result.TotalFSObjs == 0 {
+		if opts.Verbose {
+			log.Printf("No objects in repo %s, skip GC.", repo.ID)
+		}
+		return result, nil
+	}
+
+	index := newGCIndex(result.TotalBlocks, result.TotalFSObjs)
+
+	repos := []*repomgr.Repo{repo}
+	vrepoIDs, err := repomgr.GetVirtualRepoIDsByOrigin(repo.ID)
+	if err != nil {
+		err := fmt.Errorf("failed to get virtual repos: %v", err)
+		return nil, err
+	}
+	for _, vrepoID := range vrepoIDs {
+		vrepo := repomgr.GetForCheck(vrepoID)
+		if vrepo == nil {
+			err := fmt.Errorf("failed to get virtual repo %s", vrepoID)
+			return nil, err
+		}
+		repos = append(repos, vrepo)
+	}
+
+	for _, r := range repos {
+		if err := index.populate(r, opts); err != nil {
+			return nil, err
+		}
+	}
+	result.ReachableBlocks = index.traversedBlocks
+	result.ReachableFSObjs = index.traversedFSObjs
+
+	err = blockmgr.List(repo.StoreID, func(blockID string) error {
+		if index.blocks.test(blockID) {
+			return nil
+		}
+		size, err := blockmgr.Stat(repo.StoreID, blockID)
+		if err != nil {
+			log.Printf("Failed to stat block %s:%s: %v", repo.StoreID, blockID, err)
+			size = 0
+		}
+		if !opts.DryRun {
+			if err := blockmgr.Remove(repo.StoreID, blockID); err != nil {
+				log.Printf("Failed to remove block %s:%s: %v", repo.StoreID, blockID, err)
+				return nil
+			}
+		}
+		result.RemovedBlocks++
+		result.RemovedBytes += size
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to clean dead blocks: %v", err)
+		return nil, err
+	}
+
+	err = fsmgr.List(repo.StoreID, func(objID string) error {
+		if index.fsObjs.test(objID) {
+			return nil
+		}
+		size, err := fsmgr.Stat(repo.StoreID, objID)
+		if err != nil {
+			log.Printf("Failed to stat fs object %s:%s: %v", repo.StoreID, objID, err)
+			size = 0
+		}
+		if !opts.DryRun {
+			if err := fsmgr.Remove(repo.StoreID, objID); err != nil {
+				log.Printf("Failed to remove fs object %s:%s: %v", repo.StoreID, objID, err)
+				return nil
+			}
+		}
+		result.RemovedFSObjs++
+		result.RemovedBytes += size
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to clean dead fs objects: %v", err)
+		return nil, err
+	}
+
+	// Removed fs objects only take space in packs until the pack is rewritten.
+	if !opts.DryRun && result.RemovedFSObjs > 0 {
+		if _, err := fsmgr.Repack(repo.StoreID); err != nil {
+			log.Printf("Failed to repack fs objects of repo %s: %v", repo.StoreID, err)
+		}
+	}
+
+	if opts.Verbose {
+		log.Printf("GC finished for repo %s. %d blocks total, about %d reachable blocks, %d blocks removed. "+
+			"%d fs objects total, %d fs objects removed.",
+			repo.ID, result.TotalBlocks, result.ReachableBlocks, result.RemovedBlocks,
+			result.TotalFSObjs, result.RemovedFSObjs)
+	}
+
+	return result, nil
+}
+
+// gcIndex records the objects reachable from the commits of a repo and its virtual repos.
+type gcIndex struct {
+	blocks *bloomFilter
+	fsObjs *bloomFilter
+	// fs objects that have been traversed, so that shared subtrees are only traversed once.
+	visited         map[string]bool
+	traversedBlocks int64
+	traversedFSObjs int64
+}
+
+func newGCIndex(nBlocks int64, nFSObjs int64) *gcIndex {
+	index := new(gcIndex)
+	index.blocks = newBloomFilter(nBlocks)
+	index.fsObjs = newBloomFilter(nFSObjs)
+	index.visited = make(map[string]bool)
+	return index
+}
+
+func (index *gcIndex) populate(repo *repomgr.Repo, opts *Options) error {
+	if opts.Verbose {
+		log.Printf("Populating index for repo %s.", repo.ID)
+	}
+
+	branches, err := repomgr.GetBranchList(repo.ID)
+	if err != nil {
+		err := fmt.Errorf("failed to get branch list of repo %s: %v", repo.ID, err)
+		return err
+	}
+	if len(branches) == 0 {
+		err := fmt.Errorf("repo %s has no branch", repo.ID)
+		return err
+	}
+
+	truncateTime, err := repomgr.GetRepoTruncateTime(repo.ID, opts.DefaultKeepDays)
+	if err != nil {
+		err := fmt.Errorf("failed to get truncate time of repo %s: %v", repo.ID, err)
+		return err
+	}
+	if !opts.DryRun {
+		if truncateTime > 0 {
+			if err := repomgr.SetRepoValidSince(repo.ID, truncateTime); err != nil {
+				err := fmt.Errorf("failed to set valid since of repo %s: %v", repo.ID, err)
+				return err
+			}
+		} else if truncateTime == 0 {
+			// Only the head commit is valid after GC if no history is kept.
+			head, err := commitmgr.Load(repo.ID, repo.HeadCommitID)
+			if err == nil {
+				if err := repomgr.SetRepoValidSince(repo.ID, head.Ctime); err != nil {
+					err := fmt.Errorf("failed to set valid since of repo %s: %v", repo.ID, err)
+					return err
+				}
+			}
+		}
+	}
+
+	traversedHead := false
+	traverseCommit := func(commit *commitmgr.Commit) error {
+		skipParents := false
+		if truncateTime == 0 {
+			// Stop after traversing the head commit.
+			skipParents = true
+		} else if truncateTime > 0 && commit.Ctime < truncateTime && traversedHead {
+			// Still traverse the first commit older than truncate time.
+			// If a file in the child commit of this commit is deleted,
+			// we need to access this commit in order to restore it from trash.
+			skipParents = true
+		}
+		traversedHead = true
+
+		if opts.Verbose {
+			log.Printf("Traversing commit %.8s.", commit.CommitID)
+		}
+
+		if err := index.traverseDir(repo.StoreID, commit.RootID); err != nil {
+			return err
+		}
+
+		if skipParents {
+			return commitmgr.SkipParents
+		}
+		return nil
+	}
+
+	for _, branch := range branches {
+		err := commitmgr.TraverseCommitTree(repo.ID, branch.CommitID, traverseCommit)
+		if err != nil {
+			err := fmt.Errorf("failed to traverse branch %s of repo %s: %v", branch.Name, repo.ID, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (index *gcIndex) traverseDir(storeID string, dirID string) error {
+	opts := &fsmgr.WalkOptions{Visited: index.visited}
+	err := fsmgr.Walk(context.Background(), storeID, dirID, func(path string, dent *fsmgr.SeafDirent) error {
+		if fsmgr.IsDir(dent.Mode) {
+			index.fsObjs.add(dent.ID)
+			index.traversedFSObjs++
+			return nil
+		}
+		return index.addFile(storeID, dent.ID)
+	}, opts)
+	if err != nil {
+		err := fmt.Errorf("failed to traverse dir %s:%s: %v", storeID, dirID, err)
+		return err
+	}
+
+	return nil
+}
+
+func (index *gcIndex) addFile(storeID string, fileID string) error {
+	if index.visited[fileID] {
+		return nil
+	}
+	index.visited[fileID] = true
+	index.fsObjs.add(fileID)
+	index.traversedFSObjs++
+
+	file, err := fsmgr.GetSeafile(storeID, fileID)
+	if err != nil {
+		err := fmt.Errorf("failed to get file %s:%s: %v", storeID, fileID, err)
+		return err
+	}
+
+	for _, blkID := range file.BlkIDs {
+		index.blocks.add(blkID)
+		index.traversedBlocks++
+	}
+
+	return nil
+}
+
+func deleteGarbageRepos(report *Report, opts *Options) error {
+	repoIDs, err := repomgr.ListGarbageRepos()
+	if err != nil {
+		err := fmt.Errorf("failed to list garbage repos: %v", err)
+		return err
+	}
+
+	for _, repoID := range repoIDs {
+		// Confirm repo doesn't exist before removing objects.
+		exists, err := repomgr.Exists(repoID)
+		if err != nil {
+			log.Printf("Failed to check whether repo %s exists: %v", repoID, err)
+			continue
+		}
+		if !exists {
+			size, err := removeStore(repoID, opts.DryRun)
+			if err != nil {
+				log.Printf("Failed to remove objects of deleted repo %s: %v", repoID, err)
+				continue
+			}
+			report.DeletedRepos = append(report.DeletedRepos, repoID)
+			report.RemovedBytes += size
+		}
+
+		if !opts.DryRun {
+			if err := repomgr.RemoveGarbageRepo(repoID); err != nil {
+				log.Printf("Failed to remove garbage repo %s: %v", repoID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeStore removes all commits, fs objects and blocks of a repo, and returns the bytes reclaimed.
+func removeStore(repoID string, dryRun bool) (int64, error) {
+	var total int64
+
+	err := commitmgr.List(repoID, func(commitID string) error {
+		if !dryRun {
+			return commitmgr.Remove(repoID, commitID)
+		}
+		return nil
+	})
+	if err != nil {
+		return total, err
+	}
+
+	err = fsmgr.List(repoID, func(objID string) error {
+		if size, err := fsmgr.Stat(repoID, objID); err == nil {
+			total += size
+		}
+		if !dryRun {
+			return fsmgr.Remove(repoID, objID)
+		}
+		return nil
+	})
+	if err != nil {
+		return total, err
+	}
+	if !dryRun {
+		if _, err := fsmgr.Repack(repoID); err != nil {
+			return total, err
+		}
+	}
+
+	err = blockmgr.List(repoID, func(blockID string) error {
+		if size, err := blockmgr.Stat(repoID, blockID); err == nil {
+			total += size
+		}
+		if !dryRun {
+			return blockmgr.Remove(repoID, blockID)
+		}
+		return nil
+	})
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,186 @@
+package gc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	"github.com/haiwen/seafile-server/fileserver/repotest"
+)
+
+const (
+	repoID        = "b1f2ad61-9164-418a-a47f-ab805dbd5694"
+	deletedRepoID = "1c3ec28d-08bd-4cab-8cd5-3a3b7a6d2df0"
+)
+
+var env *repotest.Env
+
+func TestMain(m *testing.M) {
+	var err error
+	env, err = repotest.Setup("gc-test")
+	if err != nil {
+		fmt.Printf("Failed to set up test repos : %v\n", err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	env.Close()
+	os.Exit(code)
+}
+
+func fileDirent(name string, fileID string) *fsmgr.SeafDirent {
+	return fsmgr.NewDirent(fileID, name, syscall.S_IFREG|0644, time.Now().Unix(), "", 0)
+}
+
+type testObjects struct {
+	oldBlock, sharedBlock, newBlock, garbageBlock string
+	oldFile, newFile, garbageFile                 string
+	oldRoot, newRoot                              string
+}
+
+// createRepo creates a repo with two commits, the first one references oldBlock and sharedBlock,
+// the head references sharedBlock and newBlock. garbageBlock and garbageFile aren't referenced.
+func createRepo(t *testing.T) *testObjects {
+	env.Reset(t)
+
+	objs := new(testObjects)
+	objs.oldBlock = repotest.WriteBlock(t, repoID, "old block")
+	objs.sharedBlock = repotest.WriteBlock(t, repoID, "shared block")
+	objs.newBlock = repotest.WriteBlock(t, repoID, "new block")
+	objs.garbageBlock = repotest.WriteBlock(t, repoID, "garbage block")
+
+	objs.oldFile = repotest.WriteFile(t, repoID, 2, objs.oldBlock, objs.sharedBlock)
+	objs.newFile = repotest.WriteFile(t, repoID, 2, objs.sharedBlock, objs.newBlock)
+	objs.garbageFile = repotest.WriteFile(t, repoID, 1, objs.garbageBlock)
+
+	objs.oldRoot = repotest.WriteDir(t, repoID, fileDirent("a.txt", objs.oldFile))
+	objs.newRoot = repotest.WriteDir(t, repoID, fileDirent("a.txt", objs.newFile))
+
+	now := time.Now().Unix()
+	oldCommit := repotest.WriteCommit(t, repoID, objs.oldRoot, "", now-10*24*3600)
+	headCommit := repotest.WriteCommit(t, repoID, objs.newRoot, oldCommit, now)
+	env.AddRepo(t, repoID, headCommit)
+
+	return objs
+}
+
+func setHistoryLimit(t *testing.T, days int) {
+	if _, err := env.DB.Exec("INSERT INTO RepoHistoryLimit (repo_id, days) VALUES (?, ?)", repoID, days); err != nil {
+		t.Fatalf("Failed to set history limit : %v\n", err)
+	}
+}
+
+func TestGCDryRun(t *testing.T) {
+	objs := createRepo(t)
+
+	result, err := RunRepo(repoID, &Options{DryRun: true, DefaultKeepDays: -1})
+	if err != nil {
+		t.Fatalf("Failed to run gc : %v\n", err)
+	}
+	if result.TotalBlocks != 4 || result.RemovedBlocks != 1 || result.RemovedFSObjs != 1 {
+		t.Errorf("Unexpected dry run result %+v\n", result)
+	}
+	if result.RemovedBytes == 0 {
+		t.Errorf("Dry run doesn't report reclaimable bytes\n")
+	}
+	if !blockmgr.Exists(repoID, objs.garbageBlock) {
+		t.Errorf("Dry run removed garbage block\n")
+	}
+}
+
+func TestGCKeepAllHistory(t *testing.T) {
+	objs := createRepo(t)
+
+	result, err := RunRepo(repoID, &Options{DefaultKeepDays: -1})
+	if err != nil {
+		t.Fatalf("Failed to run gc : %v\n", err)
+	}
+	if result.RemovedBlocks != 1 || result.RemovedFSObjs != 1 {
+		t.Errorf("Unexpected gc result %+v\n", result)
+	}
+
+	if blockmgr.Exists(repoID, objs.garbageBlock) {
+		t.Errorf("Garbage block is not removed\n")
+	}
+	if exists, _ := fsmgr.Exists(repoID, objs.garbageFile); exists {
+		t.Errorf("Garbage file is not removed\n")
+	}
+	for _, blkID := range []string{objs.oldBlock, objs.sharedBlock, objs.newBlock} {
+		if !blockmgr.Exists(repoID, blkID) {
+			t.Errorf("Reachable block %s is removed\n", blkID)
+		}
+	}
+}
+
+func TestGCHistoryLimit(t *testing.T) {
+	objs := createRepo(t)
+	setHistoryLimit(t, 0)
+
+	_, err := RunRepo(repoID, &Options{DefaultKeepDays: -1})
+	if err != nil {
+		t.Fatalf("Failed to run gc : %v\n", err)
+	}
+
+	if blockmgr.Exists(repoID, objs.oldBlock) {
+		t.Errorf("Block only referenced by history is not removed\n")
+	}
+	if exists, _ := fsmgr.Exists(repoID, objs.oldRoot); exists {
+		t.Errorf("Dir only referenced by history is not removed\n")
+	}
+	for _, blkID := range []string{objs.sharedBlock, objs.newBlock} {
+		if !blockmgr.Exists(repoID, blkID) {
+			t.Errorf("Block referenced by head commit %s is removed\n", blkID)
+		}
+	}
+
+	validSince, err := repomgr.GetRepoValidSince(repoID)
+	if err != nil || validSince <= 0 {
+		t.Errorf("Valid since is not set after gc : %v\n", err)
+	}
+}
+
+func TestGCDeletedRepo(t *testing.T) {
+	createRepo(t)
+	blkID := repotest.WriteBlock(t, deletedRepoID, "block of deleted repo")
+	if _, err := env.DB.Exec("INSERT INTO GarbageRepos (repo_id) VALUES (?)", deletedRepoID); err != nil {
+		t.Fatalf("Failed to insert garbage repo : %v\n", err)
+	}
+
+	report, err := Run(nil, &Options{DefaultKeepDays: -1})
+	if err != nil {
+		t.Fatalf("Failed to run gc : %v\n", err)
+	}
+	if len(report.DeletedRepos) != 1 || report.DeletedRepos[0] != deletedRepoID {
+		t.Errorf("Deleted repo is not collected : %v\n", report.DeletedRepos)
+	}
+	if blockmgr.Exists(deletedRepoID, blkID) {
+		t.Errorf("Block of deleted repo is not removed\n")
+	}
+	garbage, _ := repomgr.ListGarbageRepos()
+	if len(garbage) != 0 {
+		t.Errorf("Garbage repo list is not cleaned : %v\n", garbage)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(100)
+	var ids []string
+	for i := 0; i < 100; i++ {
+		checkSum := sha1.Sum([]byte(fmt.Sprintf("object %d", i)))
+		id := hex.EncodeToString(checkSum[:])
+		filter.add(id)
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if !filter.test(id) {
+			t.Errorf("Added object %s is not in bloom filter\n", id)
+		}
+	}
+}
@@ -1,12 +1,28 @@
 module github.com/haiwen/seafile-server/fileserver
 
-go 1.14
+go 1.17
 
 require (
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/mux v1.7.4
+	github.com/klauspost/compress v1.11.13
 	github.com/mattn/go-sqlite3 v1.14.0
-	github.com/smartystreets/goconvey v1.6.4 // indirect
+	github.com/prometheus/client_golang v1.12.2
+	golang.org/x/crypto v0.11.0
+	golang.org/x/net v0.11.0
 	gopkg.in/ini.v1 v1.55.0
 )
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	github.com/smartystreets/goconvey v1.6.4 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
+)
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/diff"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// historyCommit is a commit in the history returned to clients, without the key
+// info of encrypted repos.
+type historyCommit struct {
+	CommitID       string `json:"commit_id"`
+	RootID         string `json:"root_id"`
+	ParentID       string `json:"parent_id,omitempty"`
+	SecondParentID string `json:"second_parent_id,omitempty"`
+	CreatorName    string `json:"creator_name,omitempty"`
+	CreatorID      string `json:"creator"`
+	Desc           string `json:"description"`
+	Ctime          int64  `json:"ctime"`
+	DeviceName     string `json:"device_name,omitempty"`
+}
+
+type historyPage struct {
+	Commits    []*historyCommit `json:"commits"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// parseHistoryOptions parses the since, until, limit, cursor and max-depth parameters.
+func parseHistoryOptions(queries url.Values) (*commitmgr.HistoryOptions, *appError) {
+	opts := new(commitmgr.HistoryOptions)
+	opts.Limit = defaultHistoryLimit
+
+	ints := []struct {
+		name string
+		val  *int64
+	}{
+		{"since", &opts.Since},
+		{"until", &opts.Until},
+	}
+	for _, arg := range ints {
+		if s := queries.Get(arg.name); s != "" {
+			val, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || val < 0 {
+				msg := fmt.Sprintf("Invalid %s parameter.", arg.name)
+				return nil, &appError{nil, msg, http.StatusBadRequest}
+			}
+			*arg.val = val
+		}
+	}
+
+	if s := queries.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			msg := "Invalid limit parameter."
+			return nil, &appError{nil, msg, http.StatusBadRequest}
+		}
+		opts.Limit = limit
+	}
+	if s := queries.Get("max-depth"); s != "" {
+		depth, err := strconv.Atoi(s)
+		if err != nil || depth < 0 {
+			msg := "Invalid max-depth parameter."
+			return nil, &appError{nil, msg, http.StatusBadRequest}
+		}
+		opts.MaxDepth = depth
+	}
+
+	opts.Cursor = queries.Get("cursor")
+	if opts.Cursor != "" && !isObjectIDValid(opts.Cursor) {
+		msg := "Invalid cursor parameter."
+		return nil, &appError{nil, msg, http.StatusBadRequest}
+	}
+
+	return opts, nil
+}
+
+func getHistoryCB(rsp http.ResponseWriter, r *http.Request) *appError {
+	queries := r.URL.Query()
+	opts, appErr := parseHistoryOptions(queries)
+	if appErr != nil {
+		return appErr
+	}
+
+	vars := mux.Vars(r)
+	repoID := vars["repoid"]
+	user, appErr := validateToken(r, repoID, false)
+	if appErr != nil {
+		return appErr
+	}
+	appErr = checkPermission(repoID, user, "download", false)
+	if appErr != nil {
+		return appErr
+	}
+	repo := repomgr.Get(repoID)
+	if repo == nil {
+		err := fmt.Errorf("Failed to find repo %.8s", repoID)
+		return &appError{err, "", http.StatusInternalServerError}
+	}
+
+	ctx := r.Context()
+	filePath := filepath.Join("/", queries.Get("path"))
+	if filePath != "/" {
+		opts.Filter = func(commit *commitmgr.Commit) (bool, error) {
+			return diff.CommitTouchesPath(ctx, commit, filePath)
+		}
+	}
+
+	commits, cursor, err := commitmgr.History(repo.ID, repo.HeadCommitID, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == commitmgr.ErrCursorNotFound {
+			msg := "Invalid cursor parameter."
+			return &appError{nil, msg, http.StatusBadRequest}
+		}
+		err := fmt.Errorf("Failed to get history of repo %.8s path %s: %v", repoID, filePath, err)
+		return &appError{err, "", http.StatusInternalServerError}
+	}
+
+	page := historyPage{Commits: []*historyCommit{}, NextCursor: cursor}
+	for _, commit := range commits {
+		c := new(historyCommit)
+		c.CommitID = commit.CommitID
+		c.RootID = commit.RootID
+		c.ParentID = commit.ParentID.String
+		c.SecondParentID = commit.SecondParentID.String
+		c.CreatorName = commit.CreatorName
+		c.CreatorID = commit.CreatorID
+		c.Desc = commit.Desc
+		c.Ctime = commit.Ctime
+		c.DeviceName = commit.DeviceName
+		page.Commits = append(page.Commits, c)
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return &appError{err, "", http.StatusInternalServerError}
+	}
+	rsp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rsp.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(data)
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseHistoryOptions(t *testing.T) {
+	queries, _ := url.ParseQuery("since=100&until=200&limit=10&max-depth=3&cursor=0401fc662e3bc87a41f299a907c056aaf8322a27")
+	opts, appErr := parseHistoryOptions(queries)
+	if appErr != nil {
+		t.Fatalf("Failed to parse history options : %v\n", appErr.Message)
+	}
+	if opts.Since != 100 || opts.Until != 200 || opts.Limit != 10 || opts.MaxDepth != 3 ||
+		opts.Cursor != "0401fc662e3bc87a41f299a907c056aaf8322a27" {
+		t.Errorf("Unexpected history options %+v\n", opts)
+	}
+
+	opts, appErr = parseHistoryOptions(url.Values{})
+	if appErr != nil || opts.Limit != defaultHistoryLimit {
+		t.Errorf("Unexpected default history options %+v\n", opts)
+	}
+
+	for _, query := range []string{"since=-1", "until=x", "limit=0", "limit=1001", "max-depth=-1", "cursor=HEAD"} {
+		queries, _ := url.ParseQuery(query)
+		if _, appErr := parseHistoryOptions(queries); appErr == nil {
+			t.Errorf("Invalid history options %s are accepted\n", query)
+		}
+	}
+}
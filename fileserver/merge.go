@@ -148,11 +148,11 @@ func mergeEntries(storeID string, dents []*fsmgr.SeafDirent, baseDir string, opt
 	remote := files[2]
 
 	if head != nil && remote != nil {
-		if head.ID == remote.ID {
+		if sameFile(head, remote) {
 			mergedDents = append(mergedDents, head)
-		} else if base != nil && base.ID == head.ID {
+		} else if base != nil && sameFile(base, head) {
 			mergedDents = append(mergedDents, remote)
-		} else if base != nil && base.ID == remote.ID {
+		} else if base != nil && sameFile(base, remote) {
 			mergedDents = append(mergedDents, head)
 		} else {
 			conflictName, _ := mergeConflictFileName(storeID, opt, baseDir, head.Name)
@@ -165,7 +165,7 @@ func mergeEntries(storeID string, dents []*fsmgr.SeafDirent, baseDir string, opt
 			opt.conflict = true
 		}
 	} else if base != nil && head == nil && remote != nil {
-		if base.ID != remote.ID {
+		if !sameFile(base, remote) {
 			if dents[1] != nil {
 				conflictName, _ := mergeConflictFileName(storeID, opt, baseDir, remote.Name)
 				if conflictName == "" {
@@ -180,7 +180,7 @@ func mergeEntries(storeID string, dents []*fsmgr.SeafDirent, baseDir string, opt
 			}
 		}
 	} else if base != nil && head != nil && remote == nil {
-		if base.ID != head.ID {
+		if !sameFile(base, head) {
 			if dents[2] != nil {
 				conflictName, _ := mergeConflictFileName(storeID, opt, baseDir, dents[2].Name)
 				if conflictName == "" {
@@ -197,7 +197,7 @@ func mergeEntries(storeID string, dents []*fsmgr.SeafDirent, baseDir string, opt
 	} else if base == nil && head == nil && remote != nil {
 		if dents[1] == nil {
 			mergedDents = append(mergedDents, remote)
-		} else if dents[0] != nil && dents[0].ID == dents[1].ID {
+		} else if dents[0] != nil && sameFile(dents[0], dents[1]) {
 			mergedDents = append(mergedDents, remote)
 		} else {
 			conflictName, _ := mergeConflictFileName(storeID, opt, baseDir, remote.Name)
@@ -212,7 +212,7 @@ func mergeEntries(storeID string, dents []*fsmgr.SeafDirent, baseDir string, opt
 	} else if base == nil && head != nil && remote == nil {
 		if dents[2] == nil {
 			mergedDents = append(mergedDents, head)
-		} else if dents[0] != nil && dents[0].ID == dents[2].ID {
+		} else if dents[0] != nil && sameFile(dents[0], dents[2]) {
 			mergedDents = append(mergedDents, head)
 		} else {
 			conflictName, _ := mergeConflictFileName(storeID, opt, baseDir, dents[2].Name)
@@ -230,6 +230,12 @@ func mergeEntries(storeID string, dents []*fsmgr.SeafDirent, baseDir string, opt
 	return mergedDents, nil
 }
 
+// sameFile returns whether two file dirents have the same content and type.
+// Links and files with the same content have the same ID, but they're different entries.
+func sameFile(a, b *fsmgr.SeafDirent) bool {
+	return a.ID == b.ID && fsmgr.IsLink(a.Mode) == fsmgr.IsLink(b.Mode)
+}
+
 func mergeDirectories(storeID string, dents []*fsmgr.SeafDirent, baseDir string, opt *mergeOptions) ([]*fsmgr.SeafDirent, error) {
 	var dirMask int
 	var mergedDents []*fsmgr.SeafDirent
@@ -232,6 +232,7 @@ func TestMergeTrees(t *testing.T) {
 	t.Run("test10", testMergeTrees10)
 	t.Run("test11", testMergeTrees11)
 	t.Run("test12", testMergeTrees12)
+	t.Run("test13", testMergeTrees13)
 
 	err = mergeTestDelFile()
 	if err != nil {
@@ -483,3 +484,30 @@ func testMergeTrees12(t *testing.T) {
 		t.Errorf("merge error %s/%s.\n", opt.mergedRoot, mergeTestTree1)
 	}
 }
+
+// head replace file with link of the same content and remote delete the file
+func testMergeTrees13(t *testing.T) {
+	fileDent := fsmgr.NewDirent(mergeTestCommitID, "testfile", syscall.S_IFREG|0644, 1, "", 1)
+	base, err := mergeTestCreateSeafdir([]*fsmgr.SeafDirent{fileDent})
+	if err != nil {
+		t.Fatalf("failed to create seafdir: %v\n", err)
+	}
+	linkDent := fsmgr.NewDirent(mergeTestCommitID, "testfile", syscall.S_IFLNK|0777, 2, "", 1)
+	head, err := mergeTestCreateSeafdir([]*fsmgr.SeafDirent{linkDent})
+	if err != nil {
+		t.Fatalf("failed to create seafdir: %v\n", err)
+	}
+
+	roots := []string{base, head, mergeTestTree5}
+	opt := new(mergeOptions)
+	opt.remoteRepoID = mergeTestRepoID
+	opt.remoteHead = mergeTestTree3CommitID
+
+	err = mergeTrees(mergeTestRepoID, roots, opt)
+	if err != nil {
+		t.Errorf("failed to merge.\n")
+	}
+	if opt.mergedRoot != head {
+		t.Errorf("merge error %s/%s.\n", opt.mergedRoot, head)
+	}
+}
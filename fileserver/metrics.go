@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_http_requests_total",
+		Help: "Number of http requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "seafile_http_request_duration_seconds",
+		Help: "Time spent serving http requests by route and method.",
+	}, []string{"route", "method"})
+	transferBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_transfer_bytes_total",
+		Help: "Number of uploaded and downloaded bytes by operation.",
+	}, []string{"operation"})
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_cache_requests_total",
+		Help: "Number of cache lookups by cache and result.",
+	}, []string{"cache", "result"})
+)
+
+func recordCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+func metricsInit() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "seafile_worker_pool_pending_jobs",
+		Help:        "Number of jobs waiting for a worker.",
+		ConstLabels: prometheus.Labels{"pool": "update-size"},
+	}, func() float64 { return float64(updateSizePool.Pending()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "seafile_worker_pool_pending_jobs",
+		Help:        "Number of jobs waiting for a worker.",
+		ConstLabels: prometheus.Labels{"pool": "merge-virtual-repo"},
+	}, func() float64 { return float64(mergeVirtualRepoPool.Pending()) })
+
+	if options.metricsAddr != "" {
+		go serveMetrics(options.metricsAddr)
+	}
+}
+
+// serveMetrics serves the metrics under /metrics on addr, which shouldn't be reachable from
+// the public network since the metrics are not authenticated.
+func serveMetrics(addr string) {
+	handler := http.NewServeMux()
+	handler.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Printf("Failed to serve metrics on %s: %v", addr, err)
+	}
+}
+
+// metricsMiddleware records the number and the latency of requests to each route.
+// The response writer passed to next implements the same optional interfaces, like
+// http.Hijacker and io.ReaderFrom, as the one of the server.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rsp http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route = routeLabel(tpl)
+			}
+		}
+
+		labels := prometheus.Labels{"route": route}
+		handler := promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), next)
+		handler = promhttp.InstrumentHandlerDuration(httpRequestSeconds.MustCurryWith(labels), handler)
+		handler.ServeHTTP(rsp, r)
+	})
+}
+
+// routeLabel removes the patterns of variables from a route template, so that
+// "/repo/{repoid:[\\da-z]{8}-...}/commit/HEAD{slash:\\/?}" becomes "/repo/{repoid}/commit/HEAD{slash}".
+func routeLabel(tpl string) string {
+	var b strings.Builder
+	depth := 0
+	inPattern := false
+	for _, c := range tpl {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				inPattern = false
+			}
+		case ':':
+			if depth == 1 {
+				inPattern = true
+				continue
+			}
+		}
+		if !inPattern {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
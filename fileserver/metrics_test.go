@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRouteLabel(t *testing.T) {
+	cases := map[string]string{
+		"/files/{.*}/{.*}": "/files/{.*}/{.*}",
+		"/repo/{repoid:[\\da-z]{8}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{4}-[\\da-z]{12}}/commit/HEAD{slash:\\/?}": "/repo/{repoid}/commit/HEAD{slash}",
+		"/upload-tus/{token}/{id}": "/upload-tus/{token}/{id}",
+	}
+	for tpl, want := range cases {
+		if got := routeLabel(tpl); got != want {
+			t.Errorf("Label of %s is %s, want %s\n", tpl, got, want)
+		}
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/metrics-test/{id:[0-9]+}", func(rsp http.ResponseWriter, r *http.Request) {
+		if _, ok := rsp.(http.Hijacker); !ok {
+			t.Errorf("Response writer doesn't implement http.Hijacker\n")
+		}
+		if _, ok := rsp.(io.ReaderFrom); !ok {
+			t.Errorf("Response writer doesn't implement io.ReaderFrom\n")
+		}
+		rsp.WriteHeader(http.StatusNotFound)
+	})
+	router.Use(metricsMiddleware)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	requests := httpRequests.WithLabelValues("/metrics-test/{id}", "get", "404")
+	count := testutil.ToFloat64(requests)
+	rsp, err := http.Get(server.URL + "/metrics-test/1")
+	if err != nil {
+		t.Fatalf("Failed to send request : %v\n", err)
+	}
+	rsp.Body.Close()
+
+	if testutil.ToFloat64(requests) != count+1 {
+		t.Errorf("Request is not counted\n")
+	}
+}
@@ -0,0 +1,489 @@
+// Package migrate copies commits, fs objects and blocks from one object store configuration to another.
+//
+// A full pass lists all objects in the source and copies the ones missing in the destination,
+// so an interrupted migration can be resumed by running it again. Commits are copied before
+// fs objects, and fs objects before blocks. Since objects are written before the objects
+// referencing them, every object referenced by a copied commit exists in the destination
+// once a full pass is finished, even if the file server keeps writing during the pass.
+//
+// An incremental pass relies on this to only copy the objects of the commits created after
+// the last pass. It walks the history from the branch heads and stops at commits that exist
+// in the destination. Objects of new commits are copied before the objects referencing them,
+// so it can be interrupted too. An incremental pass must follow a finished full pass.
+package migrate
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/objstore"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+)
+
+// Object types in the order they're copied by a full pass.
+var objTypes = []string{"commits", "fs", "blocks"}
+
+// Stores are the object stores of all object types of a configuration.
+type Stores map[string]*objstore.ObjectStore
+
+// NewStores creates the object stores configured by seafile.conf in seafileConfPath.
+func NewStores(seafileConfPath string, seafileDataDir string) (Stores, error) {
+	stores := make(Stores)
+	for _, objType := range objTypes {
+		s, err := objstore.New(seafileConfPath, seafileDataDir, objType)
+		if err != nil {
+			return nil, err
+		}
+		stores[objType] = s
+	}
+	return stores, nil
+}
+
+// Options controls a migration.
+type Options struct {
+	// Number of objects copied concurrently.
+	Workers int
+	// Only copy objects of commits that don't exist in the destination.
+	Incremental bool
+	Verbose     bool
+}
+
+// Counts are the numbers of objects of one type handled by a migration.
+type Counts struct {
+	Copied int64
+	// Objects that already exist in the destination.
+	Skipped int64
+	Failed  int64
+	// Bytes of copied objects.
+	Bytes int64
+}
+
+// Report is the result of a migration.
+type Report struct {
+	Commits Counts
+	FS      Counts
+	Blocks  Counts
+	// Objects whose content doesn't match their IDs in the source, as "type/repo_id/obj_id".
+	// They're copied as is.
+	Corrupted []string
+	// Repos that can't be migrated incrementally.
+	FailedRepos []string
+}
+
+func (r *Report) counts(objType string) *Counts {
+	switch objType {
+	case "commits":
+		return &r.Commits
+	case "fs":
+		return &r.FS
+	}
+	return &r.Blocks
+}
+
+// Failed returns the number of objects that failed to be copied.
+func (r *Report) Failed() int64 {
+	return r.Commits.Failed + r.FS.Failed + r.Blocks.Failed + int64(len(r.FailedRepos))
+}
+
+type job struct {
+	objType string
+	repoID  string
+	objID   string
+}
+
+type migrator struct {
+	src    Stores
+	dst    Stores
+	opts   *Options
+	report *Report
+
+	lock    sync.Mutex
+	jobs    chan job
+	pending sync.WaitGroup
+}
+
+// Run copies the objects of repos in repoIDs from src to dst. If repoIDs is empty,
+// a full pass copies all objects in src, including objects of deleted repos,
+// and an incremental pass copies the objects of all repos.
+func Run(src, dst Stores, repoIDs []string, opts *Options) (*Report, error) {
+	m := new(migrator)
+	m.src = src
+	m.dst = dst
+	m.opts = opts
+	m.report = new(Report)
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	m.jobs = make(chan job, workers)
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	defer close(m.jobs)
+
+	var err error
+	if opts.Incremental {
+		err = m.runIncremental(repoIDs)
+	} else {
+		err = m.runFull(repoIDs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.report, nil
+}
+
+func (m *migrator) worker() {
+	for j := range m.jobs {
+		m.copy(j)
+		m.pending.Done()
+	}
+}
+
+func (m *migrator) submit(objType, repoID, objID string) {
+	m.pending.Add(1)
+	m.jobs <- job{objType, repoID, objID}
+}
+
+// wait waits until all submitted objects are copied.
+func (m *migrator) wait() {
+	m.pending.Wait()
+}
+
+func (m *migrator) failed() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.report.Commits.Failed + m.report.FS.Failed + m.report.Blocks.Failed
+}
+
+func (m *migrator) runFull(repoIDs []string) error {
+	// Commits are stored by repo ID, fs objects and blocks by store ID.
+	stores := make(map[string][]string)
+	if len(repoIDs) == 0 {
+		for _, objType := range objTypes {
+			err := m.src[objType].ListRepos(func(repoID string) error {
+				stores[objType] = append(stores[objType], repoID)
+				return nil
+			})
+			if err != nil {
+				err := fmt.Errorf("failed to list repos of %s objects: %v", objType, err)
+				return err
+			}
+		}
+	} else {
+		for _, repoID := range repoIDs {
+			storeID := repoID
+			if repo := repomgr.Get(repoID); repo != nil {
+				storeID = repo.StoreID
+			}
+			stores["commits"] = append(stores["commits"], repoID)
+			// Virtual repos store their commits by their own IDs.
+			vRepoIDs, err := repomgr.GetVirtualRepoIDsByOrigin(repoID)
+			if err != nil {
+				err := fmt.Errorf("failed to get virtual repos of repo %s: %v", repoID, err)
+				return err
+			}
+			for _, vRepoID := range vRepoIDs {
+				if vRepoID != repoID {
+					stores["commits"] = append(stores["commits"], vRepoID)
+				}
+			}
+			stores["fs"] = append(stores["fs"], storeID)
+			stores["blocks"] = append(stores["blocks"], storeID)
+		}
+	}
+
+	for _, objType := range objTypes {
+		for _, repoID := range stores[objType] {
+			if m.opts.Verbose {
+				log.Printf("Copying %s objects of repo %s", objType, repoID)
+			}
+			err := m.src[objType].List(repoID, func(objID string) error {
+				m.submit(objType, repoID, objID)
+				return nil
+			})
+			if err != nil {
+				m.wait()
+				err := fmt.Errorf("failed to list %s objects of repo %s: %v", objType, repoID, err)
+				return err
+			}
+		}
+		m.wait()
+	}
+	return nil
+}
+
+// copy copies an object if it doesn't exist in the destination, and verifies the copy.
+func (m *migrator) copy(j job) {
+	counts := m.report.counts(j.objType)
+	if exists, err := m.dst[j.objType].Exists(j.repoID, j.objID); exists && err == nil {
+		m.lock.Lock()
+		counts.Skipped++
+		m.lock.Unlock()
+		return
+	}
+
+	size, err := m.copyObject(j)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err != nil {
+		log.Printf("Failed to copy %s object %s/%s: %v", j.objType, j.repoID, j.objID, err)
+		counts.Failed++
+		return
+	}
+	counts.Copied++
+	counts.Bytes += size
+}
+
+func (m *migrator) copyObject(j job) (int64, error) {
+	var buf bytes.Buffer
+	if err := m.src[j.objType].Read(j.repoID, j.objID, &buf); err != nil {
+		return 0, err
+	}
+	data := buf.Bytes()
+	if !matchID(j.objType, j.objID, data) {
+		m.lock.Lock()
+		m.report.Corrupted = append(m.report.Corrupted, j.objType+"/"+j.repoID+"/"+j.objID)
+		m.lock.Unlock()
+	}
+
+	dst := m.dst[j.objType]
+	if err := dst.Write(j.repoID, j.objID, bytes.NewReader(data), true); err != nil {
+		return 0, err
+	}
+
+	var copied bytes.Buffer
+	if err := dst.Read(j.repoID, j.objID, &copied); err != nil {
+		err := fmt.Errorf("failed to read the copy: %v", err)
+		return 0, err
+	}
+	if sha1.Sum(copied.Bytes()) != sha1.Sum(data) {
+		dst.Remove(j.repoID, j.objID)
+		err := fmt.Errorf("content of the copy doesn't match the source")
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
+
+// matchID checks whether the content of a block or fs object matches its ID.
+// Commit IDs are not checksums of their content, so commits always match.
+func matchID(objType, objID string, data []byte) bool {
+	switch objType {
+	case "blocks":
+		sum := sha1.Sum(data)
+		return hex.EncodeToString(sum[:]) == objID
+	case "fs":
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return false
+		}
+		defer r.Close()
+		p, err := ioutil.ReadAll(r)
+		if err != nil {
+			return false
+		}
+		sum := sha1.Sum(p)
+		return hex.EncodeToString(sum[:]) == objID
+	}
+	return true
+}
+
+func (m *migrator) runIncremental(repoIDs []string) error {
+	if len(repoIDs) == 0 {
+		ids, err := repomgr.GetRepoIDList()
+		if err != nil {
+			err := fmt.Errorf("failed to get repo list: %v", err)
+			return err
+		}
+		repoIDs = ids
+	}
+
+	for _, repoID := range repoIDs {
+		if err := m.migrateNewCommits(repoID); err != nil {
+			log.Printf("Failed to migrate repo %s incrementally: %v", repoID, err)
+			m.report.FailedRepos = append(m.report.FailedRepos, repoID)
+		}
+	}
+	return nil
+}
+
+// migrateNewCommits copies the commits of a repo that don't exist in the destination, with their objects.
+func (m *migrator) migrateNewCommits(repoID string) error {
+	repo := repomgr.Get(repoID)
+	if repo == nil {
+		err := fmt.Errorf("failed to get repo %s", repoID)
+		return err
+	}
+	branches, err := repomgr.GetBranchList(repoID)
+	if err != nil {
+		err := fmt.Errorf("failed to get branches: %v", err)
+		return err
+	}
+
+	var queue []string
+	for _, branch := range branches {
+		queue = append(queue, branch.CommitID)
+	}
+	seen := make(map[string]bool)
+	var commits []*commitmgr.Commit
+	for len(queue) > 0 {
+		commitID := queue[0]
+		queue = queue[1:]
+		if seen[commitID] {
+			continue
+		}
+		seen[commitID] = true
+		if exists, _ := m.dst["commits"].Exists(repoID, commitID); exists {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := m.src["commits"].Read(repoID, commitID, &buf); err != nil {
+			err := fmt.Errorf("failed to read commit %s: %v", commitID, err)
+			return err
+		}
+		commit := new(commitmgr.Commit)
+		if err := commit.FromData(buf.Bytes()); err != nil {
+			err := fmt.Errorf("failed to parse commit %s: %v", commitID, err)
+			return err
+		}
+		commit.CommitID = commitID
+		commits = append(commits, commit)
+		if commit.ParentID.Valid {
+			queue = append(queue, commit.ParentID.String)
+		}
+		if commit.SecondParentID.Valid {
+			queue = append(queue, commit.SecondParentID.String)
+		}
+	}
+
+	t := &treeCopy{m: m, storeID: repo.StoreID, visited: make(map[string]bool), blocks: make(map[string]bool)}
+	// Older commits first, so that a commit is copied after its parents.
+	for i := len(commits) - 1; i >= 0; i-- {
+		commit := commits[i]
+		if m.opts.Verbose {
+			log.Printf("Copying commit %s of repo %s", commit.CommitID, repoID)
+		}
+		if err := t.copyTree(commit.RootID); err != nil {
+			return err
+		}
+		// The commit is only copied if all its objects are, the next pass copies it otherwise.
+		failed := m.failed()
+		m.copy(job{"commits", repoID, commit.CommitID})
+		if m.failed() != failed {
+			err := fmt.Errorf("failed to copy commit %s", commit.CommitID)
+			return err
+		}
+	}
+	return nil
+}
+
+// treeCopy copies the objects of dir trees missing in the destination. Blocks are
+// copied before files, and files before dirs, so that every object in the destination
+// has the objects it references.
+type treeCopy struct {
+	m       *migrator
+	storeID string
+	visited map[string]bool
+	blocks  map[string]bool
+	files   []string
+	// dirs are in post order.
+	dirs []string
+}
+
+func (t *treeCopy) copyTree(rootID string) error {
+	t.files = t.files[:0]
+	t.dirs = t.dirs[:0]
+	failed := t.m.failed()
+	if err := t.walk(rootID); err != nil {
+		t.m.wait()
+		return err
+	}
+
+	t.m.wait()
+	if t.m.failed() == failed {
+		for _, fileID := range t.files {
+			t.m.submit("fs", t.storeID, fileID)
+		}
+		t.m.wait()
+	}
+	if t.m.failed() == failed {
+		for _, dirID := range t.dirs {
+			t.m.copy(job{"fs", t.storeID, dirID})
+		}
+	}
+	if n := t.m.failed() - failed; n > 0 {
+		err := fmt.Errorf("failed to copy %d objects of tree %s", n, rootID)
+		return err
+	}
+	return nil
+}
+
+func (t *treeCopy) exists(objID string) bool {
+	if t.visited[objID] || objID == fsmgr.EmptySha1 {
+		return true
+	}
+	t.visited[objID] = true
+	exists, _ := t.m.dst["fs"].Exists(t.storeID, objID)
+	return exists
+}
+
+func (t *treeCopy) walk(dirID string) error {
+	if t.exists(dirID) {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := t.m.src["fs"].Read(t.storeID, dirID, &buf); err != nil {
+		err := fmt.Errorf("failed to read dir %s: %v", dirID, err)
+		return err
+	}
+	dir := new(fsmgr.SeafDir)
+	if err := dir.FromData(buf.Bytes()); err != nil {
+		err := fmt.Errorf("failed to parse dir %s: %v", dirID, err)
+		return err
+	}
+
+	for _, dent := range dir.Entries {
+		if fsmgr.IsDir(dent.Mode) {
+			if err := t.walk(dent.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if t.exists(dent.ID) {
+			continue
+		}
+
+		buf.Reset()
+		if err := t.m.src["fs"].Read(t.storeID, dent.ID, &buf); err != nil {
+			err := fmt.Errorf("failed to read file %s: %v", dent.ID, err)
+			return err
+		}
+		file := new(fsmgr.Seafile)
+		if err := file.FromData(buf.Bytes()); err != nil {
+			err := fmt.Errorf("failed to parse file %s: %v", dent.ID, err)
+			return err
+		}
+		for _, blkID := range file.BlkIDs {
+			if !t.blocks[blkID] {
+				t.blocks[blkID] = true
+				t.m.submit("blocks", t.storeID, blkID)
+			}
+		}
+		t.files = append(t.files, dent.ID)
+	}
+
+	t.dirs = append(t.dirs, dirID)
+	return nil
+}
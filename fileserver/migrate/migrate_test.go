@@ -0,0 +1,166 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const repoID = "b1f2ad61-9164-418a-a47f-ab805dbd5694"
+
+var seafileDataDir string
+var seafileDB *sql.DB
+
+var schema = []string{
+	"CREATE TABLE Repo (repo_id CHAR(36) PRIMARY KEY)",
+	"CREATE TABLE Branch (name VARCHAR(10), repo_id CHAR(36), commit_id CHAR(41), PRIMARY KEY (repo_id, name))",
+	"CREATE TABLE VirtualRepo (repo_id CHAR(36) PRIMARY KEY, origin_repo CHAR(36), path TEXT, base_commit CHAR(40))",
+}
+
+func TestMain(m *testing.M) {
+	var err error
+	seafileDataDir, err = ioutil.TempDir("", "migrate-test")
+	if err != nil {
+		fmt.Printf("Failed to create data dir : %v\n", err)
+		os.Exit(1)
+	}
+
+	seafileDB, err = sql.Open("sqlite3", filepath.Join(seafileDataDir, "seafile.db"))
+	if err != nil {
+		fmt.Printf("Failed to open database : %v\n", err)
+		os.Exit(1)
+	}
+	for _, stmt := range schema {
+		if _, err := seafileDB.Exec(stmt); err != nil {
+			fmt.Printf("Failed to create table : %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	srcDir := filepath.Join(seafileDataDir, "src")
+	repomgr.Init(seafileDB)
+	fsmgr.Init("", srcDir)
+	blockmgr.Init("", srcDir)
+	commitmgr.Init("", srcDir)
+
+	code := m.Run()
+	seafileDB.Close()
+	os.RemoveAll(seafileDataDir)
+	os.Exit(code)
+}
+
+// writeCommit writes a commit with /docs/<name> containing content, and sets it as the head commit.
+func writeCommit(t *testing.T, parentID, name, content string) string {
+	checkSum := sha1.Sum([]byte(content))
+	blkID := hex.EncodeToString(checkSum[:])
+	if err := blockmgr.Write(repoID, blkID, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+	file, _ := fsmgr.NewSeafile(1, int64(len(content)), []string{blkID})
+	if err := fsmgr.SaveSeafile(repoID, file); err != nil {
+		t.Fatalf("Failed to save seafile : %v\n", err)
+	}
+	fileDent := fsmgr.NewDirent(file.FileID, name, syscall.S_IFREG|0644, time.Now().Unix(), "", int64(len(content)))
+	subDir, _ := fsmgr.NewSeafdir(1, []*fsmgr.SeafDirent{fileDent})
+	if err := fsmgr.SaveSeafdir(repoID, subDir); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+	dirDent := fsmgr.NewDirent(subDir.DirID, "docs", syscall.S_IFDIR, time.Now().Unix(), "", 0)
+	root, _ := fsmgr.NewSeafdir(1, []*fsmgr.SeafDirent{dirDent})
+	if err := fsmgr.SaveSeafdir(repoID, root); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+
+	commit := commitmgr.NewCommit(repoID, parentID, root.DirID, "seafile", "test commit")
+	commit.CommitID = fmt.Sprintf("%x", sha1.Sum([]byte(root.DirID+parentID)))
+	commit.RepoName = "test"
+	commit.Version = 1
+	if parentID == "" {
+		commit.ParentID.Valid = false
+	}
+	if err := commitmgr.Save(commit); err != nil {
+		t.Fatalf("Failed to save commit : %v\n", err)
+	}
+
+	if _, err := seafileDB.Exec("REPLACE INTO Branch (name, repo_id, commit_id) VALUES ('master', ?, ?)", repoID, commit.CommitID); err != nil {
+		t.Fatalf("Failed to update branch : %v\n", err)
+	}
+	return commit.CommitID
+}
+
+func TestMigrate(t *testing.T) {
+	if _, err := seafileDB.Exec("INSERT INTO Repo (repo_id) VALUES (?)", repoID); err != nil {
+		t.Fatalf("Failed to insert repo : %v\n", err)
+	}
+	first := writeCommit(t, "", "a.txt", "hello world")
+
+	src, err := NewStores("", filepath.Join(seafileDataDir, "src"))
+	if err != nil {
+		t.Fatalf("Failed to open source : %v\n", err)
+	}
+	dst, err := NewStores("", filepath.Join(seafileDataDir, "dst"))
+	if err != nil {
+		t.Fatalf("Failed to open destination : %v\n", err)
+	}
+
+	opts := &Options{Workers: 4}
+	report, err := Run(src, dst, nil, opts)
+	if err != nil {
+		t.Fatalf("Failed to migrate : %v\n", err)
+	}
+	if report.Commits.Copied != 1 || report.FS.Copied != 3 || report.Blocks.Copied != 1 || report.Failed() != 0 {
+		t.Errorf("Unexpected report of full pass : %+v\n", report)
+	}
+
+	// Objects that exist in the destination are skipped.
+	report, err = Run(src, dst, []string{repoID}, opts)
+	if err != nil {
+		t.Fatalf("Failed to migrate : %v\n", err)
+	}
+	if report.Commits.Skipped != 1 || report.FS.Skipped != 3 || report.Blocks.Skipped != 1 ||
+		report.Commits.Copied+report.FS.Copied+report.Blocks.Copied != 0 {
+		t.Errorf("Unexpected report of resumed pass : %+v\n", report)
+	}
+
+	// An incremental pass copies the objects of new commits.
+	head := writeCommit(t, first, "b.txt", "new content")
+	opts.Incremental = true
+	report, err = Run(src, dst, nil, opts)
+	if err != nil {
+		t.Fatalf("Failed to migrate : %v\n", err)
+	}
+	if report.Commits.Copied != 1 || report.FS.Copied != 3 || report.Blocks.Copied != 1 || report.Failed() != 0 {
+		t.Errorf("Unexpected report of incremental pass : %+v\n", report)
+	}
+	if exists, _ := dst["commits"].Exists(repoID, head); !exists {
+		t.Errorf("Head commit is not copied\n")
+	}
+
+	// Damaged objects are reported.
+	blkID := "0401fc662e3bc87a41f299a907c056aaf8322a27"
+	if err := blockmgr.Write(repoID, blkID, bytes.NewBufferString("bad content")); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+	opts.Incremental = false
+	report, err = Run(src, dst, nil, opts)
+	if err != nil {
+		t.Fatalf("Failed to migrate : %v\n", err)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != "blocks/"+repoID+"/"+blkID {
+		t.Errorf("Damaged block is not reported : %v\n", report.Corrupted)
+	}
+}
@@ -0,0 +1,237 @@
+// Transparent compression of objects on top of another backend.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/ini.v1"
+)
+
+// Compressed objects start with compressMagic followed by the size of the uncompressed
+// content as a big-endian uint64. Objects without the header are read as is, so
+// objects written before compression is enabled can still be read.
+var compressMagic = []byte("\x00SFZSTD\x01")
+
+const compressHeaderSize = 16
+
+// maxDecompressedSize limits the size of decompressed objects, so that a damaged header
+// or content can't make the decoder allocate unbounded memory. It's far larger than
+// the blocks and fs objects written by the file server.
+const maxDecompressedSize = 1 << 30
+
+// The buffer of decompressed content is preallocated to at most this many times the
+// size of the compressed content, and grows if the content is larger.
+const maxPreallocRatio = 32
+
+var errHeaderRead = errors.New("header is read")
+
+type compressBackend struct {
+	Backend
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// wrapCompression wraps backend to compress objects if "compression" is set in section.
+func wrapCompression(backend Backend, section *ini.Section) (Backend, error) {
+	if section == nil {
+		return backend, nil
+	}
+	key, ok := ownKey(section, "compression")
+	if !ok || key.String() == "" || key.String() == "none" {
+		return backend, nil
+	}
+	if key.String() != "zstd" {
+		err := fmt.Errorf("unknown compression %s in section %s", key.String(), section.Name())
+		return nil, err
+	}
+
+	level := zstd.SpeedDefault
+	if key, ok := ownKey(section, "compression_level"); ok {
+		n, err := key.Int()
+		if err != nil {
+			err := fmt.Errorf("invalid compression_level in section %s: %v", section.Name(), err)
+			return nil, err
+		}
+		level = zstd.EncoderLevelFromZstd(n)
+	}
+
+	return newCompressBackend(backend, level)
+}
+
+func newCompressBackend(backend Backend, level zstd.EncoderLevel) (*compressBackend, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	if err != nil {
+		return nil, err
+	}
+	return &compressBackend{backend, encoder, decoder}, nil
+}
+
+func (b *compressBackend) Read(repoID string, objID string, w io.Writer) error {
+	return b.ReadCtx(context.Background(), repoID, objID, w)
+}
+
+func (b *compressBackend) ReadCtx(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	var buf bytes.Buffer
+	if err := readCtx(ctx, b.Backend, repoID, objID, &buf); err != nil {
+		return err
+	}
+	content, err := b.decompress(repoID, objID, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// decompress returns the content of an object stored as data.
+func (b *compressBackend) decompress(repoID string, objID string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressMagic) {
+		return data, nil
+	}
+
+	if len(data) < compressHeaderSize {
+		err := fmt.Errorf("compressed object %s/%s is truncated", repoID, objID)
+		return nil, err
+	}
+	size := binary.BigEndian.Uint64(data[len(compressMagic):compressHeaderSize])
+	if size > maxDecompressedSize {
+		err := fmt.Errorf("size %d of compressed object %s/%s is too large", size, repoID, objID)
+		return nil, err
+	}
+	capacity := size
+	if max := uint64(len(data)) * maxPreallocRatio; capacity > max {
+		capacity = max
+	}
+	content, err := b.decoder.DecodeAll(data[compressHeaderSize:], make([]byte, 0, capacity))
+	if err != nil {
+		err := fmt.Errorf("failed to decompress object %s/%s: %v", repoID, objID, err)
+		return nil, err
+	}
+	if uint64(len(content)) != size {
+		err := fmt.Errorf("size of decompressed object %s/%s is %d, expected %d", repoID, objID, len(content), size)
+		return nil, err
+	}
+	return content, nil
+}
+
+// Write compresses the content of r, the content is stored uncompressed if compression doesn't make it smaller.
+func (b *compressBackend) Write(repoID string, objID string, r io.Reader, sync bool) error {
+	return b.WriteCtx(context.Background(), repoID, objID, r, sync)
+}
+
+func (b *compressBackend) WriteCtx(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	content, err := ioutil.ReadAll(&ctxReader{ctx, r})
+	if err != nil {
+		return err
+	}
+	return writeCtx(ctx, b.Backend, repoID, objID, bytes.NewReader(b.compress(content)), sync)
+}
+
+func (b *compressBackend) ExistsCtx(ctx context.Context, repoID string, objID string) (bool, error) {
+	return existsCtx(ctx, b.Backend, repoID, objID)
+}
+
+// WriteBatch compresses the objects and writes them in one batch if the backend supports it.
+func (b *compressBackend) WriteBatch(repoID string, objs []Object, sync bool) error {
+	compressed := make([]Object, len(objs))
+	for i, obj := range objs {
+		compressed[i] = Object{obj.ID, b.compress(obj.Data)}
+	}
+	return writeBatch(b.Backend, repoID, compressed, sync)
+}
+
+func (b *compressBackend) compress(content []byte) []byte {
+	header := make([]byte, compressHeaderSize)
+	copy(header, compressMagic)
+	binary.BigEndian.PutUint64(header[len(compressMagic):], uint64(len(content)))
+	compressed := b.encoder.EncodeAll(content, header)
+
+	// Uncompressed content starting with the magic would be mistaken for compressed object.
+	if len(compressed) >= len(content) && !bytes.HasPrefix(content, compressMagic) {
+		return content
+	}
+	return compressed
+}
+
+// ReadMulti reads the objects in one batch if the backend supports it, and decompresses them.
+func (b *compressBackend) ReadMulti(repoID string, objIDs []string, fn func(objID string, data []byte) error) error {
+	return readMulti(b.Backend, repoID, objIDs, func(objID string, data []byte) error {
+		content, err := b.decompress(repoID, objID, data)
+		if err != nil {
+			return err
+		}
+		return fn(objID, content)
+	})
+}
+
+// quarantine checks the decompressed content of the copies of an object, the damaged copies
+// are saved decompressed if possible.
+func (b *compressBackend) quarantine(repoID string, objID string, valid func(data []byte) bool, save func(data []byte) error) error {
+	return quarantineCopies(b.Backend, repoID, objID, func(data []byte) bool {
+		content, err := b.decompress(repoID, objID, data)
+		return err == nil && valid(content)
+	}, func(data []byte) error {
+		if content, err := b.decompress(repoID, objID, data); err == nil {
+			data = content
+		}
+		return save(data)
+	})
+}
+
+// Repack repacks the objects of a repo if the backend needs it.
+func (b *compressBackend) Repack(repoID string) (int64, error) {
+	if r, ok := b.Backend.(Repacker); ok {
+		return r.Repack(repoID)
+	}
+	return 0, nil
+}
+
+// Stat returns the size of the uncompressed content.
+func (b *compressBackend) Stat(repoID string, objID string) (int64, error) {
+	return b.StatCtx(context.Background(), repoID, objID)
+}
+
+func (b *compressBackend) StatCtx(ctx context.Context, repoID string, objID string) (int64, error) {
+	w := &headerWriter{}
+	err := readCtx(ctx, b.Backend, repoID, objID, w)
+	if err != nil && err != errHeaderRead && !w.full() {
+		return -1, err
+	}
+	if w.full() && bytes.HasPrefix(w.header, compressMagic) {
+		return int64(binary.BigEndian.Uint64(w.header[len(compressMagic):])), nil
+	}
+	return statCtx(ctx, b.Backend, repoID, objID)
+}
+
+// headerWriter keeps the first compressHeaderSize bytes written to it, and
+// stops the reading of the rest by returning errHeaderRead.
+type headerWriter struct {
+	header []byte
+}
+
+func (w *headerWriter) full() bool {
+	return len(w.header) >= compressHeaderSize
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	n := compressHeaderSize - len(w.header)
+	if n > len(p) {
+		n = len(p)
+	}
+	w.header = append(w.header, p[:n]...)
+	if w.full() {
+		return n, errHeaderRead
+	}
+	return n, nil
+}
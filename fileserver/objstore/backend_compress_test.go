@@ -0,0 +1,125 @@
+package objstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressBackend(t *testing.T) {
+	inner := &memBackend{objects: make(map[string][]byte)}
+	backend, err := newCompressBackend(inner, zstd.SpeedDefault)
+	if err != nil {
+		t.Fatalf("Failed to create compress backend : %v\n", err)
+	}
+
+	text := bytes.Repeat([]byte("hello world!\n"), 1000)
+	random := make([]byte, 1000)
+	x := uint32(1)
+	for i := range random {
+		x = x*1103515245 + 12345
+		random[i] = byte(x >> 16)
+	}
+	objects := map[string][]byte{
+		"text":   text,
+		"random": random,
+		"magic":  append(append([]byte(nil), compressMagic...), 'x'),
+		"empty":  nil,
+	}
+
+	for name, content := range objects {
+		if err := backend.Write(repoID, name, bytes.NewReader(content), false); err != nil {
+			t.Fatalf("Failed to write %s : %v\n", name, err)
+		}
+		var buf bytes.Buffer
+		if err := backend.Read(repoID, name, &buf); err != nil {
+			t.Fatalf("Failed to read %s : %v\n", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("Content of %s is changed\n", name)
+		}
+		size, err := backend.Stat(repoID, name)
+		if err != nil || size != int64(len(content)) {
+			t.Errorf("Size of %s is %d, expected %d : %v\n", name, size, len(content), err)
+		}
+	}
+
+	if stored := len(inner.objects[repoID+"/text"]); stored >= len(text)/10 {
+		t.Errorf("Text is not compressed, stored size is %d\n", stored)
+	}
+	if !bytes.Equal(inner.objects[repoID+"/random"], random) {
+		t.Errorf("Incompressible content is not stored as is\n")
+	}
+
+	// Objects written without compression can be read.
+	inner.objects[repoID+"/legacy"] = text
+	var buf bytes.Buffer
+	if err := backend.Read(repoID, "legacy", &buf); err != nil || !bytes.Equal(buf.Bytes(), text) {
+		t.Errorf("Failed to read uncompressed object : %v\n", err)
+	}
+	if size, _ := backend.Stat(repoID, "legacy"); size != int64(len(text)) {
+		t.Errorf("Size of uncompressed object is %d\n", size)
+	}
+}
+
+func TestDecompressSizeLimit(t *testing.T) {
+	inner := &memBackend{objects: make(map[string][]byte)}
+	backend, err := newCompressBackend(inner, zstd.SpeedDefault)
+	if err != nil {
+		t.Fatalf("Failed to create compress backend : %v\n", err)
+	}
+	text := bytes.Repeat([]byte("hello world!\n"), 1000)
+	if err := backend.Write(repoID, "text", bytes.NewReader(text), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	// The size in a damaged header is not trusted.
+	stored := inner.objects[repoID+"/text"]
+	for _, size := range []uint64{maxDecompressedSize + 1, 1 << 40} {
+		binary.BigEndian.PutUint64(stored[len(compressMagic):], size)
+		if err := backend.Read(repoID, "text", ioutil.Discard); err == nil {
+			t.Errorf("Object with size %d in header is read\n", size)
+		}
+	}
+	binary.BigEndian.PutUint64(stored[len(compressMagic):], maxDecompressedSize)
+	if err := backend.Read(repoID, "text", ioutil.Discard); err == nil {
+		t.Errorf("Object with wrong size in header is read\n")
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-conf")
+	if err != nil {
+		t.Fatalf("Failed to create conf dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+
+	conf := "[block_backend]\nname = fs\ncompression = zstd\ncompression_level = 1\n\n[fs_object_backend]\ncompression = lz4\n"
+	err = ioutil.WriteFile(filepath.Join(confDir, "seafile.conf"), []byte(conf), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write seafile.conf : %v\n", err)
+	}
+
+	s, err := New(confDir, confDir, "blocks")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
+	if _, ok := s.backend.(*compressBackend); !ok {
+		t.Errorf("Block backend is not compressed\n")
+	}
+	if _, err := New(confDir, confDir, "fs"); err == nil {
+		t.Errorf("Unknown compression is accepted\n")
+	}
+	s, err = New(confDir, confDir, "commits")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
+	if _, ok := s.backend.(*compressBackend); ok {
+		t.Errorf("Commit backend is compressed without configuration\n")
+	}
+}
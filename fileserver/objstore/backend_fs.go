@@ -8,6 +8,10 @@ import (
 	"path"
 )
 
+// Number of directory entries read at a time when listing objects,
+// block directories of big repos may contain millions of entries.
+const readDirBatchSize = 1024
+
 type fsBackend struct {
 	// Path of the object directory
 	objDir  string
@@ -33,7 +37,7 @@ func newFSBackend(seafileDataDir string, objType string) (*fsBackend, error) {
 	return backend, nil
 }
 
-func (b *fsBackend) read(repoID string, objID string, w io.Writer) error {
+func (b *fsBackend) Read(repoID string, objID string, w io.Writer) error {
 	p := path.Join(b.objDir, repoID, objID[:2], objID[2:])
 	fd, err := os.Open(p)
 	if err != nil {
@@ -49,7 +53,7 @@ func (b *fsBackend) read(repoID string, objID string, w io.Writer) error {
 	return nil
 }
 
-func (b *fsBackend) write(repoID string, objID string, r io.Reader, sync bool) error {
+func (b *fsBackend) Write(repoID string, objID string, r io.Reader, sync bool) error {
 	parentDir := path.Join(b.objDir, repoID, objID[:2])
 	p := path.Join(parentDir, objID[2:])
 	err := os.MkdirAll(parentDir, os.ModePerm)
@@ -77,7 +81,7 @@ func (b *fsBackend) write(repoID string, objID string, r io.Reader, sync bool) e
 	return nil
 }
 
-func (b *fsBackend) exists(repoID string, objID string) (bool, error) {
+func (b *fsBackend) Exists(repoID string, objID string) (bool, error) {
 	path := path.Join(b.objDir, repoID, objID[:2], objID[2:])
 	_, err := os.Stat(path)
 	if err != nil {
@@ -89,7 +93,7 @@ func (b *fsBackend) exists(repoID string, objID string) (bool, error) {
 	return true, nil
 }
 
-func (b *fsBackend) stat(repoID string, objID string) (int64, error) {
+func (b *fsBackend) Stat(repoID string, objID string) (int64, error) {
 	path := path.Join(b.objDir, repoID, objID[:2], objID[2:])
 	fileInfo, err := os.Stat(path)
 	if err != nil {
@@ -97,3 +101,58 @@ func (b *fsBackend) stat(repoID string, objID string) (int64, error) {
 	}
 	return fileInfo.Size(), nil
 }
+
+// Remove deletes an object, removing an object that doesn't exist is not an error.
+func (b *fsBackend) Remove(repoID string, objID string) error {
+	path := path.Join(b.objDir, repoID, objID[:2], objID[2:])
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List calls fn for every object of a repo.
+func (b *fsBackend) List(repoID string, fn func(objID string) error) error {
+	repoDir := path.Join(b.objDir, repoID)
+	return readDirNames(repoDir, func(prefix string) error {
+		if len(prefix) != 2 {
+			return nil
+		}
+		return readDirNames(path.Join(repoDir, prefix), func(name string) error {
+			return fn(prefix + name)
+		})
+	})
+}
+
+// ListRepos calls fn for every repo that has objects in the backend.
+func (b *fsBackend) ListRepos(fn func(repoID string) error) error {
+	return readDirNames(b.objDir, fn)
+}
+
+// readDirNames calls fn for every entry in dir, a missing dir is treated as empty.
+func readDirNames(dir string, fn func(name string) error) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fd.Close()
+
+	for {
+		names, err := fd.Readdirnames(readDirBatchSize)
+		for _, name := range names {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
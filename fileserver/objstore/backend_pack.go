@@ -0,0 +1,754 @@
+// Implementation of a backend appending objects of a repo to a pack file.
+package objstore
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A pack file starts with packMagic, followed by records of objects in the same format
+// as the objects sent by pack-fs: the 40 bytes object ID, the length of the content as a
+// big-endian uint32, and the content. A record with length packTombstone removes an object.
+//
+// The index file of a pack has a record for every record of the pack: the object ID, the
+// offset of the record in the pack as a big-endian uint64, and the length.
+// The index can be rebuilt from the pack, records missing in it after a crash are recovered
+// from the pack when it's opened.
+//
+// Packs may be used by several processes, e.g. the file server and GC. Every use of a pack
+// holds a flock on the pack file, shared for reading and exclusive for writing, and the pack
+// is reopened if the file is replaced or changed by another process since it's opened.
+var packMagic = []byte("SEAFPACK")
+
+const (
+	packIDSize          = 40
+	packHeaderSize      = packIDSize + 4
+	packIndexRecordSize = packIDSize + 8 + 4
+	packTombstone       = 0xffffffff
+	// Maximum number of packs kept open.
+	packOpenFiles = 256
+)
+
+// MultiReader is implemented by backends that can read many objects of a repo
+// more efficiently than one at a time.
+type MultiReader interface {
+	// ReadMulti calls fn with the content of every object in objIDs, in any order.
+	// It stops at the first error returned by fn, and returns the error.
+	ReadMulti(repoID string, objIDs []string, fn func(objID string, data []byte) error) (err error)
+}
+
+// Repacker is implemented by backends that need to reclaim the space of removed objects.
+type Repacker interface {
+	// Repack rewrites the objects of a repo without the removed ones, and returns the number of bytes reclaimed.
+	Repack(repoID string) (reclaimed int64, err error)
+}
+
+type packEntry struct {
+	offset int64
+	length uint32
+}
+
+type repoPack struct {
+	// lock is held for reading to read objects, and for writing to change the pack.
+	lock   sync.RWMutex
+	repoID string
+	// refs is the number of users of the pack, protected by the lock of the backend.
+	// Only packs without users are closed to keep the number of open files low.
+	refs int
+	// closed is set when the files of the pack are replaced by Repack.
+	closed bool
+	path   string
+	pack   *os.File
+	idx    *os.File
+	// info is the pack file when it's opened.
+	info os.FileInfo
+	// readers is the number of users reading the pack, which share the flock on the pack file.
+	readersLock sync.Mutex
+	readers     int
+	// size is the end of the last record in the pack.
+	size  int64
+	index map[string]packEntry
+	// dead is the number of bytes of removed and overwritten objects.
+	dead int64
+}
+
+// packBackend stores the objects of every repo in a pack file and its index, under
+// storage/<type>/<repo id>.pack and .idx. It's meant for fs objects: objects are removed
+// by appending tombstones, and the space is reclaimed when the pack is repacked after GC.
+type packBackend struct {
+	dir string
+	// lock protects packs and lru.
+	lock  sync.Mutex
+	packs map[string]*list.Element
+	lru   *list.List
+}
+
+func newPackBackend(seafileDataDir string, objType string) (*packBackend, error) {
+	dir := filepath.Join(seafileDataDir, "storage", objType)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	b := new(packBackend)
+	b.dir = dir
+	b.packs = make(map[string]*list.Element)
+	b.lru = list.New()
+	return b, nil
+}
+
+func (b *packBackend) packPath(repoID string) string {
+	return filepath.Join(b.dir, repoID+".pack")
+}
+
+func (b *packBackend) indexPath(repoID string) string {
+	return filepath.Join(b.dir, repoID+".idx")
+}
+
+// get returns the open pack of a repo, opening it if needed, the caller must release it.
+// If the pack doesn't exist, it's created if create is true, otherwise nil is returned.
+func (b *packBackend) get(repoID string, create bool) (*repoPack, error) {
+	if repoID == "" || strings.ContainsAny(repoID, "/\\") || strings.HasPrefix(repoID, ".") {
+		err := fmt.Errorf("invalid repo id %s", repoID)
+		return nil, err
+	}
+
+	b.lock.Lock()
+	if elem, ok := b.packs[repoID]; ok {
+		b.lru.MoveToFront(elem)
+		p := elem.Value.(*repoPack)
+		p.refs++
+		b.lock.Unlock()
+		return p, nil
+	}
+	b.lock.Unlock()
+
+	// The pack is opened without the lock, as it may wait for other processes.
+	p, err := openPack(b.packPath(repoID), b.indexPath(repoID), create)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	p.repoID = repoID
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if elem, ok := b.packs[repoID]; ok {
+		// Opened by another user in the meantime.
+		p.closeFiles()
+		b.lru.MoveToFront(elem)
+		p = elem.Value.(*repoPack)
+		p.refs++
+		return p, nil
+	}
+	p.refs++
+	b.packs[repoID] = b.lru.PushFront(p)
+
+	// Close the least recently used pack without users.
+	if b.lru.Len() > packOpenFiles {
+		for elem := b.lru.Back(); elem != nil; elem = elem.Prev() {
+			old := elem.Value.(*repoPack)
+			if old.refs == 0 {
+				b.lru.Remove(elem)
+				delete(b.packs, old.repoID)
+				old.closeFiles()
+				break
+			}
+		}
+	}
+	return p, nil
+}
+
+func (b *packBackend) release(p *repoPack) {
+	b.lock.Lock()
+	p.refs--
+	b.lock.Unlock()
+}
+
+// forget closes the pack of a repo after its files are replaced, the next user of
+// the repo opens the new files. The caller must hold the lock of the pack for writing.
+func (b *packBackend) forget(p *repoPack) {
+	b.lock.Lock()
+	if elem, ok := b.packs[p.repoID]; ok && elem.Value == p {
+		b.lru.Remove(elem)
+		delete(b.packs, p.repoID)
+	}
+	b.lock.Unlock()
+	p.closeFiles()
+}
+
+// use calls fn with the pack of a repo, locked for writing if write is true.
+// fn isn't called if the pack doesn't exist and create is false, notExist is returned instead.
+func (b *packBackend) use(repoID string, create bool, write bool, notExist error, fn func(p *repoPack) error) error {
+	for {
+		p, err := b.get(repoID, create)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return notExist
+		}
+		if write {
+			p.lock.Lock()
+		} else {
+			p.lock.RLock()
+		}
+		closed := p.closed
+		stale := false
+		if !closed {
+			err = p.lockFile(write)
+			if err == nil {
+				stale, err = p.changed()
+				if err == nil && !stale {
+					err = fn(p)
+				}
+				// The files are closed by fn if they are replaced.
+				if !p.closed {
+					p.unlockFile(write)
+				}
+			}
+		}
+		if write {
+			p.lock.Unlock()
+		} else {
+			p.lock.RUnlock()
+		}
+		if stale {
+			// Changed by another process, the next user opens the files again.
+			p.lock.Lock()
+			b.forget(p)
+			p.lock.Unlock()
+		}
+		b.release(p)
+		if closed || stale {
+			// Repacked after it's returned by get, open the new files.
+			continue
+		}
+		return err
+	}
+}
+
+// lockFile locks the pack file against other processes, exclusively if write is true.
+// The caller must hold the lock of the pack accordingly.
+func (p *repoPack) lockFile(write bool) error {
+	if write {
+		return flock(p.pack, syscall.LOCK_EX)
+	}
+	// Readers of the process share the flock, it's released by the last one.
+	p.readersLock.Lock()
+	defer p.readersLock.Unlock()
+	if p.readers == 0 {
+		if err := flock(p.pack, syscall.LOCK_SH); err != nil {
+			return err
+		}
+	}
+	p.readers++
+	return nil
+}
+
+func (p *repoPack) unlockFile(write bool) {
+	if !write {
+		p.readersLock.Lock()
+		defer p.readersLock.Unlock()
+		p.readers--
+		if p.readers > 0 {
+			return
+		}
+	}
+	flock(p.pack, syscall.LOCK_UN)
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// changed returns whether the pack file is replaced or changed by another process since it's opened.
+// The caller must hold the flock of the pack file.
+func (p *repoPack) changed() (bool, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return !os.SameFile(info, p.info) || info.Size() != p.size, nil
+}
+
+func openPack(packPath, indexPath string, create bool) (*repoPack, error) {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	for {
+		pack, err := os.OpenFile(packPath, flag, 0644)
+		if err != nil {
+			if os.IsNotExist(err) && !create {
+				return nil, nil
+			}
+			return nil, err
+		}
+		// The pack is loaded with the flock held, so that it's not changed by other processes
+		// in the meantime. If it's replaced or removed before it's locked, it's opened again.
+		if err := flock(pack, syscall.LOCK_EX); err != nil {
+			pack.Close()
+			return nil, err
+		}
+		packInfo, err := pack.Stat()
+		if err != nil {
+			pack.Close()
+			return nil, err
+		}
+		if info, err := os.Stat(packPath); err != nil || !os.SameFile(info, packInfo) {
+			pack.Close()
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+
+		idx, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			pack.Close()
+			return nil, err
+		}
+		p := &repoPack{path: packPath, pack: pack, idx: idx, info: packInfo, index: make(map[string]packEntry)}
+		if err := p.load(); err != nil {
+			p.closeFiles()
+			err := fmt.Errorf("failed to load pack %s: %v", packPath, err)
+			return nil, err
+		}
+		flock(pack, syscall.LOCK_UN)
+		return p, nil
+	}
+}
+
+// load reads the index, and recovers the records of the pack missing in it.
+// A record partially written to the pack is truncated.
+func (p *repoPack) load() error {
+	info, err := p.pack.Stat()
+	if err != nil {
+		return err
+	}
+	packSize := info.Size()
+	if packSize == 0 {
+		if _, err := p.pack.WriteAt(packMagic, 0); err != nil {
+			return err
+		}
+		packSize = int64(len(packMagic))
+	} else {
+		magic := make([]byte, len(packMagic))
+		if _, err := p.pack.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, packMagic) {
+			return fmt.Errorf("not a pack file")
+		}
+	}
+	p.size = int64(len(packMagic))
+
+	// Records of the index pointing beyond the pack were written before their objects
+	// reached the disk, they are dropped and recovered from the pack if possible.
+	data, err := ioutil.ReadAll(p.idx)
+	if err != nil {
+		return err
+	}
+	var idxSize int64
+	for len(data) >= packIndexRecordSize {
+		objID := string(data[:packIDSize])
+		offset := int64(binary.BigEndian.Uint64(data[packIDSize:]))
+		length := binary.BigEndian.Uint32(data[packIDSize+8:])
+		end := offset + packHeaderSize
+		if length != packTombstone {
+			end += int64(length)
+		}
+		if offset != p.size || end > packSize {
+			break
+		}
+		p.apply(objID, packEntry{offset, length})
+		p.size = end
+		idxSize += packIndexRecordSize
+		data = data[packIndexRecordSize:]
+	}
+	if err := p.idx.Truncate(idxSize); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(p.pack, p.size, packSize-p.size))
+	header := make([]byte, packHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		objID := string(header[:packIDSize])
+		length := binary.BigEndian.Uint32(header[packIDSize:])
+		end := p.size + packHeaderSize
+		if length != packTombstone {
+			if _, err := r.Discard(int(length)); err != nil {
+				break
+			}
+			end += int64(length)
+		}
+		entry := packEntry{p.size, length}
+		if err := p.appendIndex(objID, entry); err != nil {
+			return err
+		}
+		p.apply(objID, entry)
+		p.size = end
+	}
+	if p.size < packSize {
+		return p.pack.Truncate(p.size)
+	}
+	return nil
+}
+
+// apply updates the index with a record.
+func (p *repoPack) apply(objID string, entry packEntry) {
+	if old, ok := p.index[objID]; ok {
+		p.dead += packHeaderSize + int64(old.length)
+	}
+	if entry.length == packTombstone {
+		p.dead += packHeaderSize
+		delete(p.index, objID)
+		return
+	}
+	p.index[objID] = entry
+}
+
+func (p *repoPack) appendIndex(objID string, entry packEntry) error {
+	record := make([]byte, packIndexRecordSize)
+	copy(record, objID)
+	binary.BigEndian.PutUint64(record[packIDSize:], uint64(entry.offset))
+	binary.BigEndian.PutUint32(record[packIDSize+8:], entry.length)
+	_, err := p.idx.Write(record)
+	return err
+}
+
+// append writes a record to the pack and the index, the caller must hold the lock for writing.
+func (p *repoPack) append(objID string, data []byte, length uint32, sync bool) error {
+	record := make([]byte, packHeaderSize, packHeaderSize+len(data))
+	copy(record, objID)
+	binary.BigEndian.PutUint32(record[packIDSize:], length)
+	record = append(record, data...)
+	if _, err := p.pack.WriteAt(record, p.size); err != nil {
+		// Drop what may have been written, so that the next record starts at p.size.
+		p.pack.Truncate(p.size)
+		return err
+	}
+	if sync {
+		if err := p.pack.Sync(); err != nil {
+			return err
+		}
+	}
+
+	entry := packEntry{p.size, length}
+	p.size += int64(len(record))
+	p.apply(objID, entry)
+	if err := p.appendIndex(objID, entry); err != nil {
+		// The record is recovered from the pack when it's opened again.
+		return err
+	}
+	if sync {
+		return p.idx.Sync()
+	}
+	return nil
+}
+
+func (p *repoPack) read(entry packEntry) ([]byte, error) {
+	data := make([]byte, entry.length)
+	if _, err := p.pack.ReadAt(data, entry.offset+packHeaderSize); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (p *repoPack) closeFiles() {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.pack.Close()
+	p.idx.Close()
+}
+
+func packNotExist(repoID, objID string) error {
+	return &os.PathError{Op: "read", Path: repoID + "/" + objID, Err: os.ErrNotExist}
+}
+
+func (b *packBackend) Read(repoID string, objID string, w io.Writer) error {
+	var data []byte
+	notExist := packNotExist(repoID, objID)
+	err := b.use(repoID, false, false, notExist, func(p *repoPack) error {
+		entry, ok := p.index[objID]
+		if !ok {
+			return notExist
+		}
+		var err error
+		data, err = p.read(entry)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadMulti reads the objects in the order they are stored in the pack,
+// so that objects written together are read sequentially.
+func (b *packBackend) ReadMulti(repoID string, objIDs []string, fn func(objID string, data []byte) error) error {
+	type object struct {
+		id    string
+		entry packEntry
+	}
+	if len(objIDs) == 0 {
+		return nil
+	}
+	var objs []object
+	err := b.use(repoID, false, false, packNotExist(repoID, objIDs[0]), func(p *repoPack) error {
+		for _, objID := range objIDs {
+			entry, ok := p.index[objID]
+			if !ok {
+				return packNotExist(repoID, objID)
+			}
+			objs = append(objs, object{objID, entry})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].entry.offset < objs[j].entry.offset })
+
+	for _, obj := range objs {
+		var data []byte
+		err := b.use(repoID, false, false, packNotExist(repoID, obj.id), func(p *repoPack) error {
+			// The pack may have been repacked since the offsets are looked up.
+			entry, ok := p.index[obj.id]
+			if !ok {
+				return packNotExist(repoID, obj.id)
+			}
+			var err error
+			data, err = p.read(entry)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := fn(obj.id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write appends the object to the pack, unless an object with the same ID is already in it.
+func (b *packBackend) Write(repoID string, objID string, r io.Reader, sync bool) error {
+	if len(objID) != packIDSize {
+		err := fmt.Errorf("invalid object id %s", objID)
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) >= packTombstone {
+		err := fmt.Errorf("object %s/%s is too large", repoID, objID)
+		return err
+	}
+
+	return b.use(repoID, true, true, nil, func(p *repoPack) error {
+		if _, ok := p.index[objID]; ok {
+			return nil
+		}
+		return p.append(objID, data, uint32(len(data)), sync)
+	})
+}
+
+// WriteBatch appends the objects to the pack, and syncs it once if sync is true.
+func (b *packBackend) WriteBatch(repoID string, objs []Object, sync bool) error {
+	for _, obj := range objs {
+		if len(obj.ID) != packIDSize {
+			err := fmt.Errorf("invalid object id %s", obj.ID)
+			return err
+		}
+		if len(obj.Data) >= packTombstone {
+			err := fmt.Errorf("object %s/%s is too large", repoID, obj.ID)
+			return err
+		}
+	}
+
+	return b.use(repoID, true, true, nil, func(p *repoPack) error {
+		for _, obj := range objs {
+			if _, ok := p.index[obj.ID]; ok {
+				continue
+			}
+			if err := p.append(obj.ID, obj.Data, uint32(len(obj.Data)), false); err != nil {
+				return err
+			}
+		}
+		if !sync {
+			return nil
+		}
+		if err := p.pack.Sync(); err != nil {
+			return err
+		}
+		return p.idx.Sync()
+	})
+}
+
+func (b *packBackend) Exists(repoID string, objID string) (bool, error) {
+	exists := false
+	err := b.use(repoID, false, false, nil, func(p *repoPack) error {
+		_, exists = p.index[objID]
+		return nil
+	})
+	return exists, err
+}
+
+func (b *packBackend) Stat(repoID string, objID string) (int64, error) {
+	notExist := packNotExist(repoID, objID)
+	var size int64
+	err := b.use(repoID, false, false, notExist, func(p *repoPack) error {
+		entry, ok := p.index[objID]
+		if !ok {
+			return notExist
+		}
+		size = int64(entry.length)
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+// Remove appends a tombstone of the object to the pack, its space is reclaimed by Repack.
+// Removing an object that doesn't exist is not an error.
+func (b *packBackend) Remove(repoID string, objID string) error {
+	return b.use(repoID, false, true, nil, func(p *repoPack) error {
+		if _, ok := p.index[objID]; !ok {
+			return nil
+		}
+		return p.append(objID, nil, packTombstone, false)
+	})
+}
+
+// List calls fn for every object of a repo, in the order they are stored in the pack.
+func (b *packBackend) List(repoID string, fn func(objID string) error) error {
+	var objIDs []string
+	err := b.use(repoID, false, false, nil, func(p *repoPack) error {
+		for objID := range p.index {
+			objIDs = append(objIDs, objID)
+		}
+		sort.Slice(objIDs, func(i, j int) bool { return p.index[objIDs[i]].offset < p.index[objIDs[j]].offset })
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, objID := range objIDs {
+		if err := fn(objID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListRepos calls fn for every repo that has a pack.
+func (b *packBackend) ListRepos(fn func(repoID string) error) error {
+	return readDirNames(b.dir, func(name string) error {
+		if !strings.HasSuffix(name, ".pack") {
+			return nil
+		}
+		return fn(strings.TrimSuffix(name, ".pack"))
+	})
+}
+
+// Repack rewrites the pack of a repo with only the objects in it, dropping removed and
+// overwritten objects. The pack is removed if it has no object.
+// The new index is removed before the new pack replaces the old one, and renamed after,
+// so that a crash in between leaves a pack whose index is rebuilt when it's opened.
+func (b *packBackend) Repack(repoID string) (int64, error) {
+	var reclaimed int64
+	err := b.use(repoID, false, true, nil, func(p *repoPack) error {
+		if p.dead == 0 {
+			return nil
+		}
+		reclaimed = p.dead
+		packPath, indexPath := b.packPath(repoID), b.indexPath(repoID)
+
+		if len(p.index) == 0 {
+			defer b.forget(p)
+			if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return os.Remove(packPath)
+		}
+
+		objIDs := make([]string, 0, len(p.index))
+		for objID := range p.index {
+			objIDs = append(objIDs, objID)
+		}
+		sort.Slice(objIDs, func(i, j int) bool { return p.index[objIDs[i]].offset < p.index[objIDs[j]].offset })
+
+		// Remove the files of a repack interrupted before.
+		os.Remove(packPath + ".tmp")
+		os.Remove(indexPath + ".tmp")
+		tmp, err := openPack(packPath+".tmp", indexPath+".tmp", true)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			tmp.closeFiles()
+			os.Remove(packPath + ".tmp")
+			os.Remove(indexPath + ".tmp")
+		}()
+		for _, objID := range objIDs {
+			entry := p.index[objID]
+			data, err := p.read(entry)
+			if err != nil {
+				return err
+			}
+			if err := tmp.append(objID, data, entry.length, false); err != nil {
+				return err
+			}
+		}
+		if err := tmp.pack.Sync(); err != nil {
+			return err
+		}
+		if err := tmp.idx.Sync(); err != nil {
+			return err
+		}
+
+		// The files are replaced while the pack is in the open packs and locked,
+		// so that no one opens them in the meantime. The new pack is locked as well,
+		// so that other processes don't open it before the new index is in place.
+		if err := flock(tmp.pack, syscall.LOCK_EX); err != nil {
+			return err
+		}
+		defer b.forget(p)
+		if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(packPath+".tmp", packPath); err != nil {
+			return err
+		}
+		return os.Rename(indexPath+".tmp", indexPath)
+	})
+	if err != nil {
+		err := fmt.Errorf("failed to repack %s: %v", repoID, err)
+		return 0, err
+	}
+	return reclaimed, nil
+}
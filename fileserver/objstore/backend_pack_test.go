@@ -0,0 +1,217 @@
+package objstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func packObjID(i int) string {
+	return fmt.Sprintf("%040d", i)
+}
+
+func TestPackBackend(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "objstore-pack")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	b, err := newPackBackend(dataDir, "fs")
+	if err != nil {
+		t.Fatalf("Failed to create pack backend : %v\n", err)
+	}
+	var objs []Object
+	for i := 0; i < 10; i++ {
+		objs = append(objs, Object{packObjID(i), []byte(fmt.Sprintf("object %d", i))})
+	}
+	if err := b.WriteBatch(repoID, objs[:5], true); err != nil {
+		t.Fatalf("Failed to write objects : %v\n", err)
+	}
+	for _, obj := range objs[5:] {
+		if err := b.Write(repoID, obj.ID, bytes.NewReader(obj.Data), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := b.Read(repoID, objs[3].ID, &buf); err != nil || !bytes.Equal(buf.Bytes(), objs[3].Data) {
+		t.Errorf("Failed to read object : %v\n", err)
+	}
+	if size, err := b.Stat(repoID, objs[3].ID); err != nil || size != int64(len(objs[3].Data)) {
+		t.Errorf("Wrong size of object %d : %v\n", size, err)
+	}
+	var order []string
+	err = b.ReadMulti(repoID, []string{objs[7].ID, objs[2].ID}, func(objID string, data []byte) error {
+		order = append(order, objID)
+		return nil
+	})
+	if err != nil || len(order) != 2 || order[0] != objs[2].ID {
+		t.Errorf("Objects are not read in the order they are stored : %v, %v\n", order, err)
+	}
+	if err := b.Read(repoID, packObjID(100), &buf); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error of reading missing object : %v\n", err)
+	}
+
+	// Removed objects are gone after the pack is opened again, and their space is reclaimed by repacking.
+	for _, obj := range objs[:4] {
+		if err := b.Remove(repoID, obj.ID); err != nil {
+			t.Fatalf("Failed to remove object : %v\n", err)
+		}
+	}
+	b, _ = newPackBackend(dataDir, "fs")
+	if exists, _ := b.Exists(repoID, objs[0].ID); exists {
+		t.Errorf("Removed object exists\n")
+	}
+	info, _ := os.Stat(b.packPath(repoID))
+	reclaimed, err := b.Repack(repoID)
+	if err != nil || reclaimed == 0 {
+		t.Fatalf("Failed to repack : %v\n", err)
+	}
+	repacked, _ := os.Stat(b.packPath(repoID))
+	if info.Size()-repacked.Size() != reclaimed {
+		t.Errorf("Reclaimed %d bytes, pack size changed from %d to %d\n", reclaimed, info.Size(), repacked.Size())
+	}
+	listed := 0
+	b.List(repoID, func(objID string) error { listed++; return nil })
+	if listed != 6 {
+		t.Errorf("Listed %d objects after repacking, expected 6\n", listed)
+	}
+	buf.Reset()
+	if err := b.Read(repoID, objs[9].ID, &buf); err != nil || !bytes.Equal(buf.Bytes(), objs[9].Data) {
+		t.Errorf("Failed to read object after repacking : %v\n", err)
+	}
+
+	// A pack without objects is removed.
+	for _, obj := range objs[4:] {
+		b.Remove(repoID, obj.ID)
+	}
+	if _, err := b.Repack(repoID); err != nil {
+		t.Fatalf("Failed to repack : %v\n", err)
+	}
+	if _, err := os.Stat(b.packPath(repoID)); !os.IsNotExist(err) {
+		t.Errorf("Empty pack is not removed\n")
+	}
+}
+
+func TestPackRecovery(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "objstore-pack")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	b, err := newPackBackend(dataDir, "fs")
+	if err != nil {
+		t.Fatalf("Failed to create pack backend : %v\n", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Write(repoID, packObjID(i), bytes.NewReader([]byte("content")), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	info, _ := os.Stat(b.packPath(repoID))
+
+	// The index lost its last record, and the pack has a partially written record.
+	idx, _ := ioutil.ReadFile(b.indexPath(repoID))
+	ioutil.WriteFile(b.indexPath(repoID), idx[:len(idx)-packIndexRecordSize], 0644)
+	f, _ := os.OpenFile(b.packPath(repoID), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(packObjID(3) + "\x00\x00\x01\x00partial"))
+	f.Close()
+
+	b, _ = newPackBackend(dataDir, "fs")
+	for i := 0; i < 3; i++ {
+		if exists, err := b.Exists(repoID, packObjID(i)); !exists {
+			t.Errorf("Object %d is not recovered : %v\n", i, err)
+		}
+	}
+	if exists, _ := b.Exists(repoID, packObjID(3)); exists {
+		t.Errorf("Partially written object exists\n")
+	}
+	if recovered, _ := os.Stat(b.packPath(repoID)); recovered.Size() != info.Size() {
+		t.Errorf("Partially written record is not truncated\n")
+	}
+}
+
+func TestPackSharedByProcesses(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "objstore-pack")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	// The backends stand for a server and a GC process using the same packs.
+	server, err := newPackBackend(dataDir, "fs")
+	if err != nil {
+		t.Fatalf("Failed to create pack backend : %v\n", err)
+	}
+	gc, _ := newPackBackend(dataDir, "fs")
+	for i := 0; i < 4; i++ {
+		if err := server.Write(repoID, packObjID(i), bytes.NewReader([]byte(packObjID(i))), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	// Objects appended by one process are found by the other one.
+	if exists, err := gc.Exists(repoID, packObjID(3)); !exists {
+		t.Fatalf("Object written by another process is not found : %v\n", err)
+	}
+	if err := gc.Remove(repoID, packObjID(0)); err != nil {
+		t.Fatalf("Failed to remove object : %v\n", err)
+	}
+	if exists, _ := server.Exists(repoID, packObjID(0)); exists {
+		t.Errorf("Object removed by another process exists\n")
+	}
+
+	// The server keeps using the pack after it's replaced by repacking.
+	if _, err := gc.Repack(repoID); err != nil {
+		t.Fatalf("Failed to repack : %v\n", err)
+	}
+	if err := server.Write(repoID, packObjID(4), bytes.NewReader([]byte(packObjID(4))), false); err != nil {
+		t.Fatalf("Failed to write object after repacking : %v\n", err)
+	}
+	if err := gc.Remove(repoID, packObjID(1)); err != nil {
+		t.Fatalf("Failed to remove object : %v\n", err)
+	}
+
+	// Writes and repacks of both processes run concurrently.
+	done := make(chan error)
+	go func() {
+		for i := 5; i < 100; i++ {
+			if err := server.Write(repoID, packObjID(i), bytes.NewReader([]byte(packObjID(i))), false); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 20; i++ {
+		tmpID := packObjID(1000 + i)
+		gc.Write(repoID, tmpID, bytes.NewReader([]byte(tmpID)), false)
+		gc.Remove(repoID, tmpID)
+		if _, err := gc.Repack(repoID); err != nil {
+			t.Fatalf("Failed to repack : %v\n", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to write object while repacking : %v\n", err)
+	}
+
+	reopened, _ := newPackBackend(dataDir, "fs")
+	for _, b := range []*packBackend{server, gc, reopened} {
+		for i := 0; i < 100; i++ {
+			var buf bytes.Buffer
+			err := b.Read(repoID, packObjID(i), &buf)
+			if i < 2 {
+				if !os.IsNotExist(err) {
+					t.Errorf("Removed object %d is read : %v\n", i, err)
+				}
+				continue
+			}
+			if err != nil || buf.String() != packObjID(i) {
+				t.Errorf("Failed to read object %d : %v\n", i, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,406 @@
+// Implementation of a backend replicating objects to several other backends.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// A replica is tried after the healthy ones for this long after it fails.
+	replicaFailureBackoff = 30 * time.Second
+	replicaRepairQueueLen = 1000
+	replicaRepairWorkers  = 2
+)
+
+var (
+	replicaErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_replica_errors_total",
+		Help: "Number of failed operations on replicas by object type, replica and operation.",
+	}, []string{"type", "replica", "op"})
+	replicaRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_replica_repairs_total",
+		Help: "Number of objects copied to replicas missing them by object type and result.",
+	}, []string{"type", "result"})
+)
+
+type replica struct {
+	name    string
+	backend Backend
+	// failedUntil is the unix time in nanoseconds until which the replica is considered unhealthy.
+	failedUntil int64
+}
+
+func (r *replica) healthy() bool {
+	return atomic.LoadInt64(&r.failedUntil) < time.Now().UnixNano()
+}
+
+func (r *replica) fail(objType, op string, err error) {
+	if os.IsNotExist(err) || IsContextError(err) {
+		return
+	}
+	atomic.StoreInt64(&r.failedUntil, time.Now().Add(replicaFailureBackoff).UnixNano())
+	replicaErrors.WithLabelValues(objType, r.name, op).Inc()
+}
+
+type repairJob struct {
+	repoID string
+	objID  string
+	// targets are the indexes of the replicas missing the object.
+	targets []int
+}
+
+// replicatedBackend writes objects to all replicas and reads them from the first
+// healthy replica that has them. Replicas that fail to read or write an object get
+// a copy of it from another replica in the background.
+type replicatedBackend struct {
+	objType  string
+	replicas []*replica
+	// Number of replicas that must succeed for a write to succeed.
+	writeQuorum int
+	repairs     chan repairJob
+}
+
+// newReplicatedBackend creates the replicas from the child sections of section, in the order
+// they appear in seafile.conf. The name of a replica is not inherited from section, it defaults
+// to an fs backend. Compression is set in section for all replicas, objects are compressed
+// once before they are written to the replicas. For example:
+//
+//	[block_backend]
+//	name = replicated
+//	write_quorum = 2
+//
+//	[block_backend.disk1]
+//	name = fs
+//	dir = /mnt/disk1/seafile-data
+//
+//	[block_backend.disk2]
+//	name = fs
+//	dir = /mnt/disk2/seafile-data
+func newReplicatedBackend(seafileDataDir string, objType string, section *ini.Section) (*replicatedBackend, error) {
+	if section == nil {
+		err := fmt.Errorf("no section for replicated %s backend", objType)
+		return nil, err
+	}
+
+	b := new(replicatedBackend)
+	b.objType = objType
+	for _, child := range section.ChildSections() {
+		backendName := "fs"
+		if key, ok := ownKey(child, "name"); ok && key.String() != "" {
+			backendName = key.String()
+		}
+		factory, ok := getBackendFactory(backendName)
+		if !ok {
+			err := fmt.Errorf("unknown backend %s in section %s", backendName, child.Name())
+			return nil, err
+		}
+		backend, err := factory(seafileDataDir, objType, child)
+		if err != nil {
+			err := fmt.Errorf("failed to create backend of section %s: %v", child.Name(), err)
+			return nil, err
+		}
+		if _, ok := ownKey(child, "compression"); ok {
+			err := fmt.Errorf("compression of replicas must be set in section %s instead of %s", section.Name(), child.Name())
+			return nil, err
+		}
+		b.replicas = append(b.replicas, &replica{name: child.Name(), backend: backend})
+	}
+	if len(b.replicas) < 2 {
+		err := fmt.Errorf("replicated backend of section %s needs at least 2 replicas", section.Name())
+		return nil, err
+	}
+
+	b.writeQuorum = len(b.replicas)/2 + 1
+	if key, err := section.GetKey("write_quorum"); err == nil {
+		n, err := key.Int()
+		if err != nil || n < 1 || n > len(b.replicas) {
+			err := fmt.Errorf("write_quorum of section %s must be between 1 and %d", section.Name(), len(b.replicas))
+			return nil, err
+		}
+		b.writeQuorum = n
+	}
+
+	if backgroundTasks {
+		b.startRepair()
+	}
+	return b, nil
+}
+
+func (b *replicatedBackend) startRepair() {
+	b.repairs = make(chan repairJob, replicaRepairQueueLen)
+	for i := 0; i < replicaRepairWorkers; i++ {
+		go func() {
+			for job := range b.repairs {
+				b.repair(job)
+			}
+		}()
+	}
+}
+
+// order returns the indexes of the replicas, healthy replicas first.
+func (b *replicatedBackend) order() []int {
+	order := make([]int, 0, len(b.replicas))
+	var unhealthy []int
+	for i, r := range b.replicas {
+		if r.healthy() {
+			order = append(order, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return append(order, unhealthy...)
+}
+
+func (b *replicatedBackend) queueRepair(repoID, objID string, targets []int) {
+	if len(targets) == 0 || b.repairs == nil {
+		return
+	}
+	select {
+	case b.repairs <- repairJob{repoID, objID, targets}:
+	default:
+		log.Printf("Repair queue of replicated %s backend is full, %s/%s is not repaired", b.objType, repoID, objID)
+	}
+}
+
+func (b *replicatedBackend) repair(job repairJob) {
+	var data []byte
+	skip := make(map[int]bool)
+	for _, i := range job.targets {
+		skip[i] = true
+	}
+	for _, i := range b.order() {
+		if skip[i] {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := b.replicas[i].backend.Read(job.repoID, job.objID, &buf); err == nil {
+			data = buf.Bytes()
+			break
+		}
+	}
+	if data == nil {
+		replicaRepairs.WithLabelValues(b.objType, "failed").Inc()
+		log.Printf("Failed to repair %s object %s/%s: no replica can read it", b.objType, job.repoID, job.objID)
+		return
+	}
+
+	for _, i := range job.targets {
+		r := b.replicas[i]
+		if err := r.backend.Write(job.repoID, job.objID, bytes.NewReader(data), false); err != nil {
+			r.fail(b.objType, "repair", err)
+			replicaRepairs.WithLabelValues(b.objType, "failed").Inc()
+			log.Printf("Failed to repair %s object %s/%s in %s: %v", b.objType, job.repoID, job.objID, r.name, err)
+			continue
+		}
+		replicaRepairs.WithLabelValues(b.objType, "repaired").Inc()
+	}
+}
+
+// Read reads the object from the first replica that can read it.
+// The content is buffered, so that a replica failing in the middle of a read doesn't
+// leave partial content in w.
+func (b *replicatedBackend) Read(repoID string, objID string, w io.Writer) error {
+	return b.ReadCtx(context.Background(), repoID, objID, w)
+}
+
+func (b *replicatedBackend) ReadCtx(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	var failed []int
+	var firstErr error
+	for _, i := range b.order() {
+		r := b.replicas[i]
+		var buf bytes.Buffer
+		err := readCtx(ctx, r.backend, repoID, objID, &buf)
+		if IsContextError(err) {
+			return err
+		}
+		if err != nil {
+			r.fail(b.objType, "read", err)
+			failed = append(failed, i)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		b.queueRepair(repoID, objID, failed)
+		_, err = w.Write(buf.Bytes())
+		return err
+	}
+	return firstErr
+}
+
+// Write writes the object to all replicas in parallel, it succeeds if at least
+// writeQuorum replicas succeed. Failed replicas are repaired in the background.
+func (b *replicatedBackend) Write(repoID string, objID string, r io.Reader, fsync bool) error {
+	return b.WriteCtx(context.Background(), repoID, objID, r, fsync)
+}
+
+func (b *replicatedBackend) WriteCtx(ctx context.Context, repoID string, objID string, r io.Reader, fsync bool) error {
+	data, err := ioutil.ReadAll(&ctxReader{ctx, r})
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, rep := range b.replicas {
+		wg.Add(1)
+		go func(i int, rep *replica) {
+			defer wg.Done()
+			errs[i] = writeCtx(ctx, rep.backend, repoID, objID, bytes.NewReader(data), fsync)
+		}(i, rep)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var failed []int
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			b.replicas[i].fail(b.objType, "write", err)
+			failed = append(failed, i)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", b.replicas[i].name, err)
+			}
+		}
+	}
+	if len(b.replicas)-len(failed) < b.writeQuorum {
+		err := fmt.Errorf("failed to write object %s/%s to %d of %d replicas: %v",
+			repoID, objID, len(failed), len(b.replicas), firstErr)
+		return err
+	}
+	b.queueRepair(repoID, objID, failed)
+	return nil
+}
+
+// Exists checks whether any replica has the object.
+func (b *replicatedBackend) Exists(repoID string, objID string) (bool, error) {
+	return b.ExistsCtx(context.Background(), repoID, objID)
+}
+
+func (b *replicatedBackend) ExistsCtx(ctx context.Context, repoID string, objID string) (bool, error) {
+	var res bool
+	var err error
+	for _, i := range b.order() {
+		res, err = existsCtx(ctx, b.replicas[i].backend, repoID, objID)
+		if res && err == nil {
+			return true, nil
+		}
+	}
+	return res, err
+}
+
+// Stat returns the size of the object in the first replica that has it.
+func (b *replicatedBackend) Stat(repoID string, objID string) (int64, error) {
+	return b.StatCtx(context.Background(), repoID, objID)
+}
+
+func (b *replicatedBackend) StatCtx(ctx context.Context, repoID string, objID string) (int64, error) {
+	var firstErr error
+	for _, i := range b.order() {
+		size, err := statCtx(ctx, b.replicas[i].backend, repoID, objID)
+		if err == nil {
+			return size, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return -1, firstErr
+}
+
+// Remove removes the object from all replicas.
+func (b *replicatedBackend) Remove(repoID string, objID string) error {
+	var firstErr error
+	for _, r := range b.replicas {
+		if err := r.backend.Remove(repoID, objID); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", r.name, err)
+		}
+	}
+	return firstErr
+}
+
+// quarantine quarantines the damaged copies of an object in every replica. Replicas with
+// damaged copies are marked failed, and the copies are repaired from intact ones in the background.
+func (b *replicatedBackend) quarantine(repoID string, objID string, valid func(data []byte) bool, save func(data []byte) error) error {
+	var damaged []int
+	var firstErr error
+	for i, r := range b.replicas {
+		removed := false
+		err := quarantineCopies(r.backend, repoID, objID, valid, func(data []byte) error {
+			removed = true
+			return save(data)
+		})
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", r.name, err)
+		}
+		if removed {
+			r.fail(b.objType, "checksum", &ChecksumError{ObjType: b.objType, RepoID: repoID, ObjID: objID})
+			damaged = append(damaged, i)
+		}
+	}
+	b.queueRepair(repoID, objID, damaged)
+	return firstErr
+}
+
+// List calls fn for every object of a repo in any replica.
+func (b *replicatedBackend) List(repoID string, fn func(objID string) error) error {
+	return b.union(func(backend Backend, fn func(string) error) error {
+		return backend.List(repoID, fn)
+	}, fn)
+}
+
+// ListRepos calls fn for every repo that has objects in any replica.
+func (b *replicatedBackend) ListRepos(fn func(repoID string) error) error {
+	return b.union(func(backend Backend, fn func(string) error) error {
+		return backend.ListRepos(fn)
+	}, fn)
+}
+
+// union calls fn once for every name listed by any replica.
+// Replicas failing to list are skipped, an error is returned only if all of them fail.
+func (b *replicatedBackend) union(list func(backend Backend, fn func(string) error) error, fn func(string) error) error {
+	seen := make(map[string]bool)
+	var fnErr, listErr error
+	listed := false
+	for _, r := range b.replicas {
+		err := list(r.backend, func(name string) error {
+			if seen[name] {
+				return nil
+			}
+			seen[name] = true
+			fnErr = fn(name)
+			return fnErr
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			r.fail(b.objType, "list", err)
+			log.Printf("Failed to list %s objects in %s: %v", b.objType, r.name, err)
+			if listErr == nil {
+				listErr = err
+			}
+			continue
+		}
+		listed = true
+	}
+	if !listed {
+		return listErr
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package objstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// lockedBackend serializes the operations on a backend and can be made to fail.
+type lockedBackend struct {
+	lock    sync.Mutex
+	backend Backend
+	broken  bool
+}
+
+var errBroken = errors.New("backend is broken")
+
+func newLockedBackend() *lockedBackend {
+	return &lockedBackend{backend: &memBackend{objects: make(map[string][]byte)}}
+}
+
+func (b *lockedBackend) Read(repoID string, objID string, w io.Writer) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.broken {
+		return errBroken
+	}
+	return b.backend.Read(repoID, objID, w)
+}
+
+func (b *lockedBackend) Write(repoID string, objID string, r io.Reader, sync bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.broken {
+		return errBroken
+	}
+	return b.backend.Write(repoID, objID, r, sync)
+}
+
+func (b *lockedBackend) Exists(repoID string, objID string) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.backend.Exists(repoID, objID)
+}
+
+func (b *lockedBackend) Stat(repoID string, objID string) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.backend.Stat(repoID, objID)
+}
+
+func (b *lockedBackend) Remove(repoID string, objID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.backend.Remove(repoID, objID)
+}
+
+func (b *lockedBackend) List(repoID string, fn func(objID string) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.broken {
+		return errBroken
+	}
+	return b.backend.List(repoID, fn)
+}
+
+func (b *lockedBackend) ListRepos(fn func(repoID string) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.backend.ListRepos(fn)
+}
+
+func (b *lockedBackend) setBroken(broken bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.broken = broken
+}
+
+func newTestReplicatedBackend(n, quorum int) (*replicatedBackend, []*lockedBackend) {
+	b := &replicatedBackend{objType: "blocks", writeQuorum: quorum}
+	var backends []*lockedBackend
+	for i := 0; i < n; i++ {
+		backend := newLockedBackend()
+		backends = append(backends, backend)
+		b.replicas = append(b.replicas, &replica{name: string(rune('a' + i)), backend: backend})
+	}
+	b.startRepair()
+	return b, backends
+}
+
+func waitForObject(backend Backend, objID string) bool {
+	for i := 0; i < 100; i++ {
+		if ok, _ := backend.Exists(repoID, objID); ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestReplicatedWrite(t *testing.T) {
+	b, backends := newTestReplicatedBackend(3, 2)
+	content := []byte("hello world!\n")
+
+	backends[2].setBroken(true)
+	if err := b.Write(repoID, objID, bytes.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write with a broken replica : %v\n", err)
+	}
+	backends[1].setBroken(true)
+	if err := b.Write(repoID, "other", bytes.NewReader(content), false); err == nil {
+		t.Errorf("Write succeeded without quorum\n")
+	}
+
+	// The broken replica gets the object when it comes back.
+	backends[1].setBroken(false)
+	backends[2].setBroken(false)
+	b.queueRepair(repoID, objID, []int{2})
+	if !waitForObject(backends[2], objID) {
+		t.Errorf("Broken replica is not repaired\n")
+	}
+}
+
+func TestReplicatedRead(t *testing.T) {
+	b, backends := newTestReplicatedBackend(2, 2)
+	content := []byte("hello world!\n")
+	if err := b.Write(repoID, objID, bytes.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	// Reading an object missing in the first replica falls back to the second and repairs the first.
+	backends[0].Remove(repoID, objID)
+	var buf bytes.Buffer
+	if err := b.Read(repoID, objID, &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Fatalf("Failed to read object : %v\n", err)
+	}
+	if !waitForObject(backends[0], objID) {
+		t.Errorf("Missing replica is not repaired\n")
+	}
+
+	// Broken replicas are tried last.
+	backends[0].setBroken(true)
+	buf.Reset()
+	if err := b.Read(repoID, objID, &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Fatalf("Failed to read object : %v\n", err)
+	}
+	if order := b.order(); order[0] != 1 {
+		t.Errorf("Broken replica is tried first : %v\n", order)
+	}
+
+	var listed []string
+	if err := b.List(repoID, func(id string) error { listed = append(listed, id); return nil }); err != nil {
+		t.Errorf("Failed to list objects with a broken replica : %v\n", err)
+	}
+	if len(listed) != 1 || listed[0] != objID {
+		t.Errorf("Unexpected objects %v\n", listed)
+	}
+}
+
+func TestReplicatedQuarantine(t *testing.T) {
+	b, backends := newTestReplicatedBackend(3, 2)
+	content := []byte("hello world!\n")
+	damaged := []byte("hello world?\n")
+	backends[0].Write(repoID, objID, bytes.NewReader(content), false)
+	backends[1].Write(repoID, objID, bytes.NewReader(damaged), false)
+	backends[2].Write(repoID, objID, bytes.NewReader(content), false)
+
+	quarantineDir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatalf("Failed to create quarantine dir : %v\n", err)
+	}
+	defer os.RemoveAll(quarantineDir)
+	s := NewWithBackend("blocks", b)
+	s.quarantineDir = quarantineDir
+
+	valid := func(data []byte) bool { return bytes.Equal(data, content) }
+	if err := s.Quarantine(repoID, objID, valid, errBroken); err != nil {
+		t.Fatalf("Failed to quarantine object : %v\n", err)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(quarantineDir, repoID, objID)); err != nil || !bytes.Equal(data, damaged) {
+		t.Errorf("Damaged copy is not moved to quarantine : %v\n", err)
+	}
+	if b.replicas[1].healthy() || !b.replicas[0].healthy() || !b.replicas[2].healthy() {
+		t.Errorf("Replica with damaged copy is not marked failed\n")
+	}
+	// The damaged copy is repaired from an intact one, intact copies are kept.
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		if backends[1].Read(repoID, objID, &buf) == nil && valid(buf.Bytes()) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, backend := range backends {
+		var buf bytes.Buffer
+		if err := backend.Read(repoID, objID, &buf); err != nil || !valid(buf.Bytes()) {
+			t.Errorf("Copy of replica %d is not intact : %v\n", i, err)
+		}
+	}
+}
+
+func TestReplicatedConfig(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-conf")
+	if err != nil {
+		t.Fatalf("Failed to create conf dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+
+	disk1 := filepath.Join(confDir, "disk1")
+	disk2 := filepath.Join(confDir, "disk2")
+	conf := "[block_backend]\nname = replicated\nwrite_quorum = 2\ncompression = zstd\n\n" +
+		"[block_backend.disk1]\nname = fs\ndir = " + disk1 + "\n\n" +
+		"[block_backend.disk2]\ndir = " + disk2 + "\n\n" +
+		"[fs_object_backend]\nname = replicated\n\n" +
+		"[fs_object_backend.disk1]\ndir = " + disk1 + "\ncompression = zstd\n\n" +
+		"[fs_object_backend.disk2]\ndir = " + disk2 + "\n"
+	err = ioutil.WriteFile(filepath.Join(confDir, "seafile.conf"), []byte(conf), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write seafile.conf : %v\n", err)
+	}
+
+	s, err := New(confDir, confDir, "blocks")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
+	content := bytes.Repeat([]byte("hello"), 100)
+	if err := s.Write(repoID, objID, bytes.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	for _, dir := range []string{disk1, disk2} {
+		p := filepath.Join(dir, "storage", "blocks", repoID, objID[:2], objID[2:])
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("Object is not written to %s : %v\n", dir, err)
+			continue
+		}
+		// The object is compressed once for all replicas.
+		decoder, _ := zstd.NewReader(nil)
+		decoded, err := decoder.DecodeAll(data[compressHeaderSize:], nil)
+		if !bytes.HasPrefix(data, compressMagic) || err != nil || !bytes.Equal(decoded, content) {
+			t.Errorf("Object is not compressed once in %s : %v\n", dir, err)
+		}
+	}
+
+	if _, err := New(confDir, confDir, "fs"); err == nil {
+		t.Errorf("Compression of a single replica is accepted\n")
+	}
+}
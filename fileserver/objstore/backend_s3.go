@@ -0,0 +1,560 @@
+// Implementation of S3 compatible storage backend.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+const (
+	s3DefaultRegion             = "us-east-1"
+	s3DefaultMultipartThreshold = 1 << 24
+	s3DefaultPartSize           = 1 << 23
+	// S3 requires every part except the last one to be at least 5MB.
+	s3MinPartSize = 5 << 20
+	s3Service     = "s3"
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3TimeFormat  = "20060102T150405Z"
+	s3DateFormat  = "20060102"
+)
+
+type s3Backend struct {
+	bucket    string
+	keyID     string
+	key       string
+	region    string
+	host      string
+	useHTTPS  bool
+	pathStyle bool
+	// Objects larger than multipartThreshold are uploaded in parts of partSize bytes.
+	multipartThreshold int64
+	partSize           int64
+	client             *http.Client
+}
+
+func newS3Backend(section *ini.Section) (*s3Backend, error) {
+	backend := new(s3Backend)
+
+	key, err := section.GetKey("bucket")
+	if err != nil {
+		err := fmt.Errorf("no bucket in section %s", section.Name())
+		return nil, err
+	}
+	backend.bucket = key.String()
+
+	if key, err = section.GetKey("key_id"); err != nil {
+		err := fmt.Errorf("no key_id in section %s", section.Name())
+		return nil, err
+	}
+	backend.keyID = key.String()
+
+	if key, err = section.GetKey("key"); err != nil {
+		err := fmt.Errorf("no key in section %s", section.Name())
+		return nil, err
+	}
+	backend.key = key.String()
+
+	backend.region = s3DefaultRegion
+	if key, err = section.GetKey("aws_region"); err == nil {
+		backend.region = key.String()
+	}
+
+	backend.useHTTPS = true
+	if key, err = section.GetKey("use_https"); err == nil {
+		backend.useHTTPS, _ = key.Bool()
+	}
+
+	if key, err = section.GetKey("path_style_request"); err == nil {
+		backend.pathStyle, _ = key.Bool()
+	}
+
+	if key, err = section.GetKey("host"); err == nil {
+		backend.host = key.String()
+	} else {
+		backend.host = fmt.Sprintf("s3.%s.amazonaws.com", backend.region)
+	}
+
+	backend.multipartThreshold = s3DefaultMultipartThreshold
+	if key, err = section.GetKey("multipart_threshold"); err == nil {
+		if threshold, err := key.Int64(); err == nil && threshold > 0 {
+			backend.multipartThreshold = threshold
+		}
+	}
+
+	backend.partSize = s3DefaultPartSize
+	if key, err = section.GetKey("multipart_part_size"); err == nil {
+		if size, err := key.Int64(); err == nil && size >= s3MinPartSize {
+			backend.partSize = size
+		}
+	}
+
+	backend.client = &http.Client{}
+
+	return backend, nil
+}
+
+func (b *s3Backend) objectKey(repoID string, objID string) string {
+	return repoID + "/" + objID
+}
+
+func (b *s3Backend) objectURL(objKey string, query url.Values) *url.URL {
+	u := new(url.URL)
+	if b.useHTTPS {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	if b.pathStyle {
+		u.Host = b.host
+		u.Path = "/" + b.bucket + "/" + objKey
+	} else {
+		u.Host = b.bucket + "." + b.host
+		u.Path = "/" + objKey
+	}
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return u
+}
+
+// newRequest creates a request signed with AWS signature version 4.
+// The request is cancelled when ctx is done.
+func (b *s3Backend) newRequest(ctx context.Context, method string, objKey string, query url.Values, body []byte) (*http.Request, error) {
+	u := b.objectURL(objKey, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := sha256.Sum256(body)
+	b.sign(req, u, hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+
+	return req, nil
+}
+
+func (b *s3Backend) sign(req *http.Request, u *url.URL, payloadHash string, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	date := now.Format(s3DateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name)
+		canonHeaders.WriteByte(':')
+		canonHeaders.WriteString(headers[name])
+		canonHeaders.WriteByte('\n')
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, b.region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+b.key), date)
+	signingKey = hmacSHA256(signingKey, b.region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	auth := fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, b.keyID, scope, signedHeaders, signature)
+	req.Header.Set("Authorization", auth)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by key, as required by signature version 4.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func (b *s3Backend) do(req *http.Request) (*http.Response, error) {
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		// Report cancellation as the context error, so that callers can tell it from failures.
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		rsp.Body.Close()
+		err := fmt.Errorf("s3 request %s %s failed with status %d: %s", req.Method, req.URL.Path, rsp.StatusCode, msg)
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (b *s3Backend) Read(repoID string, objID string, w io.Writer) error {
+	return b.ReadCtx(context.Background(), repoID, objID, w)
+}
+
+func (b *s3Backend) ReadCtx(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	req, err := b.newRequest(ctx, http.MethodGet, b.objectKey(repoID, objID), nil, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	_, err = io.Copy(w, rsp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (b *s3Backend) Write(repoID string, objID string, r io.Reader, sync bool) error {
+	return b.WriteCtx(context.Background(), repoID, objID, r, sync)
+}
+
+func (b *s3Backend) WriteCtx(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	objKey := b.objectKey(repoID, objID)
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, b.multipartThreshold+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n <= b.multipartThreshold {
+		return b.putObject(ctx, objKey, buf.Bytes())
+	}
+
+	return b.multipartUpload(ctx, objKey, io.MultiReader(&buf, r))
+}
+
+func (b *s3Backend) putObject(ctx context.Context, objKey string, data []byte) error {
+	req, err := b.newRequest(ctx, http.MethodPut, objKey, nil, data)
+	if err != nil {
+		return err
+	}
+	rsp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+
+	return nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func (b *s3Backend) multipartUpload(ctx context.Context, objKey string, r io.Reader) error {
+	query := url.Values{"uploads": []string{""}}
+	req, err := b.newRequest(ctx, http.MethodPost, objKey, query, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	var initResult s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(rsp.Body).Decode(&initResult)
+	rsp.Body.Close()
+	if err != nil {
+		err := fmt.Errorf("failed to parse initiate multipart upload result: %v", err)
+		return err
+	}
+	uploadID := initResult.UploadID
+
+	parts, err := b.uploadParts(ctx, objKey, uploadID, r)
+	if err != nil {
+		b.abortMultipartUpload(objKey, uploadID)
+		return err
+	}
+
+	complete := s3CompleteMultipartUpload{Parts: parts}
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		b.abortMultipartUpload(objKey, uploadID)
+		return err
+	}
+	query = url.Values{"uploadId": []string{uploadID}}
+	req, err = b.newRequest(ctx, http.MethodPost, objKey, query, body)
+	if err != nil {
+		b.abortMultipartUpload(objKey, uploadID)
+		return err
+	}
+	rsp, err = b.do(req)
+	if err != nil {
+		b.abortMultipartUpload(objKey, uploadID)
+		return err
+	}
+	rsp.Body.Close()
+
+	return nil
+}
+
+func (b *s3Backend) uploadParts(ctx context.Context, objKey string, uploadID string, r io.Reader) ([]s3CompletedPart, error) {
+	var parts []s3CompletedPart
+	buf := make([]byte, b.partSize)
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		query := url.Values{
+			"partNumber": []string{strconv.Itoa(partNumber)},
+			"uploadId":   []string{uploadID},
+		}
+		req, err := b.newRequest(ctx, http.MethodPut, objKey, query, buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := b.do(req)
+		if err != nil {
+			return nil, err
+		}
+		rsp.Body.Close()
+		parts = append(parts, s3CompletedPart{partNumber, rsp.Header.Get("ETag")})
+
+		if int64(n) < b.partSize {
+			break
+		}
+	}
+
+	return parts, nil
+}
+
+// abortMultipartUpload isn't cancelled with the upload, so that the parts are removed.
+func (b *s3Backend) abortMultipartUpload(objKey string, uploadID string) {
+	query := url.Values{"uploadId": []string{uploadID}}
+	req, err := b.newRequest(context.Background(), http.MethodDelete, objKey, query, nil)
+	if err != nil {
+		return
+	}
+	rsp, err := b.do(req)
+	if err != nil {
+		return
+	}
+	rsp.Body.Close()
+}
+
+func (b *s3Backend) head(ctx context.Context, repoID string, objID string) (*http.Response, error) {
+	req, err := b.newRequest(ctx, http.MethodHead, b.objectKey(repoID, objID), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	return rsp, nil
+}
+
+func (b *s3Backend) Exists(repoID string, objID string) (bool, error) {
+	return b.ExistsCtx(context.Background(), repoID, objID)
+}
+
+func (b *s3Backend) ExistsCtx(ctx context.Context, repoID string, objID string) (bool, error) {
+	rsp, err := b.head(ctx, repoID, objID)
+	if err != nil {
+		return false, err
+	}
+	if rsp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("s3 head object %s/%s failed with status %d", repoID, objID, rsp.StatusCode)
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *s3Backend) Stat(repoID string, objID string) (int64, error) {
+	return b.StatCtx(context.Background(), repoID, objID)
+}
+
+func (b *s3Backend) StatCtx(ctx context.Context, repoID string, objID string) (int64, error) {
+	rsp, err := b.head(ctx, repoID, objID)
+	if err != nil {
+		return -1, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("s3 head object %s/%s failed with status %d", repoID, objID, rsp.StatusCode)
+		return -1, err
+	}
+	return rsp.ContentLength, nil
+}
+
+// Remove deletes an object, S3 doesn't report an error when the object doesn't exist.
+func (b *s3Backend) Remove(repoID string, objID string) error {
+	req, err := b.newRequest(context.Background(), http.MethodDelete, b.objectKey(repoID, objID), nil, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listBucket lists the keys under prefix with ListObjectsV2, following continuation tokens.
+// If delimiter is not empty, keys are rolled up into common prefixes and fn is called with those instead.
+func (b *s3Backend) listBucket(prefix string, delimiter string, fn func(key string) error) error {
+	var token string
+	for {
+		query := url.Values{
+			"list-type": []string{"2"},
+			"prefix":    []string{prefix},
+		}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := b.newRequest(context.Background(), http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		rsp, err := b.do(req)
+		if err != nil {
+			return err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(rsp.Body).Decode(&result)
+		rsp.Body.Close()
+		if err != nil {
+			err := fmt.Errorf("failed to parse list objects result: %v", err)
+			return err
+		}
+
+		for _, content := range result.Contents {
+			if err := fn(content.Key); err != nil {
+				return err
+			}
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			if err := fn(commonPrefix.Prefix); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// List calls fn for every object of a repo.
+func (b *s3Backend) List(repoID string, fn func(objID string) error) error {
+	prefix := repoID + "/"
+	return b.listBucket(prefix, "", func(key string) error {
+		return fn(strings.TrimPrefix(key, prefix))
+	})
+}
+
+// ListRepos calls fn for every repo that has objects in the bucket.
+func (b *s3Backend) ListRepos(fn func(repoID string) error) error {
+	return b.listBucket("", "/", func(key string) error {
+		if !strings.HasSuffix(key, "/") {
+			return nil
+		}
+		return fn(strings.TrimSuffix(key, "/"))
+	})
+}
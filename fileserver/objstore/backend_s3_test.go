@@ -0,0 +1,278 @@
+package objstore
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// fakeS3 is an in-memory stand-in for an S3 compatible server using path style requests.
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3() *fakeS3 {
+	s := new(fakeS3)
+	s.objects = make(map[string][]byte)
+	s.uploads = make(map[string]map[int][]byte)
+	return s
+}
+
+func (s *fakeS3) ServeHTTP(rsp http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), s3Algorithm) {
+		rsp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	objKey := r.URL.Path
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		var complete s3CompleteMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			rsp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parts := s.uploads[query.Get("uploadId")]
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, parts[part.PartNumber]...)
+		}
+		s.objects[objKey] = data
+		delete(s.uploads, query.Get("uploadId"))
+	case r.Method == http.MethodPost:
+		s.nextID++
+		uploadID := fmt.Sprintf("upload-%d", s.nextID)
+		s.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(rsp, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		var partNumber int
+		fmt.Sscanf(query.Get("partNumber"), "%d", &partNumber)
+		s.uploads[query.Get("uploadId")][partNumber] = body
+		rsp.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", partNumber))
+	case r.Method == http.MethodPut:
+		s.objects[objKey] = body
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+	case r.Method == http.MethodDelete:
+		delete(s.objects, objKey)
+		rsp.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.listObjects(rsp, objKey, query)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		data, ok := s.objects[objKey]
+		if !ok {
+			rsp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rsp.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		rsp.Write(data)
+	}
+}
+
+// listObjects returns at most two keys per page to exercise continuation tokens.
+func (s *fakeS3) listObjects(rsp http.ResponseWriter, bucketPath string, query url.Values) {
+	prefix := strings.TrimSuffix(bucketPath, "/") + "/" + query.Get("prefix")
+	var keys []string
+	seen := make(map[string]bool)
+	for objKey := range s.objects {
+		if !strings.HasPrefix(objKey, prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(objKey, strings.TrimSuffix(bucketPath, "/")+"/")
+		if delimiter := query.Get("delimiter"); delimiter != "" {
+			rest := strings.TrimPrefix(key, query.Get("prefix"))
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				key = query.Get("prefix") + rest[:i+len(delimiter)]
+			}
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := start + 2
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	var result s3ListBucketResult
+	for _, key := range keys[start:end] {
+		if strings.HasSuffix(key, "/") {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{key})
+		} else {
+			result.Contents = append(result.Contents, struct{ Key string }{key})
+		}
+	}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	xml.NewEncoder(rsp).Encode(&result)
+}
+
+func newTestS3Backend(t *testing.T, server *httptest.Server) *s3Backend {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse server url : %v\n", err)
+	}
+
+	cfg := ini.Empty()
+	section, _ := cfg.NewSection("block_backend")
+	section.NewKey("name", "s3")
+	section.NewKey("bucket", "seafile-blocks")
+	section.NewKey("key_id", "test-key-id")
+	section.NewKey("key", "test-key")
+	section.NewKey("host", u.Host)
+	section.NewKey("use_https", "false")
+	section.NewKey("path_style_request", "true")
+
+	backend, err := newS3Backend(section)
+	if err != nil {
+		t.Fatalf("Failed to create s3 backend : %v\n", err)
+	}
+	return backend
+}
+
+func TestS3Backend(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	backend := newTestS3Backend(t, server)
+
+	data := []byte("hello world!\n")
+	if err := backend.Write(repoID, objID, bytes.NewReader(data), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	if _, ok := fake.objects["/seafile-blocks/"+repoID+"/"+objID]; !ok {
+		t.Errorf("Object is not stored under repoID/objID in the bucket\n")
+	}
+
+	var buf bytes.Buffer
+	if err := backend.Read(repoID, objID, &buf); err != nil {
+		t.Fatalf("Failed to read object : %v\n", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Read data %q, want %q\n", buf.Bytes(), data)
+	}
+
+	exists, err := backend.Exists(repoID, objID)
+	if err != nil || !exists {
+		t.Errorf("Object is not exist : %v\n", err)
+	}
+	exists, err = backend.Exists(repoID, "0000000000000000000000000000000000000001")
+	if err != nil || exists {
+		t.Errorf("Missing object is reported to exist : %v\n", err)
+	}
+
+	size, err := backend.Stat(repoID, objID)
+	if err != nil || size != int64(len(data)) {
+		t.Errorf("Stat returned %d, want %d : %v\n", size, len(data), err)
+	}
+}
+
+func TestS3BackendMultipart(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	backend := newTestS3Backend(t, server)
+	backend.multipartThreshold = 1 << 10
+	backend.partSize = 1 << 9
+
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	if err := backend.Write(repoID, objID, bytes.NewReader(data), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	var buf bytes.Buffer
+	if err := backend.Read(repoID, objID, &buf); err != nil {
+		t.Fatalf("Failed to read object : %v\n", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Multipart upload stored %d bytes, want %d\n", buf.Len(), len(data))
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("Multipart upload is not completed\n")
+	}
+}
+
+func TestS3BackendList(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	backend := newTestS3Backend(t, server)
+
+	otherRepoID := "1c3ec28d-08bd-4cab-8cd5-3a3b7a6d2df0"
+	objIDs := []string{
+		"0401fc662e3bc87a41f299a907c056aaf8322a27",
+		"1b6453892473a467d07372d45eb05abc2031647a",
+		"da39a3ee5e6b4b0d3255bfef95601890afd80709",
+	}
+	for _, id := range objIDs {
+		if err := backend.Write(repoID, id, strings.NewReader(id), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	if err := backend.Write(otherRepoID, objIDs[0], strings.NewReader(objIDs[0]), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	var listed []string
+	err := backend.List(repoID, func(objID string) error {
+		listed = append(listed, objID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list objects : %v\n", err)
+	}
+	if strings.Join(listed, ",") != strings.Join(objIDs, ",") {
+		t.Errorf("Listed objects %v, want %v\n", listed, objIDs)
+	}
+
+	var repos []string
+	err = backend.ListRepos(func(repoID string) error {
+		repos = append(repos, repoID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list repos : %v\n", err)
+	}
+	if len(repos) != 2 {
+		t.Errorf("Listed repos %v, want 2 repos\n", repos)
+	}
+
+	if err := backend.Remove(repoID, objIDs[1]); err != nil {
+		t.Fatalf("Failed to remove object : %v\n", err)
+	}
+	if exists, _ := backend.Exists(repoID, objIDs[1]); exists {
+		t.Errorf("Removed object still exists\n")
+	}
+}
@@ -0,0 +1,724 @@
+// Implementation of a backend spreading objects across several local disks.
+package objstore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// Number of points a disk of weight 1 has on the hash ring.
+	shardVirtualNodes = 100
+	// Free space of a disk is checked at most once in this interval.
+	shardFreeSpaceInterval = 5 * time.Second
+	// Default of min_free_space in MB.
+	shardDefaultMinFreeSpace = 1024
+	shardRebalanceRetry      = 10 * time.Minute
+	shardKeyLocks            = 64
+)
+
+var (
+	shardFreeBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "seafile_shard_free_bytes",
+		Help: "Free space of the disks of sharded backends found by the last check by object type and disk.",
+	}, []string{"type", "disk"})
+	shardMoves = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_shard_moves_total",
+		Help: "Number of objects moved between disks by rebalancing by object type and result.",
+	}, []string{"type", "result"})
+)
+
+var errNoSpace = errors.New("no disk has enough free space")
+var errRebalancing = errors.New("rebalance is in progress")
+
+// statFreeSpace returns the number of bytes available in the file system of dir.
+var statFreeSpace = syscallFreeSpace
+
+func syscallFreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+type shardDisk struct {
+	name    string
+	dir     string
+	weight  int
+	minFree uint64
+	backend *fsBackend
+	// free is the free space found by the last check at checkedAt, in unix nanoseconds.
+	free      uint64
+	checkedAt int64
+}
+
+func (d *shardDisk) freeSpace() uint64 {
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&d.checkedAt) < int64(shardFreeSpaceInterval) {
+		return atomic.LoadUint64(&d.free)
+	}
+	free, err := statFreeSpace(d.dir)
+	if err != nil {
+		log.Printf("Failed to check free space of %s: %v", d.dir, err)
+		free = 0
+	}
+	atomic.StoreUint64(&d.free, free)
+	atomic.StoreInt64(&d.checkedAt, now)
+	shardFreeBytes.WithLabelValues(d.backend.objType, d.name).Set(float64(free))
+	return free
+}
+
+func (d *shardDisk) hasSpace() bool {
+	return d.freeSpace() >= d.minFree
+}
+
+// ringDisk is a disk of a hash ring as stored in the placement map.
+type ringDisk struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+type ringPoint struct {
+	hash uint64
+	disk *shardDisk
+}
+
+// shardRing is a consistent hash ring, a disk has a number of points proportional to its weight.
+type shardRing struct {
+	points []ringPoint
+}
+
+func shardHash(s string) uint64 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// newShardRing builds the ring of def, disks that are not configured are left out.
+func newShardRing(def []ringDisk, disks map[string]*shardDisk) *shardRing {
+	ring := new(shardRing)
+	for _, rd := range def {
+		disk, ok := disks[rd.Name]
+		if !ok {
+			continue
+		}
+		for i := 0; i < rd.Weight*shardVirtualNodes; i++ {
+			ring.points = append(ring.points, ringPoint{shardHash(rd.Name + "#" + strconv.Itoa(i)), disk})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+// walk calls fn for the disks in the order they follow key on the ring, until fn returns false.
+// The first disk is the owner of key.
+func (r *shardRing) walk(key string, fn func(disk *shardDisk) bool) {
+	if len(r.points) == 0 {
+		return
+	}
+	h := shardHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	seen := make(map[*shardDisk]bool)
+	for i := 0; i < len(r.points); i++ {
+		disk := r.points[(start+i)%len(r.points)].disk
+		if seen[disk] {
+			continue
+		}
+		seen[disk] = true
+		if !fn(disk) {
+			return
+		}
+	}
+}
+
+func (r *shardRing) owner(key string) *shardDisk {
+	var owner *shardDisk
+	r.walk(key, func(disk *shardDisk) bool {
+		owner = disk
+		return false
+	})
+	return owner
+}
+
+// placement is the placement map saved next to the objects.
+// Rings lists the hash rings objects may have been placed with, the current one first.
+// Older rings are kept until rebalancing moves all objects to the disks of the current ring.
+// Overrides lists the disks, other than their owners, that keys are placed on because their
+// owners were full.
+type placement struct {
+	Rings     [][]ringDisk        `json:"rings"`
+	Overrides map[string][]string `json:"overrides"`
+}
+
+// shardedBackend spreads objects across the disks configured in the child sections of its
+// section. Objects are placed by consistent hashing of the repo ID, or of the repo and object
+// IDs if "shard_by = object" is set, so adding a disk only moves the objects it takes over.
+//
+// When the disks or their weights change, objects are looked up on the disks they were placed
+// on before, and are moved to their new disks in the background. Writes to disks with less than
+// min_free_space MB free go to the next disk on the ring. For example:
+//
+//	[block_backend]
+//	name = sharded
+//	min_free_space = 2048
+//
+//	[block_backend.disk1]
+//	dir = /mnt/disk1/seafile-data
+//	weight = 2
+//
+//	[block_backend.disk2]
+//	dir = /mnt/disk2/seafile-data
+//
+// A disk is drained by setting its weight to 0.
+type shardedBackend struct {
+	objType  string
+	byObject bool
+	disks    []*shardDisk
+	// Path of the placement map file
+	placementPath string
+
+	// lock protects the placement map and the rings built from it.
+	lock      sync.RWMutex
+	placement placement
+	rings     []*shardRing
+	// overrideSeq records when overrides are last used, see Rebalance.
+	overrideSeq map[string]uint64
+	seq         uint64
+
+	// keyLocks serialize the moving and removal of objects. Reads take them for reading,
+	// so that an object being moved is found on either disk.
+	keyLocks    [shardKeyLocks]sync.RWMutex
+	rebalancing int32
+}
+
+func newShardedBackend(seafileDataDir string, objType string, section *ini.Section) (*shardedBackend, error) {
+	if section == nil {
+		err := fmt.Errorf("no section for sharded %s backend", objType)
+		return nil, err
+	}
+
+	b := new(shardedBackend)
+	b.objType = objType
+	if key, err := section.GetKey("shard_by"); err == nil {
+		switch key.String() {
+		case "", "repo":
+		case "object":
+			b.byObject = true
+		default:
+			err := fmt.Errorf("shard_by of section %s must be repo or object", section.Name())
+			return nil, err
+		}
+	}
+
+	var current []ringDisk
+	disks := make(map[string]*shardDisk)
+	for _, child := range section.ChildSections() {
+		disk, err := newShardDisk(objType, child)
+		if err != nil {
+			return nil, err
+		}
+		b.disks = append(b.disks, disk)
+		disks[disk.name] = disk
+		current = append(current, ringDisk{disk.name, disk.weight})
+	}
+	if len(newShardRing(current, disks).points) == 0 {
+		err := fmt.Errorf("sharded backend of section %s has no disk with positive weight", section.Name())
+		return nil, err
+	}
+
+	b.placementPath = filepath.Join(seafileDataDir, "storage", objType+"-placement.json")
+	if key, err := section.GetKey("placement_file"); err == nil && key.String() != "" {
+		b.placementPath = key.String()
+	}
+	if err := b.loadPlacement(current, disks); err != nil {
+		return nil, err
+	}
+
+	autoRebalance := true
+	if key, err := section.GetKey("rebalance"); err == nil {
+		autoRebalance, _ = key.Bool()
+	}
+	if autoRebalance && backgroundTasks && b.unbalanced() {
+		go b.rebalanceLoop()
+	}
+	return b, nil
+}
+
+func newShardDisk(objType string, section *ini.Section) (*shardDisk, error) {
+	disk := new(shardDisk)
+	disk.name = section.Name()
+	key, ok := ownKey(section, "dir")
+	if !ok || key.String() == "" {
+		err := fmt.Errorf("no dir in section %s", section.Name())
+		return nil, err
+	}
+	disk.dir = key.String()
+
+	disk.weight = 1
+	if key, ok := ownKey(section, "weight"); ok {
+		weight, err := key.Int()
+		if err != nil || weight < 0 {
+			err := fmt.Errorf("weight of section %s must be a non-negative integer", section.Name())
+			return nil, err
+		}
+		disk.weight = weight
+	}
+
+	// min_free_space is inherited, so that it can be set for all disks in the parent section.
+	minFree := int64(shardDefaultMinFreeSpace)
+	if key, err := section.GetKey("min_free_space"); err == nil {
+		n, err := key.Int64()
+		if err != nil || n < 0 {
+			err := fmt.Errorf("min_free_space of section %s must be a non-negative integer", section.Name())
+			return nil, err
+		}
+		minFree = n
+	}
+	disk.minFree = uint64(minFree) * (1 << 20)
+
+	backend, err := newFSBackend(disk.dir, objType)
+	if err != nil {
+		err := fmt.Errorf("failed to create backend of section %s: %v", section.Name(), err)
+		return nil, err
+	}
+	disk.backend = backend
+	return disk, nil
+}
+
+// loadPlacement loads the placement map, the current ring is added to it if the disks changed.
+func (b *shardedBackend) loadPlacement(current []ringDisk, disks map[string]*shardDisk) error {
+	data, err := ioutil.ReadFile(b.placementPath)
+	if err != nil && !os.IsNotExist(err) {
+		err := fmt.Errorf("failed to read placement map: %v", err)
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &b.placement); err != nil {
+			err := fmt.Errorf("failed to parse placement map %s: %v", b.placementPath, err)
+			return err
+		}
+	}
+	if b.placement.Overrides == nil {
+		b.placement.Overrides = make(map[string][]string)
+	}
+
+	for _, def := range b.placement.Rings {
+		for _, rd := range def {
+			if _, ok := disks[rd.Name]; !ok {
+				log.Printf("Disk %s of %s placement map is not configured, its objects can't be accessed", rd.Name, b.objType)
+			}
+		}
+	}
+
+	if len(b.placement.Rings) == 0 || !sameRing(b.placement.Rings[0], current) {
+		b.placement.Rings = append([][]ringDisk{current}, b.placement.Rings...)
+		if err := b.savePlacement(); err != nil {
+			return err
+		}
+	}
+	b.overrideSeq = make(map[string]uint64)
+	for _, def := range b.placement.Rings {
+		b.rings = append(b.rings, newShardRing(def, disks))
+	}
+	return nil
+}
+
+func sameRing(a, b []ringDisk) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// savePlacement writes the placement map, the caller must hold the lock.
+func (b *shardedBackend) savePlacement() error {
+	data, err := json.Marshal(&b.placement)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.placementPath), os.ModePerm); err != nil {
+		return err
+	}
+	tmpPath := b.placementPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		err := fmt.Errorf("failed to write placement map: %v", err)
+		return err
+	}
+	if err := os.Rename(tmpPath, b.placementPath); err != nil {
+		err := fmt.Errorf("failed to write placement map: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (b *shardedBackend) key(repoID, objID string) string {
+	if b.byObject {
+		return repoID + "/" + objID
+	}
+	return repoID
+}
+
+func (b *shardedBackend) keyLock(repoID, objID string) *sync.RWMutex {
+	return &b.keyLocks[shardHash(repoID+"/"+objID)%shardKeyLocks]
+}
+
+func (b *shardedBackend) disk(name string) *shardDisk {
+	for _, disk := range b.disks {
+		if disk.name == name {
+			return disk
+		}
+	}
+	return nil
+}
+
+// candidates returns the disks an object of key may be placed on: its owners in the current
+// and older rings, then the disks of its overrides.
+func (b *shardedBackend) candidates(key string) []*shardDisk {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var disks []*shardDisk
+	add := func(disk *shardDisk) {
+		if disk == nil {
+			return
+		}
+		for _, d := range disks {
+			if d == disk {
+				return
+			}
+		}
+		disks = append(disks, disk)
+	}
+	for _, ring := range b.rings {
+		add(ring.owner(key))
+	}
+	for _, name := range b.placement.Overrides[key] {
+		add(b.disk(name))
+	}
+	return disks
+}
+
+// writeDisk returns the disk to write an object of key to: its owner in the current ring if it
+// has enough free space, otherwise the first disk with enough free space that follows it.
+func (b *shardedBackend) writeDisk(key string) (*shardDisk, error) {
+	b.lock.RLock()
+	ring := b.rings[0]
+	b.lock.RUnlock()
+
+	var target *shardDisk
+	ring.walk(key, func(disk *shardDisk) bool {
+		if disk.hasSpace() {
+			target = disk
+			return false
+		}
+		return true
+	})
+	if target == nil {
+		return nil, errNoSpace
+	}
+	if target != ring.owner(key) {
+		if err := b.addOverride(key, target.name); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// addOverride records that objects of key are placed on the disk name.
+func (b *shardedBackend) addOverride(key string, name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.seq++
+	b.overrideSeq[key] = b.seq
+	for _, n := range b.placement.Overrides[key] {
+		if n == name {
+			return nil
+		}
+	}
+	b.placement.Overrides[key] = append(b.placement.Overrides[key], name)
+	if err := b.savePlacement(); err != nil {
+		b.placement.Overrides[key] = b.placement.Overrides[key][:len(b.placement.Overrides[key])-1]
+		return err
+	}
+	return nil
+}
+
+func (b *shardedBackend) Read(repoID string, objID string, w io.Writer) error {
+	lock := b.keyLock(repoID, objID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var firstErr error
+	for _, disk := range b.candidates(b.key(repoID, objID)) {
+		err := disk.backend.Read(repoID, objID, w)
+		if err == nil || !os.IsNotExist(err) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Write writes the object to its owner, or to the next disk on the ring if the owner is full.
+func (b *shardedBackend) Write(repoID string, objID string, r io.Reader, fsync bool) error {
+	disk, err := b.writeDisk(b.key(repoID, objID))
+	if err != nil {
+		err := fmt.Errorf("failed to write object %s/%s: %v", repoID, objID, err)
+		return err
+	}
+	return disk.backend.Write(repoID, objID, r, fsync)
+}
+
+func (b *shardedBackend) Exists(repoID string, objID string) (bool, error) {
+	lock := b.keyLock(repoID, objID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var res bool
+	var err error
+	for _, disk := range b.candidates(b.key(repoID, objID)) {
+		res, err = disk.backend.Exists(repoID, objID)
+		if res && err == nil {
+			return true, nil
+		}
+	}
+	return res, err
+}
+
+func (b *shardedBackend) Stat(repoID string, objID string) (int64, error) {
+	lock := b.keyLock(repoID, objID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var firstErr error
+	for _, disk := range b.candidates(b.key(repoID, objID)) {
+		size, err := disk.backend.Stat(repoID, objID)
+		if err == nil {
+			return size, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return -1, firstErr
+}
+
+// Remove removes the object from all disks it may be placed on.
+func (b *shardedBackend) Remove(repoID string, objID string) error {
+	lock := b.keyLock(repoID, objID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, disk := range b.candidates(b.key(repoID, objID)) {
+		if err := disk.backend.Remove(repoID, objID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantine quarantines the damaged copies of an object on the disks it may be placed on.
+func (b *shardedBackend) quarantine(repoID string, objID string, valid func(data []byte) bool, save func(data []byte) error) error {
+	lock := b.keyLock(repoID, objID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, disk := range b.candidates(b.key(repoID, objID)) {
+		if err := quarantineCopies(disk.backend, repoID, objID, valid, save); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List calls fn for every object of a repo on any disk.
+func (b *shardedBackend) List(repoID string, fn func(objID string) error) error {
+	return b.union(func(backend Backend, fn func(string) error) error {
+		return backend.List(repoID, fn)
+	}, fn)
+}
+
+// ListRepos calls fn for every repo that has objects on any disk.
+func (b *shardedBackend) ListRepos(fn func(repoID string) error) error {
+	return b.union(func(backend Backend, fn func(string) error) error {
+		return backend.ListRepos(fn)
+	}, fn)
+}
+
+// union calls fn once for every name listed on any disk.
+func (b *shardedBackend) union(list func(backend Backend, fn func(string) error) error, fn func(string) error) error {
+	seen := make(map[string]bool)
+	for _, disk := range b.disks {
+		err := list(disk.backend, func(name string) error {
+			if seen[name] {
+				return nil
+			}
+			seen[name] = true
+			return fn(name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unbalanced returns whether some objects may not be placed on their owners.
+func (b *shardedBackend) unbalanced() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.placement.Rings) > 1 || len(b.placement.Overrides) > 0
+}
+
+func (b *shardedBackend) rebalanceLoop() {
+	for {
+		err := b.Rebalance()
+		if err == nil || err == errRebalancing {
+			return
+		}
+		log.Printf("Failed to rebalance %s objects, retry in %v: %v", b.objType, shardRebalanceRetry, err)
+		time.Sleep(shardRebalanceRetry)
+	}
+}
+
+// Rebalance moves objects to their owners in the current ring. Objects whose owners are full
+// stay where they are and are recorded as overrides.
+// Once a pass over all disks moves nothing, the older rings are dropped from the placement map,
+// along with the overrides that are no longer used.
+// Objects can be read, written and removed while they are moved.
+func (b *shardedBackend) Rebalance() error {
+	if !atomic.CompareAndSwapInt32(&b.rebalancing, 0, 1) {
+		return errRebalancing
+	}
+	defer atomic.StoreInt32(&b.rebalancing, 0)
+
+	// Owners may run out of space or get free space while a pass runs,
+	// so passes are repeated until one moves nothing.
+	for {
+		b.lock.RLock()
+		start := b.seq
+		b.lock.RUnlock()
+
+		moved, err := b.rebalancePass()
+		if err != nil {
+			return err
+		}
+		if moved == 0 {
+			b.finishRebalance(start)
+			return nil
+		}
+		log.Printf("Moved %d %s objects to their disks", moved, b.objType)
+	}
+}
+
+func (b *shardedBackend) rebalancePass() (int, error) {
+	moved := 0
+	var firstErr error
+	for _, disk := range b.disks {
+		err := disk.backend.ListRepos(func(repoID string) error {
+			return disk.backend.List(repoID, func(objID string) error {
+				ok, err := b.move(disk, repoID, objID)
+				if err != nil {
+					shardMoves.WithLabelValues(b.objType, "failed").Inc()
+					log.Printf("Failed to move %s object %s/%s from %s: %v", b.objType, repoID, objID, disk.name, err)
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else if ok {
+					shardMoves.WithLabelValues(b.objType, "moved").Inc()
+					moved++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			err := fmt.Errorf("failed to list objects on %s: %v", disk.name, err)
+			return moved, err
+		}
+	}
+	return moved, firstErr
+}
+
+// move moves an object from disk to its owner in the current ring.
+// It returns true if the object is moved.
+func (b *shardedBackend) move(disk *shardDisk, repoID string, objID string) (bool, error) {
+	key := b.key(repoID, objID)
+	b.lock.RLock()
+	owner := b.rings[0].owner(key)
+	b.lock.RUnlock()
+	if owner == disk {
+		return false, nil
+	}
+	if !owner.hasSpace() {
+		return false, b.addOverride(key, disk.name)
+	}
+
+	lock := b.keyLock(repoID, objID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var buf bytes.Buffer
+	if err := disk.backend.Read(repoID, objID, &buf); err != nil {
+		if os.IsNotExist(err) {
+			// Removed since it's listed.
+			return false, nil
+		}
+		return false, err
+	}
+	if exists, _ := owner.backend.Exists(repoID, objID); !exists {
+		if err := owner.backend.Write(repoID, objID, &buf, true); err != nil {
+			return false, err
+		}
+	}
+	if err := disk.backend.Remove(repoID, objID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// finishRebalance drops the older rings, and the overrides that are not used since start.
+func (b *shardedBackend) finishRebalance(start uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.placement.Rings = b.placement.Rings[:1]
+	b.rings = b.rings[:1]
+	for key := range b.placement.Overrides {
+		if b.overrideSeq[key] <= start {
+			delete(b.placement.Overrides, key)
+			delete(b.overrideSeq, key)
+		}
+	}
+	if err := b.savePlacement(); err != nil {
+		log.Printf("Failed to save %s placement map: %v", b.objType, err)
+	}
+}
@@ -0,0 +1,203 @@
+package objstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestShardedBackend(t *testing.T, confDir string, disks ...string) *shardedBackend {
+	conf := "[block_backend]\nname = sharded\nmin_free_space = 0\nrebalance = false\n\n"
+	for _, disk := range disks {
+		conf += fmt.Sprintf("[block_backend.%s]\ndir = %s\n\n", disk, filepath.Join(confDir, disk))
+	}
+	err := ioutil.WriteFile(filepath.Join(confDir, "seafile.conf"), []byte(conf), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write seafile.conf : %v\n", err)
+	}
+	section, err := loadBackendSection(confDir, "blocks")
+	if err != nil {
+		t.Fatalf("Failed to load seafile.conf : %v\n", err)
+	}
+	b, err := newShardedBackend(confDir, "blocks", section)
+	if err != nil {
+		t.Fatalf("Failed to create sharded backend : %v\n", err)
+	}
+	return b
+}
+
+// placedOn returns the disks that have the object.
+func placedOn(b *shardedBackend, repoID, objID string) []string {
+	var names []string
+	for _, disk := range b.disks {
+		if ok, _ := disk.backend.Exists(repoID, objID); ok {
+			names = append(names, disk.name)
+		}
+	}
+	return names
+}
+
+func TestShardedRebalance(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-sharded")
+	if err != nil {
+		t.Fatalf("Failed to create conf dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+
+	b := newTestShardedBackend(t, confDir, "disk1", "disk2")
+	var repos []string
+	for i := 0; i < 50; i++ {
+		repos = append(repos, fmt.Sprintf("b1f2ad61-9164-418a-a47f-ab805dbd%04d", i))
+	}
+	for _, repo := range repos {
+		if err := b.Write(repo, objID, bytes.NewReader([]byte(repo)), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	counts := make(map[string]int)
+	for _, repo := range repos {
+		counts[placedOn(b, repo, objID)[0]]++
+	}
+	if counts["block_backend.disk1"] == 0 || counts["block_backend.disk2"] == 0 {
+		t.Errorf("Objects are not spread across disks : %v\n", counts)
+	}
+
+	// Objects stay readable after a disk is added, and are moved by rebalancing.
+	b = newTestShardedBackend(t, confDir, "disk1", "disk2", "disk3")
+	if len(b.placement.Rings) != 2 {
+		t.Fatalf("Previous ring is not kept in the placement map\n")
+	}
+	for _, repo := range repos {
+		if ok, _ := b.Exists(repo, objID); !ok {
+			t.Fatalf("Object of %s is not found after adding a disk\n", repo)
+		}
+	}
+	if err := b.Rebalance(); err != nil {
+		t.Fatalf("Failed to rebalance : %v\n", err)
+	}
+	moved := 0
+	for _, repo := range repos {
+		disks := placedOn(b, repo, objID)
+		if len(disks) != 1 || disks[0] != b.rings[0].owner(repo).name {
+			t.Errorf("Object of %s is on %v after rebalancing\n", repo, disks)
+		}
+		if disks[0] == "block_backend.disk3" {
+			moved++
+		}
+		var buf bytes.Buffer
+		if err := b.Read(repo, objID, &buf); err != nil || buf.String() != repo {
+			t.Errorf("Failed to read object of %s : %v\n", repo, err)
+		}
+	}
+	if moved == 0 {
+		t.Errorf("No object is moved to the new disk\n")
+	}
+	if len(b.placement.Rings) != 1 {
+		t.Errorf("Previous ring is not dropped after rebalancing\n")
+	}
+}
+
+func TestShardedReadWhileRebalancing(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-sharded")
+	if err != nil {
+		t.Fatalf("Failed to create conf dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+
+	b := newTestShardedBackend(t, confDir, "disk1")
+	var repos []string
+	for i := 0; i < 200; i++ {
+		repo := fmt.Sprintf("b1f2ad61-9164-418a-a47f-ab805dbd%04d", i)
+		if err := b.Write(repo, objID, bytes.NewReader([]byte(repo)), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+		repos = append(repos, repo)
+	}
+
+	// Objects being moved are never missing for readers.
+	b = newTestShardedBackend(t, confDir, "disk1", "disk2", "disk3")
+	var rebalancing int32 = 1
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&rebalancing) == 1 {
+				for _, repo := range repos {
+					var buf bytes.Buffer
+					if err := b.Read(repo, objID, &buf); err != nil || buf.String() != repo {
+						errs <- fmt.Errorf("failed to read object of %s: %v", repo, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	err = b.Rebalance()
+	atomic.StoreInt32(&rebalancing, 0)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Failed to rebalance : %v\n", err)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("Object is missing while rebalancing : %v\n", err)
+	default:
+	}
+}
+
+func TestShardedFreeSpace(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-sharded")
+	if err != nil {
+		t.Fatalf("Failed to create conf dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+
+	b := newTestShardedBackend(t, confDir, "disk1", "disk2")
+	owner := b.rings[0].owner(repoID)
+	for _, disk := range b.disks {
+		disk.minFree = 1
+	}
+	full := owner.dir
+	statFreeSpace = func(dir string) (uint64, error) {
+		if dir == full {
+			return 0, nil
+		}
+		return 1 << 30, nil
+	}
+	defer func() {
+		statFreeSpace = syscallFreeSpace
+	}()
+
+	if err := b.Write(repoID, objID, bytes.NewReader([]byte("hello")), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	disks := placedOn(b, repoID, objID)
+	if len(disks) != 1 || disks[0] == owner.name {
+		t.Errorf("Object is written to a full disk : %v\n", disks)
+	}
+	if len(b.placement.Overrides[repoID]) != 1 {
+		t.Errorf("Override is not recorded : %v\n", b.placement.Overrides)
+	}
+
+	// The object goes to its owner once it has space again.
+	full = ""
+	for _, disk := range b.disks {
+		disk.checkedAt = 0
+	}
+	if err := b.Rebalance(); err != nil {
+		t.Fatalf("Failed to rebalance : %v\n", err)
+	}
+	if disks := placedOn(b, repoID, objID); len(disks) != 1 || disks[0] != owner.name {
+		t.Errorf("Object is not moved to its owner : %v\n", disks)
+	}
+	if len(b.placement.Overrides) != 0 {
+		t.Errorf("Unused override is not dropped : %v\n", b.placement.Overrides)
+	}
+}
@@ -0,0 +1,241 @@
+// Implementation of a backend storing small objects in the seafile database.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Number of rows written by one statement of WriteBatch, and read by one query of List.
+const sqlBatchSize = 100
+
+// Object is an object written by WriteBatch.
+type Object struct {
+	ID   string
+	Data []byte
+}
+
+// BatchWriter is implemented by backends that can write many objects more efficiently
+// than one at a time.
+type BatchWriter interface {
+	// WriteBatch writes the objects of a repo, the objects written before a failure may be kept.
+	WriteBatch(repoID string, objs []Object, sync bool) (err error)
+}
+
+// sqlBackend stores objects as rows of a table, one table per object type.
+// It's meant for commit and fs objects, which are small and numerous.
+type sqlBackend struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLBackend returns a backend storing objects of objType in db.
+// dbType is "mysql" or "sqlite", the table of objType is created if it doesn't exist.
+// Blocks are not supported, as they are too big to be stored in the database.
+//
+// The backend uses the seafile database, it's registered by fileserver once the
+// database is opened, and is selected by "name = sql" in the backend section.
+func NewSQLBackend(db *sql.DB, dbType string, objType string) (Backend, error) {
+	var table string
+	switch objType {
+	case "commits":
+		table = "CommitObjects"
+	case "fs":
+		table = "FSObjects"
+	default:
+		err := fmt.Errorf("%s objects can't be stored in database", objType)
+		return nil, err
+	}
+
+	var sqlStr string
+	if strings.EqualFold(dbType, "mysql") {
+		sqlStr = "CREATE TABLE IF NOT EXISTS " + table + " (id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT, " +
+			"repo_id CHAR(37) NOT NULL, obj_id CHAR(40) NOT NULL, data LONGBLOB NOT NULL, " +
+			"UNIQUE INDEX (repo_id, obj_id)) ENGINE=INNODB"
+	} else if strings.EqualFold(dbType, "sqlite") {
+		sqlStr = "CREATE TABLE IF NOT EXISTS " + table + " (repo_id CHAR(37) NOT NULL, " +
+			"obj_id CHAR(40) NOT NULL, data BLOB NOT NULL, PRIMARY KEY (repo_id, obj_id))"
+	} else {
+		err := fmt.Errorf("unsupported database %s", dbType)
+		return nil, err
+	}
+	if _, err := db.Exec(sqlStr); err != nil {
+		err := fmt.Errorf("failed to create table %s: %v", table, err)
+		return nil, err
+	}
+
+	backend := new(sqlBackend)
+	backend.db = db
+	backend.table = table
+	return backend, nil
+}
+
+// notExist returns an error for which os.IsNotExist is true, like the one of fsBackend.
+func (b *sqlBackend) notExist(repoID, objID string) error {
+	return &os.PathError{Op: "read", Path: b.table + "/" + repoID + "/" + objID, Err: os.ErrNotExist}
+}
+
+func (b *sqlBackend) Read(repoID string, objID string, w io.Writer) error {
+	return b.ReadCtx(context.Background(), repoID, objID, w)
+}
+
+func (b *sqlBackend) ReadCtx(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	var data []byte
+	sqlStr := "SELECT data FROM " + b.table + " WHERE repo_id=? AND obj_id=?"
+	row := b.db.QueryRowContext(ctx, sqlStr, repoID, objID)
+	if err := row.Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return b.notExist(repoID, objID)
+		}
+		return err
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// Write replaces the object. sync is ignored, the database decides when data is flushed.
+func (b *sqlBackend) Write(repoID string, objID string, r io.Reader, sync bool) error {
+	return b.WriteCtx(context.Background(), repoID, objID, r, sync)
+}
+
+func (b *sqlBackend) WriteCtx(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	data, err := ioutil.ReadAll(&ctxReader{ctx, r})
+	if err != nil {
+		return err
+	}
+	sqlStr := "REPLACE INTO " + b.table + " (repo_id, obj_id, data) VALUES (?, ?, ?)"
+	_, err = b.db.ExecContext(ctx, sqlStr, repoID, objID, data)
+	return err
+}
+
+// WriteBatch writes the objects in one transaction, with several rows per statement.
+func (b *sqlBackend) WriteBatch(repoID string, objs []Object, sync bool) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for len(objs) > 0 {
+		n := len(objs)
+		if n > sqlBatchSize {
+			n = sqlBatchSize
+		}
+		var sqlStr bytes.Buffer
+		sqlStr.WriteString("REPLACE INTO " + b.table + " (repo_id, obj_id, data) VALUES ")
+		args := make([]interface{}, 0, n*3)
+		for i, obj := range objs[:n] {
+			if i > 0 {
+				sqlStr.WriteString(", ")
+			}
+			sqlStr.WriteString("(?, ?, ?)")
+			args = append(args, repoID, obj.ID, obj.Data)
+		}
+		if _, err := tx.Exec(sqlStr.String(), args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+		objs = objs[n:]
+	}
+
+	return tx.Commit()
+}
+
+func (b *sqlBackend) Exists(repoID string, objID string) (bool, error) {
+	return b.ExistsCtx(context.Background(), repoID, objID)
+}
+
+func (b *sqlBackend) ExistsCtx(ctx context.Context, repoID string, objID string) (bool, error) {
+	var exists int
+	sqlStr := "SELECT 1 FROM " + b.table + " WHERE repo_id=? AND obj_id=?"
+	row := b.db.QueryRowContext(ctx, sqlStr, repoID, objID)
+	if err := row.Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *sqlBackend) Stat(repoID string, objID string) (int64, error) {
+	return b.StatCtx(context.Background(), repoID, objID)
+}
+
+func (b *sqlBackend) StatCtx(ctx context.Context, repoID string, objID string) (int64, error) {
+	var size int64
+	sqlStr := "SELECT LENGTH(data) FROM " + b.table + " WHERE repo_id=? AND obj_id=?"
+	row := b.db.QueryRowContext(ctx, sqlStr, repoID, objID)
+	if err := row.Scan(&size); err != nil {
+		if err == sql.ErrNoRows {
+			return -1, b.notExist(repoID, objID)
+		}
+		return -1, err
+	}
+	return size, nil
+}
+
+// Remove deletes an object, removing an object that doesn't exist is not an error.
+func (b *sqlBackend) Remove(repoID string, objID string) error {
+	sqlStr := "DELETE FROM " + b.table + " WHERE repo_id=? AND obj_id=?"
+	_, err := b.db.Exec(sqlStr, repoID, objID)
+	return err
+}
+
+// List calls fn for every object of a repo.
+// Objects are read by pages, so that no query is in progress while fn is called.
+func (b *sqlBackend) List(repoID string, fn func(objID string) error) error {
+	sqlStr := "SELECT obj_id FROM " + b.table + " WHERE repo_id=? AND obj_id>? ORDER BY obj_id LIMIT ?"
+	return b.listPages(func(last string) (*sql.Rows, error) {
+		return b.db.Query(sqlStr, repoID, last, sqlBatchSize)
+	}, fn)
+}
+
+// ListRepos calls fn for every repo that has objects in the table.
+func (b *sqlBackend) ListRepos(fn func(repoID string) error) error {
+	sqlStr := "SELECT DISTINCT repo_id FROM " + b.table + " WHERE repo_id>? ORDER BY repo_id LIMIT ?"
+	return b.listPages(func(last string) (*sql.Rows, error) {
+		return b.db.Query(sqlStr, last, sqlBatchSize)
+	}, fn)
+}
+
+// listPages calls fn for every name returned by query, query returns the page after last.
+func (b *sqlBackend) listPages(query func(last string) (*sql.Rows, error), fn func(name string) error) error {
+	last := ""
+	for {
+		rows, err := query(last)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			names = append(names, name)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if len(names) < sqlBatchSize {
+			return nil
+		}
+		last = names[len(names)-1]
+	}
+}
@@ -0,0 +1,83 @@
+package objstore
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLBackend(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "objstore-sql")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dataDir, "seafile.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database : %v\n", err)
+	}
+	defer db.Close()
+
+	if _, err := NewSQLBackend(db, "sqlite", "blocks"); err == nil {
+		t.Errorf("Blocks are stored in database\n")
+	}
+	b, err := NewSQLBackend(db, "sqlite", "fs")
+	if err != nil {
+		t.Fatalf("Failed to create sql backend : %v\n", err)
+	}
+
+	content := []byte("hello world!\n")
+	if err := b.Write(repoID, objID, bytes.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	var buf bytes.Buffer
+	if err := b.Read(repoID, objID, &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Failed to read object : %v\n", err)
+	}
+	if size, err := b.Stat(repoID, objID); err != nil || size != int64(len(content)) {
+		t.Errorf("Wrong size of object %d : %v\n", size, err)
+	}
+
+	var objs []Object
+	for i := 0; i < 2*sqlBatchSize+10; i++ {
+		objs = append(objs, Object{fmt.Sprintf("%040d", i), []byte(fmt.Sprintf("object %d", i))})
+	}
+	if err := writeBatch(b, repoID, objs, false); err != nil {
+		t.Fatalf("Failed to write objects : %v\n", err)
+	}
+	if err := b.Write("other-repo", objID, bytes.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	listed := 0
+	if err := b.List(repoID, func(string) error { listed++; return nil }); err != nil {
+		t.Errorf("Failed to list objects : %v\n", err)
+	}
+	if listed != len(objs)+1 {
+		t.Errorf("Listed %d objects, expected %d\n", listed, len(objs)+1)
+	}
+	var repos []string
+	if err := b.ListRepos(func(id string) error { repos = append(repos, id); return nil }); err != nil {
+		t.Errorf("Failed to list repos : %v\n", err)
+	}
+	if len(repos) != 2 {
+		t.Errorf("Unexpected repos %v\n", repos)
+	}
+
+	if err := b.Remove(repoID, objID); err != nil {
+		t.Errorf("Failed to remove object : %v\n", err)
+	}
+	if exists, err := b.Exists(repoID, objID); exists || err != nil {
+		t.Errorf("Removed object exists : %v\n", err)
+	}
+	if err := b.Read(repoID, objID, &buf); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error of reading removed object : %v\n", err)
+	}
+}
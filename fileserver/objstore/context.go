@@ -0,0 +1,117 @@
+// Cancellation of object operations.
+package objstore
+
+import (
+	"context"
+	"io"
+)
+
+// ContextBackend is implemented by backends that can stop operations when a context is
+// done, e.g. by cancelling their network requests.
+// Backends that don't implement it are given readers and writers that fail once the
+// context is done, and the context is checked before operations that don't stream data.
+type ContextBackend interface {
+	ReadCtx(ctx context.Context, repoID string, objID string, w io.Writer) (err error)
+	WriteCtx(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) (err error)
+	ExistsCtx(ctx context.Context, repoID string, objID string) (res bool, err error)
+	StatCtx(ctx context.Context, repoID string, objID string) (res int64, err error)
+}
+
+// IsContextError returns whether err is returned because a context is done.
+func IsContextError(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// ctxWriter fails writes once ctx is done.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// ctxReader fails reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func readCtx(ctx context.Context, backend Backend, repoID string, objID string, w io.Writer) error {
+	if cb, ok := backend.(ContextBackend); ok {
+		return cb.ReadCtx(ctx, repoID, objID, w)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := backend.Read(repoID, objID, &ctxWriter{ctx, w})
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func writeCtx(ctx context.Context, backend Backend, repoID string, objID string, r io.Reader, sync bool) error {
+	if cb, ok := backend.(ContextBackend); ok {
+		return cb.WriteCtx(ctx, repoID, objID, r, sync)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := backend.Write(repoID, objID, &ctxReader{ctx, r}, sync)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func existsCtx(ctx context.Context, backend Backend, repoID string, objID string) (bool, error) {
+	if cb, ok := backend.(ContextBackend); ok {
+		return cb.ExistsCtx(ctx, repoID, objID)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return backend.Exists(repoID, objID)
+}
+
+func statCtx(ctx context.Context, backend Backend, repoID string, objID string) (int64, error) {
+	if cb, ok := backend.(ContextBackend); ok {
+		return cb.StatCtx(ctx, repoID, objID)
+	}
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return backend.Stat(repoID, objID)
+}
+
+// ReadCtx reads an object like Read, and stops once ctx is done.
+func (s *ObjectStore) ReadCtx(ctx context.Context, repoID string, objID string, w io.Writer) (err error) {
+	return readCtx(ctx, s.backend, repoID, objID, w)
+}
+
+// WriteCtx writes an object like Write, and stops once ctx is done.
+func (s *ObjectStore) WriteCtx(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) (err error) {
+	return writeCtx(ctx, s.backend, repoID, objID, r, sync)
+}
+
+// ExistsCtx checks whether an object exists like Exists, and stops once ctx is done.
+func (s *ObjectStore) ExistsCtx(ctx context.Context, repoID string, objID string) (res bool, err error) {
+	return existsCtx(ctx, s.backend, repoID, objID)
+}
+
+// StatCtx calculates object size like Stat, and stops once ctx is done.
+func (s *ObjectStore) StatCtx(ctx context.Context, repoID string, objID string) (res int64, err error) {
+	return statCtx(ctx, s.backend, repoID, objID)
+}
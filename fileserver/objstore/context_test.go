@@ -0,0 +1,60 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestContextCancel(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "objstore-context")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	// Backends without cancellation support don't start operations once the context is done.
+	fsBackend, err := newFSBackend(dataDir, "fs")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	s := NewWithBackend("fs", fsBackend)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.WriteCtx(ctx, repoID, objID, bytes.NewReader([]byte("data")), false); err != context.Canceled {
+		t.Errorf("Unexpected error of writing with cancelled context : %v\n", err)
+	}
+	if exists, _ := s.Exists(repoID, objID); exists {
+		t.Errorf("Object is written with cancelled context\n")
+	}
+	if _, err := s.StatCtx(ctx, repoID, objID); err != context.Canceled {
+		t.Errorf("Unexpected error of stat with cancelled context : %v\n", err)
+	}
+
+	// Requests of the s3 backend are aborted when the deadline is exceeded.
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer server.Close()
+	defer close(stop)
+
+	backend := newTestS3Backend(t, server)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := readCtx(ctx, backend, repoID, objID, ioutil.Discard); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error of reading after deadline : %v\n", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Read didn't stop at the deadline\n")
+	}
+}
@@ -3,54 +3,289 @@
 package objstore
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/ini.v1"
 )
 
 // ObjectStore is a container to access storage backend
 type ObjectStore struct {
 	// can be "commit", "fs", or "block"
 	ObjType string
-	backend storageBackend
+	backend Backend
+	// Damaged objects are moved to this dir, see Quarantine.
+	quarantineDir string
 }
 
-// storageBackend is the interface implemented by storage backends.
+// Backend is the interface implemented by storage backends.
 // An object store may have one or multiple storage backends.
-type storageBackend interface {
+type Backend interface {
 	// Read an object from backend and write the contents into w.
-	read(repoID string, objID string, w io.Writer) (err error)
+	Read(repoID string, objID string, w io.Writer) (err error)
 	// Write the contents from r to the object.
-	write(repoID string, objID string, r io.Reader, sync bool) (err error)
-	// exists checks whether an object exists.
-	exists(repoID string, objID string) (res bool, err error)
-	// stat calculates an object's size
-	stat(repoID string, objID string) (res int64, err error)
+	Write(repoID string, objID string, r io.Reader, sync bool) (err error)
+	// Exists checks whether an object exists.
+	Exists(repoID string, objID string) (res bool, err error)
+	// Stat calculates an object's size
+	Stat(repoID string, objID string) (res int64, err error)
+	// Remove deletes an object.
+	Remove(repoID string, objID string) (err error)
+	// List calls fn for every object of a repo, iteration stops at the first error returned by fn.
+	List(repoID string, fn func(objID string) error) (err error)
+	// ListRepos calls fn for every repo that has objects, iteration stops at the first error returned by fn.
+	ListRepos(fn func(repoID string) error) (err error)
+}
+
+// BackendFactory creates a backend for objType.
+// section is the backend section of objType in seafile.conf, it's nil if the section doesn't exist.
+type BackendFactory func(seafileDataDir string, objType string, section *ini.Section) (Backend, error)
+
+// backgroundTasks tells whether backends start background maintenance like repairing
+// replicas and rebalancing shards.
+var backgroundTasks = true
+
+// DisableBackgroundTasks stops the backends created afterwards from starting background
+// maintenance. Maintenance commands call it so that only the server runs these tasks.
+func DisableBackgroundTasks() {
+	backgroundTasks = false
+}
+
+var backendsLock sync.RWMutex
+var backendFactories = make(map[string]BackendFactory)
+
+func init() {
+	RegisterBackend("fs", func(seafileDataDir string, objType string, section *ini.Section) (Backend, error) {
+		// Objects can be stored in another data dir, e.g. on another disk.
+		if section != nil {
+			if key, err := section.GetKey("dir"); err == nil && key.String() != "" {
+				seafileDataDir = key.String()
+			}
+		}
+		return newFSBackend(seafileDataDir, objType)
+	})
+	RegisterBackend("s3", func(seafileDataDir string, objType string, section *ini.Section) (Backend, error) {
+		return newS3Backend(section)
+	})
+	RegisterBackend("replicated", func(seafileDataDir string, objType string, section *ini.Section) (Backend, error) {
+		return newReplicatedBackend(seafileDataDir, objType, section)
+	})
+	RegisterBackend("pack", func(seafileDataDir string, objType string, section *ini.Section) (Backend, error) {
+		return newPackBackend(seafileDataDir, objType)
+	})
+	RegisterBackend("sharded", func(seafileDataDir string, objType string, section *ini.Section) (Backend, error) {
+		return newShardedBackend(seafileDataDir, objType, section)
+	})
+}
+
+// RegisterBackend makes a backend available by name.
+// The backend is selected by setting "name = <name>" in the backend section of seafile.conf.
+// Registering a name twice replaces the previous factory.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backendFactories[name] = factory
+}
+
+func getBackendFactory(name string) (BackendFactory, bool) {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	factory, ok := backendFactories[name]
+	return factory, ok
 }
 
 // New returns a new object store for a given type of objects.
-// objType can be "commit", "fs", or "block".
-func New(seafileConfPath string, seafileDataDir string, objType string) *ObjectStore {
+// objType can be "commits", "fs", or "blocks".
+// The backend is selected by the backend section of the object type in seafile.conf,
+// objects are stored in the local file system if no backend is configured.
+// Objects are compressed if "compression = zstd" is set in the section.
+func New(seafileConfPath string, seafileDataDir string, objType string) (*ObjectStore, error) {
+	section, err := loadBackendSection(seafileConfPath, objType)
+	if err != nil {
+		return nil, err
+	}
+
+	backendName := "fs"
+	if section != nil {
+		if key, err := section.GetKey("name"); err == nil && key.String() != "" {
+			backendName = key.String()
+		}
+	}
+
+	factory, ok := getBackendFactory(backendName)
+	if !ok {
+		err := fmt.Errorf("unknown backend %s for %s objects", backendName, objType)
+		return nil, err
+	}
+
+	backend, err := factory(seafileDataDir, objType, section)
+	if err != nil {
+		err := fmt.Errorf("failed to create backend for %s objects: %v", objType, err)
+		return nil, err
+	}
+
+	backend, err = wrapCompression(backend, section)
+	if err != nil {
+		err := fmt.Errorf("failed to create backend for %s objects: %v", objType, err)
+		return nil, err
+	}
+
+	obj := NewWithBackend(objType, backend)
+	obj.quarantineDir = filepath.Join(seafileDataDir, "quarantine", objType)
+	return obj, nil
+}
+
+// NewWithBackend returns a new object store that accesses objects through backend.
+func NewWithBackend(objType string, backend Backend) *ObjectStore {
 	obj := new(ObjectStore)
 	obj.ObjType = objType
-	obj.backend, _ = newFSBackend(seafileDataDir, objType)
+	obj.backend = backend
 	return obj
 }
 
+// backendSectionName returns the name of the seafile.conf section that configures
+// the backend of objType.
+func backendSectionName(objType string) string {
+	switch objType {
+	case "commits":
+		return "commit_object_backend"
+	case "fs":
+		return "fs_object_backend"
+	case "blocks":
+		return "block_backend"
+	}
+	return objType + "_backend"
+}
+
+// ownKey returns a key set in section itself. Unlike section.GetKey, it doesn't
+// return keys of the parent sections of a child section like "block_backend.disk1".
+func ownKey(section *ini.Section, name string) (*ini.Key, bool) {
+	for _, key := range section.Keys() {
+		if key.Name() == name {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func loadBackendSection(seafileConfPath string, objType string) (*ini.Section, error) {
+	if seafileConfPath == "" {
+		return nil, nil
+	}
+	confPath := filepath.Join(seafileConfPath, "seafile.conf")
+	if _, err := os.Stat(confPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	config, err := ini.Load(confPath)
+	if err != nil {
+		err := fmt.Errorf("failed to load seafile.conf: %v", err)
+		return nil, err
+	}
+
+	section, err := config.GetSection(backendSectionName(objType))
+	if err != nil {
+		return nil, nil
+	}
+
+	return section, nil
+}
+
 //Read data from storage backends.
 func (s *ObjectStore) Read(repoID string, objID string, w io.Writer) (err error) {
-	return s.backend.read(repoID, objID, w)
+	return s.backend.Read(repoID, objID, w)
 }
 
 //Write data to storage backends.
 func (s *ObjectStore) Write(repoID string, objID string, r io.Reader, sync bool) (err error) {
-	return s.backend.write(repoID, objID, r, sync)
+	return s.backend.Write(repoID, objID, r, sync)
+}
+
+// WriteBatch writes the objects of a repo, in one batch if the backend supports it.
+func (s *ObjectStore) WriteBatch(repoID string, objs []Object, sync bool) (err error) {
+	return writeBatch(s.backend, repoID, objs, sync)
+}
+
+func writeBatch(backend Backend, repoID string, objs []Object, sync bool) error {
+	if bw, ok := backend.(BatchWriter); ok {
+		return bw.WriteBatch(repoID, objs, sync)
+	}
+	for _, obj := range objs {
+		if err := backend.Write(repoID, obj.ID, bytes.NewReader(obj.Data), sync); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMulti calls fn with the content of every object in objIDs, in the order the backend
+// reads them most efficiently. Iteration stops at the first error returned by fn, and the error is returned.
+func (s *ObjectStore) ReadMulti(repoID string, objIDs []string, fn func(objID string, data []byte) error) (err error) {
+	return readMulti(s.backend, repoID, objIDs, fn)
+}
+
+func readMulti(backend Backend, repoID string, objIDs []string, fn func(objID string, data []byte) error) error {
+	if mr, ok := backend.(MultiReader); ok {
+		return mr.ReadMulti(repoID, objIDs, fn)
+	}
+	for _, objID := range objIDs {
+		var buf bytes.Buffer
+		if err := backend.Read(repoID, objID, &buf); err != nil {
+			return err
+		}
+		if err := fn(objID, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repack reclaims the space of the removed objects of a repo if the backend needs it,
+// and returns the number of bytes reclaimed.
+func (s *ObjectStore) Repack(repoID string) (reclaimed int64, err error) {
+	if r, ok := s.backend.(Repacker); ok {
+		return r.Repack(repoID)
+	}
+	return 0, nil
 }
 
 //Check whether object exists.
 func (s *ObjectStore) Exists(repoID string, objID string) (res bool, err error) {
-	return s.backend.exists(repoID, objID)
+	return s.backend.Exists(repoID, objID)
 }
 
 // Stat calculates object size.
 func (s *ObjectStore) Stat(repoID string, objID string) (res int64, err error) {
-	return s.backend.stat(repoID, objID)
+	return s.backend.Stat(repoID, objID)
+}
+
+// Remove deletes an object from storage backends.
+func (s *ObjectStore) Remove(repoID string, objID string) (err error) {
+	return s.backend.Remove(repoID, objID)
+}
+
+// List calls fn for every object of a repo.
+// Iteration stops at the first error returned by fn, and the error is returned.
+func (s *ObjectStore) List(repoID string, fn func(objID string) error) (err error) {
+	return s.backend.List(repoID, fn)
+}
+
+// ListRepos calls fn for every repo that has objects in the store.
+// Iteration stops at the first error returned by fn, and the error is returned.
+func (s *ObjectStore) ListRepos(fn func(repoID string) error) (err error) {
+	return s.backend.ListRepos(fn)
+}
+
+// Walk calls fn for every object of every repo in the store.
+// Iteration stops at the first error returned by fn, and the error is returned.
+func (s *ObjectStore) Walk(fn func(repoID string, objID string) error) (err error) {
+	return s.backend.ListRepos(func(repoID string) error {
+		return s.backend.List(repoID, func(objID string) error {
+			return fn(repoID, objID)
+		})
+	})
 }
@@ -2,9 +2,15 @@ package objstore
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"gopkg.in/ini.v1"
 )
 
 const (
@@ -66,7 +72,10 @@ func testWrite(t *testing.T) {
 	}
 	defer inputFile.Close()
 
-	bend := New(seafileConfPath, seafileDataDir, "commit")
+	bend, err := New(seafileConfPath, seafileDataDir, "commit")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
 	bend.Write(repoID, objID, inputFile, true)
 }
 
@@ -77,7 +86,10 @@ func testRead(t *testing.T) {
 	}
 	defer outputFile.Close()
 
-	bend := New(seafileConfPath, seafileDataDir, "commit")
+	bend, err := New(seafileConfPath, seafileDataDir, "commit")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
 	err = bend.Read(repoID, objID, outputFile)
 	if err != nil {
 		t.Errorf("Failed to read backend : %s\n", err)
@@ -85,7 +97,10 @@ func testRead(t *testing.T) {
 }
 
 func testExists(t *testing.T) {
-	bend := New(seafileConfPath, seafileDataDir, "commit")
+	bend, err := New(seafileConfPath, seafileDataDir, "commit")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
 	ret, _ := bend.Exists(repoID, objID)
 	if !ret {
 		t.Errorf("File is not exist\n")
@@ -103,3 +118,180 @@ func TestObjStore(t *testing.T) {
 	testRead(t)
 	testExists(t)
 }
+
+// memBackend is a fake backend keeping objects in memory.
+type memBackend struct {
+	objects map[string][]byte
+}
+
+func (b *memBackend) Read(repoID string, objID string, w io.Writer) error {
+	data, ok := b.objects[repoID+"/"+objID]
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (b *memBackend) Write(repoID string, objID string, r io.Reader, sync bool) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.objects[repoID+"/"+objID] = data
+	return nil
+}
+
+func (b *memBackend) Exists(repoID string, objID string) (bool, error) {
+	_, ok := b.objects[repoID+"/"+objID]
+	return ok, nil
+}
+
+func (b *memBackend) Stat(repoID string, objID string) (int64, error) {
+	data, ok := b.objects[repoID+"/"+objID]
+	if !ok {
+		return -1, os.ErrNotExist
+	}
+	return int64(len(data)), nil
+}
+
+func (b *memBackend) Remove(repoID string, objID string) error {
+	delete(b.objects, repoID+"/"+objID)
+	return nil
+}
+
+func (b *memBackend) List(repoID string, fn func(objID string) error) error {
+	for key := range b.objects {
+		if strings.HasPrefix(key, repoID+"/") {
+			if err := fn(strings.TrimPrefix(key, repoID+"/")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) ListRepos(fn func(repoID string) error) error {
+	repos := make(map[string]bool)
+	for key := range b.objects {
+		repos[key[:strings.Index(key, "/")]] = true
+	}
+	for repoID := range repos {
+		if err := fn(repoID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRegisterBackend(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-conf")
+	if err != nil {
+		t.Fatalf("Failed to create conf dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+
+	conf := "[block_backend]\nname = mem\n\n[fs_object_backend]\nname = unknown\n"
+	err = ioutil.WriteFile(filepath.Join(confDir, "seafile.conf"), []byte(conf), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write seafile.conf : %v\n", err)
+	}
+
+	backend := &memBackend{objects: make(map[string][]byte)}
+	var gotObjType string
+	RegisterBackend("mem", func(seafileDataDir string, objType string, section *ini.Section) (Backend, error) {
+		gotObjType = objType
+		return backend, nil
+	})
+
+	store, err := New(confDir, seafileDataDir, "blocks")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
+	if gotObjType != "blocks" {
+		t.Errorf("Factory is called with object type %s, want blocks\n", gotObjType)
+	}
+	if err := store.Write(repoID, objID, strings.NewReader("hello"), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	if _, ok := backend.objects[repoID+"/"+objID]; !ok {
+		t.Errorf("Object is not written to the registered backend\n")
+	}
+
+	if _, err := New(confDir, seafileDataDir, "fs"); err == nil {
+		t.Errorf("Unknown backend is accepted\n")
+	}
+
+	store, err = New(confDir, seafileDataDir, "commits")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
+	if _, ok := store.backend.(*fsBackend); !ok {
+		t.Errorf("Object type without backend section doesn't use fs backend\n")
+	}
+}
+
+func TestFSBackendWalk(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "objstore-data")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	store, err := New("", dataDir, "blocks")
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
+
+	otherRepoID := "1c3ec28d-08bd-4cab-8cd5-3a3b7a6d2df0"
+	otherObjID := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	objects := map[string]bool{repoID + "/" + objID: true, repoID + "/" + otherObjID: true, otherRepoID + "/" + objID: true}
+	for key := range objects {
+		ids := strings.Split(key, "/")
+		if err := store.Write(ids[0], ids[1], strings.NewReader(key), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	walked := make(map[string]bool)
+	err = store.Walk(func(repoID string, objID string) error {
+		walked[repoID+"/"+objID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk objects : %v\n", err)
+	}
+	if len(walked) != len(objects) {
+		t.Errorf("Walked %d objects, want %d\n", len(walked), len(objects))
+	}
+	for key := range objects {
+		if !walked[key] {
+			t.Errorf("Object %s is not walked\n", key)
+		}
+	}
+
+	if err := store.Remove(repoID, otherObjID); err != nil {
+		t.Fatalf("Failed to remove object : %v\n", err)
+	}
+	if err := store.Remove(repoID, otherObjID); err != nil {
+		t.Errorf("Removing a missing object returned error : %v\n", err)
+	}
+	var objIDs []string
+	err = store.List(repoID, func(objID string) error {
+		objIDs = append(objIDs, objID)
+		return nil
+	})
+	if err != nil || len(objIDs) != 1 || objIDs[0] != objID {
+		t.Errorf("Listed objects %v after remove, want [%s] : %v\n", objIDs, objID, err)
+	}
+
+	errStop := fmt.Errorf("stop")
+	count := 0
+	err = store.ListRepos(func(repoID string) error {
+		count++
+		return errStop
+	})
+	if err != errStop || count != 1 {
+		t.Errorf("Listing repos doesn't stop at the error returned by callback\n")
+	}
+}
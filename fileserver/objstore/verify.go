@@ -0,0 +1,140 @@
+// Checksum verification and quarantine of damaged objects.
+package objstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	corruptedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_corrupted_objects_total",
+		Help: "Number of objects whose content doesn't match their ID by object type.",
+	}, []string{"type"})
+	quarantinedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_quarantined_objects_total",
+		Help: "Number of damaged objects moved to quarantine by object type and result.",
+	}, []string{"type", "result"})
+)
+
+// ChecksumError is returned when the content of an object doesn't match its ID.
+type ChecksumError struct {
+	ObjType string
+	RepoID  string
+	ObjID   string
+	// Checksum is the checksum of the content read, it's empty if the content can't be decoded.
+	Checksum string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Checksum == "" {
+		return fmt.Sprintf("%s object %s/%s is damaged", e.ObjType, e.RepoID, e.ObjID)
+	}
+	return fmt.Sprintf("checksum of %s object %s/%s is %s", e.ObjType, e.RepoID, e.ObjID, e.Checksum)
+}
+
+// IsChecksumError returns whether err is a *ChecksumError.
+func IsChecksumError(err error) bool {
+	_, ok := err.(*ChecksumError)
+	return ok
+}
+
+// Verifiable returns whether objID is a SHA1 checksum that content can be checked against.
+func Verifiable(objID string) bool {
+	if len(objID) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(objID)
+	return err == nil
+}
+
+// quarantiner is implemented by backends that may keep several copies of an object,
+// so that only the damaged copies are quarantined.
+type quarantiner interface {
+	// quarantine calls save with every copy of the object that is not valid, and removes
+	// the copy after it's saved.
+	quarantine(repoID string, objID string, valid func(data []byte) bool, save func(data []byte) error) error
+}
+
+// Quarantine moves the damaged copies of an object out of the backend, so that they're no
+// longer served. Copies are read again from the backend and checked with valid, intact copies
+// are kept. The replicated backend repairs the damaged copies from intact ones, otherwise fsck
+// reports the object as missing. A damaged copy is kept in the quarantine directory of the data
+// dir, at quarantine/<type>/<repo id>/<object id>. cause is the error reported when the object
+// is found damaged.
+func (s *ObjectStore) Quarantine(repoID string, objID string, valid func(data []byte) bool, cause error) error {
+	corruptedObjects.WithLabelValues(s.ObjType).Inc()
+	err := s.quarantine(repoID, objID, valid)
+	if err != nil {
+		quarantinedObjects.WithLabelValues(s.ObjType, "failed").Inc()
+		log.Printf("Failed to quarantine damaged object (%v): %v", cause, err)
+		return err
+	}
+	quarantinedObjects.WithLabelValues(s.ObjType, "moved").Inc()
+	log.Printf("Moved damaged object to quarantine: %v", cause)
+	return nil
+}
+
+func (s *ObjectStore) quarantine(repoID string, objID string, valid func(data []byte) bool) error {
+	if s.quarantineDir == "" {
+		err := fmt.Errorf("no quarantine dir for %s objects", s.ObjType)
+		return err
+	}
+	if repoID == "" || objID == "" || strings.ContainsAny(repoID+objID, "/\\") ||
+		strings.HasPrefix(repoID, ".") || strings.HasPrefix(objID, ".") {
+		err := fmt.Errorf("invalid object %s/%s", repoID, objID)
+		return err
+	}
+
+	return quarantineCopies(s.backend, repoID, objID, valid, func(data []byte) error {
+		dir := filepath.Join(s.quarantineDir, repoID)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			err := fmt.Errorf("failed to create quarantine dir: %v", err)
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, objID), data, 0644); err != nil {
+			err := fmt.Errorf("failed to write object to quarantine: %v", err)
+			return err
+		}
+		return nil
+	})
+}
+
+// quarantineCopies quarantines the damaged copies of an object in backend. Backends that
+// don't implement quarantiner keep one copy of an object, it's removed if it's damaged.
+func quarantineCopies(backend Backend, repoID string, objID string, valid func(data []byte) bool, save func(data []byte) error) error {
+	if q, ok := backend.(quarantiner); ok {
+		return q.quarantine(repoID, objID, valid, save)
+	}
+
+	var buf bytes.Buffer
+	if err := backend.Read(repoID, objID, &buf); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		err := fmt.Errorf("failed to read object: %v", err)
+		return err
+	}
+	if valid(buf.Bytes()) {
+		// The content was damaged after it was read from the backend.
+		return nil
+	}
+
+	if err := save(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := backend.Remove(repoID, objID); err != nil {
+		err := fmt.Errorf("failed to remove object: %v", err)
+		return err
+	}
+	return nil
+}
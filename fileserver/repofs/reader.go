@@ -0,0 +1,156 @@
+package repofs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/crypt"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+)
+
+// Key decrypts the blocks of an encrypted repo.
+type Key struct {
+	Key []byte
+	IV  []byte
+}
+
+var errWhence = errors.New("invalid whence")
+
+// Reader reads the content of a file across its blocks, it implements io.ReadSeeker.
+// Files are usually read in order, so the block sizes are only needed after seeking.
+type Reader struct {
+	ctx     context.Context
+	storeID string
+	file    *fsmgr.Seafile
+	key     *Key
+	offset  int64
+	// Content sizes of the first blocks. The sizes of encrypted blocks are known
+	// once they're read, other blocks are stat'ed.
+	sizes []int64
+	// The last block read, it starts at blockStart in the file.
+	block      int
+	blockStart int64
+	blockData  []byte
+}
+
+// NewReader returns a reader of file in storeID, whose blocks are read with ctx.
+// The content is decrypted with key if it's not nil.
+func NewReader(ctx context.Context, storeID string, file *fsmgr.Seafile, key *Key) *Reader {
+	r := new(Reader)
+	r.ctx = ctx
+	r.storeID = storeID
+	r.file = file
+	r.key = key
+	r.block = -1
+	return r
+}
+
+// File returns the file read.
+func (r *Reader) File() *fsmgr.Seafile {
+	return r.file
+}
+
+// Size returns the size of the file.
+func (r *Reader) Size() int64 {
+	return int64(r.file.FileSize)
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.Size() {
+		return 0, io.EOF
+	}
+	if r.offset < r.blockStart || r.offset >= r.blockStart+int64(len(r.blockData)) {
+		if err := r.seekBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.blockData[r.offset-r.blockStart:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// seekBlock reads the block containing the current offset.
+func (r *Reader) seekBlock() error {
+	i, start := r.block+1, r.blockStart+int64(len(r.blockData))
+	if r.offset != start {
+		if r.key == nil {
+			if err := r.statBlocks(); err != nil {
+				return err
+			}
+		}
+		i, start = 0, 0
+		for i < len(r.sizes) && start+r.sizes[i] <= r.offset {
+			start += r.sizes[i]
+			i++
+		}
+	}
+
+	// The sizes of encrypted blocks after the known ones are found by reading them.
+	for ; i < len(r.file.BlkIDs); i++ {
+		data, err := r.readBlock(i)
+		if err != nil {
+			return err
+		}
+		if start+int64(len(data)) > r.offset {
+			r.block, r.blockStart, r.blockData = i, start, data
+			return nil
+		}
+		start += int64(len(data))
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// statBlocks finds the sizes of the blocks whose sizes are unknown.
+func (r *Reader) statBlocks() error {
+	for i := len(r.sizes); i < len(r.file.BlkIDs); i++ {
+		size, err := blockmgr.StatCtx(r.ctx, r.storeID, r.file.BlkIDs[i])
+		if err != nil {
+			return err
+		}
+		r.sizes = append(r.sizes, size)
+	}
+	return nil
+}
+
+// readBlock returns the content of block i.
+func (r *Reader) readBlock(i int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := blockmgr.ReadCtx(r.ctx, r.storeID, r.file.BlkIDs[i], &buf); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if r.key != nil {
+		var err error
+		data, err = crypt.Decrypt(data, r.key.Key, r.key.IV)
+		if err != nil {
+			err := fmt.Errorf("failed to decrypt block %s: %v", r.file.BlkIDs[i], err)
+			return nil, err
+		}
+	}
+	if i == len(r.sizes) {
+		r.sizes = append(r.sizes, int64(len(data)))
+	}
+	return data, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.Size()
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		err := fmt.Errorf("negative offset %d", offset)
+		return 0, err
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,336 @@
+// Package repofs provides the trees of repos as io/fs file systems, so that standard
+// tools like fs.WalkDir, http.FileServer and testing/fstest work on repo snapshots.
+package repofs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+)
+
+// FS is the read-only file system of a tree of fs objects.
+// It implements fs.FS, fs.ReadDirFS and fs.StatFS, and reads links with ReadLink and
+// Lstat. Other methods follow links.
+type FS struct {
+	ctx     context.Context
+	storeID string
+	root    *fsmgr.SeafDirent
+	key     *Key
+}
+
+// New returns the file system of the tree rootID in storeID.
+// The content of files is decrypted with key if it's not nil.
+func New(storeID, rootID string, key *Key) *FS {
+	fsys := new(FS)
+	fsys.ctx = context.Background()
+	fsys.storeID = storeID
+	fsys.root = &fsmgr.SeafDirent{ID: rootID, Name: ".", Mode: syscall.S_IFDIR}
+	fsys.key = key
+	return fsys
+}
+
+// FromCommit returns the file system of the tree of commit, whose fs objects are
+// in storeID. The modification time of the root is the time of the commit.
+func FromCommit(storeID string, commit *commitmgr.Commit, key *Key) *FS {
+	fsys := New(storeID, commit.RootID, key)
+	fsys.root.Mtime = commit.Ctime
+	return fsys
+}
+
+// WithContext returns a copy of the file system whose objects are read with ctx.
+func (fsys *FS) WithContext(ctx context.Context) *FS {
+	c := *fsys
+	c.ctx = ctx
+	return &c
+}
+
+// maxLinks is the maximum number of links followed when looking up a path.
+const maxLinks = 40
+
+// lookup returns the dirent of name. Links in the path are followed, and so is
+// the last element if follow is true.
+func (fsys *FS) lookup(op, name string, follow bool) (*fsmgr.SeafDirent, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dent, err := fsys.resolve(name, follow, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return dent, nil
+}
+
+// resolve returns the dirent of name, after following the given number of links.
+// Targets of links are relative to the dirs of links, and can't be outside the tree.
+func (fsys *FS) resolve(name string, follow bool, links int) (*fsmgr.SeafDirent, error) {
+	dent := fsys.root
+	if name == "." {
+		return dent, nil
+	}
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		if !fsmgr.IsDir(dent.Mode) {
+			return nil, fs.ErrNotExist
+		}
+		dir, err := fsmgr.GetSeafdirCtx(fsys.ctx, fsys.storeID, dent.ID)
+		if err != nil {
+			return nil, err
+		}
+		var found *fsmgr.SeafDirent
+		for _, e := range dir.Entries {
+			if e.Name == elem {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return nil, fs.ErrNotExist
+		}
+		dent = found
+
+		if fsmgr.IsLink(dent.Mode) && (follow || i < len(elems)-1) {
+			if links >= maxLinks {
+				return nil, syscall.ELOOP
+			}
+			target, err := fsys.readLink(dent)
+			if err != nil {
+				return nil, err
+			}
+			if path.IsAbs(target) {
+				return nil, fs.ErrNotExist
+			}
+			p := path.Join(path.Join(elems[:i]...), target)
+			p = path.Join(append([]string{p}, elems[i+1:]...)...)
+			if !fs.ValidPath(p) {
+				return nil, fs.ErrNotExist
+			}
+			return fsys.resolve(p, follow, links+1)
+		}
+	}
+	return dent, nil
+}
+
+// readLink returns the target of the link dent.
+func (fsys *FS) readLink(dent *fsmgr.SeafDirent) (string, error) {
+	seafile, err := fsmgr.GetSeafileCtx(fsys.ctx, fsys.storeID, dent.ID)
+	if err != nil {
+		return "", err
+	}
+	target, err := ioutil.ReadAll(NewReader(fsys.ctx, fsys.storeID, seafile, fsys.key))
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// readDir returns the entries of the directory dent sorted by name.
+func (fsys *FS) readDir(op, name string, dent *fsmgr.SeafDirent) ([]fs.DirEntry, error) {
+	if !fsmgr.IsDir(dent.Mode) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	dir, err := fsmgr.GetSeafdirCtx(fsys.ctx, fsys.storeID, dent.ID)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, 0, len(dir.Entries))
+	for _, e := range dir.Entries {
+		entries = append(entries, &fileInfo{e.Name, e})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// Open opens the file or directory name.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	dent, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := &fileInfo{path.Base(name), dent}
+	if fsmgr.IsDir(dent.Mode) {
+		return &dir{fsys: fsys, name: name, info: info}, nil
+	}
+
+	seafile, err := fsmgr.GetSeafileCtx(fsys.ctx, fsys.storeID, dent.ID)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{NewReader(fsys.ctx, fsys.storeID, seafile, fsys.key), name, info}, nil
+}
+
+// ReadDir returns the entries of the directory name sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dent, err := fsys.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.readDir("readdir", name, dent)
+}
+
+// Stat returns the file info of name. Its Sys method returns the *fsmgr.SeafDirent.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	dent, err := fsys.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{path.Base(name), dent}, nil
+}
+
+// Lstat returns the file info of name like Stat, without following the link name.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	dent, err := fsys.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{path.Base(name), dent}, nil
+}
+
+// ReadLink returns the target of the link name.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	dent, err := fsys.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !fsmgr.IsLink(dent.Mode) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := fsys.readLink(dent)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// fileInfo describes a dirent, it's both fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name string
+	dent *fsmgr.SeafDirent
+}
+
+func (info *fileInfo) Name() string {
+	return info.name
+}
+
+func (info *fileInfo) Size() int64 {
+	if info.IsDir() {
+		return 0
+	}
+	return info.dent.Size
+}
+
+func (info *fileInfo) Mode() fs.FileMode {
+	if info.IsDir() {
+		return fs.ModeDir | 0755
+	}
+	if fsmgr.IsLink(info.dent.Mode) {
+		return fs.ModeSymlink | 0777
+	}
+	return 0644
+}
+
+func (info *fileInfo) ModTime() time.Time {
+	return time.Unix(info.dent.Mtime, 0)
+}
+
+func (info *fileInfo) IsDir() bool {
+	return fsmgr.IsDir(info.dent.Mode)
+}
+
+func (info *fileInfo) Sys() interface{} {
+	return info.dent
+}
+
+func (info *fileInfo) Type() fs.FileMode {
+	return info.Mode().Type()
+}
+
+func (info *fileInfo) Info() (fs.FileInfo, error) {
+	return info, nil
+}
+
+// dir is an opened directory, its entries are read by the first ReadDir.
+type dir struct {
+	fsys    *FS
+	name    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.readDir("readdir", d.name, d.info.dent)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+
+	rest := d.entries
+	if count <= 0 {
+		d.entries = nil
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.entries = rest[count:]
+	return rest[:count], nil
+}
+
+// file is an opened file.
+type file struct {
+	*Reader
+	name string
+	info *fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.Reader.Seek(offset, whence)
+	if err != nil {
+		err = &fs.PathError{Op: "seek", Path: f.name, Err: err}
+	}
+	return n, err
+}
+
+func (f *file) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package repofs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/crypt"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+)
+
+const repoID = "b1f2ad61-9164-418a-a47f-ab805dbd5694"
+
+var blocks = []string{"first block ", "second block ", "third block"}
+
+func TestMain(m *testing.M) {
+	dataDir, err := ioutil.TempDir("", "repofs-test")
+	if err != nil {
+		fmt.Printf("Failed to create data dir : %v\n", err)
+		os.Exit(1)
+	}
+	blockmgr.Init("", dataDir)
+	fsmgr.Init("", dataDir)
+	commitmgr.Init("", dataDir)
+
+	code := m.Run()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
+}
+
+func encrypt(data []byte, key *Key) []byte {
+	out, _ := crypt.Encrypt(data, key.Key, key.IV)
+	return out
+}
+
+// writeFile writes a file of blocks, which are encrypted with key if it's not nil.
+func writeFile(t *testing.T, blocks []string, key *Key) (*fsmgr.Seafile, string) {
+	var content string
+	var blkIDs []string
+	for _, data := range blocks {
+		stored := []byte(data)
+		if key != nil {
+			stored = encrypt(stored, key)
+		}
+		checkSum := sha1.Sum(stored)
+		blkID := hex.EncodeToString(checkSum[:])
+		if err := blockmgr.Write(repoID, blkID, bytes.NewReader(stored)); err != nil {
+			t.Fatalf("Failed to write block : %v\n", err)
+		}
+		blkIDs = append(blkIDs, blkID)
+		content += data
+	}
+
+	file, err := fsmgr.NewSeafile(1, int64(len(content)), blkIDs)
+	if err != nil {
+		t.Fatalf("Failed to create seafile : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafile(repoID, file); err != nil {
+		t.Fatalf("Failed to save seafile : %v\n", err)
+	}
+	return file, content
+}
+
+func writeDir(t *testing.T, entries ...*fsmgr.SeafDirent) string {
+	dir, err := fsmgr.NewSeafdir(1, entries)
+	if err != nil {
+		t.Fatalf("Failed to create seafdir : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafdir(repoID, dir); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+	return dir.DirID
+}
+
+func TestFS(t *testing.T) {
+	file, content := writeFile(t, blocks, nil)
+	small, _ := writeFile(t, []string{"hello"}, nil)
+	link, _ := writeFile(t, []string{"b.txt"}, nil)
+	outside, _ := writeFile(t, []string{"../a.txt"}, nil)
+	now := time.Now().Unix()
+
+	docsID := writeDir(t,
+		fsmgr.NewDirent(link.FileID, "link", syscall.S_IFLNK|0777, now, "", 5),
+		fsmgr.NewDirent(small.FileID, "b.txt", syscall.S_IFREG|0644, now, "", 5),
+		fsmgr.NewDirent(file.FileID, "a.txt", syscall.S_IFREG|0644, now, "", int64(len(content))),
+	)
+	docsLink, _ := writeFile(t, []string{"docs"}, nil)
+	rootID := writeDir(t,
+		fsmgr.NewDirent(docsLink.FileID, "up", syscall.S_IFLNK|0777, now, "", 4),
+		fsmgr.NewDirent(fsmgr.EmptySha1, "empty", syscall.S_IFDIR, now, "", 0),
+		fsmgr.NewDirent(docsID, "docs", syscall.S_IFDIR, now, "", 0),
+		fsmgr.NewDirent(file.FileID, "a.txt", syscall.S_IFREG|0644, now, "", int64(len(content))),
+	)
+	commit := commitmgr.NewCommit(repoID, "", rootID, "seafile", "test commit")
+	fsys := FromCommit(repoID, commit, nil)
+
+	if err := fstest.TestFS(fsys, "a.txt", "docs/a.txt", "docs/b.txt", "docs/link", "empty", "up"); err != nil {
+		t.Errorf("File system test failed : %v\n", err)
+	}
+
+	data, err := fs.ReadFile(fsys, "docs/a.txt")
+	if err != nil || string(data) != content {
+		t.Errorf("Read %q, expected %q : %v\n", data, content, err)
+	}
+	if _, err := fsys.Stat("docs/missing"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error of stat missing file : %v\n", err)
+	}
+	if _, err := fsys.Stat("a.txt/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error of stat file under file : %v\n", err)
+	}
+	if _, err := fsys.ReadDir("a.txt"); err == nil {
+		t.Errorf("Read entries of file\n")
+	}
+
+	// Links are followed, except by ReadLink and Lstat.
+	if data, err := fs.ReadFile(fsys, "up/link"); err != nil || string(data) != "hello" {
+		t.Errorf("Read %q through links, expected %q : %v\n", data, "hello", err)
+	}
+	if target, err := fsys.ReadLink("up/link"); err != nil || target != "b.txt" {
+		t.Errorf("Link target is %q, expected %q : %v\n", target, "b.txt", err)
+	}
+	if info, err := fsys.Lstat("up"); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Link isn't reported by lstat : %v\n", err)
+	}
+	if info, err := fsys.Stat("up"); err != nil || !info.IsDir() {
+		t.Errorf("Link to dir isn't followed by stat : %v\n", err)
+	}
+	outsideRootID := writeDir(t, fsmgr.NewDirent(outside.FileID, "outside", syscall.S_IFLNK|0777, now, "", 8))
+	if _, err := New(repoID, outsideRootID, nil).Stat("outside"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error of stat link outside the tree : %v\n", err)
+	}
+	info, err := fsys.Stat(".")
+	if err != nil || info.ModTime().Unix() != commit.Ctime {
+		t.Errorf("Modification time of root isn't the commit time : %v\n", err)
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	key := &Key{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)}
+	for _, key := range []*Key{nil, key} {
+		file, content := writeFile(t, blocks, key)
+
+		tests := []struct {
+			offset int64
+			whence int
+			length int
+			start  int64
+		}{
+			{6, io.SeekStart, 12, 6},
+			{-5, io.SeekEnd, 5, int64(len(content)) - 5},
+			{25, io.SeekStart, 6, 25},
+			{-30, io.SeekCurrent, 30, 1},
+			{0, io.SeekStart, len(content), 0},
+		}
+		r := NewReader(context.Background(), repoID, file, key)
+		for _, test := range tests {
+			start, err := r.Seek(test.offset, test.whence)
+			if err != nil || start != test.start {
+				t.Fatalf("Seek to %d, expected %d : %v\n", start, test.start, err)
+			}
+			data := make([]byte, test.length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				t.Fatalf("Failed to read at %d : %v\n", start, err)
+			}
+			if expected := content[start : start+int64(test.length)]; string(data) != expected {
+				t.Errorf("Read %q at %d, expected %q\n", data, start, expected)
+			}
+		}
+		if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Unexpected error at end of file : %v\n", err)
+		}
+	}
+}
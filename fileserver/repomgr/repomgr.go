@@ -174,6 +174,18 @@ func RepoToCommit(repo *Repo, commit *commitmgr.Commit) {
 
 // GetEx return repo object even if it's corrupted.
 func GetEx(id string) *Repo {
+	repo := GetForCheck(id)
+	// Repos whose head commit can't be loaded are treated as deleted by sync clients.
+	if repo != nil && repo.IsCorrupted && repo.HeadCommitID != "" {
+		return nil
+	}
+	return repo
+}
+
+// GetForCheck returns the repo even if its head commit is missing or damaged, in which
+// case IsCorrupted is set. It's used by maintenance tools like GC and fsck. A repo
+// repaired by fsck gets a new head commit, so it's no longer corrupted once reloaded.
+func GetForCheck(id string) *Repo {
 	query := `SELECT r.repo_id, b.commit_id, v.origin_repo, v.path, v.base_commit FROM ` +
 		`Repo r LEFT JOIN Branch b ON r.repo_id = b.repo_id ` +
 		`LEFT JOIN VirtualRepo v ON r.repo_id = v.repo_id ` +
@@ -232,7 +244,7 @@ func GetEx(id string) *Repo {
 	if err != nil {
 		log.Printf("failed to load commit %s/%s : %v", repo.ID, repo.HeadCommitID, err)
 		repo.IsCorrupted = true
-		return nil
+		return repo
 	}
 
 	repo.Name = commit.RepoName
@@ -652,3 +664,214 @@ func UpdateRepoInfo(repoID, commitID string) error {
 
 	return nil
 }
+
+// Branch is a named reference to a commit of a repo.
+type Branch struct {
+	Name     string
+	RepoID   string
+	CommitID string
+}
+
+// GetRepoIDList returns the IDs of all repos.
+func GetRepoIDList() ([]string, error) {
+	sqlStr := "SELECT repo_id FROM Repo"
+
+	var ids []string
+	rows, err := seafileDB.Query(sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Exists checks whether a repo exists in database.
+func Exists(repoID string) (bool, error) {
+	var exists int
+	sqlStr := "SELECT 1 FROM Repo WHERE repo_id = ?"
+
+	row := seafileDB.QueryRow(sqlStr, repoID)
+	if err := row.Scan(&exists); err != nil {
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// GetBranchList returns all branches of a repo.
+func GetBranchList(repoID string) ([]*Branch, error) {
+	sqlStr := "SELECT name, repo_id, commit_id FROM Branch WHERE repo_id = ?"
+
+	var branches []*Branch
+	rows, err := seafileDB.Query(sqlStr, repoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		branch := new(Branch)
+		if err := rows.Scan(&branch.Name, &branch.RepoID, &branch.CommitID); err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+	}
+
+	return branches, rows.Err()
+}
+
+// GetRepoHistoryLimit returns the number of days of history kept for a repo.
+// A negative value means all history is kept, 0 means only the head commit is kept.
+// defaultDays is returned if the repo has no history setting.
+func GetRepoHistoryLimit(repoID string, defaultDays int) (int, error) {
+	// Virtual repos share the history setting of their origin repos.
+	vInfo, err := GetVirtualRepoInfo(repoID)
+	if err != nil {
+		return defaultDays, err
+	}
+	if vInfo != nil {
+		repoID = vInfo.OriginRepoID
+	}
+
+	var days int
+	sqlStr := "SELECT days FROM RepoHistoryLimit WHERE repo_id = ?"
+	row := seafileDB.QueryRow(sqlStr, repoID)
+	if err := row.Scan(&days); err != nil {
+		if err != sql.ErrNoRows {
+			return defaultDays, err
+		}
+		return defaultDays, nil
+	}
+	return days, nil
+}
+
+// GetRepoValidSince returns the timestamp since which the history of a repo is valid, -1 if not set.
+func GetRepoValidSince(repoID string) (int64, error) {
+	var timestamp int64
+	sqlStr := "SELECT timestamp FROM RepoValidSince WHERE repo_id = ?"
+
+	row := seafileDB.QueryRow(sqlStr, repoID)
+	if err := row.Scan(&timestamp); err != nil {
+		if err != sql.ErrNoRows {
+			return -1, err
+		}
+		return -1, nil
+	}
+	return timestamp, nil
+}
+
+// SetRepoValidSince sets the timestamp since which the history of a repo is valid.
+func SetRepoValidSince(repoID string, timestamp int64) error {
+	sqlStr := "REPLACE INTO RepoValidSince (repo_id, timestamp) VALUES (?, ?)"
+	if _, err := seafileDB.Exec(sqlStr, repoID, timestamp); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRepoTruncateTime returns the time before which the history of a repo can be dropped.
+// A positive value is a timestamp, 0 means only the head commit is kept and -1 means all history is kept.
+func GetRepoTruncateTime(repoID string, defaultKeepDays int) (int64, error) {
+	days, err := GetRepoHistoryLimit(repoID, defaultKeepDays)
+	if err != nil {
+		return -1, err
+	}
+	timestamp, err := GetRepoValidSince(repoID)
+	if err != nil {
+		return -1, err
+	}
+
+	if days > 0 {
+		truncateTime := time.Now().Unix() - int64(days)*24*3600
+		if timestamp > truncateTime {
+			return timestamp, nil
+		}
+		return truncateTime, nil
+	} else if days < 0 {
+		return timestamp, nil
+	}
+	return 0, nil
+}
+
+// ListGarbageRepos returns the IDs of repos deleted by users.
+func ListGarbageRepos() ([]string, error) {
+	sqlStr := "SELECT repo_id FROM GarbageRepos"
+
+	var ids []string
+	rows, err := seafileDB.Query(sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// RemoveGarbageRepo removes a repo from the garbage list.
+func RemoveGarbageRepo(repoID string) error {
+	sqlStr := "DELETE FROM GarbageRepos WHERE repo_id = ?"
+	if _, err := seafileDB.Exec(sqlStr, repoID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetBranch creates a branch or points an existing branch to a new commit.
+func SetBranch(branch *Branch) error {
+	sqlStr := "REPLACE INTO Branch (name, repo_id, commit_id) VALUES (?, ?, ?)"
+	if _, err := seafileDB.Exec(sqlStr, branch.Name, branch.RepoID, branch.CommitID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteRepoTokens deletes all sync tokens of a repo, so that clients have to resync the repo.
+func DeleteRepoTokens(repoID string) error {
+	sqlStr := "SELECT token FROM RepoUserToken WHERE repo_id = ?"
+
+	var tokens []string
+	rows, err := seafileDB.Query(sqlStr, repoID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		sqlStr := "DELETE FROM RepoUserToken WHERE token = ?"
+		if _, err := seafileDB.Exec(sqlStr, token); err != nil {
+			return err
+		}
+		sqlStr = "DELETE FROM RepoTokenPeerInfo WHERE token = ?"
+		if _, err := seafileDB.Exec(sqlStr, token); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
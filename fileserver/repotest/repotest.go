@@ -0,0 +1,163 @@
+// Package repotest creates repos for tests of packages that work on whole repos,
+// like gc and fsck. Objects are stored in a temporary data dir and repos are added
+// to a sqlite seafile database.
+package repotest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	// The seafile database of tests is a sqlite database.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var schema = []string{
+	"CREATE TABLE Repo (repo_id CHAR(36) PRIMARY KEY)",
+	"CREATE TABLE Branch (name VARCHAR(10), repo_id CHAR(36), commit_id CHAR(41), PRIMARY KEY (repo_id, name))",
+	"CREATE TABLE VirtualRepo (repo_id CHAR(36) PRIMARY KEY, origin_repo CHAR(36), path TEXT, base_commit CHAR(40))",
+	"CREATE TABLE RepoHistoryLimit (repo_id CHAR(36) PRIMARY KEY, days INTEGER)",
+	"CREATE TABLE RepoValidSince (repo_id CHAR(36) PRIMARY KEY, timestamp BIGINT)",
+	"CREATE TABLE GarbageRepos (repo_id CHAR(36) PRIMARY KEY)",
+	"CREATE TABLE RepoUserToken (repo_id CHAR(36), email VARCHAR(255), token CHAR(41))",
+	"CREATE TABLE RepoTokenPeerInfo (token CHAR(41) PRIMARY KEY, peer_id CHAR(41))",
+	"CREATE TABLE RepoInfo (repo_id CHAR(36) PRIMARY KEY, name VARCHAR(255), update_time INTEGER, " +
+		"version INTEGER, is_encrypted INTEGER, last_modifier VARCHAR(255), status INTEGER DEFAULT 0)",
+	"CREATE TABLE RepoOwner (repo_id CHAR(36) PRIMARY KEY, owner_id VARCHAR(255))",
+	"CREATE TABLE RepoSize (repo_id CHAR(36) PRIMARY KEY, size BIGINT, head_id CHAR(41))",
+	"CREATE TABLE UserQuota (user VARCHAR(255) PRIMARY KEY, quota BIGINT)",
+}
+
+// Env is a data dir and a seafile database used by repomgr and the object managers.
+type Env struct {
+	DataDir string
+	DB      *sql.DB
+}
+
+// Setup creates the data dir and the database, and initializes repomgr and the object
+// managers to use them. It's usually called from TestMain.
+func Setup(name string) (*Env, error) {
+	dataDir, err := ioutil.TempDir("", name)
+	if err != nil {
+		err := fmt.Errorf("failed to create data dir: %v", err)
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dataDir, "seafile.db"))
+	if err != nil {
+		os.RemoveAll(dataDir)
+		err := fmt.Errorf("failed to open database: %v", err)
+		return nil, err
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			os.RemoveAll(dataDir)
+			err := fmt.Errorf("failed to create table: %v", err)
+			return nil, err
+		}
+	}
+
+	env := &Env{dataDir, db}
+	repomgr.Init(db)
+	env.InitStores()
+	return env, nil
+}
+
+// InitStores initializes the object managers to store objects in the data dir.
+func (env *Env) InitStores() {
+	fsmgr.Init("", env.DataDir)
+	blockmgr.Init("", env.DataDir)
+	commitmgr.Init("", env.DataDir)
+}
+
+// Close closes the database and removes the data dir.
+func (env *Env) Close() {
+	env.DB.Close()
+	os.RemoveAll(env.DataDir)
+}
+
+// Reset removes all objects and all rows of the database.
+func (env *Env) Reset(t testing.TB) {
+	os.RemoveAll(filepath.Join(env.DataDir, "storage"))
+	env.InitStores()
+
+	for _, stmt := range schema {
+		var table string
+		fmt.Sscanf(stmt, "CREATE TABLE %s", &table)
+		if _, err := env.DB.Exec("DELETE FROM " + table); err != nil {
+			t.Fatalf("Failed to clean database : %v\n", err)
+		}
+	}
+}
+
+// AddRepo adds a repo whose master branch points to headCommit.
+func (env *Env) AddRepo(t testing.TB, repoID, headCommit string) {
+	if _, err := env.DB.Exec("INSERT INTO Repo (repo_id) VALUES (?)", repoID); err != nil {
+		t.Fatalf("Failed to insert repo : %v\n", err)
+	}
+	if _, err := env.DB.Exec("INSERT INTO Branch (name, repo_id, commit_id) VALUES ('master', ?, ?)", repoID, headCommit); err != nil {
+		t.Fatalf("Failed to insert branch : %v\n", err)
+	}
+}
+
+// WriteBlock writes a block containing data and returns its ID.
+func WriteBlock(t testing.TB, storeID string, data string) string {
+	checkSum := sha1.Sum([]byte(data))
+	blkID := hex.EncodeToString(checkSum[:])
+	if err := blockmgr.Write(storeID, blkID, bytes.NewBufferString(data)); err != nil {
+		t.Fatalf("Failed to write block : %v\n", err)
+	}
+	return blkID
+}
+
+// WriteFile writes a file of size made of blocks and returns its ID.
+func WriteFile(t testing.TB, storeID string, size int64, blkIDs ...string) string {
+	file, err := fsmgr.NewSeafile(1, size, blkIDs)
+	if err != nil {
+		t.Fatalf("Failed to create seafile : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafile(storeID, file); err != nil {
+		t.Fatalf("Failed to save seafile : %v\n", err)
+	}
+	return file.FileID
+}
+
+// WriteDir writes a dir containing entries and returns its ID.
+func WriteDir(t testing.TB, storeID string, entries ...*fsmgr.SeafDirent) string {
+	dir, err := fsmgr.NewSeafdir(1, entries)
+	if err != nil {
+		t.Fatalf("Failed to create seafdir : %v\n", err)
+	}
+	if err := fsmgr.SaveSeafdir(storeID, dir); err != nil {
+		t.Fatalf("Failed to save seafdir : %v\n", err)
+	}
+	return dir.DirID
+}
+
+// WriteCommit writes a commit of rootID and returns its ID, the first commit of a repo
+// has no parentID.
+func WriteCommit(t testing.TB, repoID, rootID, parentID string, ctime int64) string {
+	commit := commitmgr.NewCommit(repoID, parentID, rootID, "seafile", "test commit")
+	commit.Ctime = ctime
+	commit.CommitID = fmt.Sprintf("%x", sha1.Sum([]byte(rootID+parentID)))
+	commit.RepoName = "test"
+	commit.Version = 1
+	if parentID == "" {
+		commit.ParentID.Valid = false
+	}
+	if err := commitmgr.Save(commit); err != nil {
+		t.Fatalf("Failed to save commit : %v\n", err)
+	}
+	return commit.CommitID
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/haiwen/seafile-server/fileserver/commitmgr"
 	"github.com/haiwen/seafile-server/fileserver/diff"
 	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/objstore"
 	"github.com/haiwen/seafile-server/fileserver/repomgr"
 	"github.com/haiwen/seafile-server/fileserver/share"
 )
@@ -43,6 +44,8 @@ const (
 	virtualRepoExpireTime      = 7200
 	syncAPICleaningIntervalSec = 300
 	maxObjectPackSize          = 1 << 20 // 1MB
+	// Number of fs objects read at once by pack-fs.
+	packFSBatchSize = 100
 )
 
 var (
@@ -88,6 +91,7 @@ func syncAPIInit() {
 	go RecoverWrapper(func() {
 		for range ticker.C {
 			removeSyncAPIExpireCache()
+			removeWebDAVExpireCache()
 		}
 	})
 }
@@ -193,7 +197,7 @@ func getBlockMapCB(rsp http.ResponseWriter, r *http.Request) *appError {
 		return &appError{err, "", http.StatusInternalServerError}
 	}
 
-	seafile, err := fsmgr.GetSeafile(storeID, fileID)
+	seafile, err := fsmgr.GetSeafileCtx(r.Context(), storeID, fileID)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to get seafile object by file id %s: %v", fileID, err)
 		return &appError{nil, msg, http.StatusNotFound}
@@ -201,7 +205,7 @@ func getBlockMapCB(rsp http.ResponseWriter, r *http.Request) *appError {
 
 	var blockSizes []int64
 	for _, blockID := range seafile.BlkIDs {
-		blockSize, err := blockmgr.Stat(storeID, blockID)
+		blockSize, err := blockmgr.StatCtx(r.Context(), storeID, blockID)
 		if err != nil {
 			err := fmt.Errorf("Failed to find block %s/%s", storeID, blockID)
 			return &appError{err, "", http.StatusInternalServerError}
@@ -241,12 +245,36 @@ func getAccessibleRepoListCB(rsp http.ResponseWriter, r *http.Request) *appError
 		return appErr
 	}
 
+	repoObjects, err := getAccessibleRepos(user)
+	if err != nil {
+		return &appError{err, "", http.StatusInternalServerError}
+	}
+
+	var data []byte
+	if repoObjects != nil {
+		data, err = json.Marshal(repoObjects)
+		if err != nil {
+			err := fmt.Errorf("Failed to marshal json: %v", err)
+			return &appError{err, "", http.StatusInternalServerError}
+		}
+	} else {
+		data = []byte{'[', ']'}
+	}
+	rsp.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(data)
+	return nil
+}
+
+// getAccessibleRepos returns the repos owned by user, shared to user or the groups of user,
+// and the public repos.
+func getAccessibleRepos(user string) ([]*share.SharedRepo, error) {
 	obtainedRepos := make(map[string]string)
 
 	repos, err := share.GetReposByOwner(user)
 	if err != nil {
 		err := fmt.Errorf("Failed to get repos by owner %s: %v", user, err)
-		return &appError{err, "", http.StatusInternalServerError}
+		return nil, err
 	}
 
 	var repoObjects []*share.SharedRepo
@@ -263,7 +291,7 @@ func getAccessibleRepoListCB(rsp http.ResponseWriter, r *http.Request) *appError
 	repos, err = share.ListShareRepos(user, "to_email")
 	if err != nil {
 		err := fmt.Errorf("Failed to get share repos by user %s: %v", user, err)
-		return &appError{err, "", http.StatusInternalServerError}
+		return nil, err
 	}
 	for _, sRepo := range repos {
 		if _, ok := obtainedRepos[sRepo.ID]; ok {
@@ -277,7 +305,7 @@ func getAccessibleRepoListCB(rsp http.ResponseWriter, r *http.Request) *appError
 	repos, err = share.GetGroupReposByUser(user, -1)
 	if err != nil {
 		err := fmt.Errorf("Failed to get group repos by user %s: %v", user, err)
-		return &appError{err, "", http.StatusInternalServerError}
+		return nil, err
 	}
 	reposTable := filterGroupRepos(repos)
 
@@ -294,7 +322,7 @@ func getAccessibleRepoListCB(rsp http.ResponseWriter, r *http.Request) *appError
 	repos, err = share.ListInnerPubRepos()
 	if err != nil {
 		err := fmt.Errorf("Failed to get inner public repos: %v", err)
-		return &appError{err, "", http.StatusInternalServerError}
+		return nil, err
 	}
 
 	for _, sRepo := range repos {
@@ -307,20 +335,7 @@ func getAccessibleRepoListCB(rsp http.ResponseWriter, r *http.Request) *appError
 		repoObjects = append(repoObjects, sRepo)
 	}
 
-	var data []byte
-	if repoObjects != nil {
-		data, err = json.Marshal(repoObjects)
-		if err != nil {
-			err := fmt.Errorf("Failed to marshal json: %v", err)
-			return &appError{err, "", http.StatusInternalServerError}
-		}
-	} else {
-		data = []byte{'[', ']'}
-	}
-	rsp.Header().Set("Content-Length", strconv.Itoa(len(data)))
-	rsp.WriteHeader(http.StatusOK)
-	rsp.Write(data)
-	return nil
+	return repoObjects, nil
 }
 
 func filterGroupRepos(repos []*share.SharedRepo) map[string]*share.SharedRepo {
@@ -363,6 +378,7 @@ func recvFSCB(rsp http.ResponseWriter, r *http.Request) *appError {
 		return &appError{nil, err.Error(), http.StatusBadRequest}
 	}
 
+	var objs []objstore.Object
 	for len(fsBuf) > 44 {
 		objID := string(fsBuf[:40])
 		if !isObjectIDValid(objID) {
@@ -382,20 +398,20 @@ func recvFSCB(rsp http.ResponseWriter, r *http.Request) *appError {
 			return &appError{nil, msg, http.StatusBadRequest}
 		}
 
-		objBuffer := bytes.NewBuffer(fsBuf[44 : 44+objSize])
-		if err := fsmgr.WriteRaw(storeID, objID, objBuffer); err != nil {
-			err := fmt.Errorf("Failed to write fs obj %s:%s : %v", storeID, objID, err)
-			return &appError{err, "", http.StatusInternalServerError}
-		}
+		objs = append(objs, objstore.Object{ID: objID, Data: fsBuf[44 : 44+objSize]})
 		fsBuf = fsBuf[44+objSize:]
 	}
-	if len(fsBuf) == 0 {
-		rsp.WriteHeader(http.StatusOK)
-		return nil
+	if len(fsBuf) != 0 {
+		msg := "Request body size invalid"
+		return &appError{nil, msg, http.StatusBadRequest}
 	}
 
-	msg := "Request body size invalid"
-	return &appError{nil, msg, http.StatusBadRequest}
+	if err := fsmgr.WriteRawBatch(storeID, objs); err != nil {
+		err := fmt.Errorf("Failed to write fs objs of %s : %v", storeID, err)
+		return &appError{err, "", http.StatusInternalServerError}
+	}
+	rsp.WriteHeader(http.StatusOK)
+	return nil
 }
 func checkFSCB(rsp http.ResponseWriter, r *http.Request) *appError {
 	return postCheckExistCB(rsp, r, checkFSExist)
@@ -436,9 +452,9 @@ func postCheckExistCB(rsp http.ResponseWriter, r *http.Request, existType checkE
 			continue
 		}
 		if existType == checkFSExist {
-			ret, _ = fsmgr.Exists(storeID, objIDList[i])
+			ret, _ = fsmgr.ExistsCtx(r.Context(), storeID, objIDList[i])
 		} else if existType == checkBlockExist {
-			ret = blockmgr.Exists(storeID, objIDList[i])
+			ret = blockmgr.ExistsCtx(r.Context(), storeID, objIDList[i])
 		}
 		if !ret {
 			neededObjs = append(neededObjs, objIDList[i])
@@ -486,27 +502,48 @@ func packFSCB(rsp http.ResponseWriter, r *http.Request) *appError {
 		return &appError{nil, err.Error(), http.StatusBadRequest}
 	}
 
+	for _, fsID := range fsIDList {
+		if !isObjectIDValid(fsID) {
+			msg := fmt.Sprintf("Invalid fs id %s", fsID)
+			return &appError{nil, msg, http.StatusBadRequest}
+		}
+	}
+
+	// Objects are read in batches, in the order they are stored, and sent in the requested order.
+	// Only the first objects up to maxObjectPackSize are sent, the client requests the rest again.
 	var totalSize int
 	var data bytes.Buffer
-	for i := 0; i < len(fsIDList); i++ {
-		if !isObjectIDValid(fsIDList[i]) {
-			msg := fmt.Sprintf("Invalid fs id %s", fsIDList[i])
-			return &appError{nil, msg, http.StatusBadRequest}
+	for start := 0; start < len(fsIDList) && totalSize < maxObjectPackSize; start += packFSBatchSize {
+		end := start + packFSBatchSize
+		if end > len(fsIDList) {
+			end = len(fsIDList)
 		}
-		data.WriteString(fsIDList[i])
-		var tmp bytes.Buffer
-		if err := fsmgr.ReadRaw(storeID, fsIDList[i], &tmp); err != nil {
-			err := fmt.Errorf("Failed to read fs %s:%s: %v", storeID, fsIDList[i], err)
+		batch := fsIDList[start:end]
+		objs := make(map[string][]byte, len(batch))
+		err := fsmgr.ReadRawMulti(storeID, batch, func(fsID string, obj []byte) error {
+			if err := r.Context().Err(); err != nil {
+				return err
+			}
+			objs[fsID] = obj
+			return nil
+		})
+		if err != nil {
+			err := fmt.Errorf("Failed to read fs objects of %s: %v", storeID, err)
 			return &appError{err, "", http.StatusInternalServerError}
 		}
-		tmpLen := make([]byte, 4)
-		binary.BigEndian.PutUint32(tmpLen, uint32(tmp.Len()))
-		data.Write(tmpLen)
-		data.Write(tmp.Bytes())
-
-		totalSize += tmp.Len()
-		if totalSize >= maxObjectPackSize {
-			break
+
+		for _, fsID := range batch {
+			obj := objs[fsID]
+			data.WriteString(fsID)
+			tmpLen := make([]byte, 4)
+			binary.BigEndian.PutUint32(tmpLen, uint32(len(obj)))
+			data.Write(tmpLen)
+			data.Write(obj)
+
+			totalSize += len(obj)
+			if totalSize >= maxObjectPackSize {
+				break
+			}
 		}
 	}
 
@@ -725,7 +762,7 @@ func putSendBlockCB(rsp http.ResponseWriter, r *http.Request) *appError {
 		return &appError{err, "", http.StatusInternalServerError}
 	}
 
-	if err := blockmgr.Write(storeID, blockID, r.Body); err != nil {
+	if err := blockmgr.WriteCtx(r.Context(), storeID, blockID, r.Body); err != nil {
 		err := fmt.Errorf("Failed to close block %.8s:%s", storeID, blockID)
 		return &appError{err, "", http.StatusInternalServerError}
 	}
@@ -758,7 +795,7 @@ func getBlockInfo(rsp http.ResponseWriter, r *http.Request) *appError {
 		return &appError{err, "", http.StatusInternalServerError}
 	}
 
-	blockSize, err := blockmgr.Stat(storeID, blockID)
+	blockSize, err := blockmgr.StatCtx(r.Context(), storeID, blockID)
 	if err != nil {
 		return &appError{err, "", http.StatusInternalServerError}
 	}
@@ -769,7 +806,7 @@ func getBlockInfo(rsp http.ResponseWriter, r *http.Request) *appError {
 
 	blockLen := fmt.Sprintf("%d", blockSize)
 	rsp.Header().Set("Content-Length", blockLen)
-	if err := blockmgr.Read(storeID, blockID, rsp); err != nil {
+	if err := blockmgr.ReadCtx(r.Context(), storeID, blockID, rsp); err != nil {
 		return &appError{err, "", http.StatusInternalServerError}
 	}
 
@@ -819,6 +856,7 @@ func getRepoStoreID(repoID string) (string, error) {
 }
 
 func sendStatisticMsg(repoID, user, operation string, bytes uint64) {
+	transferBytes.WithLabelValues(operation).Add(float64(bytes))
 	rData := &statusEventData{operation, user, repoID, bytes}
 
 	publishStatusEvent(rData)
@@ -861,7 +899,7 @@ func putCommitCB(rsp http.ResponseWriter, r *http.Request) *appError {
 		return &appError{nil, msg, http.StatusBadRequest}
 	}
 
-	if err := commitmgr.Save(commit); err != nil {
+	if err := commitmgr.SaveCtx(r.Context(), commit); err != nil {
 		err := fmt.Errorf("Failed to add commit %s: %v", commitID, err)
 		return &appError{err, "", http.StatusInternalServerError}
 	}
@@ -881,13 +919,13 @@ func getCommitInfo(rsp http.ResponseWriter, r *http.Request) *appError {
 	if appErr != nil {
 		return appErr
 	}
-	if exists, _ := commitmgr.Exists(repoID, commitID); !exists {
+	if exists, _ := commitmgr.ExistsCtx(r.Context(), repoID, commitID); !exists {
 		log.Printf("%s:%s is missing", repoID, commitID)
 		return &appError{nil, "", http.StatusNotFound}
 	}
 
 	var data bytes.Buffer
-	err := commitmgr.ReadRaw(repoID, commitID, &data)
+	err := commitmgr.ReadRawCtx(r.Context(), repoID, commitID, &data)
 	if err != nil {
 		err := fmt.Errorf("Failed to read commit %s:%s: %v", repoID, commitID, err)
 		return &appError{err, "", http.StatusInternalServerError}
@@ -1014,6 +1052,7 @@ func checkPermission(repoID, user, op string, skipCache bool) *appError {
 		if value, ok := permCache.Load(fmt.Sprintf("%s:%s:%s", repoID, user, op)); ok {
 			info = value.(*permInfo)
 		}
+		recordCacheLookup("perm", info != nil)
 	}
 	if info != nil {
 		return nil
@@ -1056,6 +1095,7 @@ func validateToken(r *http.Request, repoID string, skipCache bool) (string, *app
 
 	if value, ok := tokenCache.Load(token); ok {
 		if info, ok := value.(*tokenInfo); ok {
+			recordCacheLookup("token", true)
 			if info.repoID != repoID {
 				msg := "Invalid token"
 				return "", &appError{nil, msg, http.StatusForbidden}
@@ -1064,6 +1104,8 @@ func validateToken(r *http.Request, repoID string, skipCache bool) (string, *app
 		}
 	}
 
+	recordCacheLookup("token", false)
+
 	email, err := repomgr.GetEmailByToken(repoID, token)
 	if err != nil {
 		log.Printf("Failed to get email by token %s: %v", token, err)
@@ -1201,7 +1243,7 @@ func removeSyncAPIExpireCache() {
 }
 
 func calculateSendObjectList(ctx context.Context, repo *repomgr.Repo, serverHead string, clientHead string, dirOnly bool) ([]interface{}, error) {
-	masterHead, err := commitmgr.Load(repo.ID, serverHead)
+	masterHead, err := commitmgr.LoadCtx(ctx, repo.ID, serverHead)
 	if err != nil {
 		err := fmt.Errorf("Failed to load server head commit %s:%s: %v", repo.ID, serverHead, err)
 		return nil, err
@@ -1209,7 +1251,7 @@ func calculateSendObjectList(ctx context.Context, repo *repomgr.Repo, serverHead
 	var remoteHead *commitmgr.Commit
 	remoteHeadRoot := emptySHA1
 	if clientHead != "" {
-		remoteHead, err = commitmgr.Load(repo.ID, clientHead)
+		remoteHead, err = commitmgr.LoadCtx(ctx, repo.ID, clientHead)
 		if err != nil {
 			err := fmt.Errorf("Failed to load remote head commit %s:%s: %v", repo.ID, clientHead, err)
 			return nil, err
@@ -1222,6 +1264,11 @@ func calculateSendObjectList(ctx context.Context, repo *repomgr.Repo, serverHead
 		results = append(results, masterHead.RootID)
 	}
 
+	// All objects are sent when the client has no head, so the tree is just walked.
+	if remoteHeadRoot == emptySHA1 {
+		return collectTreeIDs(ctx, repo.StoreID, masterHead.RootID, dirOnly, results)
+	}
+
 	var opt *diff.DiffOptions
 	if !dirOnly {
 		opt = &diff.DiffOptions{
@@ -1246,6 +1293,27 @@ func calculateSendObjectList(ctx context.Context, repo *repomgr.Repo, serverHead
 	return results, nil
 }
 
+func collectTreeIDs(ctx context.Context, storeID, rootID string, dirOnly bool, results []interface{}) ([]interface{}, error) {
+	files := make(map[string]bool)
+	opts := &fsmgr.WalkOptions{Visited: make(map[string]bool)}
+	err := fsmgr.Walk(ctx, storeID, rootID, func(path string, dent *fsmgr.SeafDirent) error {
+		if dent.ID == emptySHA1 || path == "/" {
+			return nil
+		}
+		if fsmgr.IsDir(dent.Mode) {
+			results = append(results, dent.ID)
+		} else if !dirOnly && !files[dent.ID] {
+			files[dent.ID] = true
+			results = append(results, dent.ID)
+		}
+		return nil
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 func collectFileIDs(ctx context.Context, baseDir string, files []*fsmgr.SeafDirent, data interface{}) error {
 	select {
 	case <-ctx.Done():
@@ -0,0 +1,559 @@
+// Resumable uploads with the tus protocol (https://tus.io/protocols/resumable-upload.html).
+//
+// An upload is created by POST /upload-tus/<token> with the Upload-Length header, the name of
+// the file and the target folder are given in Upload-Metadata. The returned location is used
+// to query the received offset with HEAD, to send the content with PATCH and to terminate
+// the upload with DELETE. Besides the tus core protocol, parts can also be sent out of order,
+// the offset returned by HEAD and PATCH is the end of the received content from the start of the file.
+// When all content is received, the file is committed to the repo like files uploaded by upload-api.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	// Uploads which are not updated for this time are removed.
+	tusUploadExpireTime       = 24 * time.Hour
+	tusCleaningIntervalSec    = 3600
+	tusOffsetOctetStreamType  = "application/offset+octet-stream"
+	tusUploadInfoFileSuffix   = ".info"
+	tusUploadFilePrefix       = "tus-"
+	tusUploadMetadataMaxBytes = 4096
+)
+
+// tusUpload is the state of an upload, it's stored in a json file next to the uploaded content
+// so that the upload can be resumed on any file server sharing the temp dir. Requests to an
+// upload are serialized by a file lock on the uploaded content, see lockTusUpload.
+type tusUpload struct {
+	ID           string `json:"id"`
+	RepoID       string `json:"repo_id"`
+	User         string `json:"user"`
+	TokenType    string `json:"token_type"`
+	ParentDir    string `json:"parent_dir"`
+	RelativePath string `json:"relative_path"`
+	FileName     string `json:"file_name"`
+	Replace      bool   `json:"replace"`
+	Length       int64  `json:"length"`
+	// Received byte ranges, sorted and merged. Each range is [start, end).
+	Ranges   [][2]int64 `json:"ranges"`
+	Expires  int64      `json:"expires"`
+	Finished bool       `json:"finished"`
+}
+
+// lockTusUpload takes an exclusive flock on the content file of the upload, which serializes
+// requests to the upload on this and other file servers sharing the temp dir. The returned
+// function releases the lock. An error satisfying os.IsNotExist is returned if the upload
+// is removed. The upload may also be removed while waiting for the lock, so the info has to
+// be loaded after locking.
+func lockTusUpload(id string) (func(), error) {
+	f, err := os.Open(tusUploadPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		err := fmt.Errorf("failed to lock upload %s: %v", id, err)
+		return nil, err
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
+
+func tusUploadDir() string {
+	return filepath.Join(absDataDir, "httptemp", "cluster-shared")
+}
+
+func tusUploadPath(id string) string {
+	return filepath.Join(tusUploadDir(), tusUploadFilePrefix+id)
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	data, err := ioutil.ReadFile(tusUploadPath(id) + tusUploadInfoFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	upload := new(tusUpload)
+	if err := json.Unmarshal(data, upload); err != nil {
+		err := fmt.Errorf("failed to decode upload info: %v", err)
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (upload *tusUpload) save() error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	infoPath := tusUploadPath(upload.ID) + tusUploadInfoFileSuffix
+	tmpPath := infoPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, infoPath)
+}
+
+func (upload *tusUpload) remove() {
+	os.Remove(tusUploadPath(upload.ID))
+	os.Remove(tusUploadPath(upload.ID) + tusUploadInfoFileSuffix)
+}
+
+// offset returns the end of the content received from the start of the file.
+func (upload *tusUpload) offset() int64 {
+	if len(upload.Ranges) == 0 || upload.Ranges[0][0] != 0 {
+		return 0
+	}
+	return upload.Ranges[0][1]
+}
+
+// addRange records that [start, end) is received.
+func (upload *tusUpload) addRange(start, end int64) {
+	if start >= end {
+		return
+	}
+	ranges := append(upload.Ranges, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	upload.Ranges = merged
+}
+
+// parseTusMetadata parses the Upload-Metadata header, which is a comma separated list of
+// keys and base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			err := fmt.Errorf("invalid metadata %s", pair)
+			return nil, err
+		}
+		var value []byte
+		if len(fields) == 2 {
+			var err error
+			value, err = base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				err := fmt.Errorf("invalid value of metadata %s: %v", fields[0], err)
+				return nil, err
+			}
+		}
+		metadata[fields[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+func setTusHeaders(rsp http.ResponseWriter) {
+	rsp.Header().Set("Tus-Resumable", tusVersion)
+	rsp.Header().Set("Access-Control-Allow-Origin", "*")
+	rsp.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size")
+}
+
+func uploadTusCB(rsp http.ResponseWriter, r *http.Request) *appError {
+	setTusHeaders(rsp)
+
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && method == "POST" {
+		method = override
+	}
+
+	if method == "OPTIONS" {
+		rsp.Header().Set("Tus-Version", tusVersion)
+		rsp.Header().Set("Tus-Extension", tusExtensions)
+		if options.maxUploadSize > 0 {
+			rsp.Header().Set("Tus-Max-Size", strconv.FormatUint(options.maxUploadSize, 10))
+		}
+		rsp.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+		rsp.Header().Set("Access-Control-Allow-Headers", "authorization, content-type, origin, x-requested-with, x-http-method-override, "+
+			"upload-length, upload-offset, upload-metadata, tus-resumable")
+		rsp.Header().Set("Access-Control-Max-Age", "86400")
+		rsp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion {
+		rsp.Header().Set("Tus-Version", tusVersion)
+		msg := "Unsupported tus version.\n"
+		return &appError{nil, msg, http.StatusPreconditionFailed}
+	}
+
+	fsm, err := parseUploadHeaders(r)
+	if err != nil {
+		return err
+	}
+
+	return handleTusUpload(rsp, r, fsm, method)
+}
+
+// handleTusUpload handles a request of method to the upload-tus API with the access token parsed into fsm.
+func handleTusUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData, method string) *appError {
+	vars := mux.Vars(r)
+	uploadID := vars["id"]
+	if uploadID == "" {
+		if method != "POST" {
+			return &appError{nil, "", http.StatusMethodNotAllowed}
+		}
+		return createTusUpload(rsp, r, fsm)
+	}
+
+	if id, err := uuid.Parse(uploadID); err != nil || id.String() != uploadID {
+		msg := "Upload not found.\n"
+		return &appError{nil, msg, http.StatusNotFound}
+	}
+
+	unlock, lockErr := lockTusUpload(uploadID)
+	if lockErr != nil {
+		if !os.IsNotExist(lockErr) {
+			return &appError{lockErr, "", http.StatusInternalServerError}
+		}
+		msg := "Upload not found.\n"
+		return &appError{nil, msg, http.StatusNotFound}
+	}
+	defer unlock()
+
+	upload, loadErr := loadTusUpload(uploadID)
+	if loadErr != nil || upload.Finished {
+		if loadErr != nil && !os.IsNotExist(loadErr) {
+			err := fmt.Errorf("failed to load upload %s: %v", uploadID, loadErr)
+			return &appError{err, "", http.StatusInternalServerError}
+		}
+		msg := "Upload not found.\n"
+		return &appError{nil, msg, http.StatusNotFound}
+	}
+	if upload.RepoID != fsm.repoID || upload.User != fsm.user {
+		msg := "Upload doesn't belong to the access token.\n"
+		return &appError{nil, msg, http.StatusForbidden}
+	}
+
+	switch method {
+	case "HEAD":
+		rsp.Header().Set("Cache-Control", "no-store")
+		rsp.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset(), 10))
+		rsp.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		rsp.Header().Set("Upload-Expires", time.Unix(upload.Expires, 0).UTC().Format(http.TimeFormat))
+		rsp.WriteHeader(http.StatusOK)
+		return nil
+	case "PATCH":
+		return patchTusUpload(rsp, r, fsm, upload)
+	case "DELETE":
+		upload.remove()
+		rsp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return &appError{nil, "", http.StatusMethodNotAllowed}
+}
+
+func createTusUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData) *appError {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		msg := "Invalid Upload-Length.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+	if options.maxUploadSize > 0 && uint64(length) > options.maxUploadSize {
+		msg := "File size is too large.\n"
+		return &appError{nil, msg, http.StatusRequestEntityTooLarge}
+	}
+
+	header := r.Header.Get("Upload-Metadata")
+	if len(header) > tusUploadMetadataMaxBytes {
+		msg := "Upload-Metadata is too large.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+	metadata, err := parseTusMetadata(header)
+	if err != nil {
+		msg := "Invalid Upload-Metadata.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+
+	upload := new(tusUpload)
+	upload.ID = uuid.New().String()
+	upload.RepoID = fsm.repoID
+	upload.User = fsm.user
+	upload.TokenType = fsm.tokenType
+	upload.Length = length
+	upload.Expires = time.Now().Add(tusUploadExpireTime).Unix()
+
+	upload.FileName = metadata["filename"]
+	if upload.FileName == "" {
+		upload.FileName = metadata["name"]
+	}
+	if upload.FileName == "" || shouldIgnoreFile(upload.FileName) {
+		msg := "Invalid file name.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+
+	upload.ParentDir = metadata["parent_dir"]
+	if upload.ParentDir == "" {
+		upload.ParentDir = fsm.parentDir
+	}
+	if upload.ParentDir == "" || upload.ParentDir[0] != '/' {
+		msg := "Invalid parent dir"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+	if !isParentMatched(fsm.parentDir, upload.ParentDir) {
+		msg := "Parent dir doesn't match."
+		return &appError{nil, msg, http.StatusForbidden}
+	}
+
+	upload.RelativePath = metadata["relative_path"]
+	if upload.RelativePath != "" && (upload.RelativePath[0] == '/' || upload.RelativePath[0] == '\\') {
+		msg := "Invalid relative path"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+
+	switch metadata["replace"] {
+	case "", "0":
+	case "1":
+		upload.Replace = true
+	default:
+		msg := "Invalid argument replace.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+
+	if appErr := checkParentDir(fsm.repoID, upload.ParentDir); appErr != nil {
+		return appErr
+	}
+	ret, err := checkQuota(fsm.repoID, length)
+	if err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to check quota: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	if ret == 1 {
+		msg := "Out of quota.\n"
+		return &appError{nil, msg, seafHTTPResNoQuota}
+	}
+
+	f, err := os.OpenFile(tusUploadPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(options.clusterSharedTempFileMode))
+	if err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to create upload file: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	f.Close()
+	if err := upload.save(); err != nil {
+		upload.remove()
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to save upload info: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+
+	location := strings.TrimSuffix(r.URL.Path, "/") + "/" + upload.ID
+	rsp.Header().Set("Location", location)
+	rsp.Header().Set("Upload-Expires", time.Unix(upload.Expires, 0).UTC().Format(http.TimeFormat))
+
+	if length == 0 {
+		unlock, err := lockTusUpload(upload.ID)
+		if err != nil {
+			msg := "Internal error.\n"
+			return &appError{err, msg, http.StatusInternalServerError}
+		}
+		defer unlock()
+		return finishTusUpload(rsp, r, fsm, upload, http.StatusCreated)
+	}
+
+	rsp.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func patchTusUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData, upload *tusUpload) *appError {
+	if r.Header.Get("Content-Type") != tusOffsetOctetStreamType {
+		msg := "Invalid Content-Type.\n"
+		return &appError{nil, msg, http.StatusUnsupportedMediaType}
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 || offset > upload.Length {
+		msg := "Invalid Upload-Offset.\n"
+		return &appError{nil, msg, http.StatusBadRequest}
+	}
+	if r.ContentLength > upload.Length-offset {
+		msg := "Content exceeds Upload-Length.\n"
+		return &appError{nil, msg, http.StatusRequestEntityTooLarge}
+	}
+
+	f, err := os.OpenFile(tusUploadPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to open upload file: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to seek upload file: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+
+	// The received part is kept even if the request is interrupted, so that the client can resume from it.
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	closeErr := f.Close()
+	if closeErr != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to write upload file: %v", closeErr)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	upload.addRange(offset, offset+n)
+	upload.Expires = time.Now().Add(tusUploadExpireTime).Unix()
+	if err := upload.save(); err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to save upload info: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	if copyErr != nil {
+		return &appError{nil, "", http.StatusBadRequest}
+	}
+
+	rsp.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset(), 10))
+	rsp.Header().Set("Upload-Expires", time.Unix(upload.Expires, 0).UTC().Format(http.TimeFormat))
+	if upload.offset() == upload.Length {
+		return finishTusUpload(rsp, r, fsm, upload, http.StatusOK)
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// finishTusUpload commits the uploaded file and removes the upload. The result of
+// postMultiFiles is written to the response with status code.
+func finishTusUpload(rsp http.ResponseWriter, r *http.Request, fsm *recvData, upload *tusUpload, code int) *appError {
+	defer upload.remove()
+
+	upload.Finished = true
+	if err := upload.save(); err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to save upload info: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+
+	fsm.rstart = 0
+	fsm.rend = upload.Length - 1
+	fsm.fsize = upload.Length
+	fsm.fileNames = []string{upload.FileName}
+	fsm.files = []string{tusUploadPath(upload.ID)}
+
+	if err := checkParentDir(upload.RepoID, upload.ParentDir); err != nil {
+		return err
+	}
+	if err := checkTmpFileList(fsm); err != nil {
+		return err
+	}
+	// The quota is checked again since other files may be added while the content is uploaded.
+	ret, err := checkQuota(upload.RepoID, upload.Length)
+	if err != nil {
+		msg := "Internal error.\n"
+		err := fmt.Errorf("failed to check quota: %v", err)
+		return &appError{err, msg, http.StatusInternalServerError}
+	}
+	if ret == 1 {
+		msg := "Out of quota.\n"
+		return &appError{nil, msg, seafHTTPResNoQuota}
+	}
+	if err := createRelativePath(upload.RepoID, upload.ParentDir, upload.RelativePath, upload.User); err != nil {
+		return err
+	}
+
+	newParentDir := filepath.Join("/", upload.ParentDir, upload.RelativePath)
+	rsp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w := &statusResponseWriter{ResponseWriter: rsp, code: code}
+	if err := postMultiFiles(w, r, upload.RepoID, newParentDir, upload.User, fsm, upload.Replace, true); err != nil {
+		return err
+	}
+	w.WriteHeader(code)
+
+	oper := "web-file-upload"
+	if upload.TokenType == "upload-link" {
+		oper = "link-file-upload"
+	}
+	sendStatisticMsg(upload.RepoID, upload.User, oper, uint64(upload.Length))
+
+	return nil
+}
+
+// statusResponseWriter writes a status code other than 200 before the first write of the body.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(w.code)
+	return w.ResponseWriter.Write(data)
+}
+
+func tusInit() {
+	ticker := time.NewTicker(time.Second * tusCleaningIntervalSec)
+	go RecoverWrapper(func() {
+		for range ticker.C {
+			removeExpiredTusUploads()
+		}
+	})
+}
+
+func removeExpiredTusUploads() {
+	matches, err := filepath.Glob(filepath.Join(tusUploadDir(), tusUploadFilePrefix+"*"+tusUploadInfoFileSuffix))
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, infoPath := range matches {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(infoPath), tusUploadFilePrefix), tusUploadInfoFileSuffix)
+		unlock, err := lockTusUpload(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The content file is created before the info file and removed before it,
+				// so the upload was interrupted while being removed.
+				os.Remove(infoPath)
+			}
+			continue
+		}
+		upload, err := loadTusUpload(id)
+		if err == nil && upload.Expires < now {
+			log.Printf("remove expired upload %s of repo %s", id, upload.RepoID)
+			upload.remove()
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	"github.com/haiwen/seafile-server/fileserver/repotest"
+	"github.com/haiwen/seafile-server/fileserver/searpc"
+	"github.com/haiwen/seafile-server/fileserver/workerpool"
+)
+
+const tusTestUser = "user@example.com"
+
+func TestTusUploadRanges(t *testing.T) {
+	upload := new(tusUpload)
+	upload.addRange(100, 200)
+	if upload.offset() != 0 {
+		t.Errorf("Offset is %d before the start is received\n", upload.offset())
+	}
+
+	upload.addRange(300, 400)
+	upload.addRange(0, 50)
+	upload.addRange(150, 300)
+	want := [][2]int64{{0, 50}, {100, 400}}
+	if !reflect.DeepEqual(upload.Ranges, want) {
+		t.Errorf("Ranges are %v, want %v\n", upload.Ranges, want)
+	}
+
+	upload.addRange(40, 120)
+	if upload.offset() != 400 || len(upload.Ranges) != 1 {
+		t.Errorf("Unexpected offset %d of ranges %v\n", upload.offset(), upload.Ranges)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,parent_dir Lw==, is_confidential")
+	if err != nil {
+		t.Fatalf("Failed to parse metadata : %v\n", err)
+	}
+	want := map[string]string{
+		"filename":        "world_domination_plan.pdf",
+		"parent_dir":      "/",
+		"is_confidential": "",
+	}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("Metadata is %v, want %v\n", metadata, want)
+	}
+
+	if _, err := parseTusMetadata("filename not-base64!"); err == nil {
+		t.Errorf("Invalid metadata is accepted\n")
+	}
+}
+
+// tusTestInit creates an empty repo and returns a router serving the upload-tus API of it
+// without access tokens. The returned function cleans up the test environment.
+func tusTestInit(t *testing.T) (*mux.Router, func()) {
+	env, err := repotest.Setup("tus-test")
+	if err != nil {
+		t.Fatalf("Failed to set up test repo : %v\n", err)
+	}
+	if err := os.MkdirAll(filepath.Join(env.DataDir, "httptemp", "cluster-shared"), 0700); err != nil {
+		t.Fatalf("Failed to create temp dir : %v\n", err)
+	}
+
+	savedOptions, savedDataDir, savedDB, savedClient := options, absDataDir, seafileDB, rpcclient
+	options.maxIndexingThreads = 1
+	options.chunkingAlgorithm = fixedChunking
+	options.fixedBlockSize = 1 << 20
+	options.clusterSharedTempFileMode = 0600
+	options.defaultQuota = InfiniteQuota
+	absDataDir = env.DataDir
+	seafileDB = env.DB
+	// Events published to the seafile server are dropped.
+	rpcclient = searpc.Init(filepath.Join(env.DataDir, "seafile.sock"), "seafserv-threaded-rpcserver")
+	if mergeVirtualRepoPool == nil {
+		// The test repo has no virtual repos to merge.
+		mergeVirtualRepoPool = workerpool.CreateWorkerPool(func(args ...string) error { return nil }, 1)
+	}
+
+	rootID := repotest.WriteDir(t, exportTestRepoID)
+	headID := repotest.WriteCommit(t, exportTestRepoID, rootID, "", time.Now().Unix())
+	env.AddRepo(t, exportTestRepoID, headID)
+	if _, err := env.DB.Exec("INSERT INTO RepoOwner (repo_id, owner_id) VALUES (?, ?)", exportTestRepoID, tusTestUser); err != nil {
+		t.Fatalf("Failed to set repo owner : %v\n", err)
+	}
+
+	handler := appHandler(func(rsp http.ResponseWriter, r *http.Request) *appError {
+		fsm := &recvData{parentDir: "/", tokenType: "upload", repoID: exportTestRepoID, user: tusTestUser}
+		return handleTusUpload(rsp, r, fsm, r.Method)
+	})
+	router := mux.NewRouter()
+	router.Handle("/upload-tus/{token}{slash:\\/?}", handler)
+	router.Handle("/upload-tus/{token}/{id}", handler)
+
+	return router, func() {
+		options, absDataDir, seafileDB, rpcclient = savedOptions, savedDataDir, savedDB, savedClient
+		env.Close()
+	}
+}
+
+func tusRequest(router *mux.Router, method, path string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, r)
+	return rsp
+}
+
+// createTestTusUpload creates an upload of a.txt in the root of the repo and returns its location.
+func createTestTusUpload(t *testing.T, router *mux.Router, length string) string {
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+	rsp := tusRequest(router, "POST", "/upload-tus/token", map[string]string{
+		"Upload-Length":   length,
+		"Upload-Metadata": metadata,
+	}, "")
+	if rsp.Code != http.StatusCreated || rsp.Header().Get("Location") == "" {
+		t.Fatalf("Failed to create upload : %d %s\n", rsp.Code, rsp.Body.String())
+	}
+	return rsp.Header().Get("Location")
+}
+
+func patchTestTusUpload(router *mux.Router, location, offset, content string) *httptest.ResponseRecorder {
+	return tusRequest(router, "PATCH", location, map[string]string{
+		"Content-Type":  tusOffsetOctetStreamType,
+		"Upload-Offset": offset,
+	}, content)
+}
+
+// repoFileSize returns the size of the file in the root of the head commit of the test repo.
+func repoFileSize(t *testing.T, name string) int64 {
+	repo := repomgr.Get(exportTestRepoID)
+	if repo == nil {
+		t.Fatalf("Failed to get repo\n")
+	}
+	head, err := commitmgr.Load(repo.ID, repo.HeadCommitID)
+	if err != nil {
+		t.Fatalf("Failed to load head commit : %v\n", err)
+	}
+	dir, err := fsmgr.GetSeafdir(repo.StoreID, head.RootID)
+	if err != nil {
+		t.Fatalf("Failed to get root dir : %v\n", err)
+	}
+	for _, dent := range dir.Entries {
+		if dent.Name == name {
+			return dent.Size
+		}
+	}
+	return -1
+}
+
+func TestTusUpload(t *testing.T) {
+	router, cleanup := tusTestInit(t)
+	defer cleanup()
+
+	location := createTestTusUpload(t, router, "10")
+
+	// The second half is received first, the offset stays at the start of the file.
+	rsp := patchTestTusUpload(router, location, "5", "56789")
+	if rsp.Code != http.StatusNoContent || rsp.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("Unexpected response of out of order patch : %d offset %s\n", rsp.Code, rsp.Header().Get("Upload-Offset"))
+	}
+
+	rsp = tusRequest(router, "HEAD", location, nil, "")
+	if rsp.Code != http.StatusOK || rsp.Header().Get("Upload-Offset") != "0" || rsp.Header().Get("Upload-Length") != "10" {
+		t.Errorf("Unexpected response of head : %d offset %s length %s\n", rsp.Code,
+			rsp.Header().Get("Upload-Offset"), rsp.Header().Get("Upload-Length"))
+	}
+
+	if rsp := patchTestTusUpload(router, location, "8", "890"); rsp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Content exceeding the upload length is accepted : %d\n", rsp.Code)
+	}
+
+	rsp = patchTestTusUpload(router, location, "0", "01234")
+	if rsp.Code != http.StatusOK || rsp.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("Failed to finish upload : %d %s\n", rsp.Code, rsp.Body.String())
+	}
+	if size := repoFileSize(t, "a.txt"); size != 10 {
+		t.Errorf("Size of uploaded file is %d, expected 10\n", size)
+	}
+
+	if rsp := tusRequest(router, "HEAD", location, nil, ""); rsp.Code != http.StatusNotFound {
+		t.Errorf("Finished upload is found : %d\n", rsp.Code)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(tusUploadDir(), tusUploadFilePrefix+"*")); len(matches) != 0 {
+		t.Errorf("Files of finished upload are not removed : %v\n", matches)
+	}
+}
+
+func TestTusUploadTermination(t *testing.T) {
+	router, cleanup := tusTestInit(t)
+	defer cleanup()
+
+	location := createTestTusUpload(t, router, "10")
+	patchTestTusUpload(router, location, "0", "01234")
+
+	if rsp := tusRequest(router, "DELETE", location, nil, ""); rsp.Code != http.StatusNoContent {
+		t.Errorf("Failed to terminate upload : %d\n", rsp.Code)
+	}
+	if rsp := tusRequest(router, "HEAD", location, nil, ""); rsp.Code != http.StatusNotFound {
+		t.Errorf("Terminated upload is found : %d\n", rsp.Code)
+	}
+	if rsp := patchTestTusUpload(router, location, "5", "56789"); rsp.Code != http.StatusNotFound {
+		t.Errorf("Terminated upload is patched : %d\n", rsp.Code)
+	}
+	if size := repoFileSize(t, "a.txt"); size != -1 {
+		t.Errorf("Terminated upload is committed\n")
+	}
+}
+
+func TestTusUploadExpiration(t *testing.T) {
+	router, cleanup := tusTestInit(t)
+	defer cleanup()
+
+	expired := createTestTusUpload(t, router, "10")
+	active := createTestTusUpload(t, router, "10")
+
+	upload, err := loadTusUpload(filepath.Base(expired))
+	if err != nil {
+		t.Fatalf("Failed to load upload : %v\n", err)
+	}
+	upload.Expires = time.Now().Add(-time.Minute).Unix()
+	if err := upload.save(); err != nil {
+		t.Fatalf("Failed to save upload : %v\n", err)
+	}
+
+	removeExpiredTusUploads()
+
+	if rsp := tusRequest(router, "HEAD", expired, nil, ""); rsp.Code != http.StatusNotFound {
+		t.Errorf("Expired upload is found : %d\n", rsp.Code)
+	}
+	if rsp := tusRequest(router, "HEAD", active, nil, ""); rsp.Code != http.StatusOK {
+		t.Errorf("Active upload is removed : %d\n", rsp.Code)
+	}
+}
+
+func TestTusUploadQuota(t *testing.T) {
+	router, cleanup := tusTestInit(t)
+	defer cleanup()
+
+	location := createTestTusUpload(t, router, "10")
+
+	// Other files use up the quota while the content is uploaded.
+	seafileDB.Exec("INSERT INTO UserQuota (user, quota) VALUES (?, 100)", tusTestUser)
+	seafileDB.Exec("INSERT INTO RepoSize (repo_id, size) VALUES (?, 95)", exportTestRepoID)
+
+	if rsp := patchTestTusUpload(router, location, "0", "0123456789"); rsp.Code != seafHTTPResNoQuota {
+		t.Errorf("Upload exceeding quota is finished : %d\n", rsp.Code)
+	}
+	if size := repoFileSize(t, "a.txt"); size != -1 {
+		t.Errorf("Upload exceeding quota is committed\n")
+	}
+}
@@ -0,0 +1,1112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repofs"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	"github.com/haiwen/seafile-server/fileserver/share"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	webdavPrefix = "/webdav"
+	// Time for which a verified password is accepted without hashing it again, as long as
+	// the password of the user isn't changed.
+	webdavAuthExpireTime = 300
+	// Failed logins allowed for a user or a client IP, until no login fails for webdavLoginAttemptTimeout.
+	// They match the defaults of LOGIN_ATTEMPT_LIMIT and LOGIN_ATTEMPT_TIMEOUT of Seahub.
+	webdavLoginAttemptLimit   = 5
+	webdavLoginAttemptTimeout = 900
+	// The quota is checked again whenever this many bytes more are written to a file.
+	webdavQuotaCheckSize = 64 << 20
+)
+
+// errLoginThrottled is returned for logins of users or client IPs with too many failed logins.
+var errLoginThrottled = errors.New("too many failed logins")
+
+// errTwoFactorEnabled is returned for password logins of users with two-factor authentication.
+var errTwoFactorEnabled = errors.New("two-factor authentication is enabled")
+
+// seahubDB is the Seahub database, which has the API tokens and the two-factor authentication
+// devices of users. seahubTablePrefix qualifies its tables when it's accessed through the
+// connection of the ccnet database.
+var seahubDB *sql.DB
+var seahubTablePrefix string
+
+// The locks of WebDAV clients are kept in memory, they're lost when the server restarts.
+var webdavLocks = webdav.NewMemLS()
+
+// webdavAuthCache maps users to *webdavAuth.
+var webdavAuthCache sync.Map
+
+type webdavAuth struct {
+	digest [sha256.Size]byte
+	// passwd is the password hash of the user when the password is verified.
+	passwd     string
+	expireTime int64
+}
+
+// webdavLoginFailures maps users and client IPs to *loginFailures.
+var webdavLoginFailures = make(map[string]*loginFailures)
+var webdavLoginFailuresLock sync.Mutex
+
+type loginFailures struct {
+	count      int
+	expireTime int64
+}
+
+// handleWebDAV serves the libraries accessible to a user over WebDAV.
+// Users log in with basic authentication, using their email and password, or an API token
+// of Seahub if they have two-factor authentication or no password, e.g. LDAP and SSO users.
+// The top level directory lists the libraries by name, encrypted libraries can't be opened.
+// Every change made by a request is saved as a new commit of the library, except a COPY,
+// whose changes are committed at once when the whole tree is copied.
+func handleWebDAV(rsp http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if ok {
+		valid, err := checkUserPassword(user, password, getClientIPAddr(r))
+		if err == errLoginThrottled {
+			rsp.Header().Set("Retry-After", strconv.Itoa(webdavLoginAttemptTimeout))
+			http.Error(rsp, "", http.StatusTooManyRequests)
+			return
+		}
+		if err == errTwoFactorEnabled {
+			rsp.Header().Set("WWW-Authenticate", `Basic realm="Seafile WebDAV"`)
+			msg := "Two-factor authentication is enabled, log in with an API token instead of the password."
+			http.Error(rsp, msg, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to check password of %s: %v", user, err)
+			http.Error(rsp, "", http.StatusInternalServerError)
+			return
+		}
+		ok = valid
+	}
+	if !ok {
+		rsp.Header().Set("WWW-Authenticate", `Basic realm="Seafile WebDAV"`)
+		http.Error(rsp, "", http.StatusUnauthorized)
+		return
+	}
+	serveWebDAV(rsp, r, &davFS{user: user})
+}
+
+// serveWebDAV serves a WebDAV request of a logged in user.
+func serveWebDAV(rsp http.ResponseWriter, r *http.Request, fs *davFS) {
+	// Listing all libraries with all their files in one response is too expensive.
+	// A PROPFIND without depth header has infinite depth.
+	if libName, _ := splitDavPath(strings.TrimPrefix(r.URL.Path, webdavPrefix)); libName == "" && r.Method == "PROPFIND" {
+		if depth := r.Header.Get("Depth"); depth != "0" && depth != "1" {
+			rsp.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			rsp.WriteHeader(http.StatusForbidden)
+			io.WriteString(rsp, `<?xml version="1.0" encoding="utf-8"?><D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+			return
+		}
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     webdavPrefix,
+		FileSystem: fs,
+		LockSystem: webdavLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) && r.Context().Err() == nil {
+				log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	if r.Method != "COPY" {
+		handler.ServeHTTP(rsp, r)
+		return
+	}
+
+	// The response is sent after the changes are committed, nothing is committed if the copy fails.
+	fs.batch = true
+	fs.batchLibs = make(map[string]*davLib)
+	buf := &davResponse{header: rsp.Header()}
+	handler.ServeHTTP(buf, r)
+	if buf.code == 0 {
+		buf.code = http.StatusOK
+	}
+	if buf.code < http.StatusMultipleChoices {
+		if err := fs.commitBatch(); err != nil {
+			log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(rsp, "", http.StatusInternalServerError)
+			return
+		}
+	}
+	rsp.WriteHeader(buf.code)
+	rsp.Write(buf.body.Bytes())
+}
+
+// davResponse buffers the response of a request whose changes are committed at the end.
+type davResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *davResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *davResponse) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+func (w *davResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// checkUserPassword checks the password of an active user against the ccnet user database.
+// Passwords are hashed by PBKDF2SHA256$iterations$salt$hash. API tokens of Seahub are accepted
+// as passwords too, while passwords of users with two-factor authentication are refused with
+// errTwoFactorEnabled.
+// Like the login of Seahub, passwords of a user or from a client IP with too many failed logins
+// are not checked, errLoginThrottled is returned instead.
+func checkUserPassword(user, password, ip string) (bool, error) {
+	active, passwd, err := getUserPasswd(user)
+	if err != nil {
+		return false, err
+	}
+
+	digest := sha256.Sum256([]byte(user + "\x00" + password))
+	cached := false
+	if v, ok := webdavAuthCache.Load(user); ok {
+		auth := v.(*webdavAuth)
+		if auth.passwd != passwd || auth.expireTime <= time.Now().Unix() {
+			// The password is changed since it's verified.
+			webdavAuthCache.Delete(user)
+		} else {
+			cached = active && subtle.ConstantTimeCompare(auth.digest[:], digest[:]) == 1
+		}
+	}
+
+	if !cached {
+		keys := []string{"user:" + user, "ip:" + ip}
+		if loginThrottled(keys) {
+			return false, errLoginThrottled
+		}
+		if !active {
+			addLoginFailure(keys)
+			return false, nil
+		}
+		if !checkPasswordHash(passwd, password) {
+			valid, err := checkAPIToken(user, password)
+			if err != nil {
+				return false, err
+			}
+			if !valid {
+				addLoginFailure(keys)
+				return false, nil
+			}
+			removeLoginFailures(keys[0])
+			return true, nil
+		}
+		removeLoginFailures(keys[0])
+	}
+
+	twoFactor, err := twoFactorEnabled(user)
+	if err != nil {
+		return false, err
+	}
+	if twoFactor {
+		return false, errTwoFactorEnabled
+	}
+	if !cached {
+		webdavAuthCache.Store(user, &webdavAuth{digest, passwd, time.Now().Unix() + webdavAuthExpireTime})
+	}
+	return true, nil
+}
+
+// getUserPasswd returns whether a user is active, and the password hash of the user.
+// LDAP users have no password hash.
+func getUserPasswd(user string) (bool, string, error) {
+	var passwd string
+	var isActive bool
+	sqlStr := "SELECT passwd, is_active FROM EmailUser WHERE email=?"
+	row := userDB.QueryRow(sqlStr, user)
+	err := row.Scan(&passwd, &isActive)
+	if err == nil {
+		return isActive, passwd, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, "", err
+	}
+
+	sqlStr = "SELECT is_active FROM LDAPUsers WHERE email=?"
+	row = userDB.QueryRow(sqlStr, user)
+	if err := row.Scan(&isActive); err != nil {
+		if err == sql.ErrNoRows {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	return isActive, "", nil
+}
+
+func checkPasswordHash(passwd, password string) bool {
+	parts := strings.Split(passwd, "$")
+	if len(parts) != 4 || parts[0] != "PBKDF2SHA256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key := pbkdf2.Key([]byte(password), salt, iter, len(hash), sha256.New)
+	return subtle.ConstantTimeCompare(key, hash) == 1
+}
+
+// checkAPIToken checks whether token is an API token of the user issued by Seahub.
+func checkAPIToken(user, token string) (bool, error) {
+	if seahubDB == nil {
+		err := fmt.Errorf("seahub database is not set")
+		return false, err
+	}
+	if len(token) != 40 {
+		return false, nil
+	}
+
+	var tokenUser string
+	sqlStr := "SELECT user FROM " + seahubTablePrefix + "api2_token WHERE `key`=?"
+	row := seahubDB.QueryRow(sqlStr, token)
+	if err := row.Scan(&tokenUser); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return tokenUser == user, nil
+}
+
+// twoFactorEnabled returns whether the user has set up two-factor authentication in Seahub.
+func twoFactorEnabled(user string) (bool, error) {
+	if seahubDB == nil {
+		err := fmt.Errorf("seahub database is not set")
+		return false, err
+	}
+
+	var count int
+	sqlStr := "SELECT COUNT(1) FROM " + seahubTablePrefix + "two_factor_totpdevice WHERE user=?"
+	row := seahubDB.QueryRow(sqlStr, user)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func loginThrottled(keys []string) bool {
+	webdavLoginFailuresLock.Lock()
+	defer webdavLoginFailuresLock.Unlock()
+
+	now := time.Now().Unix()
+	for _, key := range keys {
+		failures, ok := webdavLoginFailures[key]
+		if ok && failures.expireTime > now && failures.count >= webdavLoginAttemptLimit {
+			return true
+		}
+	}
+	return false
+}
+
+func addLoginFailure(keys []string) {
+	webdavLoginFailuresLock.Lock()
+	defer webdavLoginFailuresLock.Unlock()
+
+	now := time.Now().Unix()
+	for _, key := range keys {
+		failures, ok := webdavLoginFailures[key]
+		if !ok || failures.expireTime <= now {
+			failures = new(loginFailures)
+			webdavLoginFailures[key] = failures
+		}
+		failures.count++
+		failures.expireTime = now + webdavLoginAttemptTimeout
+	}
+}
+
+func removeLoginFailures(key string) {
+	webdavLoginFailuresLock.Lock()
+	delete(webdavLoginFailures, key)
+	webdavLoginFailuresLock.Unlock()
+}
+
+func removeWebDAVExpireCache() {
+	now := time.Now().Unix()
+	webdavAuthCache.Range(func(key interface{}, value interface{}) bool {
+		if value.(*webdavAuth).expireTime <= now {
+			webdavAuthCache.Delete(key)
+		}
+		return true
+	})
+
+	webdavLoginFailuresLock.Lock()
+	for key, failures := range webdavLoginFailures {
+		if failures.expireTime <= now {
+			delete(webdavLoginFailures, key)
+		}
+	}
+	webdavLoginFailuresLock.Unlock()
+}
+
+// davFS is the webdav.FileSystem of the libraries accessible to a user.
+// It's created for every request, the libraries are listed once per request.
+type davFS struct {
+	user string
+	// libs are the libraries by their names in the top level directory.
+	libs map[string]*share.SharedRepo
+	// In batch mode the opened libraries are kept in batchLibs by name, and their
+	// changes are committed by commitBatch.
+	batch     bool
+	batchLibs map[string]*davLib
+}
+
+// splitDavPath splits a WebDAV path into the name of a library and the path in the library.
+// Both are empty for the top level directory, the path is "/" for the root of a library.
+func splitDavPath(name string) (string, string) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", ""
+	}
+	if slash := strings.Index(name, "/"); slash >= 0 {
+		return name[:slash], name[slash:]
+	}
+	return name, "/"
+}
+
+func (fs *davFS) libraries() (map[string]*share.SharedRepo, error) {
+	if fs.libs != nil {
+		return fs.libs, nil
+	}
+
+	repos, err := getAccessibleRepos(fs.user)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	nameCount := make(map[string]int)
+	var uniqRepos []*share.SharedRepo
+	for _, repo := range repos {
+		if seen[repo.ID] {
+			continue
+		}
+		seen[repo.ID] = true
+		nameCount[repo.Name]++
+		uniqRepos = append(uniqRepos, repo)
+	}
+
+	// Libraries with the same name are told apart by their IDs.
+	libs := make(map[string]*share.SharedRepo)
+	for _, repo := range uniqRepos {
+		name := repo.Name
+		if nameCount[name] > 1 || name == "" {
+			name = fmt.Sprintf("%s (%.8s)", repo.Name, repo.ID)
+		}
+		libs[name] = repo
+	}
+	fs.libs = libs
+	return libs, nil
+}
+
+// davLib is a library opened by a request, at its head commit.
+type davLib struct {
+	repo  *repomgr.Repo
+	head  *commitmgr.Commit
+	mtime int64
+	perm  string
+	// root is the root directory with the changes of the request, which are not
+	// committed yet in batch mode.
+	root  string
+	batch bool
+}
+
+// openLib opens a library, write is whether the user needs write permission.
+func (fs *davFS) openLib(ctx context.Context, name string, write bool) (*davLib, error) {
+	if lib, ok := fs.batchLibs[name]; ok {
+		if write && lib.perm != "rw" {
+			return nil, os.ErrPermission
+		}
+		return lib, nil
+	}
+
+	libs, err := fs.libraries()
+	if err != nil {
+		return nil, err
+	}
+	sRepo, ok := libs[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	repo := repomgr.Get(sRepo.ID)
+	if repo == nil {
+		return nil, os.ErrNotExist
+	}
+	if repo.IsEncrypted {
+		return nil, os.ErrPermission
+	}
+	perm := share.CheckPerm(repo.ID, fs.user)
+	if perm == "" || (write && perm != "rw") {
+		return nil, os.ErrPermission
+	}
+
+	head, err := commitmgr.LoadCtx(ctx, repo.ID, repo.HeadCommitID)
+	if err != nil {
+		err := fmt.Errorf("failed to load head commit of %s: %v", repo.ID, err)
+		return nil, err
+	}
+
+	lib := new(davLib)
+	lib.repo = repo
+	lib.head = head
+	lib.mtime = sRepo.MTime
+	lib.perm = perm
+	lib.root = head.RootID
+	lib.batch = fs.batch
+	if fs.batch {
+		fs.batchLibs[name] = lib
+	}
+	return lib, nil
+}
+
+// commitBatch commits the changes of the libraries opened in batch mode.
+func (fs *davFS) commitBatch() error {
+	for _, lib := range fs.batchLibs {
+		if lib.root == lib.head.RootID {
+			continue
+		}
+		lib.batch = false
+		if err := lib.commit(fs.user, lib.root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the dirent at p in the library.
+func (lib *davLib) lookup(ctx context.Context, p string) (*fsmgr.SeafDirent, error) {
+	dent := &fsmgr.SeafDirent{ID: lib.root, Mode: syscall.S_IFDIR, Mtime: lib.mtime}
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !fsmgr.IsDir(dent.Mode) {
+			return nil, os.ErrNotExist
+		}
+		dir, err := fsmgr.GetSeafdirCtx(ctx, lib.repo.StoreID, dent.ID)
+		if err != nil {
+			return nil, err
+		}
+		var found *fsmgr.SeafDirent
+		for _, e := range dir.Entries {
+			if e.Name == name {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return nil, os.ErrNotExist
+		}
+		dent = found
+	}
+	return dent, nil
+}
+
+// edit saves a new tree of the library in which the entries of the directory at dirPath
+// are replaced by the result of fn, and returns the ID of the new root directory.
+func (lib *davLib) edit(ctx context.Context, rootID, dirPath string,
+	fn func(entries []*fsmgr.SeafDirent) ([]*fsmgr.SeafDirent, error)) (string, error) {
+	dir, err := fsmgr.GetSeafdirCtx(ctx, lib.repo.StoreID, rootID)
+	if err != nil {
+		return "", err
+	}
+
+	entries := dir.Entries
+	dirPath = strings.Trim(dirPath, "/")
+	if dirPath == "" {
+		entries, err = fn(entries)
+		if err != nil {
+			return "", err
+		}
+		sort.Sort(Dirents(entries))
+	} else {
+		name, remain := dirPath, ""
+		if slash := strings.Index(dirPath, "/"); slash >= 0 {
+			name, remain = dirPath[:slash], dirPath[slash+1:]
+		}
+		var found *fsmgr.SeafDirent
+		for _, e := range entries {
+			if e.Name == name && fsmgr.IsDir(e.Mode) {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return "", os.ErrNotExist
+		}
+		id, err := lib.edit(ctx, found.ID, remain, fn)
+		if err != nil {
+			return "", err
+		}
+		found.ID = id
+		found.Mtime = time.Now().Unix()
+	}
+
+	newDir, err := fsmgr.NewSeafdir(1, entries)
+	if err != nil {
+		err := fmt.Errorf("failed to new seafdir: %v", err)
+		return "", err
+	}
+	if err := fsmgr.SaveSeafdir(lib.repo.StoreID, newDir); err != nil {
+		err := fmt.Errorf("failed to save seafdir %s/%s: %v", lib.repo.ID, newDir.DirID, err)
+		return "", err
+	}
+	return newDir.DirID, nil
+}
+
+// commit saves rootID as a new commit of the library, or only as the root of the library
+// in batch mode.
+func (lib *davLib) commit(user, rootID string) error {
+	lib.root = rootID
+	if lib.batch {
+		return nil
+	}
+
+	desc := genCommitDesc(lib.repo, rootID, lib.head.RootID)
+	if desc == "" {
+		desc = "Modified by WebDAV"
+	}
+	if _, err := genNewCommit(lib.repo, lib.head, rootID, user, desc); err != nil {
+		err := fmt.Errorf("failed to generate new commit: %v", err)
+		return err
+	}
+
+	go mergeVirtualRepoPool.AddTask(lib.repo.ID, "")
+	go updateSizePool.AddTask(lib.repo.ID)
+	return nil
+}
+
+// removeEntry returns an edit function removing the entry called name.
+func removeEntry(name string) func([]*fsmgr.SeafDirent) ([]*fsmgr.SeafDirent, error) {
+	return func(entries []*fsmgr.SeafDirent) ([]*fsmgr.SeafDirent, error) {
+		for i, e := range entries {
+			if e.Name == name {
+				return append(entries[:i], entries[i+1:]...), nil
+			}
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
+// putEntry returns an edit function adding dent, replacing the entry of the same name.
+func putEntry(dent *fsmgr.SeafDirent) func([]*fsmgr.SeafDirent) ([]*fsmgr.SeafDirent, error) {
+	return func(entries []*fsmgr.SeafDirent) ([]*fsmgr.SeafDirent, error) {
+		for i, e := range entries {
+			if e.Name == dent.Name {
+				entries[i] = dent
+				return entries, nil
+			}
+		}
+		return append(entries, dent), nil
+	}
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	libName, p := splitDavPath(name)
+	if p == "" || p == "/" {
+		// Libraries are not created over WebDAV.
+		return os.ErrPermission
+	}
+	dirName := path.Base(p)
+	if shouldIgnoreFile(dirName) {
+		return os.ErrInvalid
+	}
+	lib, err := fs.openLib(ctx, libName, true)
+	if err != nil {
+		return err
+	}
+	if _, err := lib.lookup(ctx, p); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	mode := syscall.S_IFDIR | 0644
+	dent := fsmgr.NewDirent(fsmgr.EmptySha1, dirName, uint32(mode), time.Now().Unix(), "", 0)
+	rootID, err := lib.edit(ctx, lib.root, path.Dir(p), func(entries []*fsmgr.SeafDirent) ([]*fsmgr.SeafDirent, error) {
+		if nameExists(entries, dirName) {
+			return nil, os.ErrExist
+		}
+		return append(entries, dent), nil
+	})
+	if err != nil {
+		return err
+	}
+	return lib.commit(fs.user, rootID)
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	libName, p := splitDavPath(name)
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if libName == "" {
+		if write {
+			return nil, os.ErrPermission
+		}
+		return fs.openTopDir()
+	}
+
+	lib, err := fs.openLib(ctx, libName, write)
+	if err != nil {
+		return nil, err
+	}
+	dent, err := lib.lookup(ctx, p)
+	if err != nil && (!os.IsNotExist(err) || !write) {
+		return nil, err
+	}
+
+	if write {
+		if dent != nil && fsmgr.IsDir(dent.Mode) {
+			return nil, os.ErrExist
+		}
+		if dent == nil && flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		if flag&os.O_APPEND != 0 {
+			return nil, os.ErrInvalid
+		}
+		fileName := path.Base(p)
+		if shouldIgnoreFile(fileName) {
+			return nil, os.ErrInvalid
+		}
+		parent, err := lib.lookup(ctx, path.Dir(p))
+		if err != nil {
+			return nil, err
+		}
+		if !fsmgr.IsDir(parent.Mode) {
+			return nil, os.ErrNotExist
+		}
+		return newDavWriter(ctx, fs.user, lib, p)
+	}
+
+	info := &davFileInfo{path.Base(p), dent}
+	if p == "/" {
+		info.name = libName
+	}
+	if fsmgr.IsDir(dent.Mode) {
+		dir, err := fsmgr.GetSeafdirCtx(ctx, lib.repo.StoreID, dent.ID)
+		if err != nil {
+			return nil, err
+		}
+		var entries []os.FileInfo
+		for _, e := range dir.Entries {
+			entries = append(entries, &davFileInfo{e.Name, e})
+		}
+		return &davDir{info: info, entries: entries}, nil
+	}
+
+	file, err := fsmgr.GetSeafileCtx(ctx, lib.repo.StoreID, dent.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{repofs.NewReader(ctx, lib.repo.StoreID, file, nil), lib.repo.StoreID, info}, nil
+}
+
+// openTopDir opens the top level directory, which lists the libraries.
+func (fs *davFS) openTopDir() (webdav.File, error) {
+	libs, err := fs.libraries()
+	if err != nil {
+		return nil, err
+	}
+	var entries []os.FileInfo
+	for name, repo := range libs {
+		dent := &fsmgr.SeafDirent{Mode: syscall.S_IFDIR, Mtime: repo.MTime}
+		entries = append(entries, &davFileInfo{name, dent})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	info := &davFileInfo{"/", &fsmgr.SeafDirent{Mode: syscall.S_IFDIR, Mtime: time.Now().Unix()}}
+	return &davDir{info: info, entries: entries}, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	libName, p := splitDavPath(name)
+	if p == "" || p == "/" {
+		// Libraries are not deleted over WebDAV.
+		return os.ErrPermission
+	}
+	lib, err := fs.openLib(ctx, libName, true)
+	if err != nil {
+		return err
+	}
+	rootID, err := lib.edit(ctx, lib.root, path.Dir(p), removeEntry(path.Base(p)))
+	if err != nil {
+		return err
+	}
+	return lib.commit(fs.user, rootID)
+}
+
+// Rename moves a file or directory in a library, moving between libraries is not supported.
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldLib, oldPath := splitDavPath(oldName)
+	newLib, newPath := splitDavPath(newName)
+	if oldPath == "" || oldPath == "/" || newPath == "" || newPath == "/" {
+		return os.ErrPermission
+	}
+	if oldLib != newLib {
+		err := fmt.Errorf("can't move %s to another library", oldName)
+		return err
+	}
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		err := fmt.Errorf("can't move %s into itself", oldName)
+		return err
+	}
+	newBase := path.Base(newPath)
+	if shouldIgnoreFile(newBase) {
+		return os.ErrInvalid
+	}
+
+	lib, err := fs.openLib(ctx, oldLib, true)
+	if err != nil {
+		return err
+	}
+	dent, err := lib.lookup(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	rootID, err := lib.edit(ctx, lib.root, path.Dir(oldPath), removeEntry(path.Base(oldPath)))
+	if err != nil {
+		return err
+	}
+	moved := fsmgr.NewDirent(dent.ID, newBase, dent.Mode, dent.Mtime, dent.Modifier, dent.Size)
+	rootID, err = lib.edit(ctx, rootID, path.Dir(newPath), putEntry(moved))
+	if err != nil {
+		return err
+	}
+	return lib.commit(fs.user, rootID)
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	libName, p := splitDavPath(name)
+	if libName == "" {
+		return &davFileInfo{"/", &fsmgr.SeafDirent{Mode: syscall.S_IFDIR, Mtime: time.Now().Unix()}}, nil
+	}
+	lib, err := fs.openLib(ctx, libName, false)
+	if err != nil {
+		return nil, err
+	}
+	dent, err := lib.lookup(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if p == "/" {
+		return &davFileInfo{libName, dent}, nil
+	}
+	return &davFileInfo{path.Base(p), dent}, nil
+}
+
+// davFileInfo describes a dirent, it provides the content type and the ETag of files
+// without reading their content.
+type davFileInfo struct {
+	name string
+	dent *fsmgr.SeafDirent
+}
+
+func (info *davFileInfo) Name() string {
+	return info.name
+}
+
+func (info *davFileInfo) Size() int64 {
+	if info.IsDir() {
+		return 0
+	}
+	return info.dent.Size
+}
+
+func (info *davFileInfo) Mode() os.FileMode {
+	if info.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (info *davFileInfo) ModTime() time.Time {
+	return time.Unix(info.dent.Mtime, 0)
+}
+
+func (info *davFileInfo) IsDir() bool {
+	return fsmgr.IsDir(info.dent.Mode)
+}
+
+func (info *davFileInfo) Sys() interface{} {
+	return nil
+}
+
+func (info *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(filepath.Ext(info.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (info *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if info.dent.ID == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return strconv.Quote(info.dent.ID), nil
+}
+
+// davDir is a directory opened for reading.
+type davDir struct {
+	info    *davFileInfo
+	entries []os.FileInfo
+	pos     int
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.entries[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.pos += count
+	return rest[:count], nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+// davFile is a file opened for reading, its blocks are read as the file is read.
+// The file doesn't implement io.WriterTo, so that a davWriter can copy it without
+// reading its content.
+type davFile struct {
+	*repofs.Reader
+	storeID string
+	info    *davFileInfo
+}
+
+func (f *davFile) Close() error {
+	return nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// davWriter is a file opened for writing. The content is written to a temp file,
+// and indexed and committed to the library when the file is closed.
+// Nothing is committed if writing the content fails, e.g. the request body is truncated.
+type davWriter struct {
+	ctx  context.Context
+	user string
+	lib  *davLib
+	path string
+	tmp  *os.File
+	size int64
+	// ID of the file copied by ReadFrom without reading it.
+	copiedID string
+	// The size up to which the quota is checked.
+	quotaSize int64
+	// err is the first error of writing the content.
+	err error
+}
+
+func newDavWriter(ctx context.Context, user string, lib *davLib, p string) (*davWriter, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(absDataDir, "httptemp"), "webdav-")
+	if err != nil {
+		err := fmt.Errorf("failed to create temp file: %v", err)
+		return nil, err
+	}
+
+	w := new(davWriter)
+	w.ctx = ctx
+	w.user = user
+	w.lib = lib
+	w.path = p
+	w.tmp = tmp
+	return w, nil
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	if w.copiedID != "" {
+		return 0, os.ErrInvalid
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	size := w.size + int64(len(p))
+	if options.maxUploadSize > 0 && uint64(size) > options.maxUploadSize {
+		w.err = fmt.Errorf("file is larger than the max upload size %d", options.maxUploadSize)
+		return 0, w.err
+	}
+	if size > w.quotaSize {
+		if err := w.checkQuota(size); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.quotaSize = size + webdavQuotaCheckSize
+	}
+
+	n, err := w.tmp.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *davWriter) checkQuota(size int64) error {
+	ret, err := checkQuota(w.lib.repo.ID, size)
+	if err != nil {
+		err := fmt.Errorf("failed to check quota: %v", err)
+		return err
+	}
+	if ret == 1 {
+		err := fmt.Errorf("out of quota")
+		return err
+	}
+	return nil
+}
+
+// ReadFrom copies a file of the same library storage by its ID, other content is
+// written to the temp file.
+func (w *davWriter) ReadFrom(r io.Reader) (int64, error) {
+	if src, ok := r.(*davFile); ok && src.storeID == w.lib.repo.StoreID && w.size == 0 {
+		if offset, _ := src.Seek(0, io.SeekCurrent); offset == 0 {
+			w.copiedID = src.File().FileID
+			w.size, _ = src.Seek(0, io.SeekEnd)
+			return w.size, nil
+		}
+	}
+	n, err := io.Copy(struct{ io.Writer }{w}, r)
+	if err != nil && w.err == nil {
+		// Failed to read the content, e.g. the client disconnected.
+		w.err = err
+	}
+	return n, err
+}
+
+// Close commits the file, unless writing its content failed or the request is canceled.
+func (w *davWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	if err := w.tmp.Close(); err != nil {
+		return err
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := w.checkQuota(w.size); err != nil {
+		return err
+	}
+
+	fileID := w.copiedID
+	var err error
+	if fileID == "" {
+		fileID, w.size, err = indexBlocks(w.ctx, w.lib.repo.StoreID, w.lib.repo.Version, w.tmp.Name(), nil)
+		if err != nil {
+			err := fmt.Errorf("failed to index blocks: %v", err)
+			return err
+		}
+	}
+
+	mode := syscall.S_IFREG | 0644
+	dent := fsmgr.NewDirent(fileID, path.Base(w.path), uint32(mode), time.Now().Unix(), w.user, w.size)
+	rootID, err := w.lib.edit(w.ctx, w.lib.root, path.Dir(w.path), putEntry(dent))
+	if err != nil {
+		return err
+	}
+	if rootID == w.lib.root {
+		return nil
+	}
+	return w.lib.commit(w.user, rootID)
+}
+
+func (w *davWriter) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (w *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (w *davWriter) Stat() (os.FileInfo, error) {
+	mode := syscall.S_IFREG | 0644
+	dent := &fsmgr.SeafDirent{ID: w.copiedID, Mode: uint32(mode), Mtime: time.Now().Unix(), Size: w.size}
+	return &davFileInfo{path.Base(w.path), dent}, nil
+}
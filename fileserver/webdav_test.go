@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/haiwen/seafile-server/fileserver/blockmgr"
+	"github.com/haiwen/seafile-server/fileserver/commitmgr"
+	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/repofs"
+	"github.com/haiwen/seafile-server/fileserver/repomgr"
+	"github.com/haiwen/seafile-server/fileserver/repotest"
+	"github.com/haiwen/seafile-server/fileserver/share"
+	"github.com/haiwen/seafile-server/fileserver/workerpool"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestWebDAVPassword(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "webdav-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	userDB, err = sql.Open("sqlite3", filepath.Join(dataDir, "usermgr.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database : %v\n", err)
+	}
+	defer userDB.Close()
+	for _, sqlStr := range []string{
+		"CREATE TABLE EmailUser (email TEXT PRIMARY KEY, passwd TEXT, is_active INTEGER)",
+		"CREATE TABLE LDAPUsers (email TEXT PRIMARY KEY, is_active INTEGER)",
+		"CREATE TABLE api2_token (`key` TEXT PRIMARY KEY, user TEXT)",
+		"CREATE TABLE two_factor_totpdevice (user TEXT PRIMARY KEY)",
+	} {
+		if _, err := userDB.Exec(sqlStr); err != nil {
+			t.Fatalf("Failed to create table : %v\n", err)
+		}
+	}
+	seahubDB = userDB
+	defer func() { seahubDB = nil }()
+	salt := []byte("0123456789abcdef0123456789abcdef")
+	hash := pbkdf2.Key([]byte("secret"), salt, 1000, 32, sha256.New)
+	passwd := fmt.Sprintf("PBKDF2SHA256$1000$%x$%x", salt, hash)
+	userDB.Exec("INSERT INTO EmailUser VALUES ('active@example.com', ?, 1)", passwd)
+	userDB.Exec("INSERT INTO EmailUser VALUES ('inactive@example.com', ?, 0)", passwd)
+	userDB.Exec("INSERT INTO EmailUser VALUES ('2fa@example.com', ?, 1)", passwd)
+	userDB.Exec("INSERT INTO two_factor_totpdevice VALUES ('2fa@example.com')")
+	userDB.Exec("INSERT INTO LDAPUsers VALUES ('ldap@example.com', 1)")
+	tokens := map[string]string{
+		"active@example.com": strings.Repeat("a", 40),
+		"2fa@example.com":    strings.Repeat("b", 40),
+		"ldap@example.com":   strings.Repeat("c", 40),
+	}
+	for user, token := range tokens {
+		userDB.Exec("INSERT INTO api2_token VALUES (?, ?)", token, user)
+	}
+
+	tests := []struct {
+		user, password string
+		valid          bool
+	}{
+		{"active@example.com", "secret", true},
+		{"active@example.com", "wrong", false},
+		{"inactive@example.com", "secret", false},
+		{"missing@example.com", "secret", false},
+		{"active@example.com", tokens["active@example.com"], true},
+		{"active@example.com", tokens["ldap@example.com"], false},
+		{"2fa@example.com", tokens["2fa@example.com"], true},
+		{"ldap@example.com", tokens["ldap@example.com"], true},
+		{"ldap@example.com", "secret", false},
+	}
+	for _, test := range tests {
+		valid, err := checkUserPassword(test.user, test.password, "203.0.113.1")
+		if err != nil || valid != test.valid {
+			t.Errorf("Password of %s is valid %v, expected %v : %v\n", test.user, valid, test.valid, err)
+		}
+	}
+
+	// Passwords of users with two-factor authentication are refused.
+	if _, err := checkUserPassword("2fa@example.com", "secret", "192.0.2.1"); err != errTwoFactorEnabled {
+		t.Errorf("Password of user with two-factor authentication is not refused : %v\n", err)
+	}
+
+	// A wrong password is rejected after the right one is cached.
+	if valid, _ := checkUserPassword("active@example.com", "wrong", "192.0.2.1"); valid {
+		t.Errorf("Wrong password is accepted after a successful login\n")
+	}
+
+	// The cached password is dropped when the password is changed.
+	hash = pbkdf2.Key([]byte("changed"), salt, 1000, 32, sha256.New)
+	userDB.Exec("UPDATE EmailUser SET passwd=? WHERE email='active@example.com'", fmt.Sprintf("PBKDF2SHA256$1000$%x$%x", salt, hash))
+	if valid, _ := checkUserPassword("active@example.com", "secret", "192.0.2.1"); valid {
+		t.Errorf("Old password is accepted after the password is changed\n")
+	}
+	if valid, _ := checkUserPassword("active@example.com", "changed", "192.0.2.1"); !valid {
+		t.Errorf("New password is rejected after the password is changed\n")
+	}
+
+	// Passwords are not checked after too many failed logins of a user, or from a client IP.
+	webdavAuthCache.Delete("active@example.com")
+	for i := 0; i < webdavLoginAttemptLimit; i++ {
+		checkUserPassword("active@example.com", "wrong", fmt.Sprintf("192.0.2.%d", 10+i))
+	}
+	if _, err := checkUserPassword("active@example.com", "changed", "192.0.2.100"); err != errLoginThrottled {
+		t.Errorf("Login of user with too many failed logins is not throttled : %v\n", err)
+	}
+	for i := 0; i < webdavLoginAttemptLimit; i++ {
+		checkUserPassword(fmt.Sprintf("user%d@example.com", i), "secret", "198.51.100.1")
+	}
+	if _, err := checkUserPassword("inactive@example.com", "secret", "198.51.100.1"); err != errLoginThrottled {
+		t.Errorf("Login from client IP with too many failed logins is not throttled : %v\n", err)
+	}
+	if _, err := checkUserPassword("inactive@example.com", "secret", "198.51.100.2"); err != nil {
+		t.Errorf("Login from other client IP is throttled : %v\n", err)
+	}
+}
+
+// webdavTestInit initializes the storage in a temp dir and returns the dir.
+func webdavTestInit(t *testing.T) string {
+	dataDir, err := ioutil.TempDir("", "webdav-test")
+	if err != nil {
+		t.Fatalf("Failed to create data dir : %v\n", err)
+	}
+	blockmgr.Init("", dataDir)
+	fsmgr.Init("", dataDir)
+	commitmgr.Init("", dataDir)
+	return dataDir
+}
+
+func TestWebDAVFileRange(t *testing.T) {
+	dataDir := webdavTestInit(t)
+	defer os.RemoveAll(dataDir)
+
+	var content []byte
+	var blkIDs []string
+	for _, data := range []string{"first block ", "second block ", "third block"} {
+		checkSum := sha1.Sum([]byte(data))
+		blkID := hex.EncodeToString(checkSum[:])
+		if err := blockmgr.Write(exportTestRepoID, blkID, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("Failed to write block : %v\n", err)
+		}
+		blkIDs = append(blkIDs, blkID)
+		content = append(content, data...)
+	}
+	file, err := fsmgr.NewSeafile(1, int64(len(content)), blkIDs)
+	if err != nil {
+		t.Fatalf("Failed to create seafile : %v\n", err)
+	}
+
+	ranges := map[string]string{
+		"":            string(content),
+		"bytes=6-17":  string(content[6:18]),
+		"bytes=-5":    string(content[len(content)-5:]),
+		"bytes=25-30": string(content[25:31]),
+	}
+	for byteRange, expected := range ranges {
+		info := &davFileInfo{"a.txt", &fsmgr.SeafDirent{ID: file.FileID, Mode: syscall.S_IFREG, Size: int64(len(content))}}
+		f := &davFile{repofs.NewReader(context.Background(), exportTestRepoID, file, nil), exportTestRepoID, info}
+		r := httptest.NewRequest("GET", "/webdav/lib/a.txt", nil)
+		if byteRange != "" {
+			r.Header.Set("Range", byteRange)
+		}
+		rsp := httptest.NewRecorder()
+		http.ServeContent(rsp, r, "a.txt", time.Now(), f)
+		if rsp.Body.String() != expected {
+			t.Errorf("Read %q of range %q, expected %q\n", rsp.Body.String(), byteRange, expected)
+		}
+	}
+}
+
+func TestWebDAVEdit(t *testing.T) {
+	dataDir := webdavTestInit(t)
+	defer os.RemoveAll(dataDir)
+
+	repo := &repomgr.Repo{ID: exportTestRepoID, StoreID: exportTestRepoID}
+	lib := &davLib{repo: repo, head: &commitmgr.Commit{RootID: fsmgr.EmptySha1}, root: fsmgr.EmptySha1}
+	ctx := context.Background()
+
+	dirDent := fsmgr.NewDirent(fsmgr.EmptySha1, "docs", syscall.S_IFDIR|0644, 0, "", 0)
+	rootID, err := lib.edit(ctx, lib.root, "/", putEntry(dirDent))
+	if err != nil {
+		t.Fatalf("Failed to add directory : %v\n", err)
+	}
+	fileDent := fsmgr.NewDirent(fsmgr.EmptySha1, "a.txt", syscall.S_IFREG|0644, 0, "", 0)
+	rootID, err = lib.edit(ctx, rootID, "/docs", putEntry(fileDent))
+	if err != nil {
+		t.Fatalf("Failed to add file : %v\n", err)
+	}
+	if _, err := lib.edit(ctx, rootID, "/missing", putEntry(fileDent)); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error of adding file to missing directory : %v\n", err)
+	}
+
+	lib.root = rootID
+	if dent, err := lib.lookup(ctx, "/docs/a.txt"); err != nil || dent.Name != "a.txt" {
+		t.Errorf("Failed to look up added file : %v\n", err)
+	}
+
+	rootID, err = lib.edit(ctx, rootID, "/docs", removeEntry("a.txt"))
+	if err != nil {
+		t.Fatalf("Failed to remove file : %v\n", err)
+	}
+	lib.root = rootID
+	if _, err := lib.lookup(ctx, "/docs/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("Removed file exists : %v\n", err)
+	}
+	if _, err := lib.edit(ctx, rootID, "/docs", removeEntry("a.txt")); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error of removing missing file : %v\n", err)
+	}
+}
+
+func TestWebDAVIncompleteWrite(t *testing.T) {
+	env, err := repotest.Setup("webdav-test")
+	if err != nil {
+		t.Fatalf("Failed to set up test repo : %v\n", err)
+	}
+	defer env.Close()
+	if err := os.MkdirAll(filepath.Join(env.DataDir, "httptemp"), 0700); err != nil {
+		t.Fatalf("Failed to create temp dir : %v\n", err)
+	}
+	savedOptions, savedDataDir, savedDB := options, absDataDir, seafileDB
+	defer func() { options, absDataDir, seafileDB = savedOptions, savedDataDir, savedDB }()
+	absDataDir = env.DataDir
+	seafileDB = env.DB
+	options.defaultQuota = InfiniteQuota
+	options.maxUploadSize = 20
+	env.DB.Exec("INSERT INTO RepoOwner (repo_id, owner_id) VALUES (?, ?)", exportTestRepoID, "user@example.com")
+
+	repo := &repomgr.Repo{ID: exportTestRepoID, StoreID: exportTestRepoID}
+	lib := &davLib{repo: repo, head: &commitmgr.Commit{RootID: fsmgr.EmptySha1}, root: fsmgr.EmptySha1}
+	write := func(body io.Reader) (error, error) {
+		w, err := newDavWriter(context.Background(), "user@example.com", lib, "/a.txt")
+		if err != nil {
+			t.Fatalf("Failed to create writer : %v\n", err)
+		}
+		// Like the body of a request, which isn't an io.WriterTo.
+		_, copyErr := io.Copy(w, struct{ io.Reader }{body})
+		return copyErr, w.Close()
+	}
+
+	// The body is truncated.
+	body := io.MultiReader(strings.NewReader("0123"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if copyErr, closeErr := write(body); copyErr != io.ErrUnexpectedEOF || closeErr != io.ErrUnexpectedEOF {
+		t.Errorf("File with truncated body is committed : %v, %v\n", copyErr, closeErr)
+	}
+	// The file is larger than the max upload size.
+	if copyErr, closeErr := write(strings.NewReader("0123456789abcdefghijk")); copyErr == nil || closeErr == nil {
+		t.Errorf("File larger than the max upload size is committed\n")
+	}
+	// The quota is used up.
+	env.DB.Exec("INSERT INTO UserQuota (user, quota) VALUES (?, 10)", "user@example.com")
+	if copyErr, closeErr := write(strings.NewReader("0123456789")); copyErr == nil || closeErr == nil {
+		t.Errorf("File exceeding quota is committed\n")
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(env.DataDir, "httptemp", "webdav-*")); len(matches) != 0 {
+		t.Errorf("Temp files are not removed : %v\n", matches)
+	}
+}
+
+func TestWebDAVCopyDir(t *testing.T) {
+	_, cleanup := tusTestInit(t)
+	defer cleanup()
+	if updateSizePool == nil {
+		updateSizePool = workerpool.CreateWorkerPool(func(args ...string) error { return nil }, 1)
+	}
+
+	ctx := context.Background()
+	libs := map[string]*share.SharedRepo{"lib": {ID: exportTestRepoID}}
+	fs := &davFS{user: tusTestUser, libs: libs}
+	if err := fs.Mkdir(ctx, "/lib/d", 0755); err != nil {
+		t.Fatalf("Failed to create dir : %v\n", err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		f, err := fs.OpenFile(ctx, "/lib/d/"+name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open %s : %v\n", name, err)
+		}
+		io.WriteString(f, name)
+		if err := f.Close(); err != nil {
+			t.Fatalf("Failed to write %s : %v\n", name, err)
+		}
+	}
+	headID := repomgr.Get(exportTestRepoID).HeadCommitID
+
+	serve := func(method, p string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, webdavPrefix+p, nil)
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		rsp := httptest.NewRecorder()
+		serveWebDAV(rsp, r, &davFS{user: tusTestUser, libs: libs})
+		return rsp
+	}
+
+	rsp := serve("COPY", "/lib/d", map[string]string{"Destination": webdavPrefix + "/lib/e"})
+	if rsp.Code != http.StatusCreated {
+		t.Fatalf("Failed to copy dir : %d %s\n", rsp.Code, rsp.Body.String())
+	}
+	head, err := commitmgr.Load(exportTestRepoID, repomgr.Get(exportTestRepoID).HeadCommitID)
+	if err != nil {
+		t.Fatalf("Failed to load head commit : %v\n", err)
+	}
+	if head.ParentID.String != headID {
+		t.Errorf("Dir is copied in more than one commit\n")
+	}
+	lib, err := fs.openLib(ctx, "lib", false)
+	if err != nil {
+		t.Fatalf("Failed to open lib : %v\n", err)
+	}
+	lib.root = head.RootID
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if dent, err := lib.lookup(ctx, "/e/"+name); err != nil || dent.Size != int64(len(name)) {
+			t.Errorf("File %s is not copied : %v\n", name, err)
+		}
+	}
+
+	// Nothing is committed when the copy fails.
+	rsp = serve("COPY", "/lib/d", map[string]string{"Destination": webdavPrefix + "/lib/e", "Overwrite": "F"})
+	if rsp.Code != http.StatusPreconditionFailed || repomgr.Get(exportTestRepoID).HeadCommitID != head.CommitID {
+		t.Errorf("Failed copy is committed : %d\n", rsp.Code)
+	}
+
+	// The top level directory is listed only with finite depth.
+	if rsp := serve("PROPFIND", "/", nil); rsp.Code != http.StatusForbidden {
+		t.Errorf("PROPFIND of top level directory with infinite depth is served : %d\n", rsp.Code)
+	}
+	if rsp := serve("PROPFIND", "/", map[string]string{"Depth": "1"}); rsp.Code != http.StatusMultiStatus {
+		t.Errorf("Failed to list top level directory : %d %s\n", rsp.Code, rsp.Body.String())
+	}
+}
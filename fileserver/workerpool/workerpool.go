@@ -3,11 +3,14 @@ package workerpool
 import (
 	"log"
 	"runtime/debug"
+	"sync/atomic"
 )
 
 type WorkPool struct {
 	jobs  chan Job
 	jobCB JobCB
+	// pending is the number of added jobs that no worker has started yet.
+	pending int64
 }
 
 // Job is the job object of workpool.
@@ -23,7 +26,7 @@ func CreateWorkerPool(jobCB JobCB, n int) *WorkPool {
 	pool.jobCB = jobCB
 	pool.jobs = make(chan Job, 100)
 	for i := 0; i < n; i++ {
-		go worker(pool.jobs)
+		go pool.worker()
 	}
 	return pool
 }
@@ -35,17 +38,24 @@ func (pool *WorkPool) AddTask(args ...string) {
 		}
 	}()
 	job := Job{pool.jobCB, args}
+	atomic.AddInt64(&pool.pending, 1)
 	pool.jobs <- job
 }
 
-func worker(jobs chan Job) {
+// Pending returns the number of jobs waiting for a worker.
+func (pool *WorkPool) Pending() int64 {
+	return atomic.LoadInt64(&pool.pending)
+}
+
+func (pool *WorkPool) worker() {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Printf("panic: %v\n%s", err, debug.Stack())
 		}
 	}()
 
-	for job := range jobs {
+	for job := range pool.jobs {
+		atomic.AddInt64(&pool.pending, -1)
 		if job.callback != nil {
 			err := job.callback(job.args...)
 			if err != nil {